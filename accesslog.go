@@ -0,0 +1,191 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// accessLogTime is the layout of the time field in S3 server access logs.
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// An AccessEvent is a request recorded in an S3 server access log. When
+// reading the logs fails, the event carries only Err.
+type AccessEvent struct {
+	Time      time.Time
+	Bucket    string
+	Key       string
+	Operation string // such as REST.GET.OBJECT
+	Requester string
+	RemoteIP  string
+	RequestID string
+	Status    int
+	ErrorCode string
+	BytesSent int64
+	Err       error
+}
+
+// ParseAccessLogLine parses a line of an S3 server access log.
+func ParseAccessLogLine(line string) (AccessEvent, error) {
+	fields := splitLogLine(line)
+	if len(fields) < 12 {
+		return AccessEvent{}, errors.New("af3ro: short access log line")
+	}
+	for i, f := range fields {
+		if f == "-" {
+			fields[i] = ""
+		}
+	}
+	t, err := time.Parse(accessLogTime, fields[2])
+	if err != nil {
+		return AccessEvent{}, err
+	}
+	key, err := url.PathUnescape(fields[7])
+	if err != nil {
+		return AccessEvent{}, err
+	}
+	status, _ := strconv.Atoi(fields[9])
+	sent, _ := strconv.ParseInt(fields[11], 10, 64)
+	return AccessEvent{
+		Time:      t,
+		Bucket:    fields[1],
+		RemoteIP:  fields[3],
+		Requester: fields[4],
+		RequestID: fields[5],
+		Operation: fields[6],
+		Key:       key,
+		Status:    status,
+		ErrorCode: fields[10],
+		BytesSent: sent,
+	}, nil
+}
+
+// splitLogLine splits an access log line on spaces, keeping "quoted" and
+// [bracketed] fields whole and dropping their delimiters.
+func splitLogLine(line string) (fields []string) {
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimLeft(line, " ") {
+		end := " "
+		switch line[0] {
+		case '"':
+			end, line = "\"", line[1:]
+		case '[':
+			end, line = "]", line[1:]
+		}
+		i := strings.Index(line, end)
+		if i < 0 {
+			i = len(line)
+		}
+		fields = append(fields, line[:i])
+		if i < len(line) {
+			i++
+		}
+		line = line[i:]
+	}
+	return fields
+}
+
+// AccessLog tails the server access logs that S3 delivers for this
+// filesystem's bucket into logBucket under logPrefix, checking for new
+// log objects every interval. Events for requests made to other buckets
+// sharing the log prefix, or outside the filesystem's Prefix, are
+// dropped. Only logs delivered after AccessLog is called are read. The
+// channel is closed once ctx is done or the filesystem is closed.
+// CloudTrail data events aren't supported; trails log in a JSON format
+// of their own, which this doesn't parse.
+func (m *MemS3Fs) AccessLog(ctx context.Context, logBucket, logPrefix string, interval time.Duration) <-chan AccessEvent {
+	events := make(chan AccessEvent)
+	m.spawn(ctx, "AccessLog", func(ctx context.Context) error {
+		defer close(events)
+		// log objects are named for the time they were delivered
+		marker := logPrefix + m.now().UTC().Format("2006-01-02-15-04-05")
+		send := func(e AccessEvent) bool {
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			var err error
+			marker, err = m.readAccessLogs(logBucket, logPrefix, marker, func(e AccessEvent) bool {
+				if e.Err == nil && (e.Bucket != m.bucketName ||
+					m.root != "" && !strings.HasPrefix(e.Key, m.root+"/")) {
+					return true
+				}
+				return send(e)
+			})
+			if err != nil && !send(AccessEvent{Err: err}) {
+				return nil
+			}
+			select {
+			case <-clockOr(m.clock).After(interval):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	return events
+}
+
+// readAccessLogs passes fn the events in every log object after marker,
+// stopping early if fn returns false, and returns the key of the last
+// object read.
+func (m *MemS3Fs) readAccessLogs(logBucket, logPrefix, marker string, fn func(AccessEvent) bool) (string, error) {
+	for {
+		var resp *s3.ListResp
+		err := m.doRead("accesslog", logPrefix, func(b *s3.Bucket) (err error) {
+			resp, err = b.S3.Bucket(logBucket).List(logPrefix, "", marker, m.listPageSize)
+			return err
+		})
+		if err != nil {
+			return marker, err
+		}
+		for _, k := range resp.Contents {
+			var data []byte
+			err := m.doRead("accesslog", k.Key, func(b *s3.Bucket) (err error) {
+				data, err = b.S3.Bucket(logBucket).Get(k.Key)
+				return err
+			})
+			if err != nil {
+				return marker, err
+			}
+			marker = k.Key
+			lines := bufio.NewScanner(bytes.NewReader(data))
+			for lines.Scan() {
+				e, err := ParseAccessLogLine(lines.Text())
+				if err != nil {
+					e = AccessEvent{Err: err}
+				}
+				if !fn(e) {
+					return marker, nil
+				}
+			}
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return marker, nil
+		}
+	}
+}
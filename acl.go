@@ -0,0 +1,127 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// The groups S3 grants canned ACLs' permissions to.
+const (
+	allUsers  = "http://acs.amazonaws.com/groups/global/AllUsers"
+	authUsers = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+)
+
+// accessControlPolicy is the body of a GetObjectAcl response.
+type accessControlPolicy struct {
+	Owner  string `xml:"Owner>ID"`
+	Grants []struct {
+		ID         string `xml:"Grantee>ID"`
+		URI        string `xml:"Grantee>URI"`
+		Permission string
+	} `xml:"AccessControlList>Grant"`
+}
+
+// parseACL decodes a GetObjectAcl response body into the canned ACL that
+// makes the same grants. ok is false for grants no canned ACL makes.
+func parseACL(r io.Reader) (acl s3.ACL, ok bool, err error) {
+	var p accessControlPolicy
+	if err := xml.NewDecoder(r).Decode(&p); err != nil {
+		return "", false, err
+	}
+	grants := make(map[string]bool)
+	for _, g := range p.Grants {
+		grantee := g.URI
+		if g.ID == p.Owner {
+			// the object's owner always has full control
+			continue
+		} else if grantee == "" {
+			grantee = "other"
+		}
+		grants[grantee+" "+g.Permission] = true
+	}
+	switch {
+	case len(grants) == 0:
+		return s3.Private, true, nil
+	case len(grants) == 2 && grants[allUsers+" READ"] && grants[allUsers+" WRITE"]:
+		return s3.PublicReadWrite, true, nil
+	case len(grants) == 1 && grants[allUsers+" READ"]:
+		return s3.PublicRead, true, nil
+	case len(grants) == 1 && grants[authUsers+" READ"]:
+		return s3.AuthenticatedRead, true, nil
+	case len(grants) == 1 && grants["other FULL_CONTROL"]:
+		return s3.BucketOwnerFull, true, nil
+	case len(grants) == 1 && grants["other READ"]:
+		return s3.BucketOwnerRead, true, nil
+	}
+	return "", false, nil
+}
+
+// objectACL returns the canned ACL matching the grants on the object key,
+// or fallback if they can't be read or no canned ACL matches them.
+func (m *MemS3Fs) objectACL(key string, fallback s3.ACL) s3.ACL {
+	acl, ok := fallback, false
+	err := m.subresource("GET", m.bucketName, key, "acl", nil, func(body io.Reader) (err error) {
+		acl, ok, err = parseACL(body)
+		return err
+	})
+	if err != nil || !ok {
+		return fallback
+	}
+	return acl
+}
+
+// copyOptions adds to opts what S3 doesn't carry over from the object src
+// to a copy made in parts: its content type, metadata and headers,
+// including those goamz has no option for. The options a single PutCopy
+// is given are added to S3's own copy of them.
+func (m *MemS3Fs) copyOptions(op, src string, opts s3.Options) (s3.Options, string, Headers, error) {
+	var resp *http.Response
+	err := m.doRead(op, src, func(b *s3.Bucket) (err error) {
+		resp, err = headName(src, b)
+		return err
+	})
+	if err != nil {
+		return opts, "", Headers{}, err
+	}
+	meta := make(map[string][]string, len(opts.Meta))
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			meta[strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))] = v
+		}
+	}
+	for k, v := range opts.Meta {
+		meta[k] = v
+	}
+	opts.Meta = meta
+	if opts.CacheControl == "" {
+		opts.CacheControl = resp.Header.Get("Cache-Control")
+	}
+	if opts.ContentEncoding == "" {
+		opts.ContentEncoding = resp.Header.Get("Content-Encoding")
+	}
+	if opts.ContentDisposition == "" {
+		opts.ContentDisposition = resp.Header.Get("Content-Disposition")
+	}
+	var h Headers
+	h.Expires, _ = http.ParseTime(resp.Header.Get("Expires"))
+	return opts, resp.Header.Get("Content-Type"), h, nil
+}
@@ -0,0 +1,186 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// ErrNotParquet is returned by ParquetFooter for objects that don't end
+// the way Parquet files do.
+var ErrNotParquet = errors.New("af3ro: not a Parquet file")
+
+// parquetMagic ends every Parquet file, after the length of its footer.
+var parquetMagic = []byte("PAR1")
+
+// parquetFooterGuess is how much of the end of a Parquet file is fetched
+// in the hope the whole footer is in it.
+const parquetFooterGuess = 64 << 10
+
+// spanGap is how far apart spans ReadSpans fetches in one request may
+// be. Reading a gap is cheaper than another round trip.
+const spanGap = 32 << 10
+
+// A Span is Len bytes of a file starting at Off, such as a Parquet
+// column chunk.
+type Span struct {
+	Off, Len int64
+}
+
+// Tail returns the last n bytes of the object name, or all of it if it's
+// shorter, with a single range GET. Compressed files can't be decoded
+// from their tails, except for gzip files made of many members, which
+// decode from the start of any member.
+func (m *MemS3Fs) Tail(name string, n int64) ([]byte, error) {
+	if m.wholeReads(name) {
+		// ciphertext and transformed contents can't be read in pieces
+		data, _, err := m.download("read", name)
+		if err != nil {
+			return nil, m.readError("read", name, err)
+		}
+		if int64(len(data)) > n {
+			data = data[int64(len(data))-n:]
+		}
+		return data, nil
+	}
+	var data []byte
+	err := m.doRead("read", name, func(b *s3.Bucket) (err error) {
+		data, err = fetchSuffix(m.key(name), b, n)
+		return err
+	})
+	if err != nil {
+		return nil, m.readError("read", name, err)
+	}
+	return data, nil
+}
+
+// ParquetFooter returns the Thrift-encoded FileMetaData of the Parquet
+// file name, which locates its row groups and column chunks, reading
+// only the end of the object: usually with one range GET, or two if the
+// footer is large. Decoding it is left to a Parquet library; the spans
+// it gives can then be read with ReadSpans.
+func (m *MemS3Fs) ParquetFooter(name string) ([]byte, error) {
+	tail, err := m.Tail(name, parquetFooterGuess)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(len(tail))
+	if n < 8 || !bytes.Equal(tail[n-4:], parquetMagic) {
+		return nil, &os.PathError{Op: "read", Path: name, Err: ErrNotParquet}
+	}
+	size := int64(binary.LittleEndian.Uint32(tail[n-8 : n-4]))
+	if size+8 > n {
+		if n < parquetFooterGuess {
+			// that was the whole object
+			return nil, &os.PathError{Op: "read", Path: name, Err: ErrNotParquet}
+		}
+		if tail, err = m.Tail(name, size+8); err != nil {
+			return nil, err
+		}
+		if n = int64(len(tail)); size+8 > n {
+			return nil, &os.PathError{Op: "read", Path: name, Err: ErrNotParquet}
+		}
+	}
+	return tail[n-8-size : n-8], nil
+}
+
+// ReadSpans reads spans of the object name with range GETs, returning
+// their bytes in the same order. Spans close together are fetched
+// together, and up to the filesystem's Multipart concurrency of fetches
+// run at once. A span past the end of the object comes back short.
+func (m *MemS3Fs) ReadSpans(name string, spans []Span) ([][]byte, error) {
+	out := make([][]byte, len(spans))
+	if m.wholeReads(name) {
+		// ciphertext and transformed contents can't be read in pieces
+		data, _, err := m.download("read", name)
+		if err != nil {
+			return nil, m.readError("read", name, err)
+		}
+		for i, s := range spans {
+			out[i] = clip(data, s.Off, s.Off+s.Len)
+		}
+		return out, nil
+	}
+
+	ranges := make([]byteRange, 0, len(spans))
+	for _, s := range spans {
+		if s.Off < 0 || s.Len < 0 {
+			return nil, &os.PathError{Op: "read", Path: name, Err: fmt.Errorf("af3ro: bad span %+v", s)}
+		}
+		ranges = append(ranges, byteRange{s.Off, s.Off + s.Len + spanGap})
+	}
+	merged := mergeRanges(ranges)
+	fetched := make([][]byte, len(merged))
+	errs := make([]error, len(merged))
+	workers := m.partConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := range merged {
+		r := &merged[i]
+		r.end -= spanGap
+		wg.Add(1)
+		slots <- struct{}{}
+		i, span := i, *r
+		m.spawn(context.Background(), "ReadSpans", func(context.Context) error {
+			defer func() { <-slots; wg.Done() }()
+			errs[i] = m.workers.guard("ReadSpans", func() error {
+				return m.doRead("read", name, func(b *s3.Bucket) (err error) {
+					fetched[i], err = fetchRange(m.key(name), b, span.start, span.end-span.start)
+					return err
+				})
+			})
+			return nil
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, m.readError("read", name, err)
+		}
+	}
+
+	for i, s := range spans {
+		for j, r := range merged {
+			if s.Off >= r.start && s.Off+s.Len <= r.end {
+				out[i] = clip(fetched[j], s.Off-r.start, s.Off-r.start+s.Len)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// clip returns data[start:end], cut short where data ends.
+func clip(data []byte, start, end int64) []byte {
+	if n := int64(len(data)); end > n {
+		end = n
+	}
+	if start > end {
+		start = end
+	}
+	return data[start:end]
+}
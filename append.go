@@ -0,0 +1,142 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// Appender appends to a file shared with other writers, possibly in
+// other processes. S3 objects can't be appended to, so each Write is
+// stored as its own segment object under the file's name, as a
+// directory, keyed by the time it was written, the writer and a sequence
+// number. OpenAppended reads the segments back in that order. Each Write
+// should be a whole record, since the records of different writers are
+// interleaved a Write at a time.
+type Appender struct {
+	fs     *MemS3Fs
+	name   string
+	writer string
+
+	mu   sync.Mutex
+	last int64
+	seq  uint64
+}
+
+// NewAppender returns an Appender for name. writer must be unique among
+// the file's writers, such as a host or pod name, and can't contain "/".
+func (m *MemS3Fs) NewAppender(name, writer string) (*Appender, error) {
+	if writer == "" || strings.Contains(writer, "/") {
+		return nil, &os.PathError{Op: "append", Path: name, Err: os.ErrInvalid}
+	}
+	return &Appender{fs: m, name: name, writer: writer}, nil
+}
+
+// Write stores p as the file's next segment from this writer, after the
+// file's write transforms (see TransformWrites), encrypted with
+// ClientSideEncryption if it's set.
+func (a *Appender) Write(p []byte) (int, error) {
+	data, err := a.fs.transformWrite("append", a.name, p)
+	if err != nil {
+		return 0, err
+	}
+	data, opts, err := a.fs.seal(data, a.fs.putOptions())
+	if err != nil {
+		return 0, &os.PathError{Op: "append", Path: a.name, Err: err}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// the writer's own segments stay in order if the clock steps back
+	ts := a.fs.now().UnixNano()
+	if ts <= a.last {
+		ts = a.last + 1
+	}
+	a.last = ts
+	a.seq++
+
+	m := a.fs
+	key := fmt.Sprintf("%s%020d-%s-%010d", m.dirPrefix(a.name), ts, a.writer, a.seq)
+	err = m.do("append", a.name, func(b *s3.Bucket) error {
+		return b.Put(key, data, m.contentType(a.name), s3.Private, opts)
+	})
+	if err != nil {
+		return 0, err
+	}
+	m.prefixes.forgetAncestors(key)
+	return len(p), nil
+}
+
+// OpenAppended returns a reader over every segment written to name by
+// an Appender, in the order they were written. Segments are listed when
+// it's opened and downloaded one at a time as they're read, each
+// decrypted and passed through the read transforms (see TransformReads)
+// on its own.
+func (m *MemS3Fs) OpenAppended(name string) (io.Reader, error) {
+	r := &segmentReader{fs: m, name: name}
+	err := m.eachKey("read", m.dirPrefix(name), func(k s3.Key) error {
+		r.keys = append(r.keys, k.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// segmentReader reads an Appender's segments in key order.
+type segmentReader struct {
+	fs   *MemS3Fs
+	name string
+	keys []string
+	buf  []byte
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.keys) == 0 {
+			return 0, io.EOF
+		}
+		key := r.keys[0]
+		var data []byte
+		var header http.Header
+		err := r.fs.doRead("read", r.name, func(b *s3.Bucket) (err error) {
+			data, header, err = fetchObjectHeader(key, b)
+			return err
+		})
+		if err != nil {
+			return 0, r.fs.readError("read", r.name, err)
+		}
+		if data, err = r.fs.unseal(data, header); err != nil {
+			return 0, &os.PathError{Op: "read", Path: r.name, Err: err}
+		}
+		// segments were transformed one by one, so that's how they're
+		// transformed back
+		if r.buf, err = r.fs.transformRead("read", r.name, data); err != nil {
+			return 0, err
+		}
+		r.keys = r.keys[1:]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,57 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"errors"
+	"os"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+)
+
+// ErrBucketNotFound is returned by New when the bucket doesn't exist.
+var ErrBucketNotFound = errors.New("af3ro: bucket not found")
+
+// bucketSpec is how CreateBucketIfMissing makes the bucket.
+type bucketSpec struct {
+	acl    s3.ACL
+	region aws.Region
+}
+
+// checkBucket makes sure the bucket exists, creating it if asked to.
+func (m *MemS3Fs) checkBucket() error {
+	path := "s3://" + m.bucketName
+	err := m.doRead("verify", path, func(b *s3.Bucket) error {
+		_, err := b.List("", "", "", 1)
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if !isNotFound(err) {
+		return err
+	}
+	if m.createBucket == nil {
+		return &os.PathError{Op: "verify", Path: path, Err: ErrBucketNotFound}
+	}
+	if m.createBucket.region.Name != "" {
+		m.region = m.createBucket.region
+	}
+	return m.do("create", path, func(b *s3.Bucket) error {
+		return b.PutBucket(m.createBucket.acl)
+	})
+}
@@ -0,0 +1,282 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+)
+
+const defaultBulkConcurrency = 8
+
+// BulkOptions controls an operation on every object under a prefix, such
+// as ReEncryptPrefix.
+type BulkOptions struct {
+	// Concurrency is how many objects are worked on at once.
+	Concurrency int
+
+	// StartAfter skips the keys up to and including it, to resume an
+	// interrupted operation from a BulkProgress.Checkpoint.
+	StartAfter string
+
+	// Progress is called after each object is done.
+	Progress func(BulkProgress)
+}
+
+// BulkProgress reports how far an operation on a prefix has got.
+type BulkProgress struct {
+	Done   int // objects that succeeded
+	Failed int // objects that failed
+
+	// Checkpoint is the key that every key up to and including has
+	// succeeded. It stops before the first key that failed, so resuming
+	// from it retries the failures.
+	Checkpoint string
+}
+
+// BulkError is returned when an operation on a prefix fails for some of
+// the objects under it. The rest were worked on as usual.
+type BulkError struct {
+	Op     string
+	Prefix string
+	Failed map[string]error
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("%s %s: %d objects failed", e.Op, e.Prefix, len(e.Failed))
+}
+
+// bulk calls fn for every object under prefix, several at a time as set
+// by opts, which may be nil.
+func (m *MemS3Fs) bulk(op, prefix string, opts *BulkOptions, fn func(s3.Key) error) error {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	workers := opts.Concurrency
+	if workers < 1 {
+		workers = defaultBulkConcurrency
+	}
+
+	type job struct {
+		seq int
+		key s3.Key
+	}
+	type result struct {
+		seq int
+		key string
+		err error
+	}
+	jobs := make(chan job)
+	results := make(chan result)
+	done := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		m.spawn(context.Background(), op, func(context.Context) error {
+			defer func() { done <- struct{}{} }()
+			for j := range jobs {
+				k := j.key
+				err := m.workers.guard(op, func() error {
+					return m.scheduled(func() error { return fn(k) })
+				})
+				results <- result{j.seq, k.Key, err}
+			}
+			return nil
+		})
+	}
+	var listErr error
+	m.spawn(context.Background(), op, func(context.Context) error {
+		seq := 0
+		listErr = m.workers.guard(op, func() error {
+			return m.eachKeyAfter(op, prefix, opts.StartAfter, func(k s3.Key) error {
+				jobs <- job{seq, k}
+				seq++
+				return nil
+			})
+		})
+		close(jobs)
+		for w := 0; w < workers; w++ {
+			<-done
+		}
+		close(results)
+		return nil
+	})
+
+	progress := BulkProgress{Checkpoint: opts.StartAfter}
+	berr := &BulkError{Op: op, Prefix: prefix, Failed: make(map[string]error)}
+	finished := make(map[int]result)
+	next := 0
+	for r := range results {
+		if r.err != nil {
+			progress.Failed++
+			berr.Failed[r.key] = r.err
+		} else {
+			progress.Done++
+		}
+		// the checkpoint only passes keys once all before them have
+		// succeeded, and never passes one that failed
+		if finished != nil {
+			finished[r.seq] = r
+		}
+		for f, ok := finished[next]; ok; f, ok = finished[next] {
+			if f.err != nil {
+				finished = nil
+				break
+			}
+			progress.Checkpoint = f.key
+			delete(finished, next)
+			next++
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	if listErr != nil {
+		return listErr
+	}
+	if len(berr.Failed) > 0 {
+		return berr
+	}
+	return nil
+}
+
+// ReEncryptPrefix has S3 copy every object under prefix over itself,
+// encrypted with the KMS key newKMSKey, as when rotating keys. Nothing is
+// downloaded. Files cached with changes that haven't been flushed are not
+// uploaded first, and will be written with the filesystem's own settings.
+func (m *MemS3Fs) ReEncryptPrefix(prefix, newKMSKey string, opts *BulkOptions) error {
+	defer m.heads.forgetPrefix(prefix)
+	prefix = m.keyPrefix(prefix)
+	return m.bulk("reencrypt", prefix, opts, func(k s3.Key) error {
+		return m.copyObject("reencrypt", k.Key, m.bucketName, k.Key, k.Size, s3.Private, s3.Options{
+			SSEKMS:      true,
+			SSEKMSKeyId: newKMSKey,
+
+			// copies are otherwise stored in STANDARD
+			StorageClass: s3.StorageClass(k.StorageClass),
+		})
+	})
+}
+
+// TransitionFilter selects the objects TransitionPrefix rewrites. Zero
+// fields select everything.
+type TransitionFilter struct {
+	OlderThan time.Duration // last modified at least this long ago
+	MinSize   int64
+	MaxSize   int64
+}
+
+// match reports whether k is selected at now.
+func (tf TransitionFilter) match(k s3.Key, now time.Time) bool {
+	if tf.OlderThan > 0 {
+		modtime, err := time.Parse(time.RFC3339, k.LastModified)
+		if err != nil || now.Sub(modtime) < tf.OlderThan {
+			return false
+		}
+	}
+	if k.Size < tf.MinSize || (tf.MaxSize > 0 && k.Size > tf.MaxSize) {
+		return false
+	}
+	return true
+}
+
+// TransitionPrefix has S3 copy the objects under prefix that filter
+// selects over themselves in storage class class, for buckets where
+// lifecycle rules can't be used. Objects already in class are left
+// alone, and count as done.
+func (m *MemS3Fs) TransitionPrefix(prefix string, class s3.StorageClass, filter TransitionFilter, opts *BulkOptions) error {
+	defer m.heads.forgetPrefix(prefix)
+	prefix = m.keyPrefix(prefix)
+	return m.bulk("transition", prefix, opts, func(k s3.Key) error {
+		if k.StorageClass == string(class) || !filter.match(k, m.now()) {
+			return nil
+		}
+		options := m.putOptions()
+		options.StorageClass = class
+		return m.copyObject("transition", k.Key, m.bucketName, k.Key, k.Size, s3.Private, options)
+	})
+}
+
+// ChmodPrefix changes the mode of every file under prefix, as Chmod
+// does, having S3 copy each object over itself with the ACL for mode
+// and, with PosixMetadata, the mode in its metadata. Nothing is
+// downloaded. Each copy keeps the object's other metadata, headers,
+// content type, encryption and storage class as a HEAD just before it
+// finds them, and fails with ErrChanged if the object is overwritten in
+// between. Cached files under prefix are changed in memory too.
+func (m *MemS3Fs) ChmodPrefix(prefix string, mode os.FileMode, opts *BulkOptions) error {
+	return m.changePrefix("chmod", prefix, opts, true, func(f *InMemoryFile) {
+		f.mode, f.modeKnown = mode, true
+	})
+}
+
+// ChtimesPrefix changes the modification time of every file under
+// prefix, as Chtimes does. With PosixMetadata the time is stored in each
+// object's metadata by a copy, as ChmodPrefix does. Without it only the
+// cached files under prefix change, since S3 sets LastModified itself.
+func (m *MemS3Fs) ChtimesPrefix(prefix string, atime, mtime time.Time, opts *BulkOptions) error {
+	return m.changePrefix("chtimes", prefix, opts, m.posixMeta, func(f *InMemoryFile) {
+		f.modtime, f.mtimeSet = mtime, true
+	})
+}
+
+// changePrefix applies change to the cached files under prefix and, if
+// objects is set, to the metadata of every object under it.
+func (m *MemS3Fs) changePrefix(op, prefix string, opts *BulkOptions, objects bool, change func(*InMemoryFile)) error {
+	keyPrefix := m.keyPrefix(prefix)
+	var cached []*InMemoryFile
+	m.rlock()
+	for name, f := range m.getData() {
+		if ff, ok := f.(*InMemoryFile); ok && !ff.dir && strings.HasPrefix(m.key(name), keyPrefix) {
+			cached = append(cached, ff)
+		}
+	}
+	m.runlock()
+	for _, f := range cached {
+		f.mu.Lock()
+		change(f)
+		f.mu.Unlock()
+	}
+	if !objects {
+		return nil
+	}
+
+	defer m.heads.forgetPrefix(prefix)
+	return m.bulk(op, keyPrefix, opts, func(k s3.Key) error {
+		if _, ok := m.markedDir(k.Key); ok || strings.HasSuffix(k.Key, "/") {
+			return nil
+		}
+		modtime, _ := time.Parse(time.RFC3339, k.LastModified)
+		f := &InMemoryFile{fs: m, fileData: &fileData{
+			name:    m.nameOf(k.Key),
+			mode:    0640,
+			modtime: modtime,
+		}}
+		if k.StorageClass != "" && k.StorageClass != "STANDARD" {
+			// copies are otherwise stored in STANDARD
+			f.class = s3.StorageClass(k.StorageClass)
+		}
+		f.loadPosix()
+		if err := f.loadXattrs(); err != nil {
+			return err
+		}
+		change(f)
+		return f.replaceMeta()
+	})
+}
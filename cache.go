@@ -0,0 +1,313 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// A Cache keeps the contents of objects read through a filesystem on
+// the local machine, so that reopening a file whose object hasn't
+// changed doesn't download it again. Entries are identified by the
+// object's key and ETag. Caches must be safe for concurrent use.
+type Cache interface {
+	// Get returns the contents of key as of etag, if they're cached.
+	// The caller may modify the slice returned.
+	Get(key, etag string) ([]byte, bool)
+	// Put caches data as the contents of key as of etag, replacing any
+	// others. The cache must not keep data itself.
+	Put(key, etag string, data []byte)
+	// Remove drops key's contents, if they're cached.
+	Remove(key string)
+}
+
+// CacheUsage is implemented by Caches that can report how many bytes of
+// contents they hold and how many entries they've evicted to make room,
+// for CacheStats. MemCache and DiskCache implement it.
+type CacheUsage interface {
+	Usage() (bytes, evictions int64)
+}
+
+// CacheContents keeps the contents of objects read or written through
+// the filesystem in c, and drops files' contents from memory when
+// they're closed, leaving c to hold them.
+func CacheContents(c Cache) Option {
+	return func(s *MemS3Fs) {
+		s.cache = c
+	}
+}
+
+// cached returns the contents c holds for key at etag, recording the
+// lookup.
+func (m *MemS3Fs) cached(name, etag string) ([]byte, bool) {
+	data, ok := m.cache.Get(m.key(name), strings.Trim(etag, "\""))
+	m.recordLookup(ContentCache, name, ok, false)
+	return data, ok
+}
+
+// cachePut keeps data as the contents of name at etag, if there's a
+// cache.
+func (m *MemS3Fs) cachePut(name, etag string, data []byte) {
+	if m.cache != nil && etag != "" {
+		m.cache.Put(m.key(name), strings.Trim(etag, "\""), data)
+	}
+}
+
+// Prewarm downloads every object under prefix, several at a time as
+// set by opts, which may be nil, so that reading them later doesn't wait
+// on S3. Their contents go to the filesystem's Cache, if it has one, or
+// are kept in memory. It stops once ctx is done, returning ctx's error,
+// and otherwise returns a *BulkError naming the objects that couldn't be
+// fetched.
+func (m *MemS3Fs) Prewarm(ctx context.Context, prefix string, opts *BulkOptions) error {
+	view := WithContext(ctx, m).(*MemS3Fs)
+	lead := ""
+	if strings.HasPrefix(prefix, "/") {
+		// cache the files under the names they'll be opened with
+		lead = "/"
+	}
+	err := view.bulk("prewarm", m.keyPrefix(prefix), opts, func(k s3.Key) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := m.markedDir(k.Key); ok || strings.HasSuffix(k.Key, "/") {
+			return nil
+		}
+		f, err := view.Open(lead + m.nameOf(k.Key))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		ff, ok := f.(*InMemoryFile)
+		if !ok {
+			return nil
+		}
+		ff.mu.Lock()
+		defer ff.mu.Unlock()
+		return ff.load()
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// lru tracks cache entries in order of use, evicting the least recently
+// used once their sizes add up to more than max.
+type lru struct {
+	max     int64
+	size    int64
+	evicted int64
+	order   *list.List // of *lruEntry, most recently used first
+	items   map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	etag string
+	size int64
+	data []byte
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lru) get(key, etag string) (*lruEntry, bool) {
+	el, ok := c.items[key]
+	if !ok || el.Value.(*lruEntry).etag != etag {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry), true
+}
+
+// add inserts e, replacing any entry for its key, and returns the
+// entries removed to make room for it, including the one it replaced.
+func (c *lru) add(e *lruEntry) (removed []*lruEntry) {
+	if old := c.remove(e.key); old != nil {
+		removed = append(removed, old)
+	}
+	c.items[e.key] = c.order.PushFront(e)
+	c.size += e.size
+	for c.size > c.max {
+		removed = append(removed, c.remove(c.order.Back().Value.(*lruEntry).key))
+		c.evicted++
+	}
+	return removed
+}
+
+func (c *lru) remove(key string) *lruEntry {
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	e := c.order.Remove(el).(*lruEntry)
+	delete(c.items, key)
+	c.size -= e.size
+	return e
+}
+
+// MemCache is a Cache in memory.
+type MemCache struct {
+	mu      sync.Mutex
+	entries *lru
+}
+
+// NewMemCache returns a Cache holding up to maxBytes of contents in
+// memory, evicting the least recently used when it's full.
+func NewMemCache(maxBytes int64) *MemCache {
+	return &MemCache{entries: newLRU(maxBytes)}
+}
+
+func (c *MemCache) Get(key, etag string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries.get(key, etag)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), e.data...), true
+}
+
+func (c *MemCache) Put(key, etag string, data []byte) {
+	if int64(len(data)) > c.entries.max {
+		c.Remove(key)
+		return
+	}
+	e := &lruEntry{key: key, etag: etag, size: int64(len(data)), data: append([]byte(nil), data...)}
+	c.mu.Lock()
+	c.entries.add(e)
+	c.mu.Unlock()
+}
+
+func (c *MemCache) Remove(key string) {
+	c.mu.Lock()
+	c.entries.remove(key)
+	c.mu.Unlock()
+}
+
+func (c *MemCache) Usage() (bytes, evictions int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.size, c.entries.evicted
+}
+
+// diskCacheExt marks the files a DiskCache writes.
+const diskCacheExt = ".af3ro-cache"
+
+// DiskCache is a Cache in files in a local directory, for contents too
+// large to keep in memory. Which contents are cached is only known to
+// the process that cached them.
+type DiskCache struct {
+	dir     string
+	mu      sync.Mutex
+	entries *lru
+}
+
+// NewDiskCache returns a Cache holding up to maxBytes of contents in
+// files in dir, evicting the least recently used when it's full. The
+// directory is created if it doesn't exist, and emptied of files left
+// by earlier DiskCaches.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*"+diskCacheExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range old {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return &DiskCache{dir: dir, entries: newLRU(maxBytes)}, nil
+}
+
+// path is the file key's contents are kept in.
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+diskCacheExt)
+}
+
+func (c *DiskCache) Get(key, etag string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries.get(key, etag); !ok {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		c.entries.remove(key)
+		return nil, false
+	}
+	return data, true
+}
+
+// Put writes data to a file, or drops key if it can't.
+func (c *DiskCache) Put(key, etag string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(len(data)) > c.entries.max {
+		c.drop(c.entries.remove(key))
+		return
+	}
+	tmp := c.path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		c.drop(c.entries.remove(key))
+		return
+	}
+	for _, e := range c.entries.add(&lruEntry{key: key, etag: etag, size: int64(len(data))}) {
+		if e.key != key {
+			c.drop(e)
+		}
+	}
+	if err := os.Rename(tmp, c.path(key)); err != nil {
+		os.Remove(tmp)
+		c.entries.remove(key)
+	}
+}
+
+func (c *DiskCache) Remove(key string) {
+	c.mu.Lock()
+	c.drop(c.entries.remove(key))
+	c.mu.Unlock()
+}
+
+func (c *DiskCache) Usage() (bytes, evictions int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.size, c.entries.evicted
+}
+
+// drop deletes the file holding e, if there is one.
+func (c *DiskCache) drop(e *lruEntry) {
+	if e != nil {
+		os.Remove(c.path(e.key))
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInjected is the error returned by requests failed by Chaos.
+var ErrInjected = errors.New("af3ro: injected fault")
+
+// ChaosConfig describes faults to inject into S3 requests, for testing
+// how callers behave when S3 is degraded.
+type ChaosConfig struct {
+	// Ops limits the faults to requests made for these operations
+	// ("read", "write", "stat", "remove", "rename", "readdir", ...).
+	// Every operation is affected when it's empty.
+	Ops []string
+
+	// Names limits the faults to requests made for these names. Requests
+	// that work on objects directly, such as the copies that rename a
+	// directory, are made for their keys. Every name is affected when
+	// it's empty.
+	Names []string
+
+	// ErrorRate is the probability a request fails with ErrInjected.
+	ErrorRate float64
+
+	// Latency is added to a request with probability LatencyRate.
+	Latency     time.Duration
+	LatencyRate float64
+
+	// TruncateRate is the probability a download returns only part of
+	// the object.
+	TruncateRate float64
+
+	clock Clock
+	rand  Rand
+}
+
+// Chaos injects the faults described by c into every S3 request.
+func Chaos(c ChaosConfig) Option {
+	return func(s *MemS3Fs) {
+		s.chaos = &c
+	}
+}
+
+func (c *ChaosConfig) affects(op, name string) bool {
+	if c == nil {
+		return false
+	}
+	return includes(c.Ops, op) && includes(c.Names, name)
+}
+
+// includes reports whether s is in list, or list is empty.
+func includes(list []string, s string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// before is called ahead of each request, and returns the error the
+// request should fail with instead of being made.
+func (c *ChaosConfig) before(op, name string) error {
+	if !c.affects(op, name) {
+		return nil
+	}
+	r := randOr(c.rand)
+	if c.Latency > 0 && r.Float64() < c.LatencyRate {
+		<-clockOr(c.clock).After(c.Latency)
+	}
+	if r.Float64() < c.ErrorRate {
+		return ErrInjected
+	}
+	return nil
+}
+
+// truncate cuts downloaded data short with probability TruncateRate.
+func (c *ChaosConfig) truncate(op, name string, data []byte) []byte {
+	if !c.affects(op, name) || len(data) == 0 || randOr(c.rand).Float64() >= c.TruncateRate {
+		return data
+	}
+	return data[:randOr(c.rand).Intn(len(data))]
+}
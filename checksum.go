@@ -0,0 +1,196 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+)
+
+// ErrChecksum is returned when no download of an object matched its
+// checksum, or when S3 reports a different checksum for an uploaded part
+// than that of the data sent.
+var ErrChecksum = errors.New("af3ro: data doesn't match its checksum")
+
+// VerifyReads checks every whole-object download against the object's
+// ETag, and downloads it again up to retries times, then from the
+// Replica if there is one, before failing with ErrChecksum. Each bad
+// download is reported as a ChecksumMismatch metric. Only ETags that are
+// MD5s can be checked; objects uploaded in parts or encrypted with
+// SSE-KMS or SSE-C are accepted as they are.
+func VerifyReads(retries int) Option {
+	return func(s *MemS3Fs) {
+		s.verifyReads = true
+		if retries < 0 {
+			retries = 0
+		}
+		s.readRetries = retries
+	}
+}
+
+// Replica names a copy of the bucket, such as the destination of
+// cross-region replication, to read from when the bucket's own copy of
+// an object is corrupt. It's read with the filesystem's credentials.
+func Replica(bucket string, region aws.Region) Option {
+	return func(s *MemS3Fs) {
+		s.replica = bucket
+		s.replicaRegion = region
+	}
+}
+
+// download fetches all of name, checking it if VerifyReads is set, or
+// takes it from the Cache if the object hasn't changed since it was
+// cached. It returns the ETag of the object the contents are from.
+// Concurrent downloads of the same object share one.
+func (m *MemS3Fs) download(op, name string) ([]byte, string, error) {
+	if m.cache != nil {
+		if resp, err := m.head(name); err == nil {
+			etag := resp.Header.Get("ETag")
+			if data, ok := m.cached(name, etag); ok {
+				return data, strings.Trim(etag, "\""), nil
+			}
+		}
+	}
+	v, err, shared := m.flight("get "+m.key(name), func() (interface{}, error) {
+		data, etag, err := m.downloadOnce(op, name)
+		return downloaded{data, etag}, err
+	})
+	d, _ := v.(downloaded)
+	if shared && d.data != nil {
+		// every file gets its own copy to write to
+		d.data = append([]byte(nil), d.data...)
+	}
+	return d.data, d.etag, err
+}
+
+// downloaded is the result of a download shared between files.
+type downloaded struct {
+	data []byte
+	etag string
+}
+
+func (m *MemS3Fs) downloadOnce(op, name string) ([]byte, string, error) {
+	var data []byte
+	var header http.Header
+	fetch := func(replica bool) error {
+		return m.doRead(op, name, func(b *s3.Bucket) (err error) {
+			if replica {
+				b.S3.Region = m.replicaRegion
+				b = b.S3.Bucket(m.replica)
+			}
+			data, header, err = fetchObjectHeader(m.key(name), b)
+			data = m.chaos.truncate(op, name, data)
+			return err
+		})
+	}
+	if err := fetch(false); err != nil {
+		return data, "", err
+	}
+	for attempt := 0; m.verifyReads && !checksumMatches(data, header); attempt++ {
+		m.record(Metric{Kind: ChecksumMismatch, Name: name, Bytes: int64(len(data))})
+		switch {
+		case attempt < m.readRetries:
+			if err := fetch(false); err != nil {
+				return nil, "", err
+			}
+		case attempt == m.readRetries && m.replica != "":
+			if fetch(true) != nil {
+				// the replica's trouble isn't the object's
+				return nil, "", &os.PathError{Op: op, Path: name, Err: ErrChecksum}
+			}
+		default:
+			return nil, "", &os.PathError{Op: op, Path: name, Err: ErrChecksum}
+		}
+	}
+	if !complete(data, header) {
+		// cut short without VerifyReads noticing; keeping it would
+		// leave the file holding part of the object
+		return nil, "", &os.PathError{Op: op, Path: name, Err: io.ErrUnexpectedEOF}
+	}
+	data, err := m.unseal(data, header)
+	if err != nil {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if data, err = m.transformRead(op, name, data); err != nil {
+		return nil, "", err
+	}
+	m.cachePut(name, header.Get("ETag"), data)
+	return data, strings.Trim(header.Get("ETag"), "\""), nil
+}
+
+// complete reports whether data is as long as the Content-Length in
+// header, or the length isn't known.
+func complete(data []byte, header http.Header) bool {
+	n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	return err != nil || int64(len(data)) == n
+}
+
+// checksumMatches reports whether data matches the ETag in header, or
+// the ETag can't be checked.
+func checksumMatches(data []byte, header http.Header) bool {
+	if !etagIsMD5(header) {
+		return true
+	}
+	return strings.Trim(header.Get("ETag"), "\"") == md5ETag(data)
+}
+
+// etagIsMD5 reports whether the ETag in header, from a GET or HEAD, is
+// the MD5 of the object's bytes: it was uploaded in one request, and not
+// encrypted with SSE-KMS or SSE-C.
+func etagIsMD5(header http.Header) bool {
+	etag := strings.Trim(header.Get("ETag"), "\"")
+	return etag != "" && !strings.Contains(etag, "-") &&
+		header.Get("x-amz-server-side-encryption") != "aws:kms" &&
+		header.Get("x-amz-server-side-encryption-customer-algorithm") == ""
+}
+
+// checksumAlgorithms are the additional checksums S3 may store with an
+// object, strongest first.
+var checksumAlgorithms = []string{"sha256", "sha1", "crc32c", "crc32"}
+
+// contentChecksum returns the strongest checksum of an object's contents
+// in header, from a HEAD made with checksum mode enabled, falling back
+// to its ETag when that's an MD5. Checksums of parts, and of client-side
+// encrypted objects, don't identify the contents, so aren't returned.
+func contentChecksum(header http.Header) (algo string, value []byte) {
+	if header.Get("X-Amz-Meta-"+metaDataKey) != "" {
+		return "", nil
+	}
+	for _, algo := range checksumAlgorithms {
+		if v := header.Get("x-amz-checksum-" + algo); v != "" {
+			if sum, err := base64.StdEncoding.DecodeString(v); err == nil {
+				return algo, sum
+			}
+		}
+	}
+	if !etagIsMD5(header) {
+		return "", nil
+	}
+	sum, err := hex.DecodeString(strings.Trim(header.Get("ETag"), "\""))
+	if err != nil {
+		return "", nil
+	}
+	return "md5", sum
+}
@@ -0,0 +1,118 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"math/rand"
+	"time"
+)
+
+// A Clock tells the filesystem the time, for modification times,
+// snapshot names, cache expiry and the delays between retries. Requests
+// are still signed and timed out by the system clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// A TimerClock is a Clock that can also call a function once a delay has
+// passed. IdleTimeout is timed by the filesystem's TimeSource only if
+// it's a TimerClock, and by the system clock otherwise.
+type TimerClock interface {
+	Clock
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a pending call made by a TimerClock, as a *time.Timer made
+// by time.AfterFunc is.
+type Timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// A Rand supplies the randomness used to sample Shadow writes, inject
+// Chaos faults and jitter retries. It must be safe for concurrent use,
+// which a *rand.Rand isn't.
+type Rand interface {
+	Float64() float64
+	Intn(n int) int
+}
+
+// TimeSource replaces the system clock with c, so tests can control
+// the filesystem's idea of time.
+func TimeSource(c Clock) Option {
+	return func(s *MemS3Fs) {
+		s.clock = c
+	}
+}
+
+// RandSource replaces math/rand's global source with r, so tests can
+// make sampling and fault injection repeatable.
+func RandSource(r Rand) Option {
+	return func(s *MemS3Fs) {
+		s.rand = r
+	}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type systemRand struct{}
+
+func (systemRand) Float64() float64 { return rand.Float64() }
+func (systemRand) Intn(n int) int   { return rand.Intn(n) }
+
+// clockOr returns c, or the system clock if it's nil, as it is in a
+// zero MemS3Fs.
+func clockOr(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
+
+// afterFunc calls f after d by c, or by the system clock if c isn't a
+// TimerClock.
+func afterFunc(c Clock, d time.Duration, f func()) Timer {
+	if tc, ok := c.(TimerClock); ok {
+		return tc.AfterFunc(d, f)
+	}
+	return time.AfterFunc(d, f)
+}
+
+func randOr(r Rand) Rand {
+	if r == nil {
+		return systemRand{}
+	}
+	return r
+}
+
+func (m *MemS3Fs) now() time.Time {
+	return clockOr(m.clock).Now()
+}
+
+func (m *MemS3Fs) sleep(d time.Duration) {
+	<-clockOr(m.clock).After(d)
+}
+
+func (m *MemS3Fs) random() Rand {
+	return randOr(m.rand)
+}
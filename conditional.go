@@ -0,0 +1,76 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// ErrNotModified is returned by OpenIfModifiedSince for an object that
+// hasn't changed.
+var ErrNotModified = errors.New("af3ro: not modified")
+
+// OpenIfModifiedSince is Open for pollers: it downloads name with a
+// conditional GET, failing with ErrNotModified, and downloading nothing,
+// if the object hasn't changed since t. A file with unflushed writes is
+// opened as it is, and links are followed without checking their
+// targets. Handles already open on the file keep reading what it had.
+func (m *MemS3Fs) OpenIfModifiedSince(name string, t time.Time) (afero.File, error) {
+	m.rlock()
+	f, ok := m.getData()[name].(*InMemoryFile)
+	m.runlock()
+	if ok {
+		f.mu.Lock()
+		local := f.dir || f.dirty
+		f.mu.Unlock()
+		if local {
+			return m.Open(name)
+		}
+	}
+
+	var data []byte
+	var header http.Header
+	err := m.doRead("open", name, func(b *s3.Bucket) (err error) {
+		data, header, err = fetchObjectWith(m.key(name), b, map[string][]string{
+			"If-Modified-Since": {t.UTC().Format(http.TimeFormat)},
+		})
+		return err
+	})
+	if isNotModified(err) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotModified}
+	}
+	if err != nil {
+		return nil, m.readError("open", name, err)
+	}
+	if m.markers != nil && m.markers.IsLink(header) {
+		return m.Open(resolveLink(name, m.markers.LinkTarget(data, header)))
+	}
+
+	f = m.remoteFile(name, header)
+	f.mu.Lock()
+	err = f.fetched("open", data, header)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.replaceRemote(f).open(m), nil
+}
@@ -16,23 +16,96 @@
 package af3ro
 
 import (
+	"context"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
 )
 
 type Option func(*MemS3Fs)
 
+const (
+	defaultHeadCacheTTL   = 5 * time.Second
+	defaultPrefixCacheTTL = 30 * time.Second
+	defaultFlushRetries   = 3
+	flushRetryDelay       = 100 * time.Millisecond
+)
+
+// NewS3Fs returns a filesystem configured by options. Errors checking
+// the bucket, as asked for by VerifyBucket and CreateBucketIfMissing,
+// are ignored; use New to see them.
 func NewS3Fs(options ...Option) *MemS3Fs {
-	s := new(MemS3Fs)
+	s, _ := New(options...)
+	return s
+}
+
+// New returns a filesystem configured by options, or an error if the
+// bucket doesn't pass the checks asked for by VerifyBucket or
+// CreateBucketIfMissing. The filesystem is returned with the error.
+func New(options ...Option) (*MemS3Fs, error) {
+	s := &MemS3Fs{
+		data:     make(map[string]afero.File),
+		mutex:    &sync.RWMutex{},
+		heads:    newHeadMemo(defaultHeadCacheTTL),
+		prefixes: newPrefixCache(defaultPrefixCacheTTL),
+		flights:  &flightGroup{},
+		counts:   &cacheCounts{},
+		failed:   &failedFlushes{},
+		workers:  newWorkerGroup(),
+
+		flushRetries:  defaultFlushRetries,
+		retry:         defaultRetryPolicy,
+		throttle:      &throttle{},
+		skipUnchanged: true,
+		dirSize:       defaultDirSize,
+
+		multipartThreshold: defaultMultipartThreshold,
+		partSize:           defaultPartSize,
+		partConcurrency:    defaultMultipartConcurrency,
+
+		clock: systemClock{},
+		rand:  systemRand{},
+	}
 
 	Region(aws.USEast)(s) // set default region
 
 	for _, opt := range options {
 		opt(s)
 	}
-	return s
+	// the parts that keep time or sample share the filesystem's sources
+	s.heads.clock, s.prefixes.clock = s.clock, s.clock
+	s.heads.missTTL = s.missingTTL
+	if s.chaos != nil {
+		s.chaos.clock, s.chaos.rand = s.clock, s.rand
+	}
+	if s.failover != nil {
+		s.failover.clock = s.clock
+	}
+	if s.scheduler != nil {
+		s.scheduler.clock = s.clock
+	}
+	if s.limiter != nil {
+		s.limiter.clock = s.clock
+	}
+	if s.creds != nil {
+		s.creds.clock = s.clock
+	}
+
+	if s.detectRegion && s.endpoint == "" {
+		s.detectBucketRegion()
+	}
+	if s.verifyBucket || s.createBucket != nil {
+		return s, s.checkBucket()
+	}
+	return s, nil
 }
 
 func S3FsFromBucket(b s3.Bucket) *MemS3Fs {
@@ -51,22 +124,519 @@ func Region(region aws.Region) Option {
 	}
 }
 
+// DetectRegion asks S3 which region the bucket is in when the filesystem
+// is made, and uses it instead of the one set by Region, so requests
+// aren't sent to the wrong endpoint. The region is left alone if S3 can't
+// be asked, and stores set with Endpoint aren't asked.
+func DetectRegion() Option {
+	return func(s *MemS3Fs) {
+		s.detectRegion = true
+	}
+}
+
+// detectBucketRegion points the filesystem at its bucket's region.
+func (m *MemS3Fs) detectBucketRegion() {
+	var loc string
+	err := m.doRead("location", "", func(b *s3.Bucket) (err error) {
+		// any region answers, but us-east-1 is the one that always does
+		b.S3.Region = aws.USEast
+		loc, err = b.Location()
+		return err
+	})
+	if err == nil {
+		m.region = locationRegion(loc)
+	}
+}
+
+// locationRegion returns the region for a GetBucketLocation constraint,
+// which is empty for us-east-1 and "EU" for buckets made long ago in
+// eu-west-1.
+func locationRegion(loc string) aws.Region {
+	switch loc {
+	case "":
+		return aws.USEast
+	case "EU":
+		return aws.EUWest
+	}
+	return regionNamed(loc)
+}
+
 func EnvAuth() Option {
 	return func(s *MemS3Fs) {
 		s.auth, _ = aws.GetAuth("", "", "", time.Time{})
 	}
 }
 
+// Endpoint sends requests to the S3-compatible store at url, such as
+// "http://localhost:9000" for MinIO, instead of the region's AWS endpoint.
+// Buckets are addressed as subdomains of url's host unless PathStyle is
+// used as well, which most local stores need.
+func Endpoint(url string) Option {
+	return func(s *MemS3Fs) {
+		s.endpoint = strings.TrimSuffix(url, "/")
+	}
+}
+
+// HTTPClient makes the requests af3ro sends itself, rather than through
+// goamz, with c: those for object tags and ACLs, and those starting
+// multipart uploads of objects with an Expires header. goamz makes
+// every other request, including every upload and download of contents,
+// with a client of its own, which can't be replaced, so c's proxy, CAs
+// and connection pool don't apply to them. Credential providers use
+// their own Client fields.
+func HTTPClient(c *http.Client) Option {
+	return func(s *MemS3Fs) {
+		s.client = c
+	}
+}
+
+// HTTPTransport is HTTPClient with a client that sends requests with rt,
+// such as one wrapping http.DefaultTransport to record them in tests.
+func HTTPTransport(rt http.RoundTripper) Option {
+	return HTTPClient(&http.Client{Transport: rt})
+}
+
+// httpClient returns the client set by HTTPClient, or
+// http.DefaultClient.
+func (s *MemS3Fs) httpClient() *http.Client {
+	if s.client == nil {
+		return http.DefaultClient
+	}
+	return s.client
+}
+
+// PathStyle addresses buckets in the path of request URLs,
+// endpoint/bucket/key, rather than as a subdomain of the endpoint.
+func PathStyle() Option {
+	return func(s *MemS3Fs) {
+		s.pathStyle = true
+	}
+}
+
 func Bucket(name string) Option {
-	// TODO add a `verify` option to run HEAD on the bucket to ensure
-	// it exists
 	return func(s *MemS3Fs) {
 		s.bucketName = name
 	}
 }
 
+// VerifyBucket makes New fail with ErrBucketNotFound if the bucket
+// doesn't exist, or with the error S3 gave if it can't be listed.
+func VerifyBucket() Option {
+	return func(s *MemS3Fs) {
+		s.verifyBucket = true
+	}
+}
+
+// CreateBucketIfMissing makes New create the bucket with acl in region
+// if it doesn't exist, and point the filesystem at that region. The
+// filesystem's own region is used if region is the zero Region.
+func CreateBucketIfMissing(acl s3.ACL, region aws.Region) Option {
+	return func(s *MemS3Fs) {
+		s.createBucket = &bucketSpec{acl: acl, region: region}
+	}
+}
+
+// Prefix stores every file under prefix in the bucket, as if it were the
+// bucket's root, so several filesystems can share a bucket without
+// seeing each other's files. Names are cleaned before the prefix is
+// added, so ".." can't reach outside it.
+func Prefix(prefix string) Option {
+	return func(s *MemS3Fs) {
+		s.root = strings.Trim(path.Clean("/"+prefix), "/")
+	}
+}
+
+// Storage classes goamz doesn't name.
+const (
+	StandardIA         = s3.StorageClass("STANDARD_IA")
+	OneZoneIA          = s3.StorageClass("ONEZONE_IA")
+	IntelligentTiering = s3.StorageClass("INTELLIGENT_TIERING")
+	GlacierIR          = s3.StorageClass("GLACIER_IR")
+)
+
+// StorageClass stores the objects the filesystem writes and copies in
+// class instead of the bucket's default, STANDARD. Files can choose
+// their own with SetStorageClass.
+func StorageClass(class s3.StorageClass) Option {
+	return func(s *MemS3Fs) {
+		s.storageClass = class
+	}
+}
+
+// DirSize sets the Size directories report, 42 unless set. Sync tools
+// that compare sizes may want 0.
+func DirSize(n int64) Option {
+	return func(s *MemS3Fs) {
+		s.dirSize = n
+	}
+}
+
+// DirModTimes makes a directory's ModTime that of the newest object
+// under it, rather than the zero time, for sync tools that compare
+// directories' times. It's found with a listing of everything under
+// the directory the first time a FileInfo's ModTime is called.
+func DirModTimes() Option {
+	return func(s *MemS3Fs) {
+		s.dirModTimes = true
+	}
+}
+
+// Treat403AsNotFound makes S3 refusing a HEAD, GET or directory listing
+// mean the object doesn't exist, as it does for buckets whose policies
+// deny s3:ListBucket: S3 then answers 403 rather than 404 for missing
+// keys. Objects the caller can't decrypt with their KMS key still fail
+// with a KMSAccessError.
+func Treat403AsNotFound() Option {
+	return func(s *MemS3Fs) {
+		s.hide403 = true
+	}
+}
+
+// Named overrides the name returned by the filesystem's Name method, to
+// tell apart several filesystems in logs.
+func Named(name string) Option {
+	return func(s *MemS3Fs) {
+		s.name = name
+	}
+}
+
+// MimeType registers a content type for files with the extension ext,
+// overriding the standard library's mime table.
+func MimeType(ext, ctype string) Option {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return func(s *MemS3Fs) {
+		if s.mimeTypes == nil {
+			s.mimeTypes = make(map[string]string)
+		}
+		s.mimeTypes[ext] = ctype
+	}
+}
+
+// Charset is the charset declared by text/* content types, replacing
+// the one in the standard library's mime table. Types registered with
+// MimeType keep a charset they name.
+func Charset(charset string) Option {
+	return func(s *MemS3Fs) {
+		s.charset = charset
+	}
+}
+
+// RevalidateOnOpen makes Open of a file whose contents have been
+// downloaded check that its object hasn't changed since, with a GET that
+// S3 answers with 304 Not Modified if it hasn't, and download the object
+// again if it has. Without it, a file is read from memory until it's
+// evicted from the cache.
+func RevalidateOnOpen() Option {
+	return func(s *MemS3Fs) {
+		s.revalidate = true
+	}
+}
+
+// CacheTTL makes files that were found in S3, read or written more than
+// ttl ago be dropped from the cache the next time they're opened or
+// stat'd, and fetched from S3 again. Dirty files and directories are
+// kept, and a file that's open when it's dropped keeps working, apart
+// from later opens. Without it, files are cached until they're removed.
+func CacheTTL(ttl time.Duration) Option {
+	return func(s *MemS3Fs) {
+		s.cacheTTL = ttl
+	}
+}
+
+// HeadCacheTTL sets how long a HEAD response is reused by later calls
+// for the same key. Zero disables the reuse.
+func HeadCacheTTL(ttl time.Duration) Option {
+	return func(s *MemS3Fs) {
+		s.heads = newHeadMemo(ttl)
+	}
+}
+
+// NegativeCacheTTL sets how long a key found missing is reported
+// missing without asking S3 again, so that polling for an object that
+// doesn't exist yet costs one HEAD per ttl. Creating or writing the file
+// through this filesystem forgets it at once; objects written by others
+// appear once ttl has passed. Zero, the default, disables it.
+func NegativeCacheTTL(ttl time.Duration) Option {
+	return func(s *MemS3Fs) {
+		s.missingTTL = ttl
+	}
+}
+
+// PrefixCacheTTL sets how long the objects and subdirectories found by
+// listing a directory are reused. Zero disables the reuse. Either way, a
+// directory read a page at a time with Readdir is listed once per Open.
+func PrefixCacheTTL(ttl time.Duration) Option {
+	return func(s *MemS3Fs) {
+		s.prefixes = newPrefixCache(ttl)
+	}
+}
+
+// StreamingReads makes Read pull from the object's GET response, reading
+// ahead up to readahead bytes, instead of downloading the whole object
+// into memory first. Files are still loaded in full once written to.
+func StreamingReads(readahead int) Option {
+	return func(s *MemS3Fs) {
+		s.readahead = readahead
+	}
+}
+
+// Prefetch makes files read with StreamingReads download up to n bytes
+// past what's been read in the background, so that a sequential reader,
+// such as io.Copy to a local file or HTTP response, isn't held up by
+// each round trip to S3. Seeking elsewhere discards what was fetched.
+func Prefetch(n int) Option {
+	return func(s *MemS3Fs) {
+		s.prefetch = n
+	}
+}
+
+// ListPageSize sets how many keys each LIST request asks S3 for when
+// walking, reading or removing directories, trading requests for memory.
+// S3 returns at most 1000, which is what it returns by default.
+func ListPageSize(n int) Option {
+	return func(s *MemS3Fs) {
+		if n > maxListPage {
+			n = maxListPage
+		}
+		if n < 0 {
+			n = 0
+		}
+		s.listPageSize = n
+	}
+}
+
+// Multipart uploads files larger than threshold bytes in parts of
+// partSize bytes, concurrency parts at a time. S3 requires parts of at
+// least 5MiB, and won't accept objects over 5GB in a single PUT.
+func Multipart(threshold, partSize int64, concurrency int) Option {
+	return func(s *MemS3Fs) {
+		s.multipartThreshold = threshold
+		if partSize < minPartSize {
+			partSize = minPartSize
+		}
+		s.partSize = partSize
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		s.partConcurrency = concurrency
+	}
+}
+
+// StreamingWrites makes files made with Create upload each part, as
+// sized by Multipart, as soon as it's been written, so a file of any size
+// can be written without holding it in memory. Once the first part is
+// uploaded the file can only be appended to: reads, truncation and seeks
+// away from the end fail with ErrStreamingWrite. If any part fails the
+// whole upload is abandoned on Close, since its bytes can't be resent.
+// Encrypted files, and those with write transforms, are uploaded whole.
+func StreamingWrites() Option {
+	return func(s *MemS3Fs) {
+		s.streamWrites = true
+	}
+}
+
+// FlushRetries sets how many times a failed upload is retried before
+// Close gives up and leaves the file dirty.
+func FlushRetries(n int) Option {
+	return func(s *MemS3Fs) {
+		s.flushRetries = n
+	}
+}
+
+// WriteThrough uploads a file after every Write, WriteAt and Truncate,
+// rather than when it's closed. Each write costs a PUT of the whole file,
+// less those SkipUnchanged finds identical. Files written with
+// StreamingWrites still upload as their parts fill.
+func WriteThrough() Option {
+	return func(s *MemS3Fs) {
+		s.writeThrough = true
+	}
+}
+
+// SkipUnchanged controls whether Close compares the file to the object's
+// ETag and skips uploading identical contents. It's on by default, and
+// ignored when SSEKMS is used since those ETags aren't MD5 sums.
+func SkipUnchanged(enabled bool) Option {
+	return func(s *MemS3Fs) {
+		s.skipUnchanged = enabled
+	}
+}
+
+// SSE encrypts uploaded objects with S3-managed keys (SSE-S3).
+func SSE() Option {
+	return func(s *MemS3Fs) {
+		s.sse = true
+	}
+}
+
+// SSEKMS encrypts uploaded objects with the KMS key keyID, or the
+// account's default S3 key when keyID is empty.
+func SSEKMS(keyID string) Option {
+	return func(s *MemS3Fs) {
+		s.sseKMS = true
+		s.kmsKeyID = keyID
+	}
+}
+
+// OnFlush registers fn to be called after each file is written to S3,
+// with the version ID the write created on versioned buckets.
+func OnFlush(fn func(name, versionID string)) Option {
+	return func(s *MemS3Fs) {
+		s.onFlush = fn
+	}
+}
+
+func (s MemS3Fs) putOptions() s3.Options {
+	return s3.Options{
+		SSE:         s.sse && !s.sseKMS,
+		SSEKMS:      s.sseKMS,
+		SSEKMSKeyId: s.kmsKeyID,
+
+		StorageClass: s.storageClass,
+	}
+}
+
+// etagIsMD5 reports whether ETags of objects this filesystem writes can
+// be compared against local contents.
+func (s MemS3Fs) etagIsMD5() bool {
+	return s.skipUnchanged && !s.sseKMS && s.encryption == nil
+}
+
+func (s MemS3Fs) contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	ctype, ok := s.mimeTypes[ext]
+	if !ok {
+		ctype = mime.TypeByExtension(ext)
+	}
+	if ctype == "" {
+		return "application/octet-stream"
+	}
+	if s.charset == "" || !strings.HasPrefix(ctype, "text/") {
+		return ctype
+	}
+	mediatype, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return ctype
+	}
+	if _, named := params["charset"]; named && ok {
+		// a type registered with MimeType keeps the charset it names
+		return ctype
+	}
+	params["charset"] = s.charset
+	return mime.FormatMediaType(mediatype, params)
+}
+
+// WithContext returns a view of fs that shares its cache but abandons
+// S3 requests once ctx is done. Files opened through the view make their
+// requests under ctx; the same files opened through fs, or another view,
+// aren't affected.
+func WithContext(ctx context.Context, fs *MemS3Fs) afero.Fs {
+	view := *fs
+	view.ctx = ctx
+	view.base = fs.origin()
+	return &view
+}
+
+// OpenContext is Open with its S3 requests, and those made later through
+// the file it returns, abandoned once ctx is done.
+func (m *MemS3Fs) OpenContext(ctx context.Context, name string) (afero.File, error) {
+	return WithContext(ctx, m).Open(name)
+}
+
+// CreateContext is Create with the file's S3 requests abandoned once ctx
+// is done. Cancelling ctx also aborts the upload of a file being written
+// with StreamingWrites.
+func (m *MemS3Fs) CreateContext(ctx context.Context, name string) (afero.File, error) {
+	return WithContext(ctx, m).Create(name)
+}
+
+// RemoveAllContext is RemoveAll with its S3 requests abandoned once ctx is
+// done.
+func (m *MemS3Fs) RemoveAllContext(ctx context.Context, path string) error {
+	return WithContext(ctx, m).RemoveAll(path)
+}
+
+// WithTimeout returns a view of fs that shares its cache but gives each
+// S3 request at most d to complete.
+func WithTimeout(fs *MemS3Fs, d time.Duration) afero.Fs {
+	view := *fs
+	view.timeout = d
+	view.base = fs.origin()
+	return &view
+}
+
+// RequestTimeout gives each operation's S3 requests, retries included,
+// at most d to complete, as WithTimeout does for a view.
+func RequestTimeout(d time.Duration) Option {
+	return func(s *MemS3Fs) {
+		s.timeout = d
+	}
+}
+
+// ConnectTimeout gives up on connecting to S3 after d, however long the
+// request itself may take.
+func ConnectTimeout(d time.Duration) Option {
+	return func(s *MemS3Fs) {
+		s.dialTimeout = d
+	}
+}
+
+// IdleTimeout fails a read from a GET body left open by StreamingReads
+// with ErrIdleTimeout once it has waited d for data, so a stalled
+// connection can't hang a file forever. The next read starts a new GET.
+// Objects downloaded whole are bounded by RequestTimeout instead.
+func IdleTimeout(d time.Duration) Option {
+	return func(s *MemS3Fs) {
+		s.idleTimeout = d
+	}
+}
+
+// origin returns the filesystem whose files m shares: m itself, unless
+// it's a view.
+func (m *MemS3Fs) origin() *MemS3Fs {
+	if m.base != nil {
+		return m.base
+	}
+	return m
+}
+
+func (s MemS3Fs) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
 func (s MemS3Fs) s3() *s3.S3 {
-	return s3.New(s.auth, s.region)
+	auth := s.auth
+	if a := s.creds.current(); a != nil {
+		auth = *a
+	}
+	return s3.New(auth, s.endpointRegion())
+}
+
+// endpointRegion is the region with its endpoints replaced as set by
+// Endpoint and PathStyle. goamz addresses buckets by path when the region
+// has no S3BucketEndpoint.
+func (s MemS3Fs) endpointRegion() aws.Region {
+	region := s.region
+	if s.endpoint != "" {
+		if region.Name == "" {
+			region.Name = "us-east-1"
+		}
+		region.S3Endpoint = s.endpoint
+		region.S3BucketEndpoint = ""
+		if u, err := url.Parse(s.endpoint); err == nil && u.Host != "" {
+			region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+		}
+	}
+	if s.pathStyle {
+		region.S3BucketEndpoint = ""
+	}
+	return region
 }
 
 func (s MemS3Fs) bucket() *s3.Bucket {
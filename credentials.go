@@ -0,0 +1,346 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+)
+
+const (
+	// credentials are renewed this long before they expire
+	credentialRefreshWindow = 5 * time.Minute
+
+	defaultIMDSEndpoint = "http://169.254.169.254"
+	ecsEndpoint         = "http://169.254.170.2"
+	imdsTokenTTL        = "21600"
+	defaultSTSEndpoint  = "https://sts.amazonaws.com"
+)
+
+// metadataClient is used for the link-local metadata services, which
+// answer at once when they're there at all, so that looking for
+// credentials off EC2 or ECS doesn't hang.
+var metadataClient = &http.Client{Timeout: time.Second}
+
+// A CredentialProvider supplies AWS credentials. Credentials with a zero
+// Expiration never need renewing.
+type CredentialProvider interface {
+	Retrieve(ctx context.Context) (*aws.Auth, error)
+}
+
+// Credentials signs the filesystem's requests with credentials from p,
+// renewing them shortly before they expire. It replaces Auth and EnvAuth.
+func Credentials(p CredentialProvider) Option {
+	return func(s *MemS3Fs) {
+		s.creds = &credentialCache{provider: p}
+	}
+}
+
+// DefaultCredentials looks for credentials in the environment, then
+// from a web identity token, then in the shared credentials files, then
+// from the ECS container endpoint, then from the EC2 instance profile.
+func DefaultCredentials() CredentialProvider {
+	return CredentialChain{
+		EnvCredentials{},
+		WebIdentityCredentials{},
+		ProfileCredentials{},
+		ECSCredentials{},
+		IMDSCredentials{},
+	}
+}
+
+// CredentialChain uses the first of its providers that supplies
+// credentials.
+type CredentialChain []CredentialProvider
+
+func (c CredentialChain) Retrieve(ctx context.Context) (*aws.Auth, error) {
+	var errs []string
+	for _, p := range c {
+		auth, err := p.Retrieve(ctx)
+		if err == nil {
+			return auth, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, errors.New("af3ro: no credentials found: " + strings.Join(errs, "; "))
+}
+
+// EnvCredentials reads static credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type EnvCredentials struct{}
+
+func (EnvCredentials) Retrieve(ctx context.Context) (*aws.Auth, error) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return aws.NewAuth(id, secret, os.Getenv("AWS_SESSION_TOKEN"), time.Time{}), nil
+}
+
+// WebIdentityCredentials assumes a role with an OIDC token, such as the
+// service account token EKS mounts for IAM roles for service accounts.
+// Empty fields are read from the variables EKS sets:
+// AWS_WEB_IDENTITY_TOKEN_FILE, AWS_ROLE_ARN and AWS_ROLE_SESSION_NAME.
+// The token file is read again each time the role is assumed, since it's
+// rotated.
+type WebIdentityCredentials struct {
+	RoleARN     string
+	TokenFile   string
+	SessionName string
+	// Endpoint is the STS endpoint, regional if AWS_REGION is set.
+	Endpoint string
+	Client   *http.Client // http.DefaultClient if nil
+}
+
+func (p WebIdentityCredentials) Retrieve(ctx context.Context) (*aws.Auth, error) {
+	role, tokenFile, session := p.RoleARN, p.TokenFile, p.SessionName
+	if role == "" {
+		role = os.Getenv("AWS_ROLE_ARN")
+	}
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if role == "" || tokenFile == "" {
+		return nil, errors.New("AWS_ROLE_ARN or AWS_WEB_IDENTITY_TOKEN_FILE not set")
+	}
+	if session == "" {
+		session = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+	if session == "" {
+		session = fmt.Sprintf("af3ro-%d", clockOr(ctxClock(ctx)).Now().UnixNano())
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = defaultSTSEndpoint
+		if region := os.Getenv("AWS_REGION"); region != "" {
+			endpoint = "https://sts." + region + ".amazonaws.com"
+		}
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := metadata(ctx, p.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal([]byte(body), &resp); err != nil {
+		return nil, err
+	}
+	c := resp.Credentials
+	return aws.NewAuth(c.AccessKeyId, c.SecretAccessKey, c.SessionToken, c.Expiration), nil
+}
+
+// ECSCredentials reads the task role's credentials from the endpoint ECS
+// names in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI.
+type ECSCredentials struct {
+	Client *http.Client // one with a 1s timeout if nil
+}
+
+func (p ECSCredentials) Retrieve(ctx context.Context) (*aws.Auth, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = ecsEndpoint + rel
+	}
+	if u == "" {
+		return nil, errors.New("not running in an ECS task")
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	client := p.Client
+	if client == nil {
+		client = metadataClient
+	}
+	return fetchRoleCredentials(ctx, client, req)
+}
+
+// IMDSCredentials reads the instance profile's credentials from the EC2
+// instance metadata service, using IMDSv2 session tokens.
+type IMDSCredentials struct {
+	Endpoint string       // defaultIMDSEndpoint if empty
+	Client   *http.Client // one with a 1s timeout if nil
+}
+
+func (p IMDSCredentials) Retrieve(ctx context.Context) (*aws.Auth, error) {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = defaultIMDSEndpoint
+	}
+	client := p.Client
+	if client == nil {
+		client = metadataClient
+	}
+
+	req, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", imdsTokenTTL)
+	token, err := metadata(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	const path = "/latest/meta-data/iam/security-credentials/"
+	if req, err = http.NewRequest("GET", endpoint+path, nil); err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	role, err := metadata(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+
+	if req, err = http.NewRequest("GET", endpoint+path+role, nil); err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return fetchRoleCredentials(ctx, client, req)
+}
+
+// metadata returns the body of a response from a metadata service or
+// STS.
+func metadata(ctx context.Context, client *http.Client, req *http.Request) (string, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return string(body), nil
+}
+
+// fetchRoleCredentials reads the JSON credentials document served by the
+// instance and container metadata services.
+func fetchRoleCredentials(ctx context.Context, client *http.Client, req *http.Request) (*aws.Auth, error) {
+	body, err := metadata(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return nil, err
+	}
+	return aws.NewAuth(doc.AccessKeyId, doc.SecretAccessKey, doc.Token, doc.Expiration), nil
+}
+
+// credentialCache holds the credentials from a provider until they're
+// about to expire. A nil *credentialCache holds none.
+type credentialCache struct {
+	sync.Mutex
+	provider CredentialProvider
+	auth     *aws.Auth
+	clock    Clock
+}
+
+// refresh renews the credentials if they're missing or about to expire.
+// Credentials that can't be renewed are used until they do expire.
+func (c *credentialCache) refresh(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.auth != nil {
+		exp := c.auth.Expiration()
+		if exp.IsZero() || exp.Sub(clockOr(c.clock).Now()) > credentialRefreshWindow {
+			return nil
+		}
+	}
+	auth, err := c.provider.Retrieve(context.WithValue(ctx, clockKey{}, c.clock))
+	if err != nil {
+		if c.auth != nil && clockOr(c.clock).Now().Before(c.auth.Expiration()) {
+			return nil
+		}
+		return err
+	}
+	c.auth = auth
+	return nil
+}
+
+// clockKey is the context key under which refresh hands providers the
+// filesystem's Clock.
+type clockKey struct{}
+
+// ctxClock returns the Clock in ctx, or nil if there's none.
+func ctxClock(ctx context.Context) Clock {
+	c, _ := ctx.Value(clockKey{}).(Clock)
+	return c
+}
+
+// current returns the credentials last retrieved, if any.
+func (c *credentialCache) current() *aws.Auth {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.auth
+}
@@ -0,0 +1,116 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// A Processor makes derivatives of the file name, such as thumbnails or
+// resized images, from its contents. It returns each derivative's
+// contents under a name of its own, such as "thumb.jpg".
+type Processor func(name string, data []byte) (map[string][]byte, error)
+
+// deriveRule is a Processor for the files under a prefix, with the
+// directory its derivatives are stored under.
+type deriveRule struct {
+	prefix string
+	dir    string
+	fn     Processor
+}
+
+// Derive has p make derivatives of each file whose name starts with
+// prefix after it's written to S3, storing them under dir in a
+// directory named for the file's path below prefix. A derivative "thumb"
+// of photos/2020/a.jpg, with prefix "photos" and dir "thumbs", is stored
+// as thumbs/2020/a.jpg/thumb. p works in the background at low priority
+// (see WithPriority) on the contents readers would see, Close waits for
+// it, and its errors are kept for Err. Files under dir are never derived
+// from by the same rule, and derivatives aren't removed with their file.
+func Derive(prefix, dir string, p Processor) Option {
+	return func(s *MemS3Fs) {
+		s.derivers = append(s.derivers, deriveRule{prefix, dir, p})
+	}
+}
+
+// derive starts the derivatives of name, which has just been written.
+func (m *MemS3Fs) derive(name string) {
+	for _, r := range m.derivers {
+		if !under(r.prefix, name) || under(r.dir, name) {
+			continue
+		}
+		r := r
+		ctx := WithPriority(context.Background(), PriorityLow)
+		m.finish(ctx, "Derive", func(ctx context.Context) error {
+			return WithContext(ctx, m).(*MemS3Fs).makeDerivatives(r, name)
+		})
+	}
+}
+
+// makeDerivatives runs r's Processor on name and stores what it returns.
+func (m *MemS3Fs) makeDerivatives(r deriveRule, name string) error {
+	data, _, err := m.download("derive", name)
+	if err != nil {
+		return m.readError("derive", name, err)
+	}
+	out, err := r.fn(name, data)
+	if err != nil {
+		return &os.PathError{Op: "derive", Path: name, Err: err}
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(path.Clean("/"+name), "/"), strings.TrimPrefix(r.prefix, "/"))
+	variants := make([]string, 0, len(out))
+	for v := range out {
+		variants = append(variants, v)
+	}
+	sort.Strings(variants)
+	for _, v := range variants {
+		if err := m.putDerived(path.Join(r.dir, rel, v), out[v]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putDerived uploads a derivative whole, as a flush would.
+func (m *MemS3Fs) putDerived(name string, data []byte) error {
+	data, err := m.transformWrite("derive", name, data)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	data, opts, err := m.seal(data, m.putOptions())
+	if err != nil {
+		return &os.PathError{Op: "derive", Path: name, Err: err}
+	}
+	if int64(len(data)) > m.multipartThreshold {
+		err = m.putMultipart(name, data, s3.Private, opts)
+	} else {
+		err = m.do("derive", name, func(b *s3.Bucket) error {
+			return b.Put(m.key(name), data, m.contentType(name), s3.Private, opts)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	m.uploaded(name, size)
+	return nil
+}
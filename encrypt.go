@@ -0,0 +1,201 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// The metadata stored with client-side encrypted objects.
+const (
+	metaDataKey = "af3ro-key"
+	metaNonce   = "af3ro-iv"
+)
+
+// dataKeySize is the size of the AES-256 key each object is encrypted
+// with.
+const dataKeySize = 32
+
+// ErrDecrypt is returned when an object's data key can't be unwrapped or
+// its contents don't authenticate.
+var ErrDecrypt = errors.New("af3ro: can't decrypt object")
+
+// A KeyWrapper wraps the data keys of client-side encrypted objects, so
+// they can be stored alongside the objects.
+type KeyWrapper interface {
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// A KMSClient encrypts and decrypts small payloads with a KMS key, as the
+// Encrypt and Decrypt calls of an AWS SDK's KMS client do.
+type KMSClient interface {
+	Encrypt(keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// KMSKeyWrapper wraps data keys with the KMS key keyID.
+func KMSKeyWrapper(client KMSClient, keyID string) KeyWrapper {
+	return kmsWrapper{client, keyID}
+}
+
+type kmsWrapper struct {
+	client KMSClient
+	keyID  string
+}
+
+func (w kmsWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	return w.client.Encrypt(w.keyID, dataKey)
+}
+
+func (w kmsWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return w.client.Decrypt(wrapped)
+}
+
+// LocalKeyWrapper wraps data keys with AES-GCM under master, which must
+// be 16, 24 or 32 bytes long.
+func LocalKeyWrapper(master []byte) (KeyWrapper, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	return localWrapper{aead}, nil
+}
+
+type localWrapper struct {
+	aead cipher.AEAD
+}
+
+func (w localWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (w localWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	n := w.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, ErrDecrypt
+	}
+	return w.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+}
+
+// ClientSideEncryption encrypts the contents of every file before it's
+// uploaded, with AES-256-GCM under a data key made for each upload, and
+// stores the data key wrapped by w in the object's metadata. Files are
+// decrypted as they're downloaded; objects without a wrapped key are read
+// as they are. Since objects can only be decrypted whole, files are
+// always downloaded in full, StreamingWrites is ignored, and unchanged
+// files can't be recognized, so every flush uploads.
+func ClientSideEncryption(w KeyWrapper) Option {
+	return func(s *MemS3Fs) {
+		s.encryption = w
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data under a new data key, returning the ciphertext and
+// opts with the metadata needed to decrypt it added.
+func (m *MemS3Fs) seal(data []byte, opts s3.Options) ([]byte, s3.Options, error) {
+	if m.encryption == nil {
+		return data, opts, nil
+	}
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, opts, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, opts, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, opts, err
+	}
+	wrapped, err := m.encryption.WrapKey(key)
+	if err != nil {
+		return nil, opts, err
+	}
+	meta := make(map[string][]string, len(opts.Meta)+2)
+	for k, v := range opts.Meta {
+		meta[k] = v
+	}
+	meta[metaDataKey] = []string{base64.StdEncoding.EncodeToString(wrapped)}
+	meta[metaNonce] = []string{base64.StdEncoding.EncodeToString(nonce)}
+	opts.Meta = meta
+	return aead.Seal(nil, nonce, data, nil), opts, nil
+}
+
+// unseal decrypts an object downloaded with header, if it was encrypted.
+func (m *MemS3Fs) unseal(data []byte, header http.Header) ([]byte, error) {
+	wrapped64 := header.Get("X-Amz-Meta-" + metaDataKey)
+	if m.encryption == nil || wrapped64 == "" {
+		return data, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrapped64)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	nonce, err := base64.StdEncoding.DecodeString(header.Get("X-Amz-Meta-" + metaNonce))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	key, err := m.encryption.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	aead, err := newGCM(key)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// plainSize is the size of the contents of an object of n bytes, sent
+// with header, which is smaller than the object if it's encrypted.
+func (m *MemS3Fs) plainSize(n int64, header http.Header) int64 {
+	if m.encryption == nil || header.Get("X-Amz-Meta-"+metaDataKey) == "" {
+		return n
+	}
+	if n -= gcmOverhead; n < 0 {
+		return 0
+	}
+	return n
+}
+
+// gcmOverhead is how much longer AES-GCM makes what it encrypts.
+const gcmOverhead = 16
@@ -0,0 +1,180 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+const mib = 1 << 20
+
+// md5ETag is the ETag S3 assigns to an object uploaded in a single PUT.
+func md5ETag(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+// hashParts returns the MD5 of each partSize chunk of data. The chunks
+// are hashed concurrently since MD5 itself can't be parallelized. The
+// workers only hash memory and are done before it returns, so they
+// needn't be the filesystem's background work.
+func hashParts(data []byte, partSize int64) [][]byte {
+	n := int((int64(len(data)) + partSize - 1) / partSize)
+	if n == 0 {
+		n = 1
+	}
+	sums := make([][]byte, n)
+
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+	parts := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range parts {
+				start := int64(i) * partSize
+				end := start + partSize
+				if end > int64(len(data)) {
+					end = int64(len(data))
+				}
+				sum := md5.Sum(data[start:end])
+				sums[i] = sum[:]
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		parts <- i
+	}
+	close(parts)
+	wg.Wait()
+	return sums
+}
+
+// multipartETag is the ETag S3 assigns to an object uploaded in parts of
+// partSize bytes: the MD5 of the concatenated part MD5s, suffixed with
+// the number of parts.
+func multipartETag(data []byte, partSize int64) string {
+	return joinPartSums(hashParts(data, partSize))
+}
+
+// partMatches reports whether the ETag S3 gave an uploaded part is the
+// MD5 of data, the part's contents. ETags that aren't MD5s, as parts
+// encrypted with SSE-KMS get, can't be checked and always match.
+func partMatches(part s3.Part, data []byte) bool {
+	sum, err := hex.DecodeString(strings.Trim(part.ETag, "\""))
+	if err != nil || len(sum) != md5.Size {
+		return true
+	}
+	want := md5.Sum(data)
+	return bytes.Equal(sum, want[:])
+}
+
+// partsETag is the ETag of an upload completed from parts, worked out
+// from the parts' own ETags. It's "" if any of them isn't an MD5.
+func partsETag(parts []s3.Part) string {
+	sums := make([][]byte, len(parts))
+	for i, p := range parts {
+		sum, err := hex.DecodeString(strings.Trim(p.ETag, "\""))
+		if err != nil || len(sum) != md5.Size {
+			return ""
+		}
+		sums[i] = sum
+	}
+	return joinPartSums(sums)
+}
+
+func joinPartSums(sums [][]byte) string {
+	h := md5.New()
+	for _, sum := range sums {
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(sums))
+}
+
+// etagMatches reports whether etag describes data. Multipart ETags don't
+// record the part size used, so the common choices (the smallest size
+// that yields the right part count, that size rounded up to a whole MiB,
+// the defaults of popular clients, and any partSizes given) are tried.
+func etagMatches(data []byte, etag string, partSizes ...int64) bool {
+	return newDigest(data).matches(etag, partSizes...)
+}
+
+// digest hashes one copy of a file's contents at most once for each part
+// size, so that checking them against the object's ETag and recording
+// the ETag of their upload don't hash the same bytes again.
+type digest struct {
+	data  []byte
+	etags map[int64]string // by part size, 0 for a single PUT
+}
+
+func newDigest(data []byte) *digest {
+	return &digest{data: data, etags: make(map[int64]string)}
+}
+
+// etag is the ETag of the contents uploaded in parts of partSize bytes,
+// or in a single PUT if partSize is 0.
+func (d *digest) etag(partSize int64) string {
+	if etag, ok := d.etags[partSize]; ok {
+		return etag
+	}
+	var etag string
+	if partSize == 0 {
+		etag = md5ETag(d.data)
+	} else {
+		etag = multipartETag(d.data, partSize)
+	}
+	d.etags[partSize] = etag
+	return etag
+}
+
+// matches is etagMatches for the digest's contents.
+func (d *digest) matches(etag string, partSizes ...int64) bool {
+	etag = strings.Trim(etag, "\"")
+	dash := strings.LastIndex(etag, "-")
+	if dash < 0 {
+		return etag == d.etag(0)
+	}
+
+	parts, err := strconv.ParseInt(etag[dash+1:], 10, 64)
+	if err != nil || parts < 1 {
+		return false
+	}
+	size := int64(len(d.data))
+	exact := (size + parts - 1) / parts
+	candidates := []int64{exact, (exact + mib - 1) / mib * mib, 5 * mib, 8 * mib, 16 * mib}
+	candidates = append(candidates, partSizes...)
+	for _, partSize := range candidates {
+		if partSize == 0 || (size+partSize-1)/partSize != parts {
+			continue
+		}
+		if d.etag(partSize) == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+	"github.com/goamz/goamz/s3"
+)
+
+// ErrFailedOver is returned for writes refused while requests are failed
+// over to the secondary bucket.
+var ErrFailedOver = errors.New("af3ro: writes are refused while failed over")
+
+const (
+	defaultFailoverAfter      = 3
+	defaultFailoverCheckEvery = 30 * time.Second
+)
+
+// WritePolicy is what Failover does with writes while the primary bucket
+// is down.
+type WritePolicy int
+
+const (
+	// RejectWrites fails writes with ErrFailedOver.
+	RejectWrites WritePolicy = iota
+	// SecondaryWrites writes to the secondary bucket, for buckets
+	// replicated both ways.
+	SecondaryWrites
+	// QueueWrites holds writes until the primary bucket is back, or
+	// their context is done.
+	QueueWrites
+)
+
+// FailoverConfig names a secondary bucket, such as a replica in another
+// region, to use while the filesystem's own bucket is unreachable.
+type FailoverConfig struct {
+	Bucket string
+	Region aws.Region
+
+	// Writes is what happens to writes while failed over.
+	Writes WritePolicy
+
+	// After is how many requests in a row must fail with a network error
+	// or a 5xx before requests fail over. It defaults to 3.
+	After int
+
+	// CheckEvery is how often the primary bucket is checked while failed
+	// over, to fail back once it answers. It defaults to 30s.
+	CheckEvery time.Duration
+}
+
+// Failover sends requests to the secondary bucket c describes once the
+// filesystem's own bucket stops answering, and back once it recovers.
+// Reads go to the secondary; writes are handled as c.Writes says. Keys
+// are the same in both buckets.
+func Failover(c FailoverConfig) Option {
+	return func(s *MemS3Fs) {
+		if c.After < 1 {
+			c.After = defaultFailoverAfter
+		}
+		if c.CheckEvery <= 0 {
+			c.CheckEvery = defaultFailoverCheckEvery
+		}
+		s.failover = &failover{config: c}
+	}
+}
+
+// failover is the state of a Failover: whether requests have failed over
+// and how many in a row have failed.
+type failover struct {
+	config FailoverConfig
+	clock  Clock
+
+	mu       sync.Mutex
+	failures int
+	active   bool
+	checked  time.Time
+}
+
+// route reports whether a request should go to the secondary, checking
+// the primary with probe if it's time to. Requests that only read go
+// there whatever the WritePolicy. A QueueWrites write waits here for
+// the primary until ctx is done.
+func (f *failover) route(ctx context.Context, read bool, probe func() error) (secondary bool, err error) {
+	if f == nil {
+		return false, nil
+	}
+	for {
+		if !f.failedOver(probe) {
+			return false, nil
+		}
+		if read {
+			return true, nil
+		}
+		switch f.config.Writes {
+		case SecondaryWrites:
+			return true, nil
+		case QueueWrites:
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-clockOr(f.clock).After(f.config.CheckEvery):
+			}
+		default:
+			return false, ErrFailedOver
+		}
+	}
+}
+
+// failedOver reports whether requests are failed over, failing back
+// first if probe finds the primary answering again.
+func (f *failover) failedOver(probe func() error) bool {
+	f.mu.Lock()
+	now := clockOr(f.clock).Now()
+	if !f.active || now.Sub(f.checked) < f.config.CheckEvery {
+		active := f.active
+		f.mu.Unlock()
+		return active
+	}
+	f.checked = now
+	f.mu.Unlock()
+
+	if unavailable(probe()) {
+		return true
+	}
+	f.mu.Lock()
+	f.active, f.failures = false, 0
+	f.mu.Unlock()
+	return false
+}
+
+// report counts the outcome of a request made to the primary, and
+// reports whether it was the failure that made requests fail over.
+func (f *failover) report(err error) (switched bool) {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !unavailable(err) {
+		f.failures = 0
+		return false
+	}
+	f.failures++
+	if f.active || f.failures < f.config.After {
+		return false
+	}
+	f.active, f.checked = true, clockOr(f.clock).Now()
+	return true
+}
+
+// unavailable reports whether err means the bucket couldn't be reached,
+// rather than that it refused the request.
+func unavailable(err error) bool {
+	if e, ok := err.(*s3.Error); ok {
+		return e.StatusCode >= http.StatusInternalServerError
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -18,20 +18,73 @@
 package af3ro
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/md5"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/goamz/goamz/s3"
 	"github.com/spf13/afero"
 )
 
+// ErrStreamingWrite is returned for operations that need bytes a file
+// written with StreamingWrites has already handed off to S3.
+var ErrStreamingWrite = errors.New("af3ro: file is being uploaded as it's written")
+
+// ErrMetaOnly is returned for operations on a file opened with OpenMeta
+// that would read or change its contents.
+var ErrMetaOnly = errors.New("af3ro: file is open for metadata only")
+
+// ErrIdleTimeout is returned for reads of a GET body that has sent
+// nothing for the filesystem's IdleTimeout.
+var ErrIdleTimeout = errors.New("af3ro: no data received within the idle timeout")
+
 // Toss a compile error if interface isn't implemented
 var _ afero.File = new(InMemoryFile)
+var _ VersionedFile = new(InMemoryFile)
+var _ StorageClassFile = new(InMemoryFile)
+var _ HeadersFile = new(InMemoryFile)
+var _ ContentInfo = new(InMemoryFileInfo)
+
+// VersionedFile is implemented by files that know which version of their
+// object was last written, for buckets with versioning enabled.
+type VersionedFile interface {
+	afero.File
+	VersionID() string
+}
+
+// ContentInfo is implemented by FileInfos that identify their file's
+// contents without reading them, so that sync tools can tell whether a
+// remote copy matches a local one.
+type ContentInfo interface {
+	os.FileInfo
+	ETag() string
+	Checksum() (algo string, value []byte)
+}
+
+// StorageClassFile is implemented by files whose objects can be stored in
+// a storage class of their own.
+type StorageClassFile interface {
+	afero.File
+	SetStorageClass(class s3.StorageClass)
+}
+
+// HeadersFile is implemented by files whose objects can be stored with
+// headers of their own.
+type HeadersFile interface {
+	afero.File
+	SetHeaders(h Headers)
+}
 
 type MemDir interface {
 	Len() int
@@ -41,66 +94,350 @@ type MemDir interface {
 	Remove(afero.File)
 }
 
+// InMemoryFile is an open file of a MemS3Fs. Every Open of a name gives
+// another InMemoryFile, with its own offset and closed state, sharing
+// the name's contents and lock. One opened through a view made with
+// WithContext or WithTimeout makes its requests through the view.
 type InMemoryFile struct {
-	at      int64
-	name    string
-	data    []byte
-	memDir  MemDir
-	dir     bool
-	closed  bool
-	mode    os.FileMode
-	modtime time.Time
-	bucket  *s3.Bucket
+	*fileData
+	fs *MemS3Fs
+
+	at        int64
+	dirAt     int          // entries Readdir has returned since Open
+	dirFiles  []afero.File // what the first Readdir since Open listed
+	closed    bool
+	stream    io.ReadCloser
+	streamBuf io.Reader
+	streamAt  int64
 }
 
+// fileData is what every InMemoryFile of a name shares.
+type fileData struct {
+	name      string
+	data      []byte
+	memDir    MemDir
+	dir       bool
+	loaded    bool
+	dirty     bool
+	versionID string
+	patches   []patch
+	upload    *partWriter
+	objSize   int64 // or unknownSize, until it's asked of S3
+	etag      string
+	class     s3.StorageClass
+	headers   Headers
+	xattrs    map[string]string
+	metaDirty bool
+	owner     *Owner
+	modeKnown bool // mode is the object's, or was set, not a default
+	exclusive bool // uploads fail rather than replace an object
+	mtimeSet  bool
+	posixRead bool
+	loadedTag string     // the ETag of the object data was loaded from
+	cachedAt  time.Time  // when the file last matched its object
+	mu        sync.Mutex // held while reading, writing or flushing
+	mode      os.FileMode
+	modtime   time.Time
+}
+
+// MemFileCreate returns an empty file that's written to bucket when it's
+// closed, or through a filesystem with the default options if bucket is
+// nil.
 func MemFileCreate(name string, bucket *s3.Bucket) *InMemoryFile {
-	return &InMemoryFile{
-		name:    name,
-		mode:    0640,
-		modtime: time.Now(),
-		bucket:  bucket,
+	if bucket == nil {
+		return newMemFile(name, NewS3Fs())
+	}
+	return newMemFile(name, S3FsFromBucket(*bucket))
+}
+
+// newMemFile returns an empty file written through fs.
+func newMemFile(name string, fs *MemS3Fs) *InMemoryFile {
+	return &InMemoryFile{fs: fs, fileData: &fileData{
+		name:      name,
+		mode:      0640,
+		modeKnown: true,
+		modtime:   fs.now(),
+		loaded:    true,
+		dirty:     true,
+	}}
+}
+
+// in returns f as opened through fs, which may be a view of f's own
+// filesystem with its own context and timeout.
+func (f *InMemoryFile) in(fs *MemS3Fs) *InMemoryFile {
+	if f.fs == fs {
+		return f
 	}
+	return &InMemoryFile{fileData: f.fileData, fs: fs}
+}
+
+// open returns a new handle of f's contents, opened through fs.
+func (f *InMemoryFile) open(fs *MemS3Fs) *InMemoryFile {
+	return &InMemoryFile{fileData: f.fileData, fs: fs}
+}
+
+// SetStorageClass stores the file's object in class, instead of the
+// filesystem's StorageClass, from the next time it's uploaded or renamed.
+func (f *InMemoryFile) SetStorageClass(class s3.StorageClass) {
+	f.class = class
+}
+
+// SetHeaders stores the fields set in h with the file's object, over
+// those from the filesystem's HeaderRules, from the next time it's
+// uploaded.
+func (f *InMemoryFile) SetHeaders(h Headers) {
+	f.headers = h
+}
+
+// objectHeaders are the headers the file's object is written with.
+func (f *InMemoryFile) objectHeaders() Headers {
+	return f.fs.headers(f.Name()).over(f.headers)
+}
+
+// putOptions are the options the file's object is written with.
+func (f *InMemoryFile) putOptions() s3.Options {
+	opts := f.addPosix(f.addXattrs(f.objectHeaders().apply(f.fs.putOptions())))
+	if f.class != "" {
+		opts.StorageClass = f.class
+	}
+	return opts
 }
 
 func (f *InMemoryFile) Open() error {
 	atomic.StoreInt64(&f.at, 0)
+	f.dirAt, f.dirFiles = 0, nil
 	f.closed = false
 	return nil
 }
 
+// Sync writes the file to S3 if it has been modified since it was last
+// written, returning the upload's error. A file being written with
+// StreamingWrites has its upload completed, and is written whole again
+// when it's next synced or closed.
 func (f *InMemoryFile) Sync() error {
-        return nil
+	if f.closed {
+		return afero.ErrFileClosed
+	}
+	return f.flush()
 }
 
+// Close writes the file to S3. Closing an already closed file does
+// nothing and returns nil. If the upload fails the file stays dirty in
+// its filesystem's cache; see MemS3Fs.Dirty.
 func (f *InMemoryFile) Close() (err error) {
+	if f.closed {
+		return nil
+	}
 	atomic.StoreInt64(&f.at, 0)
 	f.closed = true
+	f.closeStream()
+	if err = f.flush(); err != nil {
+		return err
+	}
+	if f.fs.cache != nil && !f.dir {
+		// the Cache holds the contents instead
+		f.mu.Lock()
+		if !f.dirty {
+			f.data, f.loaded, f.loadedTag = nil, false, ""
+		}
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// flush uploads the file if it has been modified, retrying failed
+// uploads with backoff.
+func (f *InMemoryFile) flush() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dir || !f.dirty {
+		// nothing can have been written
+		return nil
+	}
+
+	start := f.fs.now()
+	var written int64
+	defer func() {
+		f.fs.failed.set(f.fileData, err != nil && f.dirty)
+		f.fs.record(Metric{
+			Kind:     Flush,
+			Name:     f.Name(),
+			Bytes:    written,
+			Duration: f.fs.now().Sub(start),
+			Err:      err,
+		})
+	}()
+
+	if f.upload.started() {
+		written = f.upload.offset() + int64(len(f.data))
+		err = f.upload.complete(f.data, getACL(f.mode), f.putOptions(), f.objectHeaders())
+		f.fs.heads.forget(f.Name())
+		f.fs.prefixes.forgetAncestors(f.fs.key(f.Name()))
+		// whatever the outcome, the uploaded bytes are gone from memory
+		f.upload, f.data, f.loaded, f.dirty, f.metaDirty = nil, nil, false, false, false
+		f.objSize = written
+		if err != nil {
+			return err
+		}
+		f.flushed(written)
+		return nil
+	}
 
-	hasher := md5.New()
-	hasher.Write(f.data)
-	expected := fmt.Sprintf("\"%x\"", hasher.Sum([]byte{}))
-	etag, err := getEtag(f.Name(), f.bucket)
+	if f.metaDirty {
+		// storing the changed metadata would lose the attributes
+		// that haven't been read
+		if err = f.loadXattrs(); err != nil {
+			return err
+		}
+	}
+	if !f.loaded && len(f.patches) == 0 {
+		// only the metadata has changed
+		err = f.replaceMeta()
+		f.fs.heads.forget(f.Name())
+		if err != nil {
+			return err
+		}
+		f.dirty, f.metaDirty, f.mtimeSet = false, false, false
+		return nil
+	}
+	if !f.loaded && (f.fs.wholeReads(f.Name()) || f.fs.wholeWrites(f.Name())) {
+		// patches can't be stitched into ciphertext or transformed contents
+		if err = f.load(); err != nil {
+			return err
+		}
+	}
+	if !f.loaded {
+		// only WriteAt patches can make an unloaded file dirty
+		for _, p := range f.patches {
+			written += int64(len(p.data))
+		}
+		err = f.fs.stitch(f)
+		f.fs.heads.forget(f.Name())
+		if err != nil {
+			return err
+		}
+		f.patches = nil
+		f.dirty, f.metaDirty, f.mtimeSet = false, false, false
+		f.flushed(-1)
+		return nil
+	}
+
+	content, err := f.fs.transformWrite("write", f.Name(), f.data)
 	if err != nil {
-		fmt.Println("Failure getting file etag", f.Name(), "Error is", err)
 		return err
 	}
+	sums := newDigest(content)
+	if f.fs.etagIsMD5() && !f.metaDirty {
+		etag, err := f.fs.etag(f.Name())
+		if err != nil {
+			return err
+		}
 
-	if etag == string(expected) {
-		// the file hasn't actually changed
-		return nil
+		if etag != "" && sums.matches(etag, partSizeFor(int64(len(content)), f.fs.partSize)) {
+			// the file hasn't actually changed
+			f.data = content
+			f.dirty, f.loadedTag = false, etag
+			return nil
+		}
 	}
 
-	err = f.bucket.Put(
-		f.Name(), f.data,
-		"", // TODO: use content-type
-		getACL(f.mode),
-		s3.Options{},
-	)
+	if f.fs.posixMeta && !f.mtimeSet {
+		f.modtime = f.fs.now()
+	}
+	written = int64(len(content))
+	data, opts, err := f.fs.seal(content, f.putOptions())
+	if err != nil {
+		return &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+	var etag string
+	delay := flushRetryDelay
+	for attempt := 0; attempt <= f.fs.flushRetries; attempt++ {
+		if attempt > 0 {
+			f.fs.sleep(delay)
+			delay *= 2
+		}
+		if int64(len(data)) > f.fs.multipartThreshold && !f.exclusive {
+			etag, err = f.fs.putMultipartETag(f.Name(), data, getACL(f.mode), opts, f.objectHeaders())
+		} else {
+			err = f.fs.do("write", f.Name(), func(b *s3.Bucket) error {
+				if h := f.objectHeaders(); !h.Expires.IsZero() || f.exclusive {
+					// goamz has no option for Expires or If-None-Match
+					headers := putHeaders(f.fs.contentType(f.Name()), opts, h)
+					if f.exclusive {
+						headers["If-None-Match"] = []string{"*"}
+					}
+					return b.PutHeader(f.fs.key(f.Name()), data, headers, getACL(f.mode))
+				}
+				return b.Put(
+					f.fs.key(f.Name()), data,
+					f.fs.contentType(f.Name()),
+					getACL(f.mode),
+					opts,
+				)
+			})
+		}
+		if err == nil || isPreconditionFailed(err) {
+			break
+		}
+	}
+	f.fs.heads.forget(f.Name())
+	f.fs.prefixes.forgetAncestors(f.fs.key(f.Name()))
 	if err != nil {
 		fmt.Println("Failure writing file", f.Name(), "Error is", err)
+		return err
+	}
+	f.data = content
+	f.dirty, f.metaDirty, f.mtimeSet = false, false, false
+	f.loadedTag = ""
+	if f.fs.etagIsMD5() {
+		// objects uploaded whole have their MD5 as their ETag; those
+		// uploaded in parts have one made of their parts' MD5s
+		if int64(len(data)) <= f.fs.multipartThreshold {
+			etag = sums.etag(0)
+		}
+		f.loadedTag = etag
+	}
+	if f.loadedTag != "" && len(matching(f.fs.readXforms, f.Name())) == 0 {
+		// a download would have transformed the contents
+		f.fs.cachePut(f.Name(), f.loadedTag, f.data)
 	}
+	f.flushed(written)
+	return nil
+}
 
-	return
+// flushed follows a successful upload of the file's size bytes, or of an
+// unknown size if size is negative.
+func (f *InMemoryFile) flushed(size int64) {
+	f.versionID, f.etag = "", ""
+	f.cachedAt = f.fs.now()
+	f.fs.shadowWrite(f.Name(), size)
+	if f.fs.index != nil {
+		if size < 0 {
+			size, _ = f.size()
+		}
+		f.fs.indexPut(f.Name(), size)
+	}
+	if f.fs.onFlush != nil {
+		f.fs.onFlush(f.Name(), f.VersionID())
+	}
+	f.fs.derive(f.Name())
+}
+
+// VersionID returns the version S3 assigned the object when this file
+// was last written, or "" if the bucket isn't versioned. goamz's Put,
+// PutHeader and Multi.Complete return no response headers, so the
+// version is read with a HEAD of its own after the upload. That HEAD
+// is made as the upload finishes when OnFlush is set, and otherwise on
+// the first call, so another process writing the object in between
+// will have its version reported.
+func (f *InMemoryFile) VersionID() string {
+	if f.versionID == "" && !f.dir {
+		// an earlier HEAD still in flight would report the old version
+		if resp, err := f.fs.headFresh(f.Name()); err == nil {
+			f.versionID = resp.Header.Get("x-amz-version-id")
+		}
+	}
+	return f.versionID
 }
 
 func (f *InMemoryFile) Name() string {
@@ -108,37 +445,87 @@ func (f *InMemoryFile) Name() string {
 }
 
 func (f *InMemoryFile) Stat() (os.FileInfo, error) {
-	return &InMemoryFileInfo{f}, nil
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	return &InMemoryFileInfo{file: f}, nil
 }
 
+// Readdir lists the directory's files along with any objects and
+// subdirectories found in S3 that this process hasn't seen.
 func (f *InMemoryFile) Readdir(count int) (res []os.FileInfo, err error) {
-	files := f.memDir.Files()
-	limit := len(files)
-
-	if len(files) == 0 {
-		return
+	res, err = f.readdir(count)
+	var listed []*InMemoryFile
+	for _, fi := range res {
+		if info, ok := fi.(*InMemoryFileInfo); ok {
+			listed = append(listed, info.file)
+		}
 	}
+	f.fs.loadPosixAll(listed)
+	return res, err
+}
 
-	if count > 0 {
-		limit = count
+// readdir is Readdir without reading the files' PosixMetadata.
+func (f *InMemoryFile) readdir(count int) (res []os.FileInfo, err error) {
+	if f.closed {
+		return nil, afero.ErrFileClosed
+	}
+	if f.memDir == nil {
+		return nil, &os.PathError{Op: "readdir", Path: f.Name(), Err: syscall.ENOTDIR}
 	}
 
-	if len(files) < limit {
-		err = io.EOF
+	if f.dirFiles == nil {
+		// later pages come from this listing, not another one
+		prefix := f.fs.dirPrefix(f.Name())
+		l, err := f.fs.listDir(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range l.prefixes {
+			f.listedDir(p)
+		}
+		for _, k := range l.keys {
+			if dir, ok := f.fs.markedDir(k.Key); ok {
+				if dir+"/" != prefix {
+					f.listedDir(dir + "/")
+				}
+			} else if k.Key != prefix {
+				f.listedFile(k)
+			}
+		}
+		f.fs.rlock()
+		f.dirFiles = append([]afero.File{}, f.memDir.Files()...)
+		f.fs.runlock()
 	}
 
-	res = make([]os.FileInfo, f.memDir.Len())
+	files := f.dirFiles
+	if f.dirAt < len(files) {
+		files = files[f.dirAt:]
+	} else {
+		files = nil
+	}
+	if count > 0 && len(files) == 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && len(files) > count {
+		files = files[:count]
+	}
+	f.dirAt += len(files)
 
-	i := 0
-	for _, file := range f.memDir.Files() {
-		res[i], _ = file.Stat()
-		i++
+	res = make([]os.FileInfo, len(files))
+	for i, file := range files {
+		if imf, ok := file.(*InMemoryFile); ok {
+			// closed files can't be Stat'ed but are still listed
+			res[i] = imf.Info()
+		} else {
+			res[i], _ = file.Stat()
+		}
 	}
 	return res, nil
 }
 
 func (f *InMemoryFile) Readdirnames(n int) (names []string, err error) {
-	fi, err := f.Readdir(n)
+	fi, err := f.readdir(n)
 	names = make([]string, len(fi))
 	for i, f := range fi {
 		names[i] = f.Name()
@@ -150,13 +537,22 @@ func (f *InMemoryFile) Read(b []byte) (n int, err error) {
 	if f.closed == true {
 		return 0, afero.ErrFileClosed
 	}
-	if len(f.data) == 0 {
-		f.data, err = f.bucket.Get(f.Name())
-		if err != nil {
-			// failed to get data from s3
-			return 0, err
-		}
-		atomic.StoreInt64(&f.at, 0)
+	f.mu.Lock()
+	if f.upload.started() {
+		f.mu.Unlock()
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: ErrStreamingWrite}
+	}
+	if f.streams() {
+		// the stream is the handle's own, and isn't held up by writers
+		f.mu.Unlock()
+		return f.readStream(b)
+	}
+	defer f.mu.Unlock()
+	if err = f.load(); err != nil {
+		return 0, err
+	}
+	if int(f.at) >= len(f.data) && len(b) > 0 {
+		return 0, io.EOF
 	}
 	if len(f.data)-int(f.at) >= len(b) {
 		n = len(b)
@@ -169,18 +565,324 @@ func (f *InMemoryFile) Read(b []byte) (n int, err error) {
 	return
 }
 
+// streams reports whether Read should come straight from a GET body
+// rather than the loaded contents.
+func (f *InMemoryFile) streams() bool {
+	return f.fs.readahead > 0 && !f.fs.wholeReads(f.Name()) && !f.loaded && !f.dir && len(f.patches) == 0
+}
+
+// readStream reads from an open GET of the object, starting a new one
+// at the file's offset if there isn't one positioned there already.
+func (f *InMemoryFile) readStream(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	at := atomic.LoadInt64(&f.at)
+	if f.stream != nil && f.streamAt != at {
+		f.closeStream()
+	}
+	if f.stream == nil {
+		var body io.ReadCloser
+		err = f.fs.doRead("read", f.Name(), func(bucket *s3.Bucket) (err error) {
+			body, err = openStream(f.fs.key(f.Name()), bucket, at)
+			return err
+		})
+		if err != nil {
+			return 0, f.fs.readError("read", f.Name(), err)
+		}
+		if body == nil {
+			return 0, io.EOF
+		}
+		if f.fs.idleTimeout > 0 {
+			body = newIdleBody(body, f.fs.idleTimeout, clockOr(f.fs.clock))
+		}
+		if f.fs.prefetch > 0 {
+			body = newPrefetcher(f.fs, body, f.fs.prefetch)
+			f.streamBuf = body
+		} else {
+			f.streamBuf = bufio.NewReaderSize(body, f.fs.readahead)
+		}
+		f.stream = body
+		f.streamAt = at
+	}
+	n, err = f.streamBuf.Read(b)
+	f.streamAt += int64(n)
+	atomic.StoreInt64(&f.at, f.streamAt)
+	if err == ErrIdleTimeout {
+		// the next read starts over from here
+		f.closeStream()
+		err = &os.PathError{Op: "read", Path: f.Name(), Err: err}
+	}
+	return n, err
+}
+
+func (f *InMemoryFile) closeStream() {
+	if f.stream != nil {
+		f.stream.Close()
+		f.stream, f.streamBuf = nil, nil
+	}
+}
+
+// prefetchChunk is the most a prefetcher reads from the body at once.
+const prefetchChunk = mib
+
+// prefetcher reads a GET body ahead of its reader in the background.
+type prefetcher struct {
+	body   io.ReadCloser
+	chunks chan []byte
+	done   chan struct{}
+	once   sync.Once
+	cur    []byte
+	err    error // why the body ended, set before chunks is closed
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newPrefetcher starts reading body up to ahead bytes ahead, as m's
+// background work.
+func newPrefetcher(m *MemS3Fs, body io.ReadCloser, ahead int) *prefetcher {
+	chunk := prefetchChunk
+	if ahead < chunk {
+		chunk = ahead
+	}
+	p := &prefetcher{
+		body:   body,
+		chunks: make(chan []byte, ahead/chunk),
+		done:   make(chan struct{}),
+	}
+	fetched := make(chan struct{})
+	m.spawn(context.Background(), "Prefetch", func(ctx context.Context) error {
+		defer close(fetched)
+		p.fetch(ctx, chunk)
+		return nil
+	})
+	m.spawn(context.Background(), "Prefetch", func(ctx context.Context) error {
+		// a read of the body only ends early if it's closed
+		select {
+		case <-ctx.Done():
+			p.closeBody()
+		case <-fetched:
+		}
+		return nil
+	})
+	return p
+}
+
+func (p *prefetcher) fetch(ctx context.Context, chunk int) {
+	defer func() {
+		if p.err == nil {
+			// stopped, or panicked, part way
+			p.err = io.ErrUnexpectedEOF
+		}
+		close(p.chunks)
+	}()
+	for {
+		buf := make([]byte, chunk)
+		n, err := io.ReadFull(p.body, buf)
+		if n > 0 {
+			select {
+			case p.chunks <- buf[:n]:
+			case <-p.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			p.err = err
+			return
+		}
+	}
+}
+
+func (p *prefetcher) Read(b []byte) (int, error) {
+	if len(p.cur) == 0 {
+		c, ok := <-p.chunks
+		if !ok {
+			return 0, p.err
+		}
+		p.cur = c
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// Close stops the prefetching and closes the body.
+func (p *prefetcher) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return p.closeBody()
+}
+
+// closeBody closes the body once, whether the reader or the filesystem
+// closing gets there first.
+func (p *prefetcher) closeBody() error {
+	p.closeOnce.Do(func() { p.closeErr = p.body.Close() })
+	return p.closeErr
+}
+
+// load fetches the object's contents the first time they're needed.
+// Tracking this separately from len(f.data) keeps zero-byte objects from
+// being refetched on every Read. f.mu must be held.
+func (f *InMemoryFile) load() error {
+	if f.loaded || f.dir {
+		return nil
+	}
+	f.closeStream()
+	data, etag, err := f.fs.download("read", f.Name())
+	if err != nil {
+		// failed to get data from s3
+		return f.fs.readError("read", f.Name(), err)
+	}
+	f.data, f.loadedTag = applyPatches(data, 0, f.patches), etag
+	f.cachedAt = f.fs.now()
+	f.patches = nil
+	f.loaded = true
+	return nil
+}
+
+// revalidate replaces the file's contents if its object has changed
+// since they were downloaded, with a GET that S3 answers with 304 Not
+// Modified if it hasn't. Files that are dirty, or whose contents weren't
+// downloaded whole, are left alone.
+func (f *InMemoryFile) revalidate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.loaded || f.dirty || f.dir || f.loadedTag == "" {
+		return nil
+	}
+	var data []byte
+	var header http.Header
+	err := f.fs.doRead("open", f.Name(), func(b *s3.Bucket) (err error) {
+		data, header, err = fetchIfChanged(f.fs.key(f.Name()), b, f.loadedTag)
+		return err
+	})
+	if isNotModified(err) {
+		return nil
+	}
+	if err != nil {
+		return f.fs.readError("open", f.Name(), err)
+	}
+	return f.fetched("open", data, header)
+}
+
+// fetched replaces the file's contents with those of a GET of its object
+// answered with header. f.mu must be held.
+func (f *InMemoryFile) fetched(op string, data []byte, header http.Header) (err error) {
+	if data, err = f.fs.unseal(data, header); err != nil {
+		return &os.PathError{Op: op, Path: f.Name(), Err: err}
+	}
+	if data, err = f.fs.transformRead(op, f.Name(), data); err != nil {
+		return err
+	}
+	f.data, f.loaded = data, true
+	f.loadedTag = strings.Trim(header.Get("ETag"), "\"")
+	f.etag, f.versionID = f.loadedTag, ""
+	f.objSize = int64(len(data))
+	if modtime, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		f.modtime = modtime
+	}
+	f.fs.heads.forget(f.Name())
+	f.fs.cachePut(f.Name(), f.loadedTag, data)
+	f.cachedAt = f.fs.now()
+	return nil
+}
+
+// loadPrefix is load for callers that only need the first size bytes,
+// such as a Truncate that shrinks the object; the rest isn't downloaded.
+func (f *InMemoryFile) loadPrefix(size int64) error {
+	if f.loaded || f.dir {
+		return nil
+	}
+	if len(f.patches) > 0 || f.fs.wholeReads(f.Name()) {
+		return f.load()
+	}
+	var data []byte
+	err := f.fs.do("truncate", f.Name(), func(b *s3.Bucket) (err error) {
+		data, err = fetchRange(f.fs.key(f.Name()), b, 0, size)
+		return err
+	})
+	if err != nil {
+		return f.fs.readError("truncate", f.Name(), err)
+	}
+	if int64(len(data)) == size {
+		// the object is at least size bytes, so the rest would be cut off
+		f.data = data
+		f.loaded = true
+		return nil
+	}
+	return f.load()
+}
+
+// ReadAt reads len(b) bytes starting at off without moving the file's
+// offset. When the contents haven't been loaded it fetches just that
+// range, so concurrent random reads of large objects are cheap.
 func (f *InMemoryFile) ReadAt(b []byte, off int64) (n int, err error) {
-	atomic.StoreInt64(&f.at, off)
-	return f.Read(b)
+	if f.closed == true {
+		return 0, afero.ErrFileClosed
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.Name(), Err: syscall.EINVAL}
+	}
+	f.mu.Lock()
+	if f.upload.started() {
+		err = &os.PathError{Op: "readat", Path: f.Name(), Err: ErrStreamingWrite}
+	} else if len(f.patches) > 0 || f.fs.wholeReads(f.Name()) {
+		err = f.load()
+	}
+	loaded := f.loaded
+	if err == nil && loaded && off < int64(len(f.data)) {
+		n = copy(b, f.data[off:])
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !loaded {
+		var data []byte
+		err := f.fs.doRead("read", f.Name(), func(bucket *s3.Bucket) (err error) {
+			data, err = fetchRange(f.fs.key(f.Name()), bucket, off, int64(len(b)))
+			return err
+		})
+		if err != nil {
+			return 0, f.fs.readError("read", f.Name(), err)
+		}
+		n = copy(b, f.fs.chaos.truncate("read", f.Name(), data))
+	}
+	if n < len(b) {
+		err = io.EOF
+	}
+	return n, err
 }
 
 func (f *InMemoryFile) Truncate(size int64) error {
+	f.mu.Lock()
+	err := f.truncate(size)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.writeThrough()
+}
+
+func (f *InMemoryFile) truncate(size int64) error {
 	if f.closed == true {
 		return afero.ErrFileClosed
 	}
 	if size < 0 {
 		return afero.ErrOutOfRange
 	}
+	if f.upload.started() {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: ErrStreamingWrite}
+	}
+	if err := f.loadPrefix(size); err != nil {
+		return err
+	}
+	f.dirty = true
 	if size > int64(len(f.data)) {
 		diff := size - int64(len(f.data))
 		f.data = append(f.data, bytes.Repeat([]byte{00}, int(diff))...)
@@ -190,23 +892,98 @@ func (f *InMemoryFile) Truncate(size int64) error {
 	return nil
 }
 
+// Seek sets the offset for the next Read or Write. Seeking relative to
+// the end of a file that hasn't been read yet uses the object's size from
+// a HEAD rather than downloading it.
 func (f *InMemoryFile) Seek(offset int64, whence int) (int64, error) {
 	if f.closed == true {
 		return 0, afero.ErrFileClosed
 	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var base int64
 	switch whence {
 	case 0:
-		atomic.StoreInt64(&f.at, offset)
 	case 1:
-		atomic.AddInt64(&f.at, int64(offset))
+		base = atomic.LoadInt64(&f.at)
 	case 2:
-		atomic.StoreInt64(&f.at, int64(len(f.data))+offset)
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		base = size
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: syscall.EINVAL}
 	}
-	return f.at, nil
+	if base+offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: syscall.EINVAL}
+	}
+	if f.upload.started() && base+offset != f.upload.offset()+int64(len(f.data)) {
+		return 0, &os.PathError{Op: "seek", Path: f.Name(), Err: ErrStreamingWrite}
+	}
+	atomic.StoreInt64(&f.at, base+offset)
+	return base + offset, nil
+}
+
+// size is the length of the file's contents, asking S3 if they haven't
+// been loaded.
+func (f *InMemoryFile) size() (int64, error) {
+	if f.loaded || f.dir {
+		return f.upload.offset() + int64(len(f.data)), nil
+	}
+	size, err := f.remoteSize()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range f.patches {
+		if end := p.off + int64(len(p.data)); end > size {
+			size = end
+		}
+	}
+	return size, nil
+}
+
+// remoteSize is the size of the object in S3.
+func (f *InMemoryFile) remoteSize() (int64, error) {
+	resp, err := f.fs.head(f.Name())
+	if err != nil {
+		return 0, f.fs.readError("seek", f.Name(), err)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return f.fs.plainSize(size, resp.Header), err
 }
 
 func (f *InMemoryFile) Write(b []byte) (n int, err error) {
+	f.mu.Lock()
+	n, err = f.write(b)
+	f.mu.Unlock()
+	if err != nil {
+		return n, err
+	}
+	return n, f.writeThrough()
+}
+
+// writeThrough uploads the file after a write if the filesystem is
+// WriteThrough. Streaming uploads already send parts as they fill.
+func (f *InMemoryFile) writeThrough() error {
+	if !f.fs.writeThrough || f.upload != nil {
+		return nil
+	}
+	return f.flush()
+}
+
+func (f *InMemoryFile) write(b []byte) (n int, err error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if f.upload.started() {
+		return f.writeUpload(b)
+	}
+	if err = f.load(); err != nil {
+		return 0, err
+	}
 	n = len(b)
+	f.dirty = true
 	cur := atomic.LoadInt64(&f.at)
 	diff := cur - int64(len(f.data))
 	var tail []byte
@@ -214,20 +991,94 @@ func (f *InMemoryFile) Write(b []byte) (n int, err error) {
 		tail = f.data[n+int(cur):]
 	}
 	if diff > 0 {
-		f.data = append(bytes.Repeat([]byte{00}, int(diff)), b...)
-		f.data = append(f.data, tail...)
+		f.data = append(f.data, bytes.Repeat([]byte{00}, int(diff))...)
+		f.data = append(f.data, b...)
 	} else {
 		f.data = append(f.data[:cur], b...)
 		f.data = append(f.data, tail...)
 	}
 
-	atomic.StoreInt64(&f.at, int64(len(f.data)))
+	atomic.StoreInt64(&f.at, cur+int64(n))
+	if f.upload != nil && cur+int64(n) == int64(len(f.data)) {
+		err = f.uploadParts()
+	}
 	return
 }
 
+// writeUpload appends b to a file whose leading parts have already been
+// handed to S3. Only writes at the end of the file are possible.
+func (f *InMemoryFile) writeUpload(b []byte) (int, error) {
+	if atomic.LoadInt64(&f.at) != f.upload.offset()+int64(len(f.data)) {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: ErrStreamingWrite}
+	}
+	if err := f.upload.failed(); err != nil {
+		// there's no point buffering more of an upload that's failed
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+	f.dirty = true
+	f.data = append(f.data, b...)
+	atomic.AddInt64(&f.at, int64(len(b)))
+	return len(b), f.uploadParts()
+}
+
+// uploadParts hands every full part at the front of the buffer to S3.
+func (f *InMemoryFile) uploadParts() (err error) {
+	size := f.fs.partSize
+	rest := f.data
+	for int64(len(rest)) >= size && err == nil {
+		part := rest[:size:size]
+		rest = rest[size:]
+		err = f.upload.put(part, getACL(f.mode), f.putOptions(), f.objectHeaders())
+	}
+	if len(rest) < len(f.data) {
+		// the parts may still be uploading, so the next part is
+		// buffered apart from them, with room for all of it
+		f.data = append(make([]byte, 0, size), rest...)
+	}
+	if err != nil {
+		return &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// WriteAt writes b at off without moving the file's offset. Writes into
+// large objects that haven't been loaded are kept aside and stitched
+// together with the unchanged ranges by S3 on Close, so the object is
+// never downloaded. Close fails with ErrChanged if the object is
+// overwritten while that happens.
 func (f *InMemoryFile) WriteAt(b []byte, off int64) (n int, err error) {
+	f.mu.Lock()
+	n, err = f.writeAt(b, off)
+	f.mu.Unlock()
+	if err != nil {
+		return n, err
+	}
+	return n, f.writeThrough()
+}
+
+func (f *InMemoryFile) writeAt(b []byte, off int64) (n int, err error) {
+	if f.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.Name(), Err: syscall.EINVAL}
+	}
+	if !f.loaded && !f.dir {
+		size, err := f.remoteSize()
+		if err != nil {
+			return 0, err
+		}
+		if size >= stitchMinSize {
+			f.patches = append(f.patches, patch{off: off, data: append([]byte(nil), b...)})
+			f.dirty = true
+			return len(b), nil
+		}
+	}
+	cur := atomic.LoadInt64(&f.at)
 	atomic.StoreInt64(&f.at, off)
-	return f.Write(b)
+	n, err = f.write(b)
+	atomic.StoreInt64(&f.at, cur)
+	return n, err
 }
 
 func (f *InMemoryFile) WriteString(s string) (ret int, err error) {
@@ -238,19 +1089,166 @@ func (f *InMemoryFile) Info() *InMemoryFileInfo {
 	return &InMemoryFileInfo{file: f}
 }
 
+// handle is an InMemoryFile opened by OpenFile with flags that limit
+// what can be done through it.
+type handle struct {
+	*InMemoryFile
+	readOnly bool
+	append   bool
+}
+
+func (h *handle) Write(b []byte) (int, error) {
+	if h.readOnly {
+		return 0, &os.PathError{Op: "write", Path: h.Name(), Err: syscall.EBADF}
+	}
+	if h.append {
+		if _, err := h.InMemoryFile.Seek(0, 2); err != nil {
+			return 0, err
+		}
+	}
+	return h.InMemoryFile.Write(b)
+}
+
+func (h *handle) WriteAt(b []byte, off int64) (int, error) {
+	if h.readOnly {
+		return 0, &os.PathError{Op: "write", Path: h.Name(), Err: syscall.EBADF}
+	}
+	if h.append {
+		return 0, errors.New("af3ro: WriteAt not allowed on a file opened with O_APPEND")
+	}
+	return h.InMemoryFile.WriteAt(b, off)
+}
+
+func (h *handle) WriteString(s string) (int, error) {
+	return h.Write([]byte(s))
+}
+
+func (h *handle) Truncate(size int64) error {
+	if h.readOnly {
+		return &os.PathError{Op: "truncate", Path: h.Name(), Err: syscall.EBADF}
+	}
+	return h.InMemoryFile.Truncate(size)
+}
+
+// metaHandle is an InMemoryFile opened with OpenMeta, which refuses
+// everything that would transfer its contents.
+type metaHandle struct {
+	*InMemoryFile
+}
+
+func (h *metaHandle) refuse(op string) error {
+	return &os.PathError{Op: op, Path: h.Name(), Err: ErrMetaOnly}
+}
+
+func (h *metaHandle) Read(b []byte) (int, error)              { return 0, h.refuse("read") }
+func (h *metaHandle) ReadAt(b []byte, off int64) (int, error) { return 0, h.refuse("read") }
+func (h *metaHandle) Write(b []byte) (int, error)             { return 0, h.refuse("write") }
+func (h *metaHandle) WriteAt(b []byte, off int64) (int, error) {
+	return 0, h.refuse("write")
+}
+func (h *metaHandle) WriteString(s string) (int, error) { return 0, h.refuse("write") }
+func (h *metaHandle) Truncate(size int64) error         { return h.refuse("truncate") }
+func (h *metaHandle) Seek(offset int64, whence int) (int64, error) {
+	return 0, h.refuse("seek")
+}
+func (h *metaHandle) Sync() error                       { return h.refuse("sync") }
+func (h *metaHandle) SetXattr(name, value string) error { return h.refuse("setxattr") }
+func (h *metaHandle) RemoveXattr(name string) error     { return h.refuse("removexattr") }
+
+// Close leaves the file alone, since nothing can have been written
+// through the handle.
+func (h *metaHandle) Close() error { return nil }
+
 type InMemoryFileInfo struct {
 	file *InMemoryFile
+
+	// a directory's DirModTimes time, once it's been found
+	dirModTime *time.Time
 }
 
 // Implements os.FileInfo
 func (s *InMemoryFileInfo) Name() string       { return s.file.Name() }
-func (s *InMemoryFileInfo) Mode() os.FileMode  { return s.file.mode }
-func (s *InMemoryFileInfo) ModTime() time.Time { return s.file.modtime }
+func (s *InMemoryFileInfo) Mode() os.FileMode  { return s.mode() }
+func (s *InMemoryFileInfo) ModTime() time.Time { return s.modTime() }
 func (s *InMemoryFileInfo) IsDir() bool        { return s.file.dir }
-func (s *InMemoryFileInfo) Sys() interface{}   { return nil }
+func (s *InMemoryFileInfo) Sys() interface{}   { return s.sys() }
+
+// ETag is the ETag S3 last reported for the file's object, or "" for
+// directories and files with changes that haven't been flushed.
+func (s *InMemoryFileInfo) ETag() string {
+	f := s.file
+	if f.dir || f.dirty {
+		return ""
+	}
+	if f.etag == "" {
+		if resp, err := f.fs.head(f.Name()); err == nil {
+			f.etag = strings.Trim(resp.Header.Get("ETag"), "\"")
+		}
+	}
+	return f.etag
+}
+
+// Checksum is the strongest checksum S3 has of the file's object, and
+// its algorithm: "sha256", "sha1", "crc32c" or "crc32" if the object
+// was uploaded with one, or else "md5" when its ETag is an MD5. It's ""
+// and nil when there's none, and for directories and files with changes
+// that haven't been flushed.
+func (s *InMemoryFileInfo) Checksum() (algo string, value []byte) {
+	f := s.file
+	if f.dir || f.dirty {
+		return "", nil
+	}
+	resp, err := f.fs.head(f.Name())
+	if err != nil {
+		return "", nil
+	}
+	return contentChecksum(resp.Header)
+}
+
+// mode is the file's mode, as PosixMetadata recorded it if it did.
+func (s *InMemoryFileInfo) mode() os.FileMode {
+	s.file.loadPosix()
+	return s.file.mode
+}
+
+// sys is the file's Owner, if PosixMetadata has recorded it.
+func (s *InMemoryFileInfo) sys() interface{} {
+	s.file.loadPosix()
+	if s.file.owner == nil {
+		return nil
+	}
+	owner := *s.file.owner
+	return &owner
+}
+
+// modTime is when the file was last modified. For directories it's the
+// zero time, or with DirModTimes when the newest object under them was.
+func (s *InMemoryFileInfo) modTime() time.Time {
+	f := s.file
+	f.loadPosix()
+	if !f.dir || !f.fs.dirModTimes {
+		return f.modtime
+	}
+	if s.dirModTime == nil {
+		t := f.fs.newestUnder(f.Name())
+		s.dirModTime = &t
+	}
+	return *s.dirModTime
+}
+
 func (s *InMemoryFileInfo) Size() int64 {
 	if s.IsDir() {
-		return int64(42)
+		return s.file.fs.dirSize
+	}
+	f := s.file
+	f.mu.Lock()
+	loaded, size := f.loaded, f.objSize
+	if loaded {
+		size = f.upload.offset() + int64(len(f.data))
+	}
+	f.mu.Unlock()
+	if !loaded && size == unknownSize {
+		size, _ = f.remoteSize()
 	}
-	return int64(len(s.file.data))
+	return size
 }
@@ -0,0 +1,89 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls for the same key into one, so
+// that goroutines opening a cold key at once share a single request. A
+// nil *flightGroup coalesces nothing.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	wg   sync.WaitGroup
+	val  interface{}
+	err  error
+	dups int
+}
+
+// do calls fn for key unless a call for key is already running, in which
+// case it waits for that call and returns its result. shared reports
+// whether the result went to more than one caller, who then mustn't
+// modify it.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	if g == nil {
+		v, err = fn()
+		return v, err, false
+	}
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := new(flight)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	shared = c.dups > 0
+	g.mu.Unlock()
+	c.wg.Done()
+	return c.val, c.err, shared
+}
+
+// flight is flights.do for a request m makes. Views share their
+// filesystem's flights, so a caller that waited on a request abandoned
+// under another view's context makes its own rather than failing with
+// that view's error.
+func (m *MemS3Fs) flight(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	ran := false
+	v, err, shared = m.flights.do(key, func() (interface{}, error) {
+		ran = true
+		return fn()
+	})
+	if !ran && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) &&
+		m.context().Err() == nil {
+		v, err = fn()
+		shared = false
+	}
+	return v, err, shared
+}
@@ -18,13 +18,17 @@
 package af3ro
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/goamz/goamz/aws"
@@ -35,49 +39,107 @@ import (
 // Toss a compile error if interface isn't implemented
 var _ afero.Fs = new(MemS3Fs)
 
-var mux = &sync.Mutex{}
-
 type MemS3Fs struct {
+	name       string
 	auth       aws.Auth
+	creds      *credentialCache
 	region     aws.Region
+	endpoint   string
+	pathStyle  bool
+	client     *http.Client
 	bucketName string
-	data       map[string]afero.File
-	mutex      *sync.RWMutex
+	root       string
+	mimeTypes  map[string]string
+	charset    string
+	heads      *headMemo
+	flights    *flightGroup
+	prefixes   *prefixCache
+	counts     *cacheCounts
+	failed     *failedFlushes
+	workers    *workerGroup
+
+	flushRetries  int
+	skipUnchanged bool
+	detectRegion  bool
+	verifyBucket  bool
+	createBucket  *bucketSpec
+	sse           bool
+	sseKMS        bool
+	kmsKeyID      string
+	encryption    KeyWrapper
+	storageClass  s3.StorageClass
+	headerRules   []headerRule
+	readXforms    []transformRule
+	writeXforms   []transformRule
+	derivers      []deriveRule
+	dirSize       int64
+	dirModTimes   bool
+	posixMeta     bool
+	hide403       bool
+	writeThrough  bool
+	cache         Cache
+	markers       MarkerCodec
+	cacheTTL      time.Duration
+	s3a           bool
+	revalidate    bool
+	missingTTL    time.Duration
+	onFlush       func(name, versionID string)
+	ctx           context.Context
+	timeout       time.Duration
+	base          *MemS3Fs // for a view, the filesystem it's a view of
+	dialTimeout   time.Duration
+	idleTimeout   time.Duration
+	chaos         *ChaosConfig
+	failover      *failover
+	scheduler     *scheduler
+	limiter       *scheduler
+	readahead     int
+	prefetch      int
+	retry         RetryPolicy
+	throttle      *throttle
+	listPageSize  int
+	metrics       Recorder
+	verifyReads   bool
+	readRetries   int
+	replica       string
+	replicaRegion aws.Region
+	index         Indexer
+	shadow        *ShadowConfig
+
+	multipartThreshold int64
+	partSize           int64
+	partConcurrency    int
+	streamWrites       bool
+
+	clock Clock
+	rand  Rand
+
+	data  map[string]afero.File
+	mutex *sync.RWMutex // made by New or Sub, and shared with views
 }
 
-func (m *MemS3Fs) lock() {
-	mx := m.getMutex()
-	mx.Lock()
-}
-func (m *MemS3Fs) unlock()  { m.getMutex().Unlock() }
-func (m *MemS3Fs) rlock()   { m.getMutex().RLock() }
-func (m *MemS3Fs) runlock() { m.getMutex().RUnlock() }
+func (m *MemS3Fs) lock()    { m.mutex.Lock() }
+func (m *MemS3Fs) unlock()  { m.mutex.Unlock() }
+func (m *MemS3Fs) rlock()   { m.mutex.RLock() }
+func (m *MemS3Fs) runlock() { m.mutex.RUnlock() }
 
 func (m *MemS3Fs) getData() map[string]afero.File {
-	if m.data == nil {
-		m.data = make(map[string]afero.File)
-	}
 	return m.data
 }
 
-func (m *MemS3Fs) getMutex() *sync.RWMutex {
-	mux.Lock()
-	if m.mutex == nil {
-		m.mutex = &sync.RWMutex{}
-	}
-	mux.Unlock()
-	return m.mutex
-}
-
 type MemDirMap map[string]afero.File
 
 func (m MemDirMap) Len() int            { return len(m) }
 func (m MemDirMap) Add(f afero.File)    { m[f.Name()] = f }
 func (m MemDirMap) Remove(f afero.File) { delete(m, f.Name()) }
+
+// Files returns the directory's files sorted by name, so that Readdir
+// can page through them.
 func (m MemDirMap) Files() (files []afero.File) {
 	for _, f := range m {
 		files = append(files, f)
 	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
 	return files
 }
 
@@ -88,44 +150,66 @@ func (m MemDirMap) Names() (names []string) {
 	return names
 }
 
-func (MemS3Fs) Name() string { return "MemS3Fs: s3-backed memfs" }
+// Name identifies the filesystem by its bucket and region or endpoint, as
+// in "MemS3Fs: s3://bucket (us-east-1)", unless it was given one with
+// Named.
+func (m MemS3Fs) Name() string {
+	if m.name != "" {
+		return m.name
+	}
+	name := "MemS3Fs: s3://" + m.bucketName
+	if m.root != "" {
+		name += "/" + m.root
+	}
+	if m.endpoint != "" {
+		name += " (" + m.endpoint + ")"
+	} else if m.region.Name != "" {
+		name += " (" + m.region.Name + ")"
+	}
+	return name
+}
 
 func (m *MemS3Fs) Create(name string) (afero.File, error) {
+	f := newMemFile(name, m.origin())
+	if m.streamWrites && !m.wholeWrites(name) {
+		f.upload = &partWriter{fs: m, name: name}
+	}
 	m.lock()
-	m.getData()[name] = MemFileCreate(name, m.bucket())
+	m.getData()[name] = f
 	m.unlock()
-	m.registerDirs(m.getData()[name])
-	return m.getData()[name], nil
+	m.heads.forget(name)
+	m.registerDirs(f)
+	return f.open(m), nil
 }
 
+// registerDirs adds f to its parent directory's listing, creating the
+// parent (and its parents) first if needed.
 func (m *MemS3Fs) registerDirs(f afero.File) {
-	var x = f.Name()
-	for x != "/" {
-		f := m.registerWithParent(f)
-		if f == nil {
-			break
-		}
-		x = f.Name()
+	pdir := path.Dir(path.Clean(f.Name()))
+	if pdir == path.Clean(f.Name()) {
+		// f is the root
+		return
 	}
+	m.mkdir(pdir)
+	m.registerWithParent(f)
 }
 
 func (m *MemS3Fs) unRegisterWithParent(f afero.File) afero.File {
 	parent := m.findParent(f)
+	if parent == nil {
+		return nil
+	}
 	pmem := parent.(*InMemoryFile)
 	pmem.memDir.Remove(f)
 	return parent
 }
 
 func (m *MemS3Fs) findParent(f afero.File) afero.File {
-	dirs, _ := path.Split(f.Name())
-	if len(dirs) > 1 {
-		_, parent := path.Split(path.Clean(dirs))
-		if len(parent) > 0 {
-			pfile, err := m.Open(parent)
-			if err != nil {
-				return pfile
-			}
-		}
+	pdir := path.Dir(path.Clean(f.Name()))
+	m.rlock()
+	defer m.runlock()
+	if pfile, ok := m.getData()[pdir].(*InMemoryFile); ok && pfile.memDir != nil {
+		return pfile
 	}
 	return nil
 }
@@ -137,167 +221,504 @@ func (m *MemS3Fs) registerWithParent(f afero.File) afero.File {
 	parent := m.findParent(f)
 	if parent != nil {
 		pmem := parent.(*InMemoryFile)
+		m.lock()
 		pmem.memDir.Add(f)
-	} else {
-		pdir := filepath.Dir(path.Clean(f.Name()))
-		m.Mkdir(pdir, 0777)
+		m.unlock()
 	}
 	return parent
 }
 
+// unregisterWithParent takes f out of its parent directory's listing.
+func (m *MemS3Fs) unregisterWithParent(f afero.File) {
+	if parent := m.findParent(f); parent != nil {
+		m.lock()
+		parent.(*InMemoryFile).memDir.Remove(f)
+		m.unlock()
+	}
+}
+
 // Mkdir doesn't actually save anything to S3 unless they have
-// contents. The cloud doesn't have directories.
+// contents, or there are Markers. The cloud doesn't have directories.
 func (m *MemS3Fs) Mkdir(name string, perm os.FileMode) error {
+	if err := m.mkdir(name); err != nil {
+		return err
+	}
+	return m.putMarker(name)
+}
+
+// mkdir caches the directory name, and its parents.
+func (m *MemS3Fs) mkdir(name string) error {
 	m.rlock()
 	d, ok := m.getData()[name]
 	m.runlock()
-	if ok {
-		if imf, o := d.(*InMemoryFile); o && imf.memDir != nil {
-			// the directory exists but that's ok
-			return nil
-		}
-		return afero.ErrFileExists
-	} else {
+	if !ok {
+		// another mkdir may have made it since
 		m.lock()
-		m.getData()[name] = &InMemoryFile{name: name, memDir: &MemDirMap{}, dir: true}
+		if d, ok = m.getData()[name]; !ok {
+			d = &InMemoryFile{fs: m.origin(), fileData: &fileData{
+				name: name, memDir: &MemDirMap{}, dir: true,
+			}}
+			m.getData()[name] = d
+		}
 		m.unlock()
-		m.registerDirs(m.getData()[name])
+		if !ok {
+			m.registerDirs(d)
+			return nil
+		}
 	}
-	return nil
+	if imf, o := d.(*InMemoryFile); o && imf.memDir != nil {
+		// the directory exists but that's ok
+		return nil
+	}
+	return &os.PathError{Op: "mkdir", Path: name, Err: afero.ErrFileExists}
 }
 
 // MkdirAll doesn't actually save anything to S3 unless they have
-// contents. The cloud doesn't have directories.
+// contents, or there are Markers. The cloud doesn't have directories.
 func (m *MemS3Fs) MkdirAll(path string, perm os.FileMode) error {
-	return m.Mkdir(path, 0777)
+	if err := m.mkdir(path); err != nil {
+		return err
+	}
+	return m.putMarkers(path)
 }
 
 func (m *MemS3Fs) Open(name string) (afero.File, error) {
+	expired := m.expire(name)
 	m.rlock()
 	f, ok := m.getData()[name]
 	ff, ok := f.(*InMemoryFile)
 	if ok {
-		ff.Open()
+		f = ff.open(m)
 	}
 	m.runlock()
 
-	if ok {
-		return f, nil
-	} else {
-		return nil, afero.ErrFileNotFound
+	m.recordLookup(FileCache, name, ok, expired)
+	if !ok {
+		f, err := m.openRemote(name)
+		if ff, isFile := f.(*InMemoryFile); isFile {
+			return ff.open(m), err
+		}
+		return f, err
+	}
+	if m.revalidate {
+		if err := ff.revalidate(); os.IsNotExist(err) {
+			m.lock()
+			delete(m.getData(), name)
+			m.unlock()
+			m.unregisterWithParent(ff)
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
 	}
+	return f, nil
 }
 
-// OpenFile ignores the `flag` argument but respects `perm`
+// openRemote adds an object this process hasn't seen to the cache
+// without downloading it, following it if it's a link.
+func (m *MemS3Fs) openRemote(name string) (afero.File, error) {
+	return m.openObject(name, 0)
+}
+
+// openObject is openRemote for a name reached by following hops links.
+func (m *MemS3Fs) openObject(name string, hops int) (afero.File, error) {
+	resp, err := m.head(name)
+	if err == afero.ErrFileNotFound {
+		return nil, &os.PathError{Op: "open", Path: name, Err: afero.ErrFileNotFound}
+	} else if err != nil {
+		return nil, err
+	}
+	if m.markers != nil && m.markers.IsLink(resp.Header) {
+		if hops == maxLinkHops {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := m.linkTarget(name, resp.Header)
+		if err != nil {
+			return nil, err
+		}
+		target = resolveLink(name, target)
+		m.rlock()
+		f, ok := m.getData()[target].(*InMemoryFile)
+		m.runlock()
+		if ok {
+			return m.Open(f.Name())
+		}
+		return m.openObject(target, hops+1)
+	}
+	return m.addRemote(m.remoteFile(name, resp.Header)), nil
+}
+
+// remoteFile is an uncached, unloaded file of the object a HEAD or GET
+// of name answered with header.
+func (m *MemS3Fs) remoteFile(name string, header http.Header) *InMemoryFile {
+	modtime, _ := http.ParseTime(header.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	f := &InMemoryFile{fs: m, fileData: &fileData{
+		name:    name,
+		mode:    0640,
+		modtime: modtime,
+		objSize: m.plainSize(size, header),
+		etag:    strings.Trim(header.Get("ETag"), "\""),
+	}}
+	if m.posixMeta {
+		f.applyPosix(header)
+	}
+	return f
+}
+
+// expire drops name from the cache if it's been cached longer than
+// CacheTTL, reporting whether it did.
+func (m *MemS3Fs) expire(name string) bool {
+	if m.cacheTTL <= 0 {
+		return false
+	}
+	m.rlock()
+	f, ok := m.getData()[name].(*InMemoryFile)
+	m.runlock()
+	if !ok || f.dir {
+		return false
+	}
+	f.mu.Lock()
+	stale := !f.dirty && m.now().Sub(f.cachedAt) > m.cacheTTL
+	f.mu.Unlock()
+	if !stale {
+		return false
+	}
+	m.unregisterWithParent(f)
+	m.lock()
+	if m.getData()[name] == f {
+		delete(m.getData(), name)
+	}
+	m.unlock()
+	m.heads.forget(name)
+	return true
+}
+
+// addRemote caches f, an object found in S3, unless its name is cached
+// already, and returns whichever is cached.
+func (m *MemS3Fs) addRemote(f *InMemoryFile) afero.File {
+	m.lock()
+	if cached, ok := m.getData()[f.Name()]; ok {
+		// lost a race with another Open
+		m.unlock()
+		return cached
+	}
+	f.cachedAt = m.now()
+	// cached files outlive any view they were found through
+	f.fs = m.origin()
+	m.getData()[f.Name()] = f
+	m.unlock()
+	m.registerDirs(f)
+	return f
+}
+
+// replaceRemote caches f, an object just downloaded, in place of the
+// file cached with its name, unless that one has unflushed writes, and
+// returns whichever is cached. Handles open on a file it replaces keep
+// reading what that file had.
+func (m *MemS3Fs) replaceRemote(f *InMemoryFile) *InMemoryFile {
+	m.rlock()
+	cached := m.getData()[f.Name()]
+	m.runlock()
+	if c, ok := cached.(*InMemoryFile); ok {
+		c.mu.Lock()
+		local := c.dir || c.dirty
+		c.mu.Unlock()
+		if local {
+			return c
+		}
+	}
+	f.fs = m.origin()
+	m.lock()
+	if cur, ok := m.getData()[f.Name()].(*InMemoryFile); ok && afero.File(cur) != cached {
+		// lost a race with another Open
+		m.unlock()
+		return cur
+	}
+	m.getData()[f.Name()] = f
+	m.unlock()
+	m.registerDirs(f)
+	return f
+}
+
+// OpenFile follows os.OpenFile's flag semantics. perm sets the file's
+// ACL when the file is created.
 func (m *MemS3Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
 	f, err := m.Open(name)
+	if err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: afero.ErrFileExists}
+	}
+	if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		if f, err = m.Create(name); err == nil {
+			err = m.Chmod(name, perm)
+		}
+	}
 	if err != nil {
-		return f, err
+		return nil, err
+	}
+
+	ff, ok := f.(*InMemoryFile)
+	if !ok || ff.dir {
+		return f, nil
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		if err = ff.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	if !writable || flag&os.O_APPEND != 0 {
+		return &handle{InMemoryFile: ff, readOnly: !writable, append: flag&os.O_APPEND != 0}, nil
 	}
-	err = m.Chmod(f.Name(), perm)
-	return f, err
+	return f, nil
+}
+
+// OpenMeta opens name for Stat, Readdir and reading its attributes only.
+// Everything that would download or upload its contents fails with
+// ErrMetaOnly, so scans of large trees are sure to make nothing but HEAD
+// and LIST requests.
+func (m *MemS3Fs) OpenMeta(name string) (afero.File, error) {
+	f, err := m.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if ff, ok := f.(*InMemoryFile); ok {
+		return &metaHandle{ff}, nil
+	}
+	return f, nil
 }
 
 // Removes file immediately from both S3 and the local cache
 func (m *MemS3Fs) Remove(name string) error {
-	m.rlock()
-	defer m.runlock()
+	_, err := m.RemoveResult(name)
+	return err
+}
 
-	m.bucket().Del(name)
-	if _, ok := m.getData()["name"]; ok {
-		m.lock()
-		delete(m.getData(), name)
-		m.unlock()
+// RemoveResult is Remove that reports the ETag and version ID the object
+// had, if they were cached, and whether S3 failed to delete it.
+func (m *MemS3Fs) RemoveResult(name string) (*OpResult, error) {
+	res := &OpResult{Op: "remove", Source: name}
+	res.SourceETag, res.SourceVersionID = m.known(name)
+	err := m.removeKey("remove", name)
+	m.rlock()
+	f, ok := m.getData()[name].(*InMemoryFile)
+	m.runlock()
+	if ok && f.dir && err == nil {
+		err = m.removeMarker(name)
 	}
-	return nil
+	m.lock()
+	delete(m.getData(), name)
+	m.unlock()
+	if err == nil {
+		err = m.keepParent(name)
+	}
+	if err != nil {
+		return res, &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return res, nil
 }
 
+// maxDeleteBatch is the most keys S3 deletes in one request.
+const maxDeleteBatch = 1000
+
+// RemoveAll deletes path and every object under it, listing them a page
+// at a time and deleting them in batches.
 func (m *MemS3Fs) RemoveAll(path string) error {
-	m.rlock()
-	defer m.runlock()
-	for p, _ := range m.getData() {
-		if strings.HasPrefix(p, path) {
-			m.runlock()
-			m.lock()
+	key, prefix := m.key(path), m.dirPrefix(path)
+	m.lock()
+	for p := range m.getData() {
+		if k := m.key(p); k == key || strings.HasPrefix(k, prefix) {
 			delete(m.getData(), p)
-			m.unlock()
-			m.rlock()
 		}
 	}
-	items := &s3.ListResp{IsTruncated: true, NextMarker: ""}
-	toDel := make([]s3.Object, 0)
-	for items.IsTruncated {
-		items, err := m.bucket().List(path, "/", items.NextMarker, 0)
-		if err != nil {
-			return err
+	m.unlock()
+	m.heads.forgetPrefix(path)
+	m.prefixes.forgetAncestors(key)
+	m.prefixes.forgetPrefix(prefix)
+
+	var batch []s3.Object
+	if key != "" {
+		batch = append(batch, s3.Object{Key: key})
+		if marker, ok := m.markerOutside(path); ok {
+			batch = append(batch, s3.Object{Key: marker})
 		}
-
-		for _, v := range items.Contents {
-			toDel = append(toDel, s3.Object{Key: v.Key})
+	}
+	del := func() error {
+		err := m.scheduled(func() error {
+			return m.do("removeall", path, func(b *s3.Bucket) error {
+				return b.DelMulti(s3.Delete{Quiet: true, Objects: batch})
+			})
+		})
+		if err == nil {
+			for _, o := range batch {
+				m.indexDelete(o.Key)
+			}
+		}
+		batch = batch[:0]
+		return err
+	}
+	err := m.eachKey("removeall", prefix, func(k s3.Key) error {
+		batch = append(batch, s3.Object{Key: k.Key})
+		if len(batch) == maxDeleteBatch {
+			return del()
 		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = del()
+	}
+	if err == nil {
+		err = m.keepParent(path)
 	}
-	return m.bucket().DelMulti(
-		s3.Delete{
-			Quiet:   false,
-			Objects: toDel,
-		},
-	)
+	return err
 }
 
+// Rename moves oldname to newname with a copy made by S3, failing with
+// afero.ErrDestinationExists if newname exists. Renaming a directory
+// moves every object under it; see RenameError for what happens when
+// only some of them move.
 func (m *MemS3Fs) Rename(oldname, newname string) error {
-	m.rlock()
-	defer m.runlock()
-	if _, ok := m.getData()[oldname]; ok {
-		if _, ok := m.getData()[newname]; !ok {
-			m.runlock()
-			m.lock()
-			m.getData()[newname] = m.getData()[oldname]
-			delete(m.getData(), oldname)
-
-			_, err := m.bucket().PutCopy(
-				newname,
-				s3.Private,
-				s3.CopyOptions{},
-				// PutCopy requires name in the format bucket/key...
-				m.bucketName+"/"+oldname,
-			)
-			m.unlock()
-			m.rlock()
+	_, err := m.RenameResult(oldname, newname)
+	return err
+}
+
+// RenameResult is Rename that also describes the move. For a directory
+// only Bytes, the total size of the objects moved, is filled in.
+func (m *MemS3Fs) RenameResult(oldname, newname string) (*OpResult, error) {
+	if m.s3a {
+		var err error
+		if newname, err = m.s3aDest(oldname, newname); err != nil {
+			return nil, err
+		}
+	}
+	res, err := m.renameResult(oldname, newname)
+	if err == nil {
+		err = m.keepParent(oldname)
+	}
+	return res, err
+}
+
+func (m *MemS3Fs) renameResult(oldname, newname string) (*OpResult, error) {
+	res := &OpResult{Op: "rename", Source: oldname, Dest: newname}
+	if m.skipsTransforms(oldname, newname) {
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrTransformedWrite}
+	}
+	f, err := m.lookup(oldname)
+	if os.IsNotExist(err) {
+		if dir, err := m.isDir(oldname); err != nil || dir {
 			if err != nil {
-				return err
+				return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
 			}
-			err = m.Remove(oldname)
-			if err != nil {
-				return err
+			res.Bytes, err = m.renameDir(oldname, newname, nil)
+			return res, err
+		}
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: afero.ErrFileNotFound}
+	} else if err != nil {
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	ff, ok := f.(*InMemoryFile)
+	if !ok {
+		return res, nil
+	}
+	ff = ff.in(m)
+	if ff.dir {
+		res.Bytes, err = m.renameDir(oldname, newname, nil)
+		return res, err
+	}
+	if _, err := m.Stat(newname); err == nil {
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: afero.ErrDestinationExists}
+	}
+	// the copy is made from S3, so it has to be up to date
+	if err := ff.flush(); err != nil {
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	res.SourceETag, res.SourceVersionID = m.known(oldname)
+	res.Bytes, err = ff.size()
+	options := ff.putOptions()
+	if err == nil && ff.class == "" {
+		// keep the object's class rather than the filesystem's; S3 only
+		// names classes other than STANDARD
+		var resp *http.Response
+		if resp, err = m.head(oldname); err == nil {
+			options.StorageClass = s3.StandardStorage
+			if class := resp.Header.Get("x-amz-storage-class"); class != "" {
+				options.StorageClass = s3.StorageClass(class)
 			}
-		} else {
-			return afero.ErrDestinationExists
 		}
-	} else {
-		return afero.ErrFileNotFound
 	}
-	return nil
+	if err == nil {
+		res.DestETag, err = m.copyObjectETag("rename", m.key(oldname), m.bucketName, m.key(newname), res.Bytes, getACL(ff.mode), options)
+	}
+	if err != nil {
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	m.heads.forget(newname)
+	m.prefixes.forgetAncestors(m.key(newname))
+	m.indexPut(newname, res.Bytes)
+
+	m.unregisterWithParent(ff)
+	m.lock()
+	delete(m.getData(), oldname)
+	ff.name = newname
+	cached := ff.in(m.origin())
+	m.getData()[newname] = cached
+	m.unlock()
+	m.registerDirs(cached)
+
+	if err := m.removeKey("rename", oldname); err != nil {
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return res, nil
 }
 
+// Stat describes name from the cache, or from a HEAD of its object if
+// this process hasn't seen it. A name that objects are stored under is a
+// directory.
 func (m *MemS3Fs) Stat(name string) (os.FileInfo, error) {
-	f, err := m.Open(name)
-	if err != nil {
-		return nil, err
+	m.expire(name)
+	m.rlock()
+	f, ok := m.getData()[name]
+	m.runlock()
+	if !ok {
+		var err error
+		f, err = m.openRemote(name)
+		if os.IsNotExist(err) {
+			var dir bool
+			if dir, err = m.isDir(name); err == nil && dir {
+				m.mkdir(name)
+				m.rlock()
+				f = m.getData()[name]
+				m.runlock()
+			} else if err == nil {
+				err = afero.ErrFileNotFound
+			}
+		}
+		if err != nil {
+			if pe, ok := err.(*os.PathError); ok {
+				err = pe.Err
+			}
+			return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+		}
 	}
-	return &InMemoryFileInfo{file: f.(*InMemoryFile)}, nil
+	return f.(*InMemoryFile).Info(), nil
 }
 
 func (m *MemS3Fs) Chmod(name string, mode os.FileMode) error {
+	m.rlock()
 	f, ok := m.getData()[name]
+	m.runlock()
 	if !ok {
-		return &os.PathError{"chmod", name, afero.ErrFileNotFound}
+		return &os.PathError{Op: "chmod", Path: name, Err: afero.ErrFileNotFound}
 	}
 
 	ff, ok := f.(*InMemoryFile)
 	if ok {
-		m.lock()
-		ff.mode = mode
-		m.unlock()
+		ff.loadPosix()
+		ff.mu.Lock()
+		ff.mode, ff.modeKnown = mode, true
+		ff.dirty = ff.dirty || ff.loaded
+		m.posixChanged(ff)
+		ff.mu.Unlock()
 	} else {
 		return errors.New("Unable to Chmod Memory File")
 	}
@@ -305,22 +726,152 @@ func (m *MemS3Fs) Chmod(name string, mode os.FileMode) error {
 }
 
 func (m *MemS3Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	m.rlock()
 	f, ok := m.getData()[name]
+	m.runlock()
 	if !ok {
-		return &os.PathError{"chtimes", name, afero.ErrFileNotFound}
+		return &os.PathError{Op: "chtimes", Path: name, Err: afero.ErrFileNotFound}
 	}
 
 	ff, ok := f.(*InMemoryFile)
 	if ok {
-		m.lock()
+		ff.loadPosix()
+		ff.mu.Lock()
 		ff.modtime = mtime
-		m.unlock()
+		ff.mtimeSet = true
+		m.posixChanged(ff)
+		ff.mu.Unlock()
 	} else {
 		return errors.New("Unable to Chtime Memory File")
 	}
 	return nil
 }
 
+// Dirty returns the names of files whose last upload failed and which
+// are kept in memory to be retried with Flush. A file is listed until an
+// upload of it succeeds, even while it's being written or flushed again.
+func (m *MemS3Fs) Dirty() (names []string) {
+	cached := make(map[*fileData]string)
+	m.rlock()
+	for name, f := range m.getData() {
+		if ff, ok := f.(*InMemoryFile); ok {
+			cached[ff.fileData] = name
+		}
+	}
+	m.runlock()
+	for _, d := range m.failed.list() {
+		if name, ok := cached[d]; ok {
+			names = append(names, name)
+		} else {
+			// removed from the cache, so there's nothing left to retry
+			m.failed.set(d, false)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// failedFlushes is the set of files whose last upload failed, kept apart
+// from their locks so Dirty can report them while they're busy. A nil
+// *failedFlushes remembers nothing.
+type failedFlushes struct {
+	mu    sync.Mutex
+	files map[*fileData]bool
+}
+
+func (s *failedFlushes) set(f *fileData, failed bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !failed {
+		delete(s.files, f)
+		return
+	}
+	if s.files == nil {
+		s.files = make(map[*fileData]bool)
+	}
+	s.files[f] = true
+}
+
+func (s *failedFlushes) list() (files []*fileData) {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for f := range s.files {
+		files = append(files, f)
+	}
+	return files
+}
+
+// Flush uploads name if it is dirty, for retrying a failed Close.
+func (m *MemS3Fs) Flush(name string) error {
+	m.rlock()
+	f, ok := m.getData()[name]
+	m.runlock()
+	if !ok {
+		return &os.PathError{Op: "flush", Path: name, Err: afero.ErrFileNotFound}
+	}
+	if ff, ok := f.(*InMemoryFile); ok {
+		return ff.flush()
+	}
+	return nil
+}
+
+// FlushEvery uploads every dirty file, open or not, each interval until
+// ctx is done, bounding what's lost if the process dies before files are
+// closed. Uploads that fail leave their files dirty to be tried again;
+// see Dirty and the Flush metric. Files written with StreamingWrites are
+// left until they're closed.
+func (m *MemS3Fs) FlushEvery(ctx context.Context, interval time.Duration) {
+	m.spawn(ctx, "FlushEvery", func(ctx context.Context) error {
+		for {
+			select {
+			case <-clockOr(m.clock).After(interval):
+			case <-ctx.Done():
+				return nil
+			}
+			for _, f := range m.dirtyFiles() {
+				f.mu.Lock()
+				// a streaming upload is done with when it's closed
+				streaming := f.upload != nil
+				f.mu.Unlock()
+				if !streaming {
+					m.workers.fail(f.flush())
+				}
+			}
+		}
+	})
+}
+
+// dirtyFiles returns the files with changes that haven't been uploaded
+// and that aren't being written or flushed.
+func (m *MemS3Fs) dirtyFiles() (files []*InMemoryFile) {
+	m.rlock()
+	for _, f := range m.getData() {
+		if ff, ok := f.(*InMemoryFile); ok {
+			files = append(files, ff)
+		}
+	}
+	m.runlock()
+	// a file being written or flushed is locked until it's done, which
+	// mustn't hold up the filesystem, so it's left out
+	dirty := files[:0]
+	for _, f := range files {
+		if !f.mu.TryLock() {
+			continue
+		}
+		if f.dirty {
+			dirty = append(dirty, f)
+		}
+		f.mu.Unlock()
+	}
+	return dirty
+}
+
 func (m *MemS3Fs) List() {
 	for _, x := range m.data {
 		y, _ := x.Stat()
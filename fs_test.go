@@ -16,17 +16,33 @@
 package af3ro
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/goamz/goamz/aws"
 	"github.com/goamz/goamz/s3"
 	"github.com/spf13/afero"
 )
@@ -85,6 +101,200 @@ func TestAcls(t *testing.T) {
 	aclEq(t, getACL(0777), s3.PublicReadWrite)
 }
 
+func TestContentType(t *testing.T) {
+	fs := NewS3Fs(MimeType("avif", "image/avif"), Charset("utf-8"))
+	for name, want := range map[string]string{
+		"/a/b.avif": "image/avif",
+		"/a/b.AVIF": "image/avif",
+		"/a/b.css":  "text/css; charset=utf-8",
+		"/a/b":      "application/octet-stream",
+	} {
+		if got := fs.contentType(name); got != want {
+			t.Errorf("contentType(%q) = %q want %q", name, got, want)
+		}
+	}
+
+	fs = NewS3Fs(MimeType("txt", "text/plain; charset=us-ascii"), Charset("iso-8859-1"))
+	for name, want := range map[string]string{
+		"/a/b.html": "text/html; charset=iso-8859-1",
+		"/a/b.txt":  "text/plain; charset=us-ascii",
+	} {
+		if got := fs.contentType(name); got != want {
+			t.Errorf("contentType(%q) = %q want %q", name, got, want)
+		}
+	}
+}
+
+func TestMemFileCreateNilBucket(t *testing.T) {
+	f := MemFileCreate("TestMemFileCreateNilBucket", nil)
+	if f.fs == nil {
+		t.Fatalf("file has no filesystem")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	data := bytes.Repeat([]byte("af3ro"), 3*mib)
+	if !etagMatches(data, "\""+md5ETag(data)+"\"") {
+		t.Error("single part etag didn't match")
+	}
+	for _, partSize := range []int64{5 * mib, 8 * mib} {
+		etag := multipartETag(data, partSize)
+		if !etagMatches(data, etag) {
+			t.Errorf("multipart etag %s (part size %d) didn't match", etag, partSize)
+		}
+		if etagMatches(data[1:], etag) {
+			t.Errorf("multipart etag %s matched different data", etag)
+		}
+	}
+	part := s3.Part{N: 1, ETag: "\"" + md5ETag(data) + "\""}
+	if !partMatches(part, data) || partMatches(part, data[1:]) {
+		t.Errorf("part etag %s matched wrongly", part.ETag)
+	}
+	if kms := (s3.Part{N: 1, ETag: "\"not-an-md5\""}); !partMatches(kms, data[1:]) {
+		t.Errorf("part etag %s that isn't an MD5 didn't match", kms.ETag)
+	}
+}
+
+func TestNotExistErrors(t *testing.T) {
+	name := testDir + "/does-not-exist"
+	_, err := fs.Open(name)
+	notExist(t, "Open", err)
+	_, err = fs.Stat(name)
+	notExist(t, "Stat", err)
+	notExist(t, "Chmod", fs.Chmod(name, 0600))
+	notExist(t, "Chtimes", fs.Chtimes(name, time.Now(), time.Now()))
+	notExist(t, "Rename", fs.Rename(name, name+".new"))
+}
+
+func notExist(t *testing.T, op string, err error) {
+	if !os.IsNotExist(err) {
+		t.Errorf("%s: os.IsNotExist(%v) = false", op, err)
+	}
+	if !errors.Is(err, afero.ErrFileNotFound) {
+		t.Errorf("%s: errors.Is(%v, afero.ErrFileNotFound) = false", op, err)
+	}
+}
+
+func TestKMSAccessError(t *testing.T) {
+	denied := &s3.Error{
+		StatusCode: 403,
+		Code:       "AccessDenied",
+		Message:    "The ciphertext refers to a customer master key that does not exist (Service: AWSKMS)",
+	}
+	var kerr *KMSAccessError
+	if err := fs.readError("read", "/secret", denied); !errors.As(err, &kerr) {
+		t.Fatalf("readError(%v) = %v want a *KMSAccessError", denied, err)
+	}
+	if kerr.Err != denied {
+		t.Errorf("KMSAccessError.Err = %v want %v", kerr.Err, denied)
+	}
+}
+
+func TestTreat403AsNotFound(t *testing.T) {
+	denied := &s3.Error{StatusCode: 403, Code: "AccessDenied", Message: "Access Denied"}
+	if err := fs.readError("read", "/hidden", denied); err != denied {
+		t.Errorf("readError(%v) = %v want it unchanged", denied, err)
+	}
+	hiding := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Treat403AsNotFound())
+	if err := hiding.readError("read", "/hidden", denied); !os.IsNotExist(err) {
+		t.Errorf("Treat403AsNotFound: readError(%v) = %v want not-exist", denied, err)
+	}
+	kms := &s3.Error{StatusCode: 403, Code: "KMS.AccessDeniedException"}
+	var kerr *KMSAccessError
+	if err := hiding.readError("read", "/hidden", kms); !errors.As(err, &kerr) {
+		t.Errorf("Treat403AsNotFound: readError(%v) = %v want a *KMSAccessError", kms, err)
+	}
+}
+
+func TestStitchPlan(t *testing.T) {
+	const size = 100 * mib
+	for _, dirty := range [][]byteRange{
+		{{0, 10}},
+		{{size - 10, size}},
+		{{size - 10, size + 10}},
+		{{50 * mib, 50*mib + 1}, {52 * mib, 52*mib + 1}, {90 * mib, 91 * mib}},
+		{{size + mib, size + 2*mib}},
+	} {
+		final := int64(size)
+		for _, d := range dirty {
+			if d.end > final {
+				final = d.end
+			}
+		}
+		plan := stitchPlan(size, append([]byteRange(nil), dirty...))
+		cursor := int64(0)
+		for i, p := range plan {
+			if p.start != cursor {
+				t.Fatalf("%v: part %d starts at %d want %d", dirty, i, p.start, cursor)
+			}
+			if i < len(plan)-1 && p.end-p.start < minPartSize {
+				t.Errorf("%v: part %d is only %d bytes", dirty, i, p.end-p.start)
+			}
+			if p.copy && p.end > size {
+				t.Errorf("%v: part %d copies past the end of the object", dirty, i)
+			}
+			for _, d := range dirty {
+				if p.copy && d.start < p.end && d.end > p.start {
+					t.Errorf("%v: part %d copies over dirty range %v", dirty, i, d)
+				}
+			}
+			cursor = p.end
+		}
+		if cursor != final {
+			t.Errorf("%v: plan ends at %d want %d", dirty, cursor, final)
+		}
+	}
+}
+
+func TestStitch(t *testing.T) {
+	pfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Prefix("TestStitch"))
+	name := "big"
+	data := bytes.Repeat([]byte("af3ro"), stitchMinSize/5+mib)
+	if err := afero.WriteFile(pfs, name, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer pfs.Remove(name)
+
+	f, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Prefix("TestStitch")).OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("STITCHED"), 20*mib); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	want := append([]byte(nil), data...)
+	copy(want[20*mib:], "STITCHED")
+	if got, err := pfs.bucket().Get("TestStitch/" + name); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("after stitching: %d bytes, %v want the patched object", len(got), err)
+	}
+
+	// ranges aren't copied from an object that's changed since its size
+	// was taken
+	b := pfs.bucket()
+	multi, err := b.InitMulti("TestStitch/"+name, "application/octet-stream", s3.Private, s3.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Abort()
+	if _, err := pfs.putPartCopy(b, multi, 1, "TestStitch/"+name, byteRange{0, 10}, "stale"); !isPreconditionFailed(err) {
+		t.Errorf("putPartCopy from a stale ETag = %v want a precondition failure", err)
+	}
+}
+
+func TestApplyPatches(t *testing.T) {
+	got := applyPatches([]byte("hello, world"), 0, []patch{
+		{7, []byte("WORLD")},
+		{12, []byte("!")},
+		{0, []byte("J")},
+	})
+	if string(got) != "Jello, WORLD!" {
+		t.Errorf("have %q want %q", got, "Jello, WORLD!")
+	}
+}
+
 //Read with length 0 should not return EOF.
 func TestRead0(t *testing.T) {
 	path := testDir + "/" + testName
@@ -92,80 +302,3860 @@ func TestRead0(t *testing.T) {
 		t.Fatal(fs.Name(), "unable to create dir", err)
 	}
 
-	f, err := fs.Create(path)
-	if err != nil {
-		t.Fatal(fs.Name(), "create failed:", err)
+	f, err := fs.Create(path)
+	if err != nil {
+		t.Fatal(fs.Name(), "create failed:", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString("Lorem ipsum dolor sit amet, consectetur " +
+		"adipisicing elit, sed do eiusmod tempor incididunt ut labore et " +
+		"dolore magna aliqua. Ut enim ad minim veniam, quis nostrud " +
+		"exercitation ullamco laboris nisi ut aliquip ex ea commodo " +
+		"consequat. Duis aute irure dolor in reprehenderit in voluptate " +
+		"velit esse cillum dolore eu fugiat nulla pariatur. Excepteur " +
+		"sint occaecat cupidatat non proident, sunt in culpa qui " +
+		"officia deserunt mollit anim id est laborum.")
+	if err != nil {
+		t.Fatal(fs.Name(), "WriteString failed:", err)
+	}
+
+	b := make([]byte, 0)
+	n, err := f.Read(b)
+	if n != 0 || err != nil {
+		t.Errorf("%v: Read(0) = %d, %v, want 0, nil", fs.Name(), n, err)
+	}
+	f.Seek(0, 0)
+	b = make([]byte, 100)
+	n, err = f.Read(b)
+	if n <= 0 || err != nil {
+		t.Errorf("%v: Read(100) = %d, %v, want >0, nil", fs.Name(), n, err)
+	}
+}
+
+func TestZeroByteFile(t *testing.T) {
+	f := newFile("TestZeroByteFile", fs, t)
+	defer fs.Remove(f.Name())
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+	resp, err := headName(f.Name(), fs.bucket())
+	if err != nil {
+		t.Fatalf("empty file %q wasn't persisted: %v", f.Name(), err)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "0" {
+		t.Errorf("Content-Length = %s want 0", cl)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	f := newFile("TestUseAfterClose", fs, t)
+	defer fs.Remove(f.Name())
+	f.WriteString("hello")
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("second close = %v want nil", err)
+	}
+	if _, err := f.Write([]byte("world")); err != afero.ErrFileClosed {
+		t.Errorf("Write after close = %v want %v", err, afero.ErrFileClosed)
+	}
+	if _, err := f.WriteAt([]byte("world"), 0); err != afero.ErrFileClosed {
+		t.Errorf("WriteAt after close = %v want %v", err, afero.ErrFileClosed)
+	}
+	if _, err := f.Read(make([]byte, 5)); err != afero.ErrFileClosed {
+		t.Errorf("Read after close = %v want %v", err, afero.ErrFileClosed)
+	}
+	if size := f.(*InMemoryFile).Info().Size(); size != 5 {
+		t.Errorf("size after close = %d want 5", size)
+	}
+}
+
+func TestHandles(t *testing.T) {
+	name := path.Join(testDir, "TestHandles")
+	afero.WriteFile(fs, name, []byte("hello"), 0640)
+	defer fs.Remove(name)
+
+	a, _ := fs.Open(name)
+	b, _ := fs.Open(name)
+	buf := make([]byte, 2)
+	a.Read(buf)
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n, err := b.Read(buf); string(buf[:n]) != "he" {
+		t.Errorf("Read of another handle after Close = %q, %v want %q", buf[:n], err, "he")
+	}
+	if _, err := fs.Open(name); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := a.Read(buf); err != afero.ErrFileClosed {
+		t.Errorf("Read of a closed handle after another Open = %v want %v", err, afero.ErrFileClosed)
+	}
+	b.Close()
+}
+
+func TestOpenFileFlags(t *testing.T) {
+	f := newFile("TestOpenFileFlags", fs, t)
+	defer fs.Remove(f.Name())
+	f.WriteString("hello")
+
+	if _, err := fs.OpenFile(f.Name(), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600); !os.IsExist(err) {
+		t.Errorf("O_EXCL open of existing file = %v want os.ErrExist", err)
+	}
+
+	ro, err := fs.OpenFile(f.Name(), os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("O_RDONLY open failed: %v", err)
+	}
+	if _, err := ro.Write([]byte("x")); err == nil {
+		t.Error("Write to O_RDONLY file succeeded")
+	}
+
+	ap, err := fs.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("O_APPEND open failed: %v", err)
+	}
+	ap.WriteString(", world")
+	checkSize(t, ap, int64(len("hello, world")))
+
+	tr, err := fs.OpenFile(f.Name(), os.O_RDWR|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("O_TRUNC open failed: %v", err)
+	}
+	checkSize(t, tr, 0)
+}
+
+func TestWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	view := WithContext(ctx, fs)
+	if _, err := view.Open(testDir + "/TestWithContext"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Open with canceled context = %v want %v", err, context.Canceled)
+	}
+}
+
+func TestCanceledView(t *testing.T) {
+	name := path.Join(testDir, "TestCanceledView")
+	if err := afero.WriteFile(fs, name, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(name)
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f, err := mfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	vf, err := WithContext(ctx, mfs).Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := vf.Read(make([]byte, 5)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read through the canceled view = %v want %v", err, context.Canceled)
+	}
+	if data, err := ioutil.ReadAll(f); string(data) != "hello" || err != nil {
+		t.Errorf("Read of the file opened before = %q, %v want %q", data, err, "hello")
+	}
+}
+
+func TestCanceledViewFlight(t *testing.T) {
+	name := path.Join(testDir, "TestCanceledViewFlight")
+	if err := afero.WriteFile(fs, name, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(name)
+
+	// a HEAD made through a view is canceled while another caller
+	// waits on it
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	ctx, cancel := context.WithCancel(context.Background())
+	view := WithContext(ctx, mfs).(*MemS3Fs)
+	key := "head " + mfs.key(name)
+	release := make(chan struct{})
+	go view.flight(key, func() (interface{}, error) {
+		<-release
+		cancel()
+		return nil, &os.PathError{Op: "stat", Path: name, Err: ctx.Err()}
+	})
+	for started := false; !started; {
+		mfs.flights.mu.Lock()
+		_, started = mfs.flights.calls[key]
+		mfs.flights.mu.Unlock()
+	}
+	waited := make(chan error)
+	go func() {
+		_, err := mfs.head(name)
+		waited <- err
+	}()
+	for joined := false; !joined; {
+		mfs.flights.mu.Lock()
+		joined = mfs.flights.calls[key].dups > 0
+		mfs.flights.mu.Unlock()
+	}
+	close(release)
+	if err := <-waited; err != nil {
+		t.Errorf("head while a canceled view's HEAD was shared = %v", err)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	fs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Chaos(ChaosConfig{
+		Ops:       []string{"stat"},
+		ErrorRate: 1,
+	}))
+	if _, err := fs.Stat(testDir + "/TestChaos"); !errors.Is(err, ErrInjected) {
+		t.Errorf("Stat = %v want %v", err, ErrInjected)
+	}
+}
+
+func TestStreamingReads(t *testing.T) {
+	f := newFile("TestStreamingReads", fs, t)
+	defer fs.Remove(f.Name())
+	const data = "hello, world\n"
+	io.WriteString(f, data)
+	f.Close()
+
+	sfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), StreamingReads(4))
+	sf, err := sfs.Open(f.Name())
+	if err != nil {
+		t.Fatalf("open %q failed: %v", f.Name(), err)
+	}
+	defer sf.Close()
+	sf.Seek(7, 0)
+	b, err := ioutil.ReadAll(sf)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(b) != data[7:] {
+		t.Errorf("have %q want %q", b, data[7:])
+	}
+	if sf.(*InMemoryFile).loaded {
+		t.Error("streaming read loaded the whole file")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	name := path.Join(testDir, "TestPrefetch")
+	data := bytes.Repeat([]byte("af3ro"), mib)
+	afero.WriteFile(fs, name, data, 0640)
+	defer fs.Remove(name)
+
+	pfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), StreamingReads(4), Prefetch(2*mib))
+	f, err := pfs.Open(name)
+	if err != nil {
+		t.Fatalf("open %q failed: %v", name, err)
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, f); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("copied %d bytes, %v want %d", buf.Len(), err, len(data))
+	}
+	f.Seek(3*mib, 0)
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(f, b); err != nil || !bytes.Equal(b, data[3*mib:3*mib+5]) {
+		t.Errorf("after Seek: read %q, %v want %q", b, err, data[3*mib:3*mib+5])
+	}
+}
+
+func TestHeadMemoBound(t *testing.T) {
+	h := newHeadMemo(time.Hour)
+	for i := 0; i <= maxHeadEntries; i++ {
+		h.put(strconv.Itoa(i), &http.Response{})
+	}
+	if len(h.entries) > maxHeadEntries {
+		t.Errorf("memo holds %d responses, want at most %d", len(h.entries), maxHeadEntries)
+	}
+	if resp, _ := h.get(strconv.Itoa(maxHeadEntries)); resp == nil {
+		t.Errorf("the newest response was dropped")
+	}
+
+	h.missTTL = time.Hour
+	for i := 0; i <= maxHeadEntries; i++ {
+		h.putMissing(strconv.Itoa(i))
+	}
+	if len(h.missing) > maxHeadEntries {
+		t.Errorf("memo holds %d missing keys, want at most %d", len(h.missing), maxHeadEntries)
+	}
+	if !h.isMissing(strconv.Itoa(maxHeadEntries)) {
+		t.Errorf("the newest missing key was dropped")
+	}
+}
+
+func TestPrefixCacheBound(t *testing.T) {
+	c := newPrefixCache(time.Hour)
+	for i := 0; i <= maxPrefixEntries; i++ {
+		c.put(strconv.Itoa(i)+"/", &listing{})
+	}
+	if len(c.entries) > maxPrefixEntries {
+		t.Errorf("cache holds %d listings, want at most %d", len(c.entries), maxPrefixEntries)
+	}
+	if l, _, _ := c.get(strconv.Itoa(maxPrefixEntries) + "/"); l == nil {
+		t.Errorf("the newest listing was dropped")
+	}
+}
+
+func TestFlushIgnoresRememberedHead(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), HeadCacheTTL(time.Hour))
+	other := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestFlushIgnoresRememberedHead")
+	if err := afero.WriteFile(mfs, name, []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+	if _, err := mfs.head(name); err != nil {
+		t.Fatal(err)
+	}
+
+	// another writer changes the object after its ETag was remembered
+	if err := afero.WriteFile(other, name, []byte("changed"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	f, err := mfs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fetchObject(mfs.key(name), mfs.bucket()); string(data) != "hello" {
+		t.Errorf("object holds %q, %v after Close, want %q", data, err, "hello")
+	}
+}
+
+// BenchmarkSmallReads reads small cached files from many goroutines at
+// once, which mostly exercises the filesystem's locking.
+func BenchmarkSmallReads(b *testing.B) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	data := bytes.Repeat([]byte("af3ro"), 100)
+	var workers int32
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		name := path.Join(testDir, "BenchmarkSmallReads", strconv.Itoa(int(atomic.AddInt32(&workers, 1))))
+		if err := afero.WriteFile(mfs, name, data, 0640); err != nil {
+			b.Error(err)
+			return
+		}
+		defer mfs.Remove(name)
+		for pb.Next() {
+			if _, err := afero.ReadFile(mfs, name); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestMultipartUpload(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Multipart(6*mib, 5*mib, 2))
+	f := newFile("TestMultipartUpload", mfs, t)
+	defer mfs.Remove(f.Name())
+	data := bytes.Repeat([]byte("af3ro"), 3*mib)
+	f.Write(data)
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+	etag, err := mfs.etag(f.Name())
+	if err != nil {
+		t.Fatalf("head %q failed: %v", f.Name(), err)
+	}
+	if want := multipartETag(data, 5*mib); etag != want {
+		t.Errorf("etag = %s want %s", etag, want)
+	}
+	// the upload's ETag is known from its parts without hashing again
+	if tag := f.(*InMemoryFile).loadedTag; tag != etag {
+		t.Errorf("uploaded etag = %q want %s", tag, etag)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	data := bytes.Repeat([]byte("af3ro"), 3*mib)
+	d := newDigest(data)
+	etag := multipartETag(data, 8*mib)
+	if !d.matches(etag, 8*mib, 8*mib) || !d.matches(etag) {
+		t.Errorf("multipart etag %s didn't match", etag)
+	}
+	// 15MiB in two parts is tried with the exact 7.5MiB, then 8MiB; the
+	// second check hashes nothing new
+	if len(d.etags) != 2 {
+		t.Errorf("hashed %d part sizes, want 2", len(d.etags))
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	if n := partSizeFor(100*mib, 16*mib); n != 16*mib {
+		t.Errorf("partSizeFor(100MiB, 16MiB) = %d want 16MiB", n)
+	}
+	size := int64(maxParts)*16*mib + 1
+	if n := partSizeFor(size, 16*mib); n <= 16*mib || (size+n-1)/n > maxParts {
+		t.Errorf("partSizeFor(%d, 16MiB) = %d, making %d parts", size, n, (size+n-1)/n)
+	}
+}
+
+func TestStreamingWrites(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Multipart(0, 5*mib, 2), StreamingWrites())
+	f := newFile("TestStreamingWrites", mfs, t)
+	defer mfs.Remove(f.Name())
+	chunk := bytes.Repeat([]byte("af3ro"), mib)
+	for i := 0; i < 3; i++ {
+		if _, err := f.Write(chunk); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+	}
+	if _, err := f.Read(make([]byte, 1)); !isStreamingWrite(err) {
+		t.Errorf("Read during upload = %v, want ErrStreamingWrite", err)
+	}
+	if _, err := f.Seek(0, 0); !isStreamingWrite(err) {
+		t.Errorf("Seek during upload = %v, want ErrStreamingWrite", err)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 3*int64(len(chunk)) {
+		t.Errorf("size = %d want %d", fi.Size(), 3*len(chunk))
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+
+	got, err := afero.ReadFile(mfs, f.Name())
+	if err != nil {
+		t.Fatalf("read back %q failed: %v", f.Name(), err)
+	}
+	if !bytes.Equal(got, bytes.Repeat(chunk, 3)) {
+		t.Errorf("read back %d bytes, want %d", len(got), 3*len(chunk))
+	}
+}
+
+func isStreamingWrite(err error) bool {
+	perr, ok := err.(*os.PathError)
+	return ok && perr.Err == ErrStreamingWrite
+}
+
+func TestShardedFile(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Multipart(minPartSize, minPartSize, 2))
+	name := path.Join(testDir, "TestShardedFile")
+	sf, err := mfs.CreateSharded(name, 2*minPartSize+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+
+	if _, err := sf.LockRange(1, minPartSize); !errors.Is(err, ErrRangeAlignment) {
+		t.Errorf("LockRange of an unaligned range = %v, want ErrRangeAlignment", err)
+	}
+	head, err := sf.LockRange(0, minPartSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sf.LockRange(0, 2*minPartSize); !errors.Is(err, ErrRangeLocked) {
+		t.Errorf("LockRange of a locked range = %v, want ErrRangeLocked", err)
+	}
+	tail, err := sf.LockRange(minPartSize, minPartSize+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sf.Finalize(); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("Finalize with locked ranges = %v, want ErrIncomplete", err)
+	}
+
+	want := bytes.Repeat([]byte("sharded!"), (2*minPartSize+3)/8+1)[:2*minPartSize+3]
+	errs := make(chan error, 2)
+	for _, r := range []*FileRange{head, tail} {
+		go func(r *FileRange) {
+			if _, err := r.Write(want[r.Offset() : r.Offset()+int64(len(r.data))]); err != nil {
+				errs <- err
+				return
+			}
+			errs <- r.Close()
+		}(r)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sf.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := afero.ReadFile(mfs, name)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("read back %d bytes, %v, want %d", len(got), err, len(want))
+	}
+}
+
+func TestShardedFileFinalizeRetry(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestShardedFileFinalizeRetry")
+	sf, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Chaos(ChaosConfig{
+		Ops:       []string{"finalize"},
+		ErrorRate: 1,
+	})).CreateSharded(name, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+	r, err := sf.LockRange(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("abc"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sf.Finalize(); !errors.Is(err, ErrInjected) {
+		t.Fatalf("Finalize = %v, want ErrInjected", err)
+	}
+
+	// the chunks are still there to finish the upload with
+	sf.fs = mfs
+	if err := sf.Finalize(); err != nil {
+		t.Fatalf("Finalize again failed: %v", err)
+	}
+	if got, err := afero.ReadFile(mfs, name); err != nil || string(got) != "abc" {
+		t.Errorf("read back %q, %v, want abc", got, err)
+	}
+}
+
+func TestAppender(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestAppender.log")
+	defer mfs.RemoveAll(name)
+	a, err := mfs.NewAppender(name, "pod-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := mfs.NewAppender(name, "pod-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mfs.NewAppender(name, "pods/c"); err == nil {
+		t.Error("NewAppender accepted a writer containing /")
+	}
+	for i, w := range []io.Writer{a, b, a, b} {
+		if _, err := fmt.Fprintf(w, "line %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := mfs.OpenAppended(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if want := "line 0\nline 1\nline 2\nline 3\n"; err != nil || string(got) != want {
+		t.Errorf("read back %q, %v, want %q", got, err, want)
+	}
+
+	// segments are transformed back as they were written, one at a time
+	encoded := name + "-encoded"
+	defer mfs.RemoveAll(encoded)
+	xfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(),
+		TransformWrites(encoded, func(_ string, data []byte) ([]byte, error) {
+			return []byte(base64.StdEncoding.EncodeToString(data)), nil
+		}),
+		TransformReads(encoded, func(_ string, data []byte) ([]byte, error) {
+			return base64.StdEncoding.DecodeString(string(data))
+		}))
+	x, _ := xfs.NewAppender(encoded, "pod-x")
+	for _, line := range []string{"line 4\n", "line 5\n"} {
+		x.Write([]byte(line))
+	}
+	r, _ = xfs.OpenAppended(encoded)
+	got, err = ioutil.ReadAll(r)
+	if want := "line 4\nline 5\n"; err != nil || string(got) != want {
+		t.Errorf("read back through transforms %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f := newFile("TestSnapshot", mfs, t)
+	defer mfs.Remove(f.Name())
+	f.WriteString("before")
+	f.Close()
+
+	dst, err := mfs.Snapshot("test.rsb.io", f.Name())
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	copied := path.Join(dst, mfs.key(f.Name()))
+	defer mfs.Remove(copied)
+
+	f, _ = mfs.Create(f.Name())
+	f.WriteString("after")
+	f.Close()
+
+	got, err := afero.ReadFile(mfs, copied)
+	if err != nil {
+		t.Fatalf("reading snapshot failed: %v", err)
+	}
+	if string(got) != "before" {
+		t.Errorf("snapshot holds %q, want %q", got, "before")
+	}
+}
+
+func TestSnapshotSkipsItself(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock), ListPageSize(1))
+	for _, name := range []string{"/2001/a", "/2001/b"} {
+		if err := afero.WriteFile(mfs, name, []byte("a"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer mfs.RemoveAll("/2001")
+
+	// the snapshot is made under 20010203T040506Z/, which "2001" covers
+	dst, err := mfs.Snapshot("test.rsb.io", "/2001")
+	defer mfs.RemoveAll("/" + dst)
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	var copied []string
+	mfs.eachKey("test", dst, func(k s3.Key) error {
+		copied = append(copied, k.Key)
+		return nil
+	})
+	if want := []string{dst + "2001/a", dst + "2001/b"}; strings.Join(copied, " ") != strings.Join(want, " ") {
+		t.Errorf("snapshot copied %q want %q", copied, want)
+	}
+}
+
+func TestReaddirListsBucket(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestReaddirListsBucket")
+	if err := mfs.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	// written by another client, so only S3 knows about it
+	name := path.Join(dir, "elsewhere")
+	if err := mfs.bucket().Put(name, []byte("hello"), "text/plain", s3.Private, s3.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+
+	d, err := mfs.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fis, err := d.Readdir(0)
+	if err != nil {
+		t.Fatalf("readdir failed: %v", err)
+	}
+	if len(fis) != 1 || fis[0].Name() != name || fis[0].Size() != 5 {
+		t.Fatalf("readdir = %v, want %s of 5 bytes", fis, name)
+	}
+}
+
+func TestSaveCache(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f := newFile("TestSaveCache", mfs, t)
+	defer mfs.Remove(f.Name())
+	f.WriteString("cached")
+	f.Close()
+	mfs.Stat(f.Name())
+
+	var buf bytes.Buffer
+	if err := mfs.SaveCache(&buf); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	var requests int
+	loaded := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Metrics(RecorderFunc(func(m Metric) {
+		if m.Kind == CacheMiss {
+			requests++
+		}
+	})))
+	if err := loaded.LoadCache(&buf); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	fi, err := loaded.Stat(f.Name())
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if fi.Size() != 6 {
+		t.Errorf("size = %d want 6", fi.Size())
+	}
+	if requests != 0 {
+		t.Errorf("%d cache misses after loading the cache", requests)
+	}
+
+	// files keep their age, and HEADs the bound on how many are kept
+	state := cacheState{Files: []fileState{{Name: f.Name(), Size: 6, At: time.Now()}}}
+	for i := 0; i <= maxHeadEntries; i++ {
+		state.Heads = append(state.Heads, headState{Name: strconv.Itoa(i), Header: http.Header{}, At: time.Now()})
+	}
+	buf.Reset()
+	json.NewEncoder(&buf).Encode(state)
+	aged := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), CacheTTL(time.Minute),
+		TimeSource(&fakeClock{now: time.Now().Add(2 * time.Minute)}))
+	if err := aged.LoadCache(&buf); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !aged.expire(f.Name()) {
+		t.Errorf("file saved two minutes ago outlived a CacheTTL of one after loading")
+	}
+	if n := len(aged.heads.entries); n > maxHeadEntries {
+		t.Errorf("loaded %d HEAD responses, want at most %d", n, maxHeadEntries)
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestRemoveAll")
+	names := []string{"a", "b/c", "b/d/e"}
+	for _, name := range names {
+		f, err := mfs.Create(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(name)
+		f.Close()
+	}
+	sibling := newFile("TestRemoveAllSibling", mfs, t)
+	sibling.Close()
+	defer mfs.Remove(sibling.Name())
+
+	if err := mfs.RemoveAll(dir); err != nil {
+		t.Fatalf("removeall failed: %v", err)
+	}
+	for _, name := range names {
+		if _, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", name, err)
+		}
+	}
+	if _, err := mfs.Stat(sibling.Name()); err != nil {
+		t.Errorf("removed %s as well: %v", sibling.Name(), err)
+	}
+}
+
+func TestRemoveAllPages(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ListPageSize(2))
+	dir := path.Join(testDir, "TestRemoveAllPages")
+	for i := 0; i < 5; i++ {
+		f, err := mfs.Create(path.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	if err := mfs.RemoveAll(dir); err != nil {
+		t.Fatalf("removeall failed: %v", err)
+	}
+	resp, err := mfs.bucket().List(mfs.dirPrefix(dir), "", "", 0)
+	if err != nil || len(resp.Contents) != 0 {
+		t.Errorf("after removing three pages: listed %v, %v want nothing", resp, err)
+	}
+}
+
+func TestReaddirCount(t *testing.T) {
+	var listings int32
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PrefixCacheTTL(0), Metrics(RecorderFunc(func(m Metric) {
+		if m.Kind == CacheMiss && m.Cache == PrefixCache {
+			atomic.AddInt32(&listings, 1)
+		}
+	})))
+	dir := path.Join(testDir, "TestReaddirCount")
+	names := []string{"a", "b", "c", "d/e"}
+	for _, name := range names {
+		f, _ := mfs.Create(path.Join(dir, name))
+		f.Close()
+	}
+	defer mfs.RemoveAll(dir)
+
+	d, err := mfs.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&listings, 0)
+	var got []string
+	for calls := 0; ; calls++ {
+		if calls > len(names) {
+			t.Fatalf("no io.EOF after %d calls", calls)
+		}
+		infos, err := d.Readdir(2)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("readdir failed: %v", err)
+		}
+		for _, fi := range infos {
+			got = append(got, path.Base(fi.Name()))
+		}
+	}
+	if want := "a b c d"; strings.Join(got, " ") != want {
+		t.Errorf("listed %v, want %s", got, want)
+	}
+	if n := atomic.LoadInt32(&listings); n != 1 {
+		t.Errorf("paging listed the directory %d times, want once", n)
+	}
+
+	d, _ = mfs.Open(dir)
+	if names, err := d.Readdirnames(-1); len(names) != 4 || err != nil {
+		t.Errorf("after reopening: Readdirnames(-1) = %v, %v want 4 names", names, err)
+	}
+}
+
+func TestReaddirPage(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestReaddirPage")
+	names := []string{"a", "b", "c", "d/e"}
+	for _, name := range names {
+		f, _ := mfs.Create(path.Join(dir, name))
+		f.Close()
+	}
+	defer mfs.RemoveAll(dir)
+
+	d, err := mfs.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	marker := ""
+	for pages := 0; ; pages++ {
+		if pages > len(names) {
+			t.Fatalf("still paging after %d pages", pages)
+		}
+		infos, next, err := d.(PaginatedReaddir).ReaddirPage(marker, 2)
+		if err != nil {
+			t.Fatalf("readdir page failed: %v", err)
+		}
+		if len(infos) > 2 {
+			t.Errorf("page of %d entries, want at most 2", len(infos))
+		}
+		for _, fi := range infos {
+			got = append(got, path.Base(fi.Name()))
+		}
+		if next == "" {
+			break
+		}
+		marker = next
+	}
+	if want := "a b c d"; strings.Join(got, " ") != want {
+		t.Errorf("listed %v, want %s", got, want)
+	}
+}
+
+func TestParseAccessLogLine(t *testing.T) {
+	line := `79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be test.rsb.io ` +
+		`[06/Feb/2019:00:00:38 +0000] 192.0.2.3 ` +
+		`79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be 3E57427F3EXAMPLE ` +
+		`REST.GET.OBJECT af3ro_tests/some%20file.txt "GET /af3ro_tests/some%20file.txt HTTP/1.1" ` +
+		`200 - 113 113 7 6 "-" "S3Console/0.4" - s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234=`
+	e, err := ParseAccessLogLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AccessEvent{
+		Time:      time.Date(2019, 2, 6, 0, 0, 38, 0, time.UTC),
+		Bucket:    "test.rsb.io",
+		Key:       "af3ro_tests/some file.txt",
+		Operation: "REST.GET.OBJECT",
+		Requester: "79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be",
+		RemoteIP:  "192.0.2.3",
+		RequestID: "3E57427F3EXAMPLE",
+		Status:    200,
+		BytesSent: 113,
+	}
+	if !e.Time.Equal(want.Time) {
+		t.Errorf("time = %v want %v", e.Time, want.Time)
+	}
+	e.Time = want.Time
+	if e != want {
+		t.Errorf("parsed %+v\nwant %+v", e, want)
+	}
+}
+
+func TestStatUncached(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestStatUncached")
+	name := path.Join(dir, "elsewhere")
+	if err := mfs.bucket().Put(name, []byte("hello"), "text/plain", s3.Private, s3.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+
+	fi, err := mfs.Stat(name)
+	if err != nil {
+		t.Fatalf("stat %s failed: %v", name, err)
+	}
+	if fi.Size() != 5 || fi.ModTime().IsZero() || fi.IsDir() {
+		t.Errorf("stat %s = size %d, modtime %v, dir %v", name, fi.Size(), fi.ModTime(), fi.IsDir())
+	}
+	if etag := fi.(*InMemoryFileInfo).ETag(); etag != md5ETag([]byte("hello")) {
+		t.Errorf("etag = %q want %q", etag, md5ETag([]byte("hello")))
+	}
+	fi, err = NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Stat(dir)
+	if err != nil || !fi.IsDir() {
+		t.Errorf("stat %s = %v, %v, want a directory", dir, fi, err)
+	}
+}
+
+func TestShadow(t *testing.T) {
+	var shadowed []Metric
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(),
+		Shadow(ShadowConfig{
+			Bucket: "test.rsb.io",
+			Key:    func(key string) string { return "shadow/" + key },
+			Rate:   1,
+		}),
+		Metrics(RecorderFunc(func(m Metric) {
+			if m.Kind == ShadowWrite {
+				shadowed = append(shadowed, m)
+			}
+		})))
+	f := newFile("TestShadow", mfs, t)
+	defer mfs.Remove(f.Name())
+	f.WriteString("shadowed")
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+	copied := "shadow/" + mfs.key(f.Name())
+	defer mfs.Remove(copied)
+
+	if len(shadowed) != 1 || shadowed[0].Err != nil {
+		t.Fatalf("recorded shadow writes %+v, want one that succeeded", shadowed)
+	}
+	got, err := afero.ReadFile(NewS3Fs(Bucket("test.rsb.io"), EnvAuth()), copied)
+	if err != nil || string(got) != "shadowed" {
+		t.Errorf("shadow copy holds %q, %v, want %q", got, err, "shadowed")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	idx := NewMemIndex()
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Index(idx))
+	f := newFile("TestIndex.txt", mfs, t)
+	f.WriteString("indexed")
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+	key := mfs.key(f.Name())
+
+	found, err := mfs.Search(IndexQuery{Prefix: path.Dir(key), ContentType: "text/plain; charset=utf-8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Key != key || found[0].Size != 7 {
+		t.Fatalf("Search found %+v, want %s of 7 bytes", found, key)
+	}
+	if found, _ := mfs.Search(IndexQuery{Prefix: key, MinSize: 8}); len(found) != 0 {
+		t.Errorf("Search by size found %+v, want nothing", found)
+	}
+
+	var saved bytes.Buffer
+	if err := idx.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := mfs.Search(IndexQuery{Prefix: key}); len(found) != 0 {
+		t.Errorf("Search after Remove found %+v", found)
+	}
+	if err := idx.Load(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := mfs.Search(IndexQuery{Prefix: key}); len(found) != 1 {
+		t.Errorf("Search after Load found %+v, want %s", found, key)
+	}
+
+	if _, err := NewS3Fs(Bucket("test.rsb.io")).Search(IndexQuery{}); err != ErrNoIndex {
+		t.Errorf("Search without an index = %v, want ErrNoIndex", err)
+	}
+}
+
+func TestIndexFailedRemove(t *testing.T) {
+	idx := NewMemIndex()
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Index(idx))
+	f := newFile("TestIndexFailedRemove.txt", mfs, t)
+	f.Close()
+	defer mfs.Remove(f.Name())
+	key := mfs.key(f.Name())
+
+	chaotic := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Index(idx), Chaos(ChaosConfig{
+		Ops:       []string{"remove"},
+		ErrorRate: 1,
+	}))
+	if _, err := chaotic.RemoveResult(f.Name()); !errors.Is(err, ErrInjected) {
+		t.Fatalf("remove = %v, want ErrInjected", err)
+	}
+	if found, _ := mfs.Search(IndexQuery{Prefix: key}); len(found) != 1 {
+		t.Errorf("Search after a failed Remove found %+v, want %s", found, key)
+	}
+}
+
+func TestVerifyReads(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f := newFile("TestVerifyReads", mfs, t)
+	defer mfs.Remove(f.Name())
+	f.WriteString("checked on the way down")
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+
+	var mismatches int
+	corrupt := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), VerifyReads(2),
+		Chaos(ChaosConfig{Ops: []string{"read"}, TruncateRate: 1}),
+		Metrics(RecorderFunc(func(m Metric) {
+			if m.Kind == ChecksumMismatch {
+				mismatches++
+			}
+		})))
+	if _, err := afero.ReadFile(corrupt, f.Name()); !errors.Is(err, ErrChecksum) {
+		t.Errorf("reading a corrupt download = %v, want ErrChecksum", err)
+	}
+	if mismatches != 3 {
+		t.Errorf("recorded %d mismatches, want 3", mismatches)
+	}
+
+	truncated := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(),
+		Chaos(ChaosConfig{Ops: []string{"read"}, TruncateRate: 1}))
+	if _, err := afero.ReadFile(truncated, f.Name()); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("reading a truncated download = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	truncated.chaos = nil
+	if got, err := afero.ReadFile(truncated, f.Name()); err != nil || string(got) != "checked on the way down" {
+		t.Errorf("after a truncated download: read back %q, %v", got, err)
+	}
+
+	// each download draws once to fail and once to truncate, so the
+	// first two are cut short
+	mismatches = 0
+	flaky := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), VerifyReads(50), RandSource(&fakeRand{zeros: 4}),
+		Chaos(ChaosConfig{Ops: []string{"read"}, TruncateRate: 0.5}),
+		Metrics(RecorderFunc(func(m Metric) {
+			if m.Kind == ChecksumMismatch {
+				mismatches++
+			}
+		})))
+	got, err := afero.ReadFile(flaky, f.Name())
+	if err != nil || string(got) != "checked on the way down" {
+		t.Errorf("read back %q, %v after retries", got, err)
+	}
+	if mismatches != 2 {
+		t.Errorf("recorded %d mismatches, want 2", mismatches)
+	}
+}
+
+func TestReEncryptPrefix(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestReEncryptPrefix")
+	for i := 0; i < 5; i++ {
+		f, _ := mfs.Create(path.Join(dir, strconv.Itoa(i)))
+		f.WriteString("secret")
+		f.Close()
+	}
+	defer mfs.RemoveAll(dir)
+
+	var last BulkProgress
+	err := mfs.ReEncryptPrefix(dir+"/", "alias/af3ro-test", &BulkOptions{
+		Concurrency: 2,
+		StartAfter:  mfs.key(path.Join(dir, "0")),
+		Progress:    func(p BulkProgress) { last = p },
+	})
+	if err != nil {
+		t.Fatalf("reencrypt failed: %v", err)
+	}
+	if last.Done != 4 || last.Checkpoint != mfs.key(path.Join(dir, "4")) {
+		t.Errorf("final progress %+v, want 4 done up to %s", last, path.Join(dir, "4"))
+	}
+	for i := 0; i < 5; i++ {
+		resp, err := mfs.head(path.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyID := resp.Header.Get("x-amz-server-side-encryption-aws-kms-key-id")
+		if want := i > 0; (keyID == "alias/af3ro-test") != want {
+			t.Errorf("%d: encrypted with %q", i, keyID)
+		}
+	}
+}
+
+func TestCreateContextCancel(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Multipart(0, 5*mib, 2), StreamingWrites())
+	ctx, cancel := context.WithCancel(context.Background())
+	name := path.Join(testDir, "TestCreateContextCancel")
+	f, err := mfs.CreateContext(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+	if _, err := f.Write(bytes.Repeat([]byte("af3ro"), mib)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	cancel()
+
+	var werr error
+	for i := 0; i < 100 && werr == nil; i++ {
+		_, werr = f.Write([]byte("more"))
+		time.Sleep(time.Millisecond)
+	}
+	if !errors.Is(werr, context.Canceled) {
+		t.Errorf("write after cancel = %v, want context.Canceled", werr)
+	}
+	if err := f.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("close after cancel = %v, want context.Canceled", err)
+	}
+	if _, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Stat(name); !os.IsNotExist(err) {
+		t.Errorf("stat after cancelled upload = %v, want not exist", err)
+	}
+}
+
+func TestTransitionPrefix(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestTransitionPrefix")
+	for name, data := range map[string]string{"small": "x", "large": "xxxxxxxxxx"} {
+		f, _ := mfs.Create(path.Join(dir, name))
+		f.WriteString(data)
+		f.Close()
+	}
+	defer mfs.RemoveAll(dir)
+
+	err := mfs.TransitionPrefix(dir+"/", s3.ReducedRedundancy, TransitionFilter{MinSize: 5}, nil)
+	if err != nil {
+		t.Fatalf("transition failed: %v", err)
+	}
+	for name, want := range map[string]string{"small": "", "large": "REDUCED_REDUNDANCY"} {
+		resp, err := mfs.head(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("x-amz-storage-class"); got != want && !(got == "STANDARD" && want == "") {
+			t.Errorf("%s: storage class %q want %q", name, got, want)
+		}
+	}
+}
+
+func TestLocationRegion(t *testing.T) {
+	for loc, want := range map[string]string{
+		"":           "us-east-1",
+		"EU":         "eu-west-1",
+		"us-west-2":  "us-west-2",
+		"ap-south-2": "ap-south-2",
+	} {
+		if got := locationRegion(loc); got.Name != want {
+			t.Errorf("locationRegion(%q) = %s, want %s", loc, got.Name, want)
+		}
+	}
+}
+
+func TestVerifyBucket(t *testing.T) {
+	if _, err := New(Bucket("test.rsb.io"), EnvAuth(), VerifyBucket()); err != nil {
+		t.Errorf("New with an existing bucket: %v", err)
+	}
+	missing := "af3ro-missing-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := New(Bucket(missing), EnvAuth(), VerifyBucket()); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("New with a missing bucket = %v, want ErrBucketNotFound", err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	root := path.Join(testDir, "TestPrefix")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Prefix(root))
+	plain := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	defer plain.RemoveAll(root)
+
+	if err := afero.WriteFile(mfs, "/../../a.txt", []byte("scoped"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	got, err := afero.ReadFile(plain, path.Join(root, "a.txt"))
+	if err != nil || string(got) != "scoped" {
+		t.Errorf("read back %q, %v from under the prefix", got, err)
+	}
+	if got, err := afero.ReadFile(NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Prefix(root)), "a.txt"); err != nil || string(got) != "scoped" {
+		t.Errorf("read back %q, %v through a fresh filesystem", got, err)
+	}
+	if want := "MemS3Fs: s3://test.rsb.io/" + mfs.root + " (us-east-1)"; mfs.Name() != want {
+		t.Errorf("Name() = %q, want %q", mfs.Name(), want)
+	}
+}
+
+func TestSub(t *testing.T) {
+	root := path.Join(testDir, "TestSub")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	defer mfs.RemoveAll(root)
+	sub := Sub(mfs, root)
+
+	if err := afero.WriteFile(sub, "a/../b.txt", []byte("inside"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := afero.ReadFile(mfs, path.Join(root, "b.txt")); err != nil || string(got) != "inside" {
+		t.Errorf("read back %q, %v from under the root", got, err)
+	}
+	for _, name := range []string{"../b.txt", "a/../../b.txt", "/b.txt", ".."} {
+		if _, err := sub.Stat(name); !errors.Is(err, ErrPathEscapes) {
+			t.Errorf("Stat(%q) = %v, want ErrPathEscapes", name, err)
+		}
+	}
+	if err := sub.Rename("b.txt", "../c.txt"); !errors.Is(err, ErrPathEscapes) {
+		t.Errorf("Rename out of the root = %v, want ErrPathEscapes", err)
+	}
+	if err := sub.Symlink("../../b.txt", "a/l"); !errors.Is(err, ErrPathEscapes) {
+		t.Errorf("Symlink out of the root = %v, want ErrPathEscapes", err)
+	}
+	if err := sub.RemoveAll("."); err == nil {
+		t.Error("RemoveAll of the root succeeded")
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		codec  MarkerCodec
+		marker string
+		links  bool
+	}{
+		{"s3fs", S3FSMarkers, "d/", true},
+		{"goofys", GoofysMarkers, "d/", true},
+		{"s3n", S3NMarkers, "d_$folder$", false},
+	} {
+		root := path.Join(testDir, "TestMarkers", c.name)
+		mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Markers(c.codec))
+		if err := mfs.Mkdir(path.Join(root, "d"), 0755); err != nil {
+			t.Fatalf("%s: Mkdir: %v", c.name, err)
+		}
+		if _, err := fetchObject(mfs.key(root)+"/"+c.marker, mfs.bucket()); err != nil {
+			t.Errorf("%s: marker %q: %v", c.name, c.marker, err)
+		}
+		fresh := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Markers(c.codec))
+		if fi, err := fresh.Stat(path.Join(root, "d")); err != nil || !fi.IsDir() {
+			t.Errorf("%s: Stat of the empty directory = %v, %v", c.name, fi, err)
+		}
+		if names, err := afero.ReadDir(fresh, root); err != nil || len(names) != 1 || !names[0].IsDir() {
+			t.Errorf("%s: ReadDir = %v, %v want just d", c.name, names, err)
+		}
+
+		afero.WriteFile(mfs, path.Join(root, "d", "f"), []byte("target"), 0640)
+		err := mfs.Symlink("d/f", path.Join(root, "l"))
+		if !c.links {
+			if !errors.Is(err, ErrNoLinks) {
+				t.Errorf("%s: Symlink = %v want ErrNoLinks", c.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: Symlink: %v", c.name, err)
+		} else {
+			if got, err := afero.ReadFile(fresh, path.Join(root, "l")); string(got) != "target" {
+				t.Errorf("%s: read through link = %q, %v want %q", c.name, got, err, "target")
+			}
+			if target, err := fresh.Readlink(path.Join(root, "l")); target != "d/f" {
+				t.Errorf("%s: Readlink = %q, %v want %q", c.name, target, err, "d/f")
+			}
+		}
+
+		if err := mfs.RemoveAll(root); err != nil {
+			t.Fatalf("%s: RemoveAll: %v", c.name, err)
+		}
+		if _, err := fetchObject(mfs.key(root)+"/"+c.marker, mfs.bucket()); err == nil {
+			t.Errorf("%s: marker %q survived RemoveAll", c.name, c.marker)
+		}
+	}
+}
+
+func TestS3ACompat(t *testing.T) {
+	root := path.Join(testDir, "TestS3ACompat")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), S3ACompat())
+	defer mfs.RemoveAll(root)
+	mfs.MkdirAll(path.Join(root, "out"), 0755)
+	afero.WriteFile(mfs, path.Join(root, "in", "part-0"), []byte("row"), 0640)
+
+	if err := mfs.Rename(path.Join(root, "in", "part-0"), path.Join(root, "out")); err != nil {
+		t.Fatalf("Rename onto a directory: %v", err)
+	}
+	if got, err := afero.ReadFile(mfs, path.Join(root, "out", "part-0")); string(got) != "row" {
+		t.Errorf("after Rename onto a directory: read %q, %v want %q", got, err, "row")
+	}
+	fresh := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), S3ACompat())
+	if fi, err := fresh.Stat(path.Join(root, "in")); err != nil || !fi.IsDir() {
+		t.Errorf("emptied directory: Stat = %v, %v want a directory", fi, err)
+	}
+	if err := mfs.Rename(path.Join(root, "out", "part-0"), path.Join(root, "missing", "part-0")); !os.IsNotExist(err) {
+		t.Errorf("Rename under a missing directory = %v want not-exist", err)
+	}
+	if err := mfs.Rename(path.Join(root, "out"), path.Join(root, "out", "sub")); err == nil {
+		t.Error("Rename of a directory into itself succeeded")
+	}
+	afero.WriteFile(mfs, path.Join(root, "out", "part-1"), []byte("other"), 0640)
+	if err := mfs.Rename(path.Join(root, "out", "part-0"), path.Join(root, "out", "part-1")); !os.IsExist(err) {
+		t.Errorf("Rename onto a file = %v want exists", err)
+	}
+	if got, _ := afero.ReadFile(mfs, path.Join(root, "out", "part-1")); string(got) != "other" {
+		t.Errorf("after Rename onto a file: read %q want %q", got, "other")
+	}
+}
+
+func TestParquetFooter(t *testing.T) {
+	name := path.Join(testDir, "TestParquetFooter")
+	defer fs.Remove(name)
+	for _, footer := range []string{"footer", strings.Repeat("big footer", 10000)} {
+		data := append([]byte("PAR1column chunks"), footer...)
+		data = append(data, byte(len(footer)), byte(len(footer)>>8), byte(len(footer)>>16), 0)
+		data = append(data, "PAR1"...)
+		if err := afero.WriteFile(fs, name, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fs.ParquetFooter(name); string(got) != footer {
+			t.Errorf("ParquetFooter() = %.20q, %v want %.20q", got, err, footer)
+		}
+	}
+	spans, err := fs.ReadSpans(name, []Span{{4, 6}, {11, 6}, {0, 4}, {1 << 20, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"column", "chunks", "PAR1", ""} {
+		if string(spans[i]) != want {
+			t.Errorf("ReadSpans()[%d] = %q want %q", i, spans[i], want)
+		}
+	}
+
+	afero.WriteFile(fs, name, []byte("a,b\n1,2\n"), 0640)
+	if got, err := fs.Tail(name, 4); string(got) != "1,2\n" {
+		t.Errorf("Tail(4) = %q, %v want %q", got, err, "1,2\n")
+	}
+	if _, err := fs.ParquetFooter(name); !errors.Is(err, ErrNotParquet) {
+		t.Errorf("ParquetFooter of a CSV = %v want ErrNotParquet", err)
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	root := path.Join(testDir, "TestShuffle")
+	defer fs.RemoveAll(root)
+	want := make(map[string]bool)
+	for shard := 0; shard < 5; shard++ {
+		var lines []string
+		for rec := 0; rec < 20; rec++ {
+			line := fmt.Sprintf("%d-%d", shard, rec)
+			lines = append(lines, line)
+			want[line] = true
+		}
+		afero.WriteFile(fs, path.Join(root, fmt.Sprintf("shard-%d", shard)), []byte(strings.Join(lines, "\n")), 0640)
+	}
+
+	r := fs.Shuffle(context.Background(), root+"/", ShuffleOptions{Workers: 2, Buffer: 30})
+	defer r.Close()
+	var got []string
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !want[string(rec)] {
+			t.Errorf("unexpected or repeated record %q", rec)
+		}
+		delete(want, string(rec))
+		got = append(got, string(rec))
+	}
+	if len(want) != 0 {
+		t.Errorf("%d records missing", len(want))
+	}
+	if sort.StringsAreSorted(got) {
+		t.Error("records came back in order")
+	}
+}
+
+func TestRecordWriter(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Multipart(0, 5*mib, 2))
+	name := path.Join(testDir, "TestRecordWriter")
+	defer mfs.Remove(name)
+	w := mfs.CreateRecords(name)
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				rec := bytes.Repeat([]byte(fmt.Sprintf("%d-%d;", p, i)), 10000)
+				if err := w.WriteRecord(rec); err != nil {
+					t.Error(err)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	w.WriteRecord(nil)
+	if err := w.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", name, err)
+	}
+	if err := w.WriteRecord([]byte("late")); err == nil {
+		t.Error("WriteRecord after Close succeeded")
+	}
+
+	f, err := mfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	scan.Buffer(nil, 1<<20)
+	scan.Split(ScanRecords)
+	seen := make(map[string]bool)
+	for scan.Scan() {
+		rec := scan.Bytes()
+		if len(rec) == 0 {
+			seen[""] = true
+			continue
+		}
+		first := string(rec[:bytes.IndexByte(rec, ';')+1])
+		if !bytes.Equal(rec, bytes.Repeat([]byte(first), 10000)) {
+			t.Fatalf("record starting %q is corrupt", first)
+		}
+		seen[first] = true
+	}
+	if err := scan.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 201 || int64(len(seen)) != w.Records() {
+		t.Errorf("read %d distinct records, wrote %d want 201", len(seen), w.Records())
+	}
+}
+
+func TestPartitionedWriter(t *testing.T) {
+	root := path.Join(testDir, "TestPartitionedWriter")
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock))
+	defer mfs.RemoveAll(root)
+	w := mfs.CreatePartitioned(root, PartitionOptions{MaxAge: time.Minute, MaxSize: 100, ID: "test"})
+
+	w.WriteRecord([]byte("a"))
+	w.WriteRecord([]byte("b"))
+	clock.now = clock.now.Add(2 * time.Minute)
+	w.WriteRecord([]byte("c")) // the batch is now old enough
+	clock.now = clock.now.Add(time.Hour)
+	w.WriteRecord(bytes.Repeat([]byte("d"), 100)) // and this one big enough
+	w.WriteRecord([]byte("e"))
+	w.WriteRecordAt(time.Date(2001, 2, 3, 3, 0, 0, 0, time.UTC), []byte("late"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := func(dir string) (recs []string) {
+		resp, err := mfs.bucket().List(mfs.keyPrefix(path.Join(root, dir))+"/", "", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range resp.Contents {
+			if !strings.HasPrefix(path.Base(k.Key), "test-") {
+				t.Errorf("object %q isn't named for the writer", k.Key)
+			}
+			data, _ := fetchObject(k.Key, mfs.bucket())
+			scan := bufio.NewScanner(bytes.NewReader(data))
+			scan.Split(ScanRecords)
+			for scan.Scan() {
+				recs = append(recs, scan.Text())
+			}
+			recs = append(recs, "|")
+		}
+		return recs
+	}
+	for dir, want := range map[string]string{
+		"2001/02/03/03": "late|",
+		"2001/02/03/04": "abc|",
+		"2001/02/03/05": strings.Repeat("d", 100) + "|e|",
+	} {
+		if got := strings.Join(records(dir), ""); got != want {
+			t.Errorf("%s holds %q want %q", dir, got, want)
+		}
+	}
+
+	failing := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), FlushRetries(0), Chaos(ChaosConfig{
+		Ops:       []string{"write"},
+		ErrorRate: 1,
+	}))
+	w = failing.CreatePartitioned(path.Join(root, "retried"), PartitionOptions{})
+	w.WriteRecord([]byte("kept"))
+	if err := w.Flush(); !errors.Is(err, ErrInjected) {
+		t.Errorf("Flush = %v want %v", err, ErrInjected)
+	}
+	failing.chaos.ErrorRate = 0
+	if err := w.Close(); err != nil {
+		t.Fatalf("retrying failed batch: %v", err)
+	}
+	resp, err := failing.bucket().List(failing.keyPrefix(path.Join(root, "retried"))+"/", "", "", 0)
+	if err != nil || len(resp.Contents) != 1 {
+		t.Errorf("after retrying: listed %v, %v want 1 object", resp, err)
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), StorageClass(StandardIA))
+	name := path.Join(testDir, "TestStorageClass")
+	defer mfs.RemoveAll(name)
+	class := func(name string) string {
+		resp, err := mfs.bucket().Head(mfs.key(name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Header.Get("x-amz-storage-class")
+	}
+
+	if err := afero.WriteFile(mfs, name+"/a", []byte("warm"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if got := class(name + "/a"); got != "STANDARD_IA" {
+		t.Errorf("uploaded in %q, want STANDARD_IA", got)
+	}
+
+	f, _ := mfs.Create(name + "/b")
+	f.(StorageClassFile).SetStorageClass(GlacierIR)
+	f.WriteString("cold")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := class(name + "/b"); got != "GLACIER_IR" {
+		t.Errorf("overridden upload in %q, want GLACIER_IR", got)
+	}
+	if err := mfs.Rename(name+"/b", name+"/c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := class(name + "/c"); got != "GLACIER_IR" {
+		t.Errorf("renamed into %q, want GLACIER_IR", got)
+	}
+	if _, err := mfs.Copy(name+"/a", name+"/d"); err != nil {
+		t.Fatal(err)
+	}
+	if got := class(name + "/d"); got != "STANDARD_IA" {
+		t.Errorf("copied into %q, want STANDARD_IA", got)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(),
+		HeaderRule("*.css", Headers{CacheControl: "max-age=3600"}),
+		HeaderRule("/af3ro_tests/*/downloads/*", Headers{ContentDisposition: "attachment"}))
+	name := path.Join(testDir, "TestHeaders")
+	defer mfs.RemoveAll(name)
+	head := func(name string) http.Header {
+		resp, err := mfs.bucket().Head(mfs.key(name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Header
+	}
+
+	if err := afero.WriteFile(mfs, name+"/site.css", []byte("body{}"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if got := head(name + "/site.css").Get("Cache-Control"); got != "max-age=3600" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	f, _ := mfs.Create(name + "/downloads/report.css")
+	f.(HeadersFile).SetHeaders(Headers{CacheControl: "no-cache", Expires: expires})
+	f.WriteString("body{}")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h := head(name + "/downloads/report.css")
+	if h.Get("Cache-Control") != "no-cache" || h.Get("Content-Disposition") != "attachment" ||
+		h.Get("Expires") != expires.Format(http.TimeFormat) || !strings.HasPrefix(h.Get("Content-Type"), "text/css") {
+		t.Errorf("headers = %v", h)
+	}
+
+	// and with a multipart upload
+	large := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Multipart(minPartSize, minPartSize, 2))
+	f, _ = large.Create(name + "/large.css")
+	f.(HeadersFile).SetHeaders(Headers{Expires: expires})
+	f.Write(make([]byte, minPartSize+1))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := head(name + "/large.css").Get("Expires"); got != expires.Format(http.TimeFormat) {
+		t.Errorf("multipart upload's Expires = %q", got)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	region := NewS3Fs(Endpoint("http://localhost:9000/")).endpointRegion()
+	if region.S3Endpoint != "http://localhost:9000" || region.S3BucketEndpoint != "http://${bucket}.localhost:9000" {
+		t.Errorf("virtual-hosted region = %+v", region)
+	}
+	region = NewS3Fs(Endpoint("http://localhost:9000"), PathStyle()).endpointRegion()
+	if region.S3Endpoint != "http://localhost:9000" || region.S3BucketEndpoint != "" {
+		t.Errorf("path-style region = %+v", region)
+	}
+}
+
+func TestContentInfo(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestContentInfo")
+	if err := afero.WriteFile(mfs, name, []byte("identity"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+	fi, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, ok := fi.(ContentInfo)
+	if !ok {
+		t.Fatalf("%T isn't a ContentInfo", fi)
+	}
+	sum := md5.Sum([]byte("identity"))
+	if algo, value := ci.Checksum(); algo != "md5" || !bytes.Equal(value, sum[:]) || ci.ETag() != md5ETag([]byte("identity")) {
+		t.Errorf("Checksum() = %s %x, ETag() = %s", algo, value, ci.ETag())
+	}
+
+	header := http.Header{}
+	header.Set("ETag", `"abc-2"`)
+	header.Set("x-amz-checksum-crc32", "AAAAAQ==")
+	if algo, value := contentChecksum(header); algo != "crc32" || !bytes.Equal(value, []byte{0, 0, 0, 1}) {
+		t.Errorf("contentChecksum = %s %x, want crc32 00000001", algo, value)
+	}
+	header.Set("x-amz-checksum-crc32", "AAAAAQ==-2")
+	if algo, _ := contentChecksum(header); algo != "" {
+		t.Errorf("contentChecksum of a multipart object's parts = %s", algo)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestXattr")
+	if err := afero.WriteFile(mfs, name, []byte("tagged"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+
+	open := func() XattrFile {
+		f, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.(XattrFile)
+	}
+	f := open()
+	if _, err := f.GetXattr("owner"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("GetXattr of a missing attribute = %v, want ErrNoXattr", err)
+	}
+	f.SetXattr("Owner", "alice")
+	f.SetXattr("team", "data")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f = open()
+	if names, err := f.ListXattr(); err != nil || strings.Join(names, ",") != "owner,team" {
+		t.Errorf("ListXattr = %v, %v", names, err)
+	}
+	if v, err := f.GetXattr("OWNER"); err != nil || v != "alice" {
+		t.Errorf("GetXattr = %q, %v", v, err)
+	}
+	f.RemoveXattr("team")
+	f.Write([]byte("retagged"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f = open()
+	if names, _ := f.ListXattr(); strings.Join(names, ",") != "owner" {
+		t.Errorf("attributes after rewriting = %v, want [owner]", names)
+	}
+	if got, _ := afero.ReadAll(f); string(got) != "retagged" {
+		t.Errorf("contents = %q", got)
+	}
+}
+
+func TestOpenMeta(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestOpenMeta")
+	defer mfs.RemoveAll(dir)
+	if err := afero.WriteFile(mfs, dir+"/a", []byte("body"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f, err := mfs.OpenMeta(dir + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != 4 {
+		t.Errorf("Stat = %v, %v", fi, err)
+	}
+	if _, err := f.Read(make([]byte, 4)); !errors.Is(err, ErrMetaOnly) {
+		t.Errorf("Read = %v, want ErrMetaOnly", err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, ErrMetaOnly) {
+		t.Errorf("Write = %v, want ErrMetaOnly", err)
+	}
+	f.Close()
+	if ff := mfs.getData()[dir+"/a"].(*InMemoryFile); ff.loaded {
+		t.Error("OpenMeta downloaded the contents")
+	}
+
+	if _, err := mfs.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	d, err := mfs.OpenMeta(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, err := d.Readdirnames(-1); err != nil || len(names) != 1 {
+		t.Errorf("Readdirnames = %v, %v", names, err)
+	}
+}
+
+func TestDirInfo(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	dir := path.Join(testDir, "TestDirInfo")
+	defer mfs.RemoveAll(dir)
+	for _, name := range []string{"a", "sub/b"} {
+		if err := afero.WriteFile(mfs, path.Join(dir, name), []byte(name), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), DirSize(0), DirModTimes())
+	var newest time.Time
+	for _, name := range []string{"a", "sub/b"} {
+		fi, err := mfs.Stat(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	fi, err := mfs.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 || !fi.ModTime().Equal(newest) {
+		t.Errorf("directory Size() = %d, ModTime() = %v, want 0 and %v", fi.Size(), fi.ModTime(), newest)
+	}
+
+	// files that haven't been flushed count too
+	clock := &fakeClock{now: newest.Add(time.Hour)}
+	mfs.clock = clock
+	if _, err := mfs.Create(path.Join(dir, "sub/c")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := mfs.Stat(dir); !fi.ModTime().Equal(clock.now) {
+		t.Errorf("directory ModTime() = %v, want %v", fi.ModTime(), clock.now)
+	}
+	if fi, _ := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Stat(dir); fi.Size() != 42 || !fi.ModTime().IsZero() {
+		t.Errorf("default directory Size() = %d, ModTime() = %v", fi.Size(), fi.ModTime())
+	}
+}
+
+func TestPosixMetadata(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata())
+	dir := path.Join(testDir, "TestPosixMetadata")
+	name := path.Join(dir, "a")
+	defer mfs.RemoveAll(dir)
+	if err := afero.WriteFile(mfs, name, []byte("owned"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	mfs.Chmod(name, 0750)
+	mfs.Chtimes(name, mtime, mtime)
+	mfs.Chown(name, 1000, 100)
+	if err := mfs.Flush(name); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(fi os.FileInfo) {
+		t.Helper()
+		if fi.Mode() != 0750 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("Mode() = %v, ModTime() = %v", fi.Mode(), fi.ModTime())
+		}
+		if owner, ok := fi.Sys().(*Owner); !ok || *owner != (Owner{1000, 100}) {
+			t.Errorf("Sys() = %v", fi.Sys())
+		}
+	}
+	fresh := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata())
+	fi, err := fresh.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(fi)
+	if got, _ := afero.ReadFile(fresh, name); string(got) != "owned" {
+		t.Errorf("contents = %q", got)
+	}
+
+	// a listing doesn't include metadata, so it's read when asked for
+	fresh = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata())
+	fresh.Mkdir(dir, 0777)
+	d, err := fresh.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := d.Readdir(-1)
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("Readdir = %v, %v", infos, err)
+	}
+	check(infos[0])
+
+	// changing a listed file keeps what's stored of the rest
+	fresh = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata())
+	fresh.Mkdir(dir, 0777)
+	d, _ = fresh.Open(dir)
+	if names, err := d.Readdirnames(-1); err != nil || len(names) != 1 {
+		t.Fatalf("Readdirnames = %v, %v", names, err)
+	}
+	fresh.Chmod(name, 0700)
+	if err := fresh.Flush(name); err != nil {
+		t.Fatal(err)
+	}
+	fi, err = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata()).Stat(name)
+	if err != nil || fi.Mode() != 0700 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("after Chmod of a listed file: %v, %v want %v, %v", fi, err, os.FileMode(0700), mtime)
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Prefix("TestCheckPermissions"))
+	if err := mfs.CheckPermissions(context.Background()); err != nil {
+		t.Fatalf("CheckPermissions() = %v", err)
+	}
+	if resp, err := mfs.bucket().List("TestCheckPermissions/", "", "", 10); err != nil || len(resp.Contents) != 0 {
+		t.Errorf("after CheckPermissions: List = %v, %v want no scratch objects", resp, err)
+	}
+	denied := &PermissionError{Bucket: "b", Denied: []string{"s3:GetObject", "s3:DeleteObject"}}
+	if want := "af3ro: s3://b denies s3:GetObject, s3:DeleteObject"; denied.Error() != want {
+		t.Errorf("PermissionError.Error() = %q want %q", denied.Error(), want)
+	}
+}
+
+func TestParseTagging(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<Tagging xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <TagSet>
+    <Tag><Key>team</Key><Value>data</Value></Tag>
+    <Tag><Key>pii</Key><Value></Value></Tag>
+  </TagSet>
+</Tagging>`
+	tags, err := parseTagging(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags["team"] != "data" {
+		t.Errorf("parsed %v", tags)
+	}
+	if v, ok := tags["pii"]; !ok || v != "" {
+		t.Errorf("empty tag pii = %q, %v", v, ok)
+	}
+}
+
+func TestParseACL(t *testing.T) {
+	policy := func(grants string) string {
+		return `<AccessControlPolicy><Owner><ID>me</ID></Owner><AccessControlList>
+<Grant><Grantee><ID>me</ID></Grantee><Permission>FULL_CONTROL</Permission></Grant>` +
+			grants + `</AccessControlList></AccessControlPolicy>`
+	}
+	group := func(uri, perm string) string {
+		return `<Grant><Grantee><URI>` + uri + `</URI></Grantee><Permission>` + perm + `</Permission></Grant>`
+	}
+	owner := `<Grant><Grantee><ID>owner</ID></Grantee><Permission>FULL_CONTROL</Permission></Grant>`
+	for _, c := range []struct {
+		grants string
+		want   s3.ACL
+	}{
+		{"", s3.Private},
+		{group(allUsers, "READ"), s3.PublicRead},
+		{group(allUsers, "READ") + group(allUsers, "WRITE"), s3.PublicReadWrite},
+		{group(authUsers, "READ"), s3.AuthenticatedRead},
+		{owner, s3.BucketOwnerFull},
+	} {
+		if acl, ok, err := parseACL(strings.NewReader(policy(c.grants))); err != nil || !ok || acl != c.want {
+			t.Errorf("parseACL = %q, %v, %v, want %q", acl, ok, err, c.want)
+		}
+	}
+	if _, ok, _ := parseACL(strings.NewReader(policy(group(authUsers, "WRITE")))); ok {
+		t.Error("matched a canned ACL for grants none makes")
+	}
+}
+
+func TestIMDSCredentials(t *testing.T) {
+	exp := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != "PUT" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+			io.WriteString(w, "session")
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			io.WriteString(w, "web-role\n")
+		case "/latest/meta-data/iam/security-credentials/web-role":
+			fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"tok","Expiration":%q}`, exp.Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	auth, err := IMDSCredentials{Endpoint: srv.URL}.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.AccessKey != "AKID" || auth.SecretKey != "secret" || auth.Token() != "tok" || !auth.Expiration().Equal(exp) {
+		t.Errorf("unexpected credentials %+v", auth)
+	}
+
+	// credentials a minute from expiry are renewed on every request
+	calls := 0
+	c := &credentialCache{provider: providerFunc(func() (*aws.Auth, error) {
+		calls++
+		return IMDSCredentials{Endpoint: srv.URL}.Retrieve(context.Background())
+	})}
+	for i := 0; i < 2; i++ {
+		if err := c.refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("retrieved credentials %d times, want 2", calls)
+	}
+	if c.current().AccessKey != "AKID" {
+		t.Errorf("current() = %+v", c.current())
+	}
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	var session string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session = r.FormValue("RoleSessionName")
+		if r.FormValue("Action") != "AssumeRoleWithWebIdentity" || r.FormValue("WebIdentityToken") != "jwt" ||
+			r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/pod" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>ASIA</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>tok</SessionToken>
+<Expiration>2030-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer srv.Close()
+
+	tokenFile := path.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := WebIdentityCredentials{RoleARN: "arn:aws:iam::123456789012:role/pod", TokenFile: tokenFile, Endpoint: srv.URL}
+	auth, err := p.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.AccessKey != "ASIA" || auth.SecretKey != "secret" || auth.Token() != "tok" || auth.Expiration().Year() != 2030 {
+		t.Errorf("unexpected credentials %+v", auth)
+	}
+
+	// the session is named from the filesystem's clock
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), Credentials(p), TimeSource(clock))
+	if err := mfs.creds.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("af3ro-%d", clock.now.UnixNano()); session != want {
+		t.Errorf("session named %q, want %q", session, want)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	dir := t.TempDir()
+	creds, config := path.Join(dir, "credentials"), path.Join(dir, "config")
+	ioutil.WriteFile(creds, []byte("[default]\naws_access_key_id = DEFAULT\naws_secret_access_key = x\n\n[dev]\n# comment\naws_access_key_id = DEV\naws_secret_access_key = devsecret\n"), 0600)
+	ioutil.WriteFile(config, []byte("[default]\nregion = us-east-1\n\n[profile dev]\nregion = eu-central-1\n"), 0600)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", creds)
+	t.Setenv("AWS_CONFIG_FILE", config)
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), Profile("dev"))
+	if mfs.region.Name != "eu-central-1" || mfs.region.S3Endpoint != "https://s3.eu-central-1.amazonaws.com" {
+		t.Errorf("region = %+v, want eu-central-1", mfs.region)
+	}
+	auth, err := mfs.creds.provider.Retrieve(context.Background())
+	if err != nil || auth.AccessKey != "DEV" || auth.SecretKey != "devsecret" {
+		t.Errorf("Retrieve() = %+v, %v, want the dev profile's keys", auth, err)
+	}
+	if _, err := (ProfileCredentials{Profile: "missing"}).Retrieve(context.Background()); err == nil {
+		t.Error("Retrieve found credentials for a missing profile")
+	}
+}
+
+type providerFunc func() (*aws.Auth, error)
+
+func (f providerFunc) Retrieve(ctx context.Context) (*aws.Auth, error) { return f() }
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// fakeRand returns 0 from its first zeros calls to Float64, and 0.99
+// from the rest.
+type fakeRand struct {
+	mu    sync.Mutex
+	zeros int
+}
+
+func (r *fakeRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.zeros > 0 {
+		r.zeros--
+		return 0
+	}
+	return 0.99
+}
+
+func (r *fakeRand) Intn(n int) int { return 0 }
+
+func TestTimeSource(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock))
+	f, err := mfs.Create(path.Join(testDir, "TestTimeSource"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := f.Stat(); !fi.ModTime().Equal(clock.now) {
+		t.Errorf("ModTime() = %v, want %v", fi.ModTime(), clock.now)
+	}
+
+	mfs.heads.put("cached", &http.Response{})
+	if resp, expired := mfs.heads.get("cached"); resp == nil || expired {
+		t.Fatal("HEAD wasn't cached")
+	}
+	clock.After(defaultHeadCacheTTL + time.Second)
+	if _, expired := mfs.heads.get("cached"); !expired {
+		t.Error("cached HEAD didn't expire when the clock moved on")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock), Failover(FailoverConfig{
+		Bucket: "test-west.rsb.io",
+		Region: aws.USWest2,
+	}))
+	f := mfs.failover
+	down := &s3.Error{StatusCode: http.StatusServiceUnavailable}
+	for i := 0; i < 2; i++ {
+		if f.report(down) {
+			t.Fatalf("failed over after %d failures", i+1)
+		}
+	}
+	// a bucket that answers at all is up
+	f.report(&s3.Error{StatusCode: http.StatusNotFound})
+	f.report(down)
+	if f.report(down) {
+		t.Fatal("a 404 didn't reset the failures")
+	}
+	if !f.report(down) {
+		t.Fatal("didn't fail over after 3 failures")
+	}
+
+	stillDown := func() error { return down }
+	if secondary, err := f.route(context.Background(), true, stillDown); !secondary || err != nil {
+		t.Errorf("read routed to secondary %v, %v", secondary, err)
+	}
+	if _, err := f.route(context.Background(), false, stillDown); err != ErrFailedOver {
+		t.Errorf("write while failed over = %v, want ErrFailedOver", err)
+	}
+
+	secondary := NewS3Fs(Bucket("test-west.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestFailover")
+	if err := afero.WriteFile(secondary, name, []byte("replicated"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Remove(name)
+	if got, err := afero.ReadFile(mfs, name); err != nil || string(got) != "replicated" {
+		t.Errorf("read %q, %v while failed over", got, err)
+	}
+	if _, err := mfs.tags(mfs.key(name)); err != nil {
+		t.Errorf("reading tags while failed over = %v", err)
+	}
+	if err := mfs.putTags(mfs.bucketName, mfs.key(name), map[string]string{"k": "v"}); !errors.Is(err, ErrFailedOver) {
+		t.Errorf("tagging while failed over = %v, want ErrFailedOver", err)
+	}
+
+	// the primary is checked once CheckEvery has passed, and is back
+	f.config.Writes = QueueWrites
+	probes := 0
+	secondary2, err := f.route(context.Background(), false, func() error {
+		probes++
+		if probes < 2 {
+			return down
+		}
+		return nil
+	})
+	if secondary2 || err != nil || probes != 2 {
+		t.Errorf("queued write routed to secondary %v, %v after %d probes", secondary2, err, probes)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock), Retry(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     100 * time.Millisecond,
+		MaxBackoff:  time.Second,
+	}))
+	slowDown := &s3.Error{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}
+	failing := func(failures int, fail error) (calls int, err error) {
+		err = mfs.do("read", "TestRetry", func(*s3.Bucket) error {
+			calls++
+			if calls <= failures {
+				return fail
+			}
+			return nil
+		})
+		return calls, err
+	}
+
+	start := clock.now
+	if calls, err := failing(2, slowDown); calls != 3 || err != nil {
+		t.Errorf("after 2 SlowDowns: %d calls, %v want 3, nil", calls, err)
+	}
+	// two backoffs, and the throttle's delay before each retry
+	if waited := clock.now.Sub(start); waited != 600*time.Millisecond {
+		t.Errorf("retries took %v want 600ms", waited)
+	}
+	if d := mfs.throttle.current(); d != 100*time.Millisecond {
+		t.Errorf("throttle delay after success = %v want 100ms", d)
+	}
+	if calls, err := failing(3, slowDown); calls != 3 || err != slowDown {
+		t.Errorf("after 3 SlowDowns: %d calls, %v want 3, %v", calls, err, slowDown)
+	}
+	notFound := &s3.Error{StatusCode: http.StatusNotFound}
+	if calls, err := failing(1, notFound); calls != 1 || err != notFound {
+		t.Errorf("after a 404: %d calls, %v want 1, %v", calls, err, notFound)
+	}
+
+	// requests that mustn't be repeated, like starting an upload, aren't
+	calls := 0
+	err := mfs.doOnce("write", "TestRetry", func(*s3.Bucket) error {
+		calls++
+		return slowDown
+	})
+	if calls != 1 || err != slowDown {
+		t.Errorf("doOnce after a SlowDown: %d calls, %v want 1, %v", calls, err, slowDown)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock), MaxRequestsPerSecond(10), MaxConcurrentRequests(1))
+	start := clock.now
+	for i := 0; i < 3; i++ {
+		mfs.do("stat", "TestRequestLimits", func(*s3.Bucket) error { return nil })
+	}
+	if waited := clock.now.Sub(start); waited != 200*time.Millisecond {
+		t.Errorf("3 requests at 10 a second took %v, want 200ms", waited)
+	}
+
+	// nothing the filesystem does needs two requests at once
+	root := path.Join(testDir, "TestRequestLimits")
+	for _, f := range []string{"a", "b", "sub/c"} {
+		if err := afero.WriteFile(mfs, path.Join(root, f), []byte(f), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mfs.Rename(path.Join(root, "sub"), path.Join(root, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), BulkLimits(1, 0))
+	sched := mfs.scheduler
+	waiting := func(p Priority) {
+		for {
+			sched.mu.Lock()
+			n := sched.waiting[p]
+			sched.mu.Unlock()
+			if n > 0 {
+				return
+			}
+			runtime.Gosched()
+		}
+	}
+
+	release, _ := sched.acquire(context.Background())
+	order := make(chan Priority, 2)
+	for _, p := range []Priority{PriorityLow, PriorityHigh} {
+		go func(p Priority) {
+			release, err := sched.acquire(WithPriority(context.Background(), p))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- p
+			release()
+		}(p)
+		waiting(p)
+	}
+	release()
+	if first, second := <-order, <-order; first != PriorityHigh || second != PriorityLow {
+		t.Errorf("turns went to %v then %v, want high then low", first, second)
+	}
+
+	done := sched.request(WithPriority(context.Background(), PriorityHigh))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sched.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquire during a high priority request = %v want %v", err, context.DeadlineExceeded)
+	}
+	done()
+	if release, err := sched.acquire(context.Background()); err != nil {
+		t.Errorf("acquire after the high priority request: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestBulkLimits(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock), BulkLimits(1, 2))
+	start := clock.now
+	for i := 0; i < 3; i++ {
+		if err := mfs.scheduled(func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if waited := clock.now.Sub(start); waited != time.Second {
+		t.Errorf("3 turns at 2 a second took %v, want 1s", waited)
+	}
+
+	release, err := mfs.scheduler.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := mfs.scheduler.acquire(ctx); err != context.Canceled {
+		t.Errorf("acquire past the concurrency limit = %v, want context.Canceled", err)
+	}
+	release()
+
+	name := path.Join(testDir, "TestBulkLimits")
+	for _, f := range []string{"a", "b", "c"} {
+		afero.WriteFile(mfs, path.Join(name, f), []byte(f), 0640)
+	}
+	if err := mfs.RemoveAll(name); err != nil {
+		t.Fatal(err)
+	}
+	if dir, _ := mfs.isDir(name); dir {
+		t.Error("RemoveAll left objects behind")
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+	results := make(chan bool, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			v, err, shared := g.do("get key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "data", nil
+			})
+			results <- v == "data" && err == nil && shared
+		}()
+	}
+	// let every caller join the first one's flight
+	for {
+		g.mu.Lock()
+		c := g.calls["get key"]
+		joined := c != nil && c.dups == 4
+		g.mu.Unlock()
+		if joined {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	for i := 0; i < 5; i++ {
+		if !<-results {
+			t.Error("a caller didn't get the shared result")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+}
+
+func TestName(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), Region(aws.USWest2))
+	if got, want := mfs.Name(), "MemS3Fs: s3://test.rsb.io (us-west-2)"; got != want {
+		t.Errorf("Name() = %q, want %q", got, want)
+	}
+	mfs = NewS3Fs(Bucket("test.rsb.io"), Named("uploads"))
+	if got := mfs.Name(); got != "uploads" {
+		t.Errorf("Name() = %q, want %q", got, "uploads")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var got []Metric
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Metrics(RecorderFunc(func(m Metric) {
+		got = append(got, m)
+	})))
+	f := newFile("TestMetrics", mfs, t)
+	defer mfs.Remove(f.Name())
+	f.WriteString("measured")
+	f.Close()
+	mfs.Open(f.Name())
+
+	count := func(kind MetricKind, cache string) (n int) {
+		for _, m := range got {
+			if m.Kind == kind && m.Cache == cache {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(CacheHit, FileCache); n != 1 {
+		t.Errorf("recorded %d file cache hits, want 1", n)
+	}
+	if n := count(Flush, ""); n != 1 {
+		t.Fatalf("recorded %d flushes, want 1", n)
+	}
+	for _, m := range got {
+		if m.Kind == Flush && (m.Bytes != 8 || m.Err != nil) {
+			t.Errorf("flush recorded %d bytes, error %v", m.Bytes, m.Err)
+		}
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opt  Option
+		want int64 // bytes uploaded rewriting identical contents
+	}{
+		{"default", SkipUnchanged(true), 0},
+		{"disabled", SkipUnchanged(false), 4},
+		{"SSEKMS", SSEKMS(""), 4},
+	} {
+		var uploaded int64
+		mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), c.opt, Metrics(RecorderFunc(func(m Metric) {
+			if m.Kind == Flush {
+				uploaded += m.Bytes
+			}
+		})))
+		name := path.Join(testDir, "TestSkipUnchanged")
+		if err := afero.WriteFile(mfs, name, []byte("same"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		uploaded = 0
+		if err := afero.WriteFile(mfs, name, []byte("same"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if uploaded != c.want {
+			t.Errorf("%s: rewriting uploaded %d bytes want %d", c.name, uploaded, c.want)
+		}
+		mfs.Remove(name)
+	}
+}
+
+func TestVersionID(t *testing.T) {
+	var flushed, version string
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), OnFlush(func(name, versionID string) {
+		flushed, version = name, versionID
+	}))
+	f := newFile("TestVersionID", mfs, t)
+	defer mfs.Remove(f.Name())
+	f.WriteString("versioned")
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := mfs.bucket().Head(mfs.key(f.Name()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := resp.Header.Get("x-amz-version-id")
+	if flushed != f.Name() || version != want {
+		t.Errorf("OnFlush(%q, %q) want (%q, %q)", flushed, version, f.Name(), want)
+	}
+	if v := f.(VersionedFile).VersionID(); v != want {
+		t.Errorf("VersionID() = %q want %q", v, want)
+	}
+}
+
+func TestRename(t *testing.T) {
+	from, to := testDir+"/renamefrom", testDir+"/renameto"
+	fs.Remove(to)              // Just in case.
+	fs.MkdirAll(testDir, 0777) // Just in case.
+	file, err := fs.Create(from)
+	if err != nil {
+		t.Fatalf("open %q failed: %v", to, err)
+	}
+	_, err = file.WriteString("Hello there.")
+	if err != nil {
+		t.Fatalf("write %q failed: %v", to, err)
+	}
+	if err = file.Close(); err != nil {
+		t.Errorf("close %q failed: %v", to, err)
+	}
+	time.Sleep(1 * time.Second)
+	err = fs.Rename(from, to)
+	if err != nil {
+		t.Fatalf("rename %q, %q failed: %v", to, from, err)
+	}
+	defer fs.Remove(to)
+	_, err = fs.Stat(to)
+	if err != nil {
+		t.Errorf("stat %q failed: %v", to, err)
+	}
+}
+
+func TestListPageSize(t *testing.T) {
+	dir := path.Join(testDir, "TestListPageSize")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	for i := 0; i < 5; i++ {
+		if err := afero.WriteFile(mfs, path.Join(dir, strconv.Itoa(i)), []byte("x"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each listing waits out the injected latency on the fake clock,
+	// which counts them
+	start := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	paged := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ListPageSize(2), TimeSource(clock), Chaos(ChaosConfig{
+		Ops:         []string{"readdir"},
+		Latency:     time.Second,
+		LatencyRate: 1,
+	}))
+	paged.Mkdir(dir, 0777)
+	infos, err := afero.ReadDir(paged, dir)
+	if err != nil || len(infos) != 5 {
+		t.Fatalf("ReadDir listed %d entries, %v, want 5", len(infos), err)
+	}
+	if pages := clock.now.Sub(start) / time.Second; pages != 3 {
+		t.Errorf("ReadDir made %d list requests, want 3", pages)
+	}
+	if err := paged.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	fresh := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	fresh.Mkdir(dir, 0777)
+	if infos, _ := afero.ReadDir(fresh, dir); len(infos) != 0 {
+		t.Errorf("RemoveAll left %d entries", len(infos))
+	}
+}
+
+func TestOpResults(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	src := path.Join(testDir, "TestOpResults")
+	if err := afero.WriteFile(mfs, src, []byte("provenance"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5ETag([]byte("provenance"))
+
+	res, err := mfs.Copy(src, src+".copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(src + ".copy")
+	if res.DestETag != sum || res.Bytes != 10 {
+		t.Errorf("Copy = %+v, want DestETag %s and 10 bytes", res, sum)
+	}
+	if got, _ := afero.ReadFile(mfs, src+".copy"); string(got) != "provenance" {
+		t.Errorf("copy holds %q", got)
+	}
+
+	if _, err := mfs.Stat(src); err != nil {
+		t.Fatal(err)
+	}
+	res, err = mfs.RenameResult(src, src+".moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DestETag != sum || res.Bytes != 10 {
+		t.Errorf("RenameResult = %+v, want DestETag %s and 10 bytes", res, sum)
+	}
+
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	mfs.Stat(src + ".moved")
+	res, err = mfs.RemoveResult(src + ".moved")
+	if err != nil || res.SourceETag != sum {
+		t.Errorf("RemoveResult = %+v, %v, want SourceETag %s", res, err, sum)
+	}
+}
+
+func TestClientSideEncryption(t *testing.T) {
+	wrapper, err := LocalKeyWrapper(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	efs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(wrapper))
+	name := path.Join(testDir, "TestClientSideEncryption")
+	if err := afero.WriteFile(efs, name, []byte("for your eyes only"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer efs.Remove(name)
+
+	raw, err := afero.ReadFile(NewS3Fs(Bucket("test.rsb.io"), EnvAuth()), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("eyes")) {
+		t.Errorf("object holds plaintext %q", raw)
+	}
+
+	efs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(wrapper))
+	if fi, err := efs.Stat(name); err != nil || fi.Size() != 18 {
+		t.Errorf("Stat = %v, %v, want size 18", fi, err)
+	}
+	if got, err := afero.ReadFile(efs, name); err != nil || string(got) != "for your eyes only" {
+		t.Errorf("ReadFile = %q, %v", got, err)
+	}
+
+	other, _ := LocalKeyWrapper(bytes.Repeat([]byte("x"), 32))
+	wrong := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(other))
+	if _, err := afero.ReadFile(wrong, name); err == nil {
+		t.Error("read with the wrong master key succeeded")
+	}
+}
+
+func TestClientSideEncryptionListing(t *testing.T) {
+	wrapper, err := LocalKeyWrapper(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := path.Join(testDir, "TestClientSideEncryptionListing")
+	efs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(wrapper))
+	if err := afero.WriteFile(efs, path.Join(dir, "sealed"), []byte("for your eyes only"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, path.Join(dir, "plain"), []byte("for anyone"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.RemoveAll(dir)
+
+	efs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(wrapper))
+	efs.Mkdir(dir, 0777)
+	infos, err := afero.ReadDir(efs, dir)
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("ReadDir = %v, %v, want 2 entries", infos, err)
+	}
+	for _, fi := range infos {
+		if want := map[string]int64{"plain": 10, "sealed": 18}[path.Base(fi.Name())]; fi.Size() != want {
+			t.Errorf("%s listed with size %d, want %d", fi.Name(), fi.Size(), want)
+		}
+	}
+}
+
+func TestClientSideEncryptionRecords(t *testing.T) {
+	wrapper, err := LocalKeyWrapper(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	efs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(wrapper))
+	name := path.Join(testDir, "TestClientSideEncryptionRecords")
+	defer efs.Remove(name)
+	w := efs.CreateRecords(name)
+	w.WriteRecord([]byte("for your eyes only"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := afero.ReadFile(fs, name)
+	if err != nil || bytes.Contains(raw, []byte("eyes")) {
+		t.Errorf("records object = %q, %v want ciphertext", raw, err)
+	}
+	if got, err := afero.ReadFile(efs, name); err != nil || !bytes.Equal(got, appendRecord(nil, []byte("for your eyes only"))) {
+		t.Errorf("ReadFile = %q, %v", got, err)
+	}
+
+	if _, err := efs.CreateSharded(name+"-sharded", 10); !errors.Is(err, ErrTransformedWrite) {
+		t.Errorf("CreateSharded = %v want %v", err, ErrTransformedWrite)
+	}
+}
+
+func TestClientSideEncryptionAppender(t *testing.T) {
+	wrapper, err := LocalKeyWrapper(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	efs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(wrapper))
+	name := path.Join(testDir, "TestClientSideEncryptionAppender.log")
+	defer efs.RemoveAll(name)
+	a, _ := efs.NewAppender(name, "pod-a")
+	if _, err := a.Write([]byte("for your eyes only\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := efs.bucket().List(efs.dirPrefix(name), "", "", 0)
+	if err != nil || len(resp.Contents) != 1 {
+		t.Fatalf("segments = %v, %v want 1", resp, err)
+	}
+	if raw, err := fetchObject(resp.Contents[0].Key, efs.bucket()); err != nil || bytes.Contains(raw, []byte("eyes")) {
+		t.Errorf("segment = %q, %v want ciphertext", raw, err)
+	}
+	r, err := efs.OpenAppended(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || string(got) != "for your eyes only\n" {
+		t.Errorf("read back %q, %v", got, err)
+	}
+}
+
+func TestClientSideEncryptionPartitions(t *testing.T) {
+	wrapper, err := LocalKeyWrapper(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	efs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ClientSideEncryption(wrapper))
+	root := path.Join(testDir, "TestClientSideEncryptionPartitions")
+	defer efs.RemoveAll(root)
+	w := efs.CreatePartitioned(root, PartitionOptions{ID: "test"})
+	w.WriteRecord([]byte("for your eyes only"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := efs.bucket().List(efs.keyPrefix(root)+"/", "", "", 0)
+	if err != nil || len(resp.Contents) != 1 {
+		t.Fatalf("List = %v, %v want one partition", resp, err)
+	}
+	key := resp.Contents[0].Key
+	if raw, err := fetchObject(key, efs.bucket()); err != nil || bytes.Contains(raw, []byte("eyes")) {
+		t.Errorf("partition object = %q, %v want ciphertext", raw, err)
+	}
+	if got, err := afero.ReadFile(efs, "/"+key); err != nil || !bytes.Equal(got, appendRecord(nil, []byte("for your eyes only"))) {
+		t.Errorf("ReadFile = %q, %v", got, err)
+	}
+}
+
+func TestRemoveFailures(t *testing.T) {
+	from, to := path.Join(testDir, "TestRemoveFailures"), path.Join(testDir, "TestRemoveFailuresTo")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Chaos(ChaosConfig{
+		Ops:       []string{"rename", "remove"},
+		Names:     []string{from},
+		ErrorRate: 1,
+	}))
+	if err := afero.WriteFile(mfs, from, []byte("twice"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(to)
+	defer fs.Remove(from)
+
+	// the copy is made, but the original can't be removed
+	if err := mfs.Rename(from, to); !errors.Is(err, ErrInjected) {
+		t.Errorf("Rename = %v want %v", err, ErrInjected)
+	}
+	if err := mfs.Remove(to); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.Remove(from); !errors.Is(err, ErrInjected) {
+		t.Errorf("Remove = %v want %v", err, ErrInjected)
+	}
+}
+
+func TestRenameKeepsStorageClass(t *testing.T) {
+	dir := path.Join(testDir, "TestRenameKeepsStorageClass")
+	ia := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), StorageClass(StandardIA))
+	for _, name := range []string{"file", "dir/a", "dir/b"} {
+		if err := afero.WriteFile(ia, path.Join(dir, name), []byte("rarely read"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer fs.RemoveAll(dir)
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	if err := mfs.Rename(path.Join(dir, "file"), path.Join(dir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.Rename(path.Join(dir, "dir"), path.Join(dir, "moveddir")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := mfs.bucket().List(mfs.dirPrefix(dir), "", "", 0)
+	if err != nil || len(resp.Contents) != 3 {
+		t.Fatalf("listed %v, %v want 3 objects", resp, err)
+	}
+	for _, k := range resp.Contents {
+		if k.StorageClass != string(StandardIA) {
+			t.Errorf("%s stored in %s, want %s", k.Key, k.StorageClass, StandardIA)
+		}
+	}
+}
+
+func TestRenameKeepsHeaders(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestRenameKeepsHeaders")
+	defer mfs.RemoveAll(name)
+	if err := afero.WriteFile(mfs, name+"/a.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.Rename(name+"/a.json", name+"/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := mfs.bucket().Head(mfs.key(name+"/b.txt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		t.Errorf("renamed object's Content-Type = %q", got)
+	}
+	if got := mfs.objectACL(mfs.key(name+"/b.txt"), ""); got != s3.PublicRead {
+		t.Errorf("renamed object's ACL = %q, want %q", got, s3.PublicRead)
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	from, to := path.Join(testDir, "renamedirfrom"), path.Join(testDir, "renamedirto")
+	names := []string{"a", "b/c"}
+	for _, name := range names {
+		f, err := mfs.Create(path.Join(from, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(name)
+		f.Close()
+	}
+	defer mfs.RemoveAll(to)
+	defer mfs.RemoveAll(from)
+
+	if err := mfs.Rename(from, to); err != nil {
+		t.Fatalf("rename %q, %q failed: %v", from, to, err)
+	}
+	for _, name := range names {
+		if _, err := mfs.Stat(path.Join(from, name)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", path.Join(from, name), err)
+		}
+		got, err := afero.ReadFile(mfs, path.Join(to, name))
+		if err != nil || string(got) != name {
+			t.Errorf("%s holds %q, %v, want %q", path.Join(to, name), got, err, name)
+		}
+	}
+
+	// a directory isn't renamed over one that has objects in it
+	afero.WriteFile(mfs, path.Join(from, "a"), []byte("new"), 0640)
+	if err := mfs.Rename(from, to); !errors.Is(err, afero.ErrFileExists) {
+		t.Errorf("rename onto a directory with objects = %v want %v", err, afero.ErrFileExists)
+	}
+	if got, err := afero.ReadFile(NewS3Fs(Bucket("test.rsb.io"), EnvAuth()), path.Join(to, "a")); string(got) != "a" {
+		t.Errorf("after the refused rename %s holds %q, %v want %q", path.Join(to, "a"), got, err, "a")
+	}
+}
+
+func TestRenameDirPartialFailure(t *testing.T) {
+	from, to := path.Join(testDir, "partialfrom"), path.Join(testDir, "partialto")
+	failed := strings.TrimPrefix(path.Join(from, "3"), "/")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Chaos(ChaosConfig{
+		Ops:       []string{"rename"},
+		Names:     []string{failed},
+		ErrorRate: 1,
+	}))
+	for i := 0; i < 10; i++ {
+		f, _ := mfs.Create(path.Join(from, strconv.Itoa(i)))
+		f.Close()
+	}
+	defer NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).RemoveAll(to)
+	defer NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).RemoveAll(from)
+
+	err := mfs.Rename(from, to)
+	rerr, ok := err.(*RenameError)
+	if !ok {
+		t.Fatalf("rename = %v want a *RenameError", err)
+	}
+	if len(rerr.Failed) != 1 || !errors.Is(rerr.Failed[failed], ErrInjected) {
+		t.Errorf("failed %v want only %s", rerr.Failed, failed)
+	}
+	if len(rerr.Moved) != 9 {
+		t.Errorf("moved %d keys want 9", len(rerr.Moved))
+	}
+	if _, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Stat(failed); err != nil {
+		t.Errorf("failed key %s is gone: %v", failed, err)
+	}
+	for _, key := range rerr.Moved {
+		if _, err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Stat(key); !os.IsNotExist(err) {
+			t.Errorf("moved key %s still exists: %v", key, err)
+		}
+	}
+}
+
+func TestRenameDirResume(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	from, to := path.Join(testDir, "resumefrom"), path.Join(testDir, "resumeto")
+	manifest := path.Join(testDir, "resume-manifest.json")
+	for i := 0; i < 5; i++ {
+		afero.WriteFile(mfs, path.Join(from, strconv.Itoa(i)), []byte("hello"), 0640)
+	}
+	defer mfs.RemoveAll(to)
+	defer mfs.RemoveAll(from)
+	defer mfs.Remove(manifest)
+
+	// interrupted after the first batch
+	ctx, cancel := context.WithCancel(context.Background())
+	view := WithContext(ctx, mfs).(*MemS3Fs)
+	_, err := view.RenameDir(from, to, &RenameOptions{
+		Manifest:  manifest,
+		BatchSize: 2,
+		Progress:  func(RenameProgress) { cancel() },
+	})
+	if err == nil {
+		t.Fatalf("interrupted rename succeeded")
+	}
+
+	var last RenameProgress
+	res, err := mfs.RenameDir(from, to, &RenameOptions{
+		Manifest:  manifest,
+		BatchSize: 2,
+		Progress:  func(p RenameProgress) { last = p },
+	})
+	if err != nil {
+		t.Fatalf("resumed rename: %v", err)
+	}
+	if last.Moved != 5 || res.Bytes != 25 {
+		t.Errorf("resumed rename moved %d objects, %d bytes want 5, 25", last.Moved, res.Bytes)
+	}
+	for i := 0; i < 5; i++ {
+		if data, err := afero.ReadFile(mfs, path.Join(to, strconv.Itoa(i))); string(data) != "hello" {
+			t.Errorf("%d after the rename: %q, %v", i, data, err)
+		}
+	}
+	if _, err := fetchObject(mfs.key(manifest), mfs.bucket()); err == nil {
+		t.Errorf("manifest %s kept after the rename finished", manifest)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	f := newFile("TestTruncate", fs, t)
+	defer fs.Remove(f.Name())
+	defer f.Close()
+
+	checkSize(t, f, 0)
+	f.WriteString("hello, world\n")
+	checkSize(t, f, 13)
+	f.Truncate(10)
+	checkSize(t, f, 10)
+	f.Truncate(1024)
+	checkSize(t, f, 1024)
+	f.Truncate(0)
+	checkSize(t, f, 0)
+	_, err := f.Write([]byte("surprise!"))
+	if err == nil {
+		checkSize(t, f, 13+9) // wrote at offset past where hello, world was.
+	}
+}
+
+func TestTruncatePersists(t *testing.T) {
+	f := newFile("TestTruncatePersists", fs, t)
+	defer fs.Remove(f.Name())
+	f.WriteString("hello, world\n")
+	f.Truncate(5)
+	f.Truncate(7)
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+	data, err := fetchObject(f.Name(), fs.bucket())
+	if err != nil {
+		t.Fatalf("get %q failed: %v", f.Name(), err)
+	}
+	if string(data) != "hello\x00\x00" {
+		t.Errorf("after truncate: have %q want %q", data, "hello\x00\x00")
+	}
+}
+
+func TestCacheContents(t *testing.T) {
+	var hits, misses int
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), CacheContents(NewMemCache(1<<20)),
+		Metrics(RecorderFunc(func(m Metric) {
+			if m.Cache != ContentCache {
+				return
+			}
+			switch m.Kind {
+			case CacheHit:
+				hits++
+			case CacheMiss:
+				misses++
+			}
+		})))
+	name := path.Join(testDir, "TestCacheContents")
+	if err := afero.WriteFile(mfs, name, []byte("cached"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer mfs.Remove(name)
+	for i := 0; i < 2; i++ {
+		if got, err := afero.ReadFile(mfs, name); string(got) != "cached" {
+			t.Errorf("read %d: have %q, %v want %q", i, got, err, "cached")
+		}
+	}
+	if hits != 2 || misses != 0 {
+		t.Errorf("after two reads: %d hits, %d misses want 2, 0", hits, misses)
+	}
+}
+
+func TestCaches(t *testing.T) {
+	disk, err := NewDiskCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := path.Join(t.TempDir(), "cache.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeCache(l, NewMemCache(10))
+	for _, c := range []Cache{NewMemCache(10), disk, NewSocketCache(sock)} {
+		c.Put("a", "1", []byte("aaaa"))
+		c.Put("b", "1", []byte("bbbb"))
+		if _, ok := c.Get("a", "2"); ok {
+			t.Errorf("%T: Get with another ETag hit", c)
+		}
+		c.Get("a", "1")
+		c.Put("c", "1", []byte("cccc")) // evicts b, used least recently
+		if _, ok := c.Get("b", "1"); ok {
+			t.Errorf("%T: b wasn't evicted", c)
+		}
+		if data, ok := c.Get("a", "1"); !ok || string(data) != "aaaa" {
+			t.Errorf("%T: Get(a) = %q, %v want %q", c, data, ok, "aaaa")
+		}
+		c.Put("big", "1", make([]byte, 11))
+		if _, ok := c.Get("big", "1"); ok {
+			t.Errorf("%T: cached more than its maximum", c)
+		}
+		c.Remove("a")
+		if _, ok := c.Get("a", "1"); ok {
+			t.Errorf("%T: Get after Remove hit", c)
+		}
+	}
+}
+
+func TestSocketCache(t *testing.T) {
+	sock := path.Join(t.TempDir(), "cache.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeCache(l, NewMemCache(1<<20))
+
+	name := path.Join(testDir, "TestSocketCache")
+	afero.WriteFile(fs, name, []byte("hello"), 0640)
+	defer fs.Remove(name)
+	for i := 0; i < 2; i++ {
+		mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), CacheContents(NewSocketCache(sock)))
+		if data, err := afero.ReadFile(mfs, name); string(data) != "hello" {
+			t.Fatalf("read %q, %v want %q", data, err, "hello")
+		}
+		if hits := mfs.CacheStats().Caches[ContentCache].Hits; hits != int64(i) {
+			t.Errorf("filesystem %d: %d content cache hits want %d", i, hits, i)
+		}
+	}
+
+	// a server that never answers is given up on
+	hung := path.Join(t.TempDir(), "hung.sock")
+	hl, err := net.Listen("unix", hung)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+	go http.Serve(hl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	done := make(chan bool)
+	go func() {
+		_, ok := NewSocketCache(hung).Get("a", "1")
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Get from a hung server hit")
+		}
+	case <-time.After(5 * socketCacheTimeout):
+		t.Error("Get from a hung server didn't time out")
+	}
+}
+
+func TestRevalidateOnOpen(t *testing.T) {
+	name := path.Join(testDir, "TestRevalidateOnOpen")
+	writer := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	reader := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), RevalidateOnOpen())
+	defer writer.Remove(name)
+
+	for _, contents := range []string{"first", "first", "second"} {
+		if err := afero.WriteFile(writer, name, []byte(contents), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := afero.ReadFile(reader, name); string(got) != contents {
+			t.Errorf("read %q, %v want %q", got, err, contents)
+		}
+	}
+	writer.Remove(name)
+	if _, err := reader.Open(name); !os.IsNotExist(err) {
+		t.Errorf("Open of a removed object = %v want not-exist", err)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	name := path.Join(testDir, "TestCacheTTL")
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	writer := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	reader := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock), CacheTTL(time.Minute))
+	defer writer.Remove(name)
+
+	afero.WriteFile(writer, name, []byte("old"), 0640)
+	afero.ReadFile(reader, name)
+	afero.WriteFile(writer, name, []byte("new"), 0640)
+	if got, _ := afero.ReadFile(reader, name); string(got) != "old" {
+		t.Errorf("within the TTL: read %q want %q", got, "old")
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	if got, _ := afero.ReadFile(reader, name); string(got) != "new" {
+		t.Errorf("after the TTL: read %q want %q", got, "new")
+	}
+}
+
+func TestNegativeCacheTTL(t *testing.T) {
+	name := path.Join(testDir, "TestNegativeCacheTTL")
+	clock := &fakeClock{now: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)}
+	writer := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	reader := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), TimeSource(clock), NegativeCacheTTL(time.Minute))
+	defer writer.Remove(name)
+
+	if _, err := reader.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("Stat before writing = %v want not exist", err)
+	}
+	afero.WriteFile(writer, name, []byte("hello"), 0640)
+	if _, err := reader.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Stat within the TTL = %v want not exist", err)
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	if _, err := reader.Stat(name); err != nil {
+		t.Errorf("Stat after the TTL = %v want nil", err)
+	}
+
+	other := name + ".created"
+	defer reader.Remove(other)
+	reader.Stat(other)
+	afero.WriteFile(reader, other, []byte("hello"), 0640)
+	if missing := reader.heads.isMissing(other); missing {
+		t.Errorf("%q still cached as missing after Create", other)
+	}
+
+	sub := Sub(reader, testDir)
+	gone := path.Base(name) + ".sub"
+	defer writer.Remove(path.Join(testDir, gone))
+	sub.Stat(gone)
+	afero.WriteFile(writer, path.Join(testDir, gone), []byte("hello"), 0640)
+	if _, err := sub.Stat(gone); !os.IsNotExist(err) {
+		t.Errorf("Stat in a Sub within the TTL = %v want not exist", err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestCacheStats")
+	defer mfs.Remove(name)
+	afero.WriteFile(mfs, name, []byte("hello"), 0640)
+	f, _ := mfs.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0640)
+	f.WriteString(", world")
+
+	st := mfs.CacheStats()
+	if st.Dirty != 1 || st.DirtyBytes != 12 {
+		t.Errorf("with %q open: %d dirty, %d bytes want 1, 12", name, st.Dirty, st.DirtyBytes)
+	}
+	if st.Bytes < 12 || st.Files < 2 {
+		t.Errorf("with %q open: %d files, %d bytes want at least 2, 12", name, st.Files, st.Bytes)
+	}
+	if c := st.Caches[FileCache]; c.Hits == 0 {
+		t.Errorf("%s counts = %+v want hits", FileCache, c)
+	}
+	f.Close()
+	if st := mfs.CacheStats(); st.Dirty != 0 {
+		t.Errorf("after Close: %d dirty want 0", st.Dirty)
+	}
+
+	// the content Cache's size and LRU evictions are counted too
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), CacheContents(NewMemCache(10)))
+	defer mfs.Remove(name + "-2")
+	afero.WriteFile(mfs, name, []byte("hello!"), 0640)
+	afero.WriteFile(mfs, name+"-2", []byte("again!"), 0640)
+	st = mfs.CacheStats()
+	if st.Bytes != 6 {
+		t.Errorf("with a content Cache: %d bytes want 6", st.Bytes)
+	}
+	if c := st.Caches[ContentCache]; c.Evictions != 1 {
+		t.Errorf("%s counts = %+v want 1 eviction", ContentCache, c)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	root := path.Join(testDir, "TestPrewarm")
+	defer fs.RemoveAll(root)
+	for i := 0; i < 5; i++ {
+		afero.WriteFile(fs, path.Join(root, fmt.Sprintf("file-%d", i)), []byte("hello"), 0640)
+	}
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	if err := mfs.Prewarm(context.Background(), root, &BulkOptions{Concurrency: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if st := mfs.CacheStats(); st.Bytes != 25 {
+		t.Errorf("after Prewarm: %d bytes cached want 25", st.Bytes)
+	}
+	if ff := mfs.getData()[path.Join(root, "file-3")].(*InMemoryFile); ff.fs != mfs {
+		t.Error("Prewarm left a cached file bound to its context")
+	}
+	if data, err := afero.ReadFile(mfs, path.Join(root, "file-3")); string(data) != "hello" {
+		t.Errorf("read %q, %v want %q", data, err, "hello")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	if err := mfs.Prewarm(ctx, root, nil); err != context.Canceled {
+		t.Errorf("Prewarm with a cancelled context = %v want %v", err, context.Canceled)
+	}
+}
+
+func TestTransformReads(t *testing.T) {
+	root := path.Join(testDir, "TestTransformReads")
+	defer fs.RemoveAll(root)
+	for _, name := range []string{"upper/a", "plain/b", "broken/c"} {
+		afero.WriteFile(fs, path.Join(root, name), []byte("hello"), 0640)
+	}
+	broken := errors.New("broken")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), StreamingReads(4),
+		TransformReads(path.Join(root, "upper"), func(name string, data []byte) ([]byte, error) {
+			return bytes.ToUpper(data), nil
+		}),
+		TransformReads(path.Join(root, "broken"), func(string, []byte) ([]byte, error) {
+			return nil, broken
+		}))
+
+	for name, want := range map[string]string{"upper/a": "HELLO", "plain/b": "hello"} {
+		if data, err := afero.ReadFile(mfs, path.Join(root, name)); string(data) != want {
+			t.Errorf("read %s: %q, %v want %q", name, data, err, want)
+		}
+	}
+	f, _ := mfs.Open(path.Join(root, "upper/a"))
+	b := make([]byte, 3)
+	if _, err := f.ReadAt(b, 2); string(b) != "LLO" {
+		t.Errorf("ReadAt: %q, %v want %q", b, err, "LLO")
+	}
+	f.Close()
+	if _, err := afero.ReadFile(mfs, path.Join(root, "broken/c")); !errors.Is(err, broken) {
+		t.Errorf("read through a failing transform = %v want %v", err, broken)
+	}
+}
+
+func TestTransformReadsCached(t *testing.T) {
+	name := path.Join(testDir, "TestTransformReadsCached")
+	defer fs.Remove(name)
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), CacheContents(NewMemCache(mib)),
+		TransformReads(name, func(name string, data []byte) ([]byte, error) {
+			return bytes.ReplaceAll(data, []byte("secret"), []byte("******")), nil
+		}))
+	// closing leaves the contents to the Cache
+	if err := afero.WriteFile(mfs, name, []byte("a secret"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := afero.ReadFile(mfs, name); string(data) != "a ******" {
+		t.Errorf("read after writing: %q, %v want %q", data, err, "a ******")
+	}
+}
+
+func TestTransformWrites(t *testing.T) {
+	root := path.Join(testDir, "TestTransformWrites")
+	defer fs.RemoveAll(root)
+	secret := errors.New("contains a secret")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), StreamingWrites(),
+		TransformWrites(path.Join(root, "upper"), func(name string, data []byte) ([]byte, error) {
+			return bytes.ToUpper(data), nil
+		}),
+		TransformWrites(root, func(name string, data []byte) ([]byte, error) {
+			if bytes.Contains(data, []byte("SECRET")) {
+				return nil, secret
+			}
+			return data, nil
+		}))
+
+	upper := path.Join(root, "upper/a")
+	if err := afero.WriteFile(mfs, upper, []byte("hello"), 0640); err != nil {
+		t.Fatalf("write %s: %v", upper, err)
 	}
-	defer f.Close()
-	_, err = f.WriteString("Lorem ipsum dolor sit amet, consectetur " +
-		"adipisicing elit, sed do eiusmod tempor incididunt ut labore et " +
-		"dolore magna aliqua. Ut enim ad minim veniam, quis nostrud " +
-		"exercitation ullamco laboris nisi ut aliquip ex ea commodo " +
-		"consequat. Duis aute irure dolor in reprehenderit in voluptate " +
-		"velit esse cillum dolore eu fugiat nulla pariatur. Excepteur " +
-		"sint occaecat cupidatat non proident, sunt in culpa qui " +
-		"officia deserunt mollit anim id est laborum.")
+	if data, err := fetchObject(mfs.key(upper), mfs.bucket()); string(data) != "HELLO" {
+		t.Errorf("stored %q, %v want %q", data, err, "HELLO")
+	}
+	if data, err := afero.ReadFile(mfs, upper); string(data) != "HELLO" {
+		t.Errorf("read back %q, %v want %q", data, err, "HELLO")
+	}
+
+	// the second rule sees what the first returned
+	leak := path.Join(root, "upper/leak")
+	if err := afero.WriteFile(mfs, leak, []byte("a secret"), 0640); !errors.Is(err, secret) {
+		t.Errorf("write of a secret = %v want %v", err, secret)
+	}
+	if _, err := fetchObject(mfs.key(leak), mfs.bucket()); err == nil {
+		t.Errorf("rejected %s was stored", leak)
+	}
+
+	a, _ := mfs.NewAppender(path.Join(root, "upper/log"), "w1")
+	a.Write([]byte("one"))
+	r, err := mfs.OpenAppended(path.Join(root, "upper/log"))
 	if err != nil {
-		t.Fatal(fs.Name(), "WriteString failed:", err)
+		t.Fatalf("OpenAppended: %v", err)
+	}
+	if data, err := ioutil.ReadAll(r); string(data) != "ONE" {
+		t.Errorf("appended %q, %v want %q", data, err, "ONE")
 	}
 
-	b := make([]byte, 0)
-	n, err := f.Read(b)
-	if n != 0 || err != nil {
-		t.Errorf("%v: Read(0) = %d, %v, want 0, nil", fs.Name(), n, err)
+	plain := path.Join(root, "plain")
+	afero.WriteFile(mfs, plain, []byte("hello"), 0640)
+	if err := mfs.Rename(plain, path.Join(root, "upper/b")); !errors.Is(err, ErrTransformedWrite) {
+		t.Errorf("rename into a transformed prefix = %v want %v", err, ErrTransformedWrite)
 	}
-	f.Seek(0, 0)
-	b = make([]byte, 100)
-	n, err = f.Read(b)
-	if n <= 0 || err != nil {
-		t.Errorf("%v: Read(100) = %d, %v, want >0, nil", fs.Name(), n, err)
+	if _, err := mfs.CreateSharded(path.Join(root, "upper/c"), 10); !errors.Is(err, ErrTransformedWrite) {
+		t.Errorf("CreateSharded = %v want %v", err, ErrTransformedWrite)
 	}
 }
 
-func TestRename(t *testing.T) {
-	from, to := testDir+"/renamefrom", testDir+"/renameto"
-	fs.Remove(to)              // Just in case.
-	fs.MkdirAll(testDir, 0777) // Just in case.
-	file, err := fs.Create(from)
+func TestDerive(t *testing.T) {
+	root := path.Join(testDir, "TestDerive")
+	defer fs.RemoveAll(root)
+	photos, thumbs := path.Join(root, "photos"), path.Join(root, "photos/.thumbs")
+	var mu sync.Mutex
+	var seen []string
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(),
+		Derive(photos, thumbs, func(name string, data []byte) (map[string][]byte, error) {
+			mu.Lock()
+			seen = append(seen, name)
+			mu.Unlock()
+			return map[string][]byte{"upper": bytes.ToUpper(data), "small": data[:2]}, nil
+		}))
+	if err := afero.WriteFile(mfs, path.Join(photos, "2020/a.jpg"), []byte("hello"), 0640); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := mfs.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	for name, want := range map[string]string{"2020/a.jpg/upper": "HELLO", "2020/a.jpg/small": "he"} {
+		key := mfs.key(path.Join(thumbs, name))
+		if data, err := fetchObject(key, mfs.bucket()); string(data) != want {
+			t.Errorf("derivative %s: %q, %v want %q", name, data, err, want)
+		}
+	}
+	// derivatives under the prefix aren't derived from again
+	if len(seen) != 1 {
+		t.Errorf("processor saw %q want only the photo", seen)
+	}
+
+	broken := errors.New("broken")
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(),
+		Derive(photos, thumbs, func(string, []byte) (map[string][]byte, error) {
+			return nil, broken
+		}))
+	afero.WriteFile(mfs, path.Join(photos, "b.jpg"), []byte("hello"), 0640)
+	if err := mfs.Close(); !errors.Is(err, broken) {
+		t.Errorf("Close after a failed derivation = %v want %v", err, broken)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	var connect time.Duration
+	check := func(b *s3.Bucket) error {
+		connect = b.S3.ConnectTimeout
+		return nil
+	}
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ConnectTimeout(time.Second))
+	if mfs.do("test", "TestTimeouts", check); connect != time.Second {
+		t.Errorf("connect timeout %v want %v", connect, time.Second)
+	}
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), ConnectTimeout(time.Hour), RequestTimeout(time.Minute))
+	if mfs.do("test", "TestTimeouts", check); connect > time.Minute {
+		t.Errorf("connect timeout %v outlasts the request timeout", connect)
+	}
+
+	// only time spent waiting in Read counts
+	clock := &timerClock{timers: make(chan *testTimer, 10)}
+	body := newIdleBody(ioutil.NopCloser(strings.NewReader("hello")), time.Second, clock)
+	b := make([]byte, 2)
+	body.Read(b)
+	first := <-clock.timers
+	first.fire()
+	if n, err := body.Read(b); n != 2 || err != nil {
+		t.Errorf("read after a pause = %d, %v", n, err)
+	}
+	if again := <-clock.timers; again != first {
+		t.Errorf("second Read made another timer")
+	}
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	body = newIdleBody(pr, time.Second, clock)
+	read := make(chan error)
+	go func() {
+		_, err := body.Read(b)
+		read <- err
+	}()
+	(<-clock.timers).fire()
+	if err := <-read; err != ErrIdleTimeout {
+		t.Errorf("read of a stalled body = %v want %v", err, ErrIdleTimeout)
+	}
+}
+
+// timerClock is a TimerClock whose timers the test fires, handing each
+// one to timers whenever it's started.
+type timerClock struct{ timers chan *testTimer }
+
+func (c *timerClock) Now() time.Time { return time.Time{} }
+
+func (c *timerClock) After(time.Duration) <-chan time.Time { return nil }
+
+func (c *timerClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &testTimer{c: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+type testTimer struct {
+	c      *timerClock
+	f      func()
+	mu     sync.Mutex
+	active bool
+}
+
+func (t *testTimer) Reset(time.Duration) bool {
+	t.mu.Lock()
+	was := t.active
+	t.active = true
+	t.mu.Unlock()
+	t.c.timers <- t
+	return was
+}
+
+func (t *testTimer) Stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+// fire calls the timer's function, if it's still pending.
+func (t *testTimer) fire() {
+	if t.Stop() {
+		t.f()
+	}
+}
+
+func TestSection(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	name := path.Join(testDir, "TestSection")
+	defer mfs.Remove(name)
+	afero.WriteFile(mfs, name, []byte("0123456789"), 0640)
+
+	s := mfs.Section(name, 2, 5)
+	if data, err := ioutil.ReadAll(s); string(data) != "23456" {
+		t.Errorf("ReadAll = %q, %v want %q", data, err, "23456")
+	}
+	b := make([]byte, 2)
+	s.Seek(1, io.SeekStart)
+	if _, err := io.ReadFull(s, b); string(b) != "34" {
+		t.Errorf("read after Seek = %q, %v want %q", b, err, "34")
+	}
+
+	// reads across blocks fetch each once
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	r := &rangeReader{fs: mfs, name: name, block: 4}
+	b = make([]byte, 8)
+	for i := 0; i < 2; i++ {
+		if n, err := r.ReadAt(b, 1); string(b[:n]) != "12345678" {
+			t.Errorf("ReadAt = %q, %v want %q", b[:n], err, "12345678")
+		}
+	}
+	if c := mfs.CacheStats().Caches[SectionCache]; c.Misses != 3 || c.Hits != 3 {
+		t.Errorf("%s counts = %+v want 3 misses, 3 hits", SectionCache, c)
+	}
+	if n, err := r.ReadAt(b, 6); n != 4 || err != io.EOF {
+		t.Errorf("ReadAt past the end = %d, %v want 4, EOF", n, err)
+	}
+
+	// an overwrite between blocks fails the read rather than mixing versions
+	r = &rangeReader{fs: mfs, name: name, block: 4}
+	if n, err := r.ReadAt(b[:4], 0); string(b[:n]) != "0123" {
+		t.Errorf("ReadAt = %q, %v want %q", b[:n], err, "0123")
+	}
+	afero.WriteFile(mfs, name, []byte("abcdefghij"), 0640)
+	if _, err := r.ReadAt(b[:4], 4); !errors.Is(err, ErrChanged) {
+		t.Errorf("ReadAt after an overwrite = %v want %v", err, ErrChanged)
+	}
+}
+
+func TestHTTPFs(t *testing.T) {
+	root := path.Join(testDir, "TestHTTPFs")
+	defer fs.RemoveAll(root)
+	afero.WriteFile(fs, path.Join(root, "a.txt"), []byte("hello world"), 0640)
+	afero.WriteFile(fs, path.Join(root, "sub/index.html"), []byte("<p>index</p>"), 0640)
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	srv := httptest.NewServer(http.FileServer(NewHTTPFs(mfs, root)))
+	defer srv.Close()
+
+	get := func(p, rng string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+p, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", p, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	if resp, body := get("/a.txt", ""); body != "hello world" || resp.Header.Get("Last-Modified") == "" {
+		t.Errorf("GET /a.txt = %q, Last-Modified %q", body, resp.Header.Get("Last-Modified"))
+	}
+	if resp, body := get("/a.txt", "bytes=6-"); resp.StatusCode != http.StatusPartialContent || body != "world" {
+		t.Errorf("GET /a.txt bytes=6- = %d %q want %d %q", resp.StatusCode, body, http.StatusPartialContent, "world")
+	}
+	if _, body := get("/sub/", ""); body != "<p>index</p>" {
+		t.Errorf("GET /sub/ = %q want the index", body)
+	}
+	if _, body := get("/", ""); !strings.Contains(body, `href="a.txt"`) || !strings.Contains(body, `href="sub/"`) {
+		t.Errorf("GET / listed %q", body)
+	}
+	if resp, _ := get("/missing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /missing = %d want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// unflushed writes change neither the body nor its length
+	f, _ := mfs.OpenFile(path.Join(root, "a.txt"), os.O_WRONLY|os.O_APPEND, 0640)
+	f.Write([]byte("!!!"))
+	if resp, body := get("/a.txt", ""); body != "hello world" || resp.ContentLength != 11 {
+		t.Errorf("GET /a.txt with unflushed writes = %q, length %d want %q, 11", body, resp.ContentLength, "hello world")
+	}
+	f.Close()
+}
+
+func TestOpenIfModifiedSince(t *testing.T) {
+	name := path.Join(testDir, "TestOpenIfModifiedSince")
+	defer fs.Remove(name)
+	afero.WriteFile(fs, name, []byte("v1"), 0640)
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f, err := mfs.OpenIfModifiedSince(name, time.Time{})
 	if err != nil {
-		t.Fatalf("open %q failed: %v", to, err)
+		t.Fatalf("first poll: %v", err)
 	}
-	_, err = file.WriteString("Hello there.")
+	if data, err := ioutil.ReadAll(f); string(data) != "v1" {
+		t.Errorf("first poll read %q, %v want %q", data, err, "v1")
+	}
+	fi, _ := f.Stat()
+	f.Close()
+	if _, err := mfs.OpenIfModifiedSince(name, fi.ModTime()); !errors.Is(err, ErrNotModified) {
+		t.Errorf("poll of an unchanged object = %v want %v", err, ErrNotModified)
+	}
+	if _, err := mfs.OpenIfModifiedSince(name+"-missing", time.Time{}); !os.IsNotExist(err) {
+		t.Errorf("poll of a missing object = %v want not found", err)
+	}
+
+	// a changed object is opened from the GET alone, and handles open on
+	// the file it replaces keep what they read
+	var heads int
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Metrics(RecorderFunc(func(m Metric) {
+		if m.Cache == HeadCache && m.Kind == CacheMiss {
+			heads++
+		}
+	})))
+	old, _ := mfs.OpenIfModifiedSince(name, time.Time{})
+	b := make([]byte, 1)
+	old.Read(b)
+	afero.WriteFile(fs, name, []byte("v2"), 0640)
+	f, err = mfs.OpenIfModifiedSince(name, time.Time{})
 	if err != nil {
-		t.Fatalf("write %q failed: %v", to, err)
+		t.Fatalf("poll of a changed object: %v", err)
 	}
-	if err = file.Close(); err != nil {
-		t.Errorf("close %q failed: %v", to, err)
+	if data, err := ioutil.ReadAll(f); string(data) != "v2" {
+		t.Errorf("poll of a changed object read %q, %v want %q", data, err, "v2")
 	}
-	time.Sleep(1 * time.Second)
-	err = fs.Rename(from, to)
+	if data, err := ioutil.ReadAll(old); string(data) != "1" {
+		t.Errorf("handle open before the poll read %q, %v want %q", data, err, "1")
+	}
+	if heads != 0 {
+		t.Errorf("polls sent %d HEADs, want 0", heads)
+	}
+}
+
+func TestChmodPrefix(t *testing.T) {
+	dir := path.Join(testDir, "TestChmodPrefix")
+	defer fs.RemoveAll(dir)
+	writer := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata())
+	for _, name := range []string{"a", "sub/b"} {
+		afero.WriteFile(writer, path.Join(dir, name), []byte("hello"), 0640)
+	}
+	f, _ := writer.Open(path.Join(dir, "a"))
+	f.(*InMemoryFile).SetXattr("owner", "data-team")
+	f.Close()
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata())
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := mfs.ChmodPrefix(dir+"/", 0600, nil); err != nil {
+		t.Fatalf("ChmodPrefix: %v", err)
+	}
+	if err := mfs.ChtimesPrefix(dir+"/", mtime, mtime, nil); err != nil {
+		t.Fatalf("ChtimesPrefix: %v", err)
+	}
+
+	reader := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), PosixMetadata())
+	for _, name := range []string{"a", "sub/b"} {
+		fi, err := reader.Stat(path.Join(dir, name))
+		if err != nil || fi.Mode() != 0600 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s after the prefix changes: %v, %v want %v, %v", name, fi, err, os.FileMode(0600), mtime)
+		}
+	}
+	f, _ = reader.Open(path.Join(dir, "a"))
+	if v, err := f.(*InMemoryFile).GetXattr("owner"); v != "data-team" {
+		t.Errorf("xattr after ChmodPrefix = %q, %v want %q", v, err, "data-team")
+	}
+
+	// a time change doesn't store a mode the object never had
+	plain := path.Join(dir, "plain/c")
+	afero.WriteFile(fs, plain, []byte("hello"), 0640)
+	if err := mfs.ChtimesPrefix(path.Dir(plain), mtime, mtime, nil); err != nil {
+		t.Fatalf("ChtimesPrefix: %v", err)
+	}
+	resp, err := reader.headFresh(plain)
 	if err != nil {
-		t.Fatalf("rename %q, %q failed: %v", to, from, err)
+		t.Fatalf("HEAD %s: %v", plain, err)
 	}
-	defer fs.Remove(to)
-	_, err = fs.Stat(to)
+	if v := resp.Header.Get("X-Amz-Meta-" + metaMode); v != "" {
+		t.Errorf("mode stored by ChtimesPrefix = %q want none", v)
+	}
+
+	// nor does a mode change lose the headers af3ro didn't write
+	kept := path.Join(dir, "kept/d")
+	b := mfs.bucket()
+	err = b.Put(mfs.key(kept), []byte("a,b"), "text/csv", s3.Private, s3.Options{
+		SSE:          true,
+		CacheControl: "max-age=60",
+		Meta:         map[string][]string{"owner": {"data-team"}},
+	})
 	if err != nil {
-		t.Errorf("stat %q failed: %v", to, err)
+		t.Fatal(err)
+	}
+	if err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).ChmodPrefix(path.Dir(kept), 0644, nil); err != nil {
+		t.Fatalf("ChmodPrefix: %v", err)
+	}
+	if resp, err = reader.headFresh(kept); err != nil {
+		t.Fatalf("HEAD %s: %v", kept, err)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":                 "text/csv",
+		"Cache-Control":                "max-age=60",
+		"X-Amz-Server-Side-Encryption": "AES256",
+		"X-Amz-Meta-Owner":             "data-team",
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Errorf("%s after ChmodPrefix = %q want %q", k, got, want)
+		}
+	}
+	stale := http.Header{}
+	stale.Set("x-amz-metadata-directive", "REPLACE")
+	stale.Set("x-amz-copy-source-if-match", `"stale"`)
+	if err := mfs.copyOver(b, mfs.key(kept), stale); !isPreconditionFailed(err) {
+		t.Errorf("copyOver from a stale ETag = %v want a precondition failure", err)
 	}
 }
 
-func TestTruncate(t *testing.T) {
-	f := newFile("TestTruncate", fs, t)
+func TestPresign(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), SSE(),
+		TransformWrites("/locked", func(name string, data []byte) ([]byte, error) { return data, nil }))
+	name := path.Join(testDir, "TestPresign.txt")
+	if u, err := mfs.PresignGet(name, time.Minute); err != nil || !strings.Contains(u, mfs.key(name)) {
+		t.Errorf("PresignGet = %q, %v", u, err)
+	}
+	u, hdr, err := mfs.PresignPut(name, time.Minute, &PresignOptions{Mode: 0644})
+	if err != nil || !strings.Contains(u, mfs.key(name)) {
+		t.Errorf("PresignPut = %q, %v", u, err)
+	}
+	for k, want := range map[string]string{
+		"Content-Type":                 mfs.contentType(name),
+		"X-Amz-Acl":                    string(s3.PublicRead),
+		"X-Amz-Server-Side-Encryption": "AES256",
+	} {
+		if got := hdr.Get(k); got != want {
+			t.Errorf("PresignPut header %s = %q want %q", k, got, want)
+		}
+	}
+	if _, _, err := mfs.PresignPut("/locked/a", time.Minute, nil); !errors.Is(err, ErrTransformedWrite) {
+		t.Errorf("PresignPut of a transformed file = %v want %v", err, ErrTransformedWrite)
+	}
+	if _, err := mfs.PresignGet(name, 0); !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("PresignGet with no expiry = %v want %v", err, os.ErrInvalid)
+	}
+
+	// signing sends no request for faults to be injected into
+	chaotic := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Chaos(ChaosConfig{ErrorRate: 1}))
+	if _, err := chaotic.PresignGet(name, time.Minute); err != nil {
+		t.Errorf("PresignGet with every request failing = %v", err)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	root := path.Join(testDir, "TestSeed")
+	defer fs.RemoveAll(root)
+	afero.WriteFile(fs, path.Join(root, "index.html"), []byte("changed"), 0640)
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	assets := fstest.MapFS{
+		"index.html":   {Data: []byte("default")},
+		"css/site.css": {Data: []byte("body {}")},
+	}
+	if err := mfs.Seed(assets, root); err != nil {
+		t.Fatalf("Seed: %v", err)
+	}
+	mem := afero.NewMemMapFs()
+	afero.WriteFile(mem, "/assets/js/app.js", []byte("main()"), 0640)
+	if err := mfs.SeedFs(mem, "/assets", root); err != nil {
+		t.Fatalf("SeedFs: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"index.html":   "changed",
+		"css/site.css": "body {}",
+		"js/app.js":    "main()",
+	} {
+		key := mfs.key(path.Join(root, name))
+		if data, err := fetchObject(key, mfs.bucket()); string(data) != want {
+			t.Errorf("%s after seeding: %q, %v want %q", name, data, err, want)
+		}
+	}
+
+	// another replica seeding and changing a file after the listing
+	other := path.Join(root, "raced.txt")
+	raced := racingFS{fstest.MapFS{"raced.txt": {Data: []byte("default")}}, func() {
+		afero.WriteFile(fs, other, []byte("changed"), 0640)
+	}}
+	if err := NewS3Fs(Bucket("test.rsb.io"), EnvAuth()).Seed(raced, root); err != nil {
+		t.Fatalf("Seed racing another replica: %v", err)
+	}
+	if data, err := fetchObject(mfs.key(other), mfs.bucket()); string(data) != "changed" {
+		t.Errorf("raced.txt after seeding: %q, %v want %q", data, err, "changed")
+	}
+}
+
+// racingFS is a MapFS that calls before as each file is read.
+type racingFS struct {
+	fstest.MapFS
+	before func()
+}
+
+func (r racingFS) ReadFile(name string) ([]byte, error) {
+	r.before()
+	return r.MapFS.ReadFile(name)
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return fn(req) }
+
+func TestHTTPClient(t *testing.T) {
+	var queries []string
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), HTTPTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		queries = append(queries, req.URL.RawQuery)
+		body := `<Tagging><TagSet><Tag><Key>team</Key><Value>data</Value></Tag></TagSet></Tagging>`
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})))
+	tags, err := mfs.tags("TestHTTPClient")
+	if err != nil || tags["team"] != "data" {
+		t.Errorf("tags = %v, %v want team=data", tags, err)
+	}
+	if len(queries) != 1 || !strings.Contains(queries[0], "tagging") {
+		t.Errorf("transport saw %q want one tagging request", queries)
+	}
+}
+
+func TestSync(t *testing.T) {
+	f := newFile("TestSync", fs, t)
 	defer fs.Remove(f.Name())
-	defer f.Close()
+	f.WriteString("hello")
+	if err := f.Sync(); err != nil {
+		t.Fatalf("sync %q failed: %v", f.Name(), err)
+	}
+	if data, err := fetchObject(f.Name(), fs.bucket()); string(data) != "hello" {
+		t.Errorf("after Sync: have %q, %v want %q", data, err, "hello")
+	}
+	f.WriteString(", world")
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %q failed: %v", f.Name(), err)
+	}
+	if data, err := fetchObject(f.Name(), fs.bucket()); string(data) != "hello, world" {
+		t.Errorf("after Close: have %q, %v want %q", data, err, "hello, world")
+	}
+	if err := f.Sync(); err != afero.ErrFileClosed {
+		t.Errorf("Sync after Close = %v want %v", err, afero.ErrFileClosed)
+	}
+}
 
-	checkSize(t, f, 0)
+func TestWriteThrough(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), WriteThrough())
+	f := newFile("TestWriteThrough", mfs, t)
+	defer mfs.Remove(f.Name())
+	defer f.Close()
 	f.WriteString("hello, world\n")
-	checkSize(t, f, 13)
-	f.Truncate(10)
-	checkSize(t, f, 10)
-	f.Truncate(1024)
-	checkSize(t, f, 1024)
-	f.Truncate(0)
-	checkSize(t, f, 0)
-	_, err := f.Write([]byte("surprise!"))
-	if err == nil {
-		checkSize(t, f, 13+9) // wrote at offset past where hello, world was.
+	if data, err := fetchObject(f.Name(), mfs.bucket()); string(data) != "hello, world\n" {
+		t.Errorf("after Write: have %q, %v want %q", data, err, "hello, world\n")
+	}
+	f.Truncate(5)
+	if data, err := fetchObject(f.Name(), mfs.bucket()); string(data) != "hello" {
+		t.Errorf("after Truncate: have %q, %v want %q", data, err, "hello")
+	}
+	if dirty := mfs.Dirty(); len(dirty) != 0 {
+		t.Errorf("Dirty() = %q want none", dirty)
+	}
+}
+
+func TestFlushEvery(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f := newFile("TestFlushEvery", mfs, t)
+	defer mfs.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("unclosed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mfs.FlushEvery(ctx, time.Millisecond)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		data, err := fetchObject(f.Name(), mfs.bucket())
+		if string(data) == "unclosed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a second after FlushEvery: have %q, %v want %q", data, err, "unclosed")
+		}
+	}
+	if dirty := mfs.dirtyFiles(); len(dirty) != 0 {
+		t.Errorf("after FlushEvery: %d files left dirty", len(dirty))
+	}
+
+	// another handle reads while the file is written and flushed
+	r, _ := mfs.Open(f.Name())
+	defer r.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b := make([]byte, 4)
+		for i := 0; i < 200; i++ {
+			r.Seek(0, io.SeekStart)
+			r.Read(b)
+			r.ReadAt(b, 2)
+			r.Stat()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		f.WriteAt([]byte("U"), 0)
+	}
+	<-done
+}
+
+func TestDirty(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), FlushRetries(0))
+	open := newFile("TestDirtyOpen", mfs, t)
+	defer mfs.Remove(open.Name())
+	defer open.Close()
+	open.WriteString("unclosed")
+	if dirty := mfs.Dirty(); len(dirty) != 0 {
+		t.Errorf("with a file open: Dirty() = %q want none", dirty)
+	}
+
+	mfs.chaos = &ChaosConfig{Ops: []string{"write"}, ErrorRate: 1}
+	f := newFile("TestDirtyFailed", mfs, t)
+	defer mfs.Remove(f.Name())
+	f.WriteString("kept")
+	if err := f.Close(); !errors.Is(err, ErrInjected) {
+		t.Fatalf("Close = %v want %v", err, ErrInjected)
+	}
+	if dirty := mfs.Dirty(); len(dirty) != 1 || dirty[0] != f.Name() {
+		t.Errorf("after a failed Close: Dirty() = %q want %q", dirty, f.Name())
+	}
+
+	// a file being flushed again isn't waited for, but is still listed
+	ff := f.(*InMemoryFile)
+	ff.mu.Lock()
+	done := make(chan []string)
+	go func() { done <- mfs.Dirty() }()
+	select {
+	case dirty := <-done:
+		if len(dirty) != 1 || dirty[0] != f.Name() {
+			t.Errorf("during a flush: Dirty() = %q want %q", dirty, f.Name())
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Dirty() waited for a flush")
+	}
+	ff.mu.Unlock()
+
+	mfs.chaos = nil
+	if err := mfs.Flush(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if dirty := mfs.Dirty(); len(dirty) != 0 {
+		t.Errorf("after Flush: Dirty() = %q want none", dirty)
+	}
+}
+
+func TestBackgroundWork(t *testing.T) {
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	mfs.FlushEvery(context.Background(), time.Millisecond)
+	mfs.spawn(context.Background(), "test", func(context.Context) error {
+		panic("boom")
+	})
+	err := mfs.Close() // returns once FlushEvery has stopped
+	if err == nil || !strings.Contains(err.Error(), "test panicked: boom") {
+		t.Errorf("Close() = %v want the panic", err)
+	}
+	if mfs.Err() != err {
+		t.Errorf("Err() = %v want %v", mfs.Err(), err)
+	}
+
+	ran := make(chan error, 1)
+	mfs.spawn(context.Background(), "late", func(ctx context.Context) error {
+		ran <- ctx.Err()
+		return nil
+	})
+	if err := <-ran; err != context.Canceled {
+		t.Errorf("work started after Close ran under %v want %v", err, context.Canceled)
+	}
+
+	// a prefetcher stuck reading a body doesn't hold up Close
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	body, w := io.Pipe()
+	defer w.Close()
+	newPrefetcher(mfs, body, mib)
+	closed := make(chan error)
+	go func() { closed <- mfs.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("Close waited for a prefetcher's read")
+	}
+
+	// a panic in work a caller waits on is that work's error
+	mfs = NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Multipart(0, 5*mib, 2))
+	err = mfs.parallel(3, func(i int) error {
+		if i == 1 {
+			panic("boom")
+		}
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "panicked: boom") || mfs.Err() != err {
+		t.Errorf("parallel = %v, Err() = %v want the panic", err, mfs.Err())
 	}
 }
 
@@ -203,6 +4193,36 @@ func TestSeek(t *testing.T) {
 			t.Errorf("#%d: Seek(%v, %v) = %v, %v want %v, nil", i, tt.in, tt.whence, off, err, tt.out)
 		}
 	}
+	if off, err := f.Seek(-1, 0); err == nil {
+		t.Errorf("Seek(-1, 0) = %v, nil want an error", off)
+	}
+}
+
+func TestSeekEnd(t *testing.T) {
+	name := path.Join(testDir, "TestSeekEnd")
+	if err := afero.WriteFile(fs, name, []byte("hello, world"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(name)
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f, err := mfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if off, err := f.Seek(-5, 2); off != 7 || err != nil {
+		t.Fatalf("Seek(-5, 2) = %v, %v want 7, nil", off, err)
+	}
+	if f.(*InMemoryFile).loaded {
+		t.Error("Seek(-5, 2) downloaded the object")
+	}
+	if data, err := ioutil.ReadAll(f); string(data) != "world" || err != nil {
+		t.Errorf("read after Seek(-5, 2) = %q, %v want %q", data, err, "world")
+	}
+	if off, err := f.Seek(-13, 2); err == nil {
+		t.Errorf("Seek(-13, 2) = %v, nil want an error", off)
+	}
 }
 
 func TestReadAt(t *testing.T) {
@@ -223,6 +4243,34 @@ func TestReadAt(t *testing.T) {
 	}
 }
 
+func TestReadAtRange(t *testing.T) {
+	name := path.Join(testDir, "TestReadAtRange")
+	if err := afero.WriteFile(fs, name, []byte("hello, world\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(name)
+
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth())
+	f, err := mfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 5)
+	if n, err := f.ReadAt(b, 7); n != 5 || err != nil || string(b) != "world" {
+		t.Errorf("ReadAt 7: %d, %v, %q want 5, nil, %q", n, err, b[:n], "world")
+	}
+	if n, err := f.ReadAt(b, 10); n != 3 || err != io.EOF || string(b[:n]) != "ld\n" {
+		t.Errorf("ReadAt 10: %d, %v, %q want 3, EOF, %q", n, err, b[:n], "ld\n")
+	}
+	if f.(*InMemoryFile).loaded {
+		t.Error("ReadAt downloaded the whole object")
+	}
+	if off, _ := f.Seek(0, 1); off != 0 {
+		t.Errorf("ReadAt moved the offset to %d", off)
+	}
+}
+
 func TestWriteAt(t *testing.T) {
 	f := newFile("TestWriteAt", fs, t)
 	defer fs.Remove(f.Name())
@@ -353,3 +4401,31 @@ func checkSize(t *testing.T, f afero.File, size int64) {
 		t.Errorf("Stat %q: size %d want %d", f.Name(), dir.Size(), size)
 	}
 }
+
+func TestBulkCheckpointStopsAtFailure(t *testing.T) {
+	dir := path.Join(testDir, "TestBulkCheckpointStopsAtFailure")
+	failed := strings.TrimPrefix(path.Join(dir, "2"), "/")
+	mfs := NewS3Fs(Bucket("test.rsb.io"), EnvAuth(), Chaos(ChaosConfig{
+		Ops:       []string{"reencrypt"},
+		Names:     []string{failed},
+		ErrorRate: 1,
+	}))
+	for i := 0; i < 5; i++ {
+		f, _ := mfs.Create(path.Join(dir, strconv.Itoa(i)))
+		f.WriteString("secret")
+		f.Close()
+	}
+	defer mfs.RemoveAll(dir)
+
+	var last BulkProgress
+	err := mfs.ReEncryptPrefix(dir+"/", "alias/af3ro-test", &BulkOptions{
+		Concurrency: 1,
+		Progress:    func(p BulkProgress) { last = p },
+	})
+	if berr, ok := err.(*BulkError); !ok || len(berr.Failed) != 1 {
+		t.Fatalf("reencrypt = %v, want one failure", err)
+	}
+	if want := mfs.key(path.Join(dir, "1")); last.Done != 4 || last.Failed != 1 || last.Checkpoint != want {
+		t.Errorf("final progress %+v, want 4 done and 1 failed up to %s", last, want)
+	}
+}
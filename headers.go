@@ -0,0 +1,126 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// Headers are HTTP headers stored with an object and sent back whenever
+// it's read, such as by CloudFront. Zero fields aren't set.
+type Headers struct {
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	Expires            time.Time
+}
+
+// over returns h with the fields set in o replacing its own.
+func (h Headers) over(o Headers) Headers {
+	if o.CacheControl != "" {
+		h.CacheControl = o.CacheControl
+	}
+	if o.ContentDisposition != "" {
+		h.ContentDisposition = o.ContentDisposition
+	}
+	if o.ContentEncoding != "" {
+		h.ContentEncoding = o.ContentEncoding
+	}
+	if !o.Expires.IsZero() {
+		h.Expires = o.Expires
+	}
+	return h
+}
+
+// headerRule is a HeaderRule.
+type headerRule struct {
+	pattern string
+	headers Headers
+}
+
+// HeaderRule stores h with the objects of files whose names match
+// pattern, as for path.Match. Patterns without a slash are matched
+// against the base name, so "*.css" matches CSS files anywhere. Where
+// several rules match, later ones override the fields they set, and a
+// file's own SetHeaders overrides them all.
+func HeaderRule(pattern string, h Headers) Option {
+	return func(s *MemS3Fs) {
+		s.headerRules = append(s.headerRules, headerRule{pattern, h})
+	}
+}
+
+// headers returns the headers the rules give name.
+func (s MemS3Fs) headers(name string) Headers {
+	var h Headers
+	for _, r := range s.headerRules {
+		subject := path.Clean("/" + name)
+		if !strings.Contains(r.pattern, "/") {
+			subject = path.Base(subject)
+		}
+		if ok, _ := path.Match(r.pattern, subject); ok {
+			h = h.over(r.headers)
+		}
+	}
+	return h
+}
+
+// apply sets the headers goamz has options for in opts.
+func (h Headers) apply(opts s3.Options) s3.Options {
+	opts.CacheControl = h.CacheControl
+	opts.ContentDisposition = h.ContentDisposition
+	opts.ContentEncoding = h.ContentEncoding
+	return opts
+}
+
+// putHeaders are the request headers for uploading an object of type
+// ctype with opts and h in one request, for headers such as Expires that
+// goamz has no option for.
+func putHeaders(ctype string, opts s3.Options, h Headers) map[string][]string {
+	hdr := http.Header{}
+	hdr.Set("Content-Type", ctype)
+	for k, v := range opts.Meta {
+		hdr[http.CanonicalHeaderKey("X-Amz-Meta-"+k)] = v
+	}
+	if opts.SSEKMS {
+		hdr.Set("x-amz-server-side-encryption", "aws:kms")
+		if opts.SSEKMSKeyId != "" {
+			hdr.Set("x-amz-server-side-encryption-aws-kms-key-id", opts.SSEKMSKeyId)
+		}
+	} else if opts.SSE {
+		hdr.Set("x-amz-server-side-encryption", "AES256")
+	}
+	if opts.StorageClass != "" {
+		hdr.Set("x-amz-storage-class", string(opts.StorageClass))
+	}
+	if opts.CacheControl != "" {
+		hdr.Set("Cache-Control", opts.CacheControl)
+	}
+	if opts.ContentDisposition != "" {
+		hdr.Set("Content-Disposition", opts.ContentDisposition)
+	}
+	if opts.ContentEncoding != "" {
+		hdr.Set("Content-Encoding", opts.ContentEncoding)
+	}
+	if !h.Expires.IsZero() {
+		hdr.Set("Expires", h.Expires.UTC().Format(http.TimeFormat))
+	}
+	return hdr
+}
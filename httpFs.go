@@ -0,0 +1,175 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HTTPFs serves the files under a directory of a MemS3Fs as an
+// http.FileSystem, so http.FileServer can serve a bucket directly.
+type HTTPFs struct {
+	fs   *MemS3Fs
+	root string
+}
+
+// NewHTTPFs returns an http.FileSystem of the files under root. Files
+// are read with range GETs through Section, so Range requests fetch only
+// what they ask for, and each request gets its own reader. What's served
+// is what's been flushed to S3, and a response whose object is
+// overwritten while it's being sent is cut short rather than mixing the
+// two.
+func NewHTTPFs(m *MemS3Fs, root string) *HTTPFs {
+	return &HTTPFs{fs: m, root: root}
+}
+
+func (h *HTTPFs) Open(name string) (http.File, error) {
+	if strings.Contains(name, "\x00") {
+		return nil, errors.New("http: invalid character in file path")
+	}
+	name = path.Join(h.root, path.Clean("/"+name))
+	if name == "" {
+		name = "/"
+	}
+	fi, err := h.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &httpDir{fs: h.fs, name: name, info: fi}, nil
+	}
+	info := &httpInfo{FileInfo: fi, modtime: fi.ModTime()}
+	var content io.ReadSeeker
+	if h.fs.wholeReads(name) {
+		// the size served has to be that of the contents read
+		data, _, err := h.fs.download("read", name)
+		if err != nil {
+			return nil, h.fs.readError("read", name, err)
+		}
+		content = bytes.NewReader(data)
+		info.size = int64(len(data))
+	} else {
+		// the headers served and every range read describe the object
+		// this HEAD found, whatever's cached or written since
+		resp, err := h.fs.headFresh(name)
+		if err != nil {
+			return nil, h.fs.readError("read", name, err)
+		}
+		info.size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		info.modtime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+		content = h.fs.section(name, etag, 0, info.size)
+	}
+	return &httpFile{ReadSeeker: content, info: info}, nil
+}
+
+// httpInfo is a served file's FileInfo, with the size and modification
+// time of the object served rather than of the file.
+type httpInfo struct {
+	os.FileInfo
+	size    int64
+	modtime time.Time
+}
+
+func (fi *httpInfo) Size() int64        { return fi.size }
+func (fi *httpInfo) ModTime() time.Time { return fi.modtime }
+
+// httpFile is a file served by HTTPFs.
+type httpFile struct {
+	io.ReadSeeker
+	info os.FileInfo
+}
+
+func (f *httpFile) Close() error { return nil }
+
+func (f *httpFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func (f *httpFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.info.Name(), Err: syscall.ENOTDIR}
+}
+
+// httpDir is a directory served by HTTPFs.
+type httpDir struct {
+	fs   *MemS3Fs
+	name string
+	info os.FileInfo
+
+	entries []os.FileInfo // not yet returned by Readdir
+	listed  bool
+}
+
+func (d *httpDir) Close() error { return nil }
+
+func (d *httpDir) Stat() (os.FileInfo, error) { return d.info, nil }
+
+func (d *httpDir) Read([]byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *httpDir) Seek(int64, int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: d.name, Err: syscall.EISDIR}
+}
+
+// Readdir lists the directory the first time it's called, then pages
+// through the listing as os.File does.
+func (d *httpDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		f, err := d.fs.Open(d.name)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range entries {
+			d.entries = append(d.entries, baseInfo{fi})
+		}
+		d.listed = true
+	}
+	if count <= 0 {
+		res := d.entries
+		d.entries = nil
+		return res, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	res := d.entries[:count]
+	d.entries = d.entries[count:]
+	return res, nil
+}
+
+// baseInfo is a FileInfo named by its base name alone, as http.FileServer
+// expects of a listing, where the cache names files by their paths.
+type baseInfo struct {
+	os.FileInfo
+}
+
+func (fi baseInfo) Name() string { return path.Base(fi.FileInfo.Name()) }
@@ -0,0 +1,184 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoIndex is returned by Search when the filesystem has no Indexer.
+var ErrNoIndex = errors.New("af3ro: no index configured")
+
+// IndexEntry is the metadata an Indexer keeps for an object.
+type IndexEntry struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// IndexQuery selects entries from an index. Zero fields match
+// everything.
+type IndexQuery struct {
+	Prefix         string
+	ContentType    string
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// Limit is the most entries returned.
+	Limit int
+}
+
+// Match reports whether e is selected by q.
+func (q IndexQuery) Match(e IndexEntry) bool {
+	switch {
+	case !strings.HasPrefix(e.Key, q.Prefix):
+		return false
+	case q.ContentType != "" && e.ContentType != q.ContentType:
+		return false
+	case e.Size < q.MinSize, q.MaxSize > 0 && e.Size > q.MaxSize:
+		return false
+	case !q.ModifiedAfter.IsZero() && !e.ModTime.After(q.ModifiedAfter):
+		return false
+	case !q.ModifiedBefore.IsZero() && !e.ModTime.Before(q.ModifiedBefore):
+		return false
+	}
+	return true
+}
+
+// An Indexer keeps the metadata of the filesystem's objects searchable,
+// so they can be found without listing the bucket. It's told about
+// every object the filesystem writes, renames and removes; objects
+// written by anything else aren't indexed.
+type Indexer interface {
+	Put(e IndexEntry) error
+	Delete(key string) error
+	Search(q IndexQuery) ([]IndexEntry, error)
+}
+
+// Index pushes the metadata of every object the filesystem writes to
+// idx and makes it available to Search. The index can fall behind the
+// bucket: when idx rejects an update, the change it describes has still
+// been made in S3, and the rejection is recorded as an IndexUpdate
+// metric.
+func Index(idx Indexer) Option {
+	return func(s *MemS3Fs) {
+		s.index = idx
+	}
+}
+
+// Search returns the entries of the filesystem's index selected by q,
+// ordered by key.
+func (m *MemS3Fs) Search(q IndexQuery) ([]IndexEntry, error) {
+	if m.index == nil {
+		return nil, ErrNoIndex
+	}
+	return m.index.Search(q)
+}
+
+// indexPut records the object written for name.
+func (m *MemS3Fs) indexPut(name string, size int64) {
+	if m.index == nil {
+		return
+	}
+	e := IndexEntry{
+		Key:         m.key(name),
+		Size:        size,
+		ContentType: m.contentType(name),
+		ModTime:     m.now(),
+	}
+	if err := m.index.Put(e); err != nil {
+		m.record(Metric{Kind: IndexUpdate, Name: name, Err: err})
+	}
+}
+
+// indexDelete forgets the object stored under key.
+func (m *MemS3Fs) indexDelete(key string) {
+	if m.index == nil {
+		return
+	}
+	if err := m.index.Delete(key); err != nil {
+		m.record(Metric{Kind: IndexUpdate, Name: key, Err: err})
+	}
+}
+
+// MemIndex is an Indexer held in memory. It can be saved to and loaded
+// from any writer, such as a file in the bucket, to outlive the process.
+type MemIndex struct {
+	mu      sync.RWMutex
+	entries map[string]IndexEntry
+}
+
+// NewMemIndex returns an empty MemIndex.
+func NewMemIndex() *MemIndex {
+	return &MemIndex{entries: make(map[string]IndexEntry)}
+}
+
+func (x *MemIndex) Put(e IndexEntry) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries[e.Key] = e
+	return nil
+}
+
+func (x *MemIndex) Delete(key string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.entries, key)
+	return nil
+}
+
+func (x *MemIndex) Search(q IndexQuery) ([]IndexEntry, error) {
+	x.mu.RLock()
+	var found []IndexEntry
+	for _, e := range x.entries {
+		if q.Match(e) {
+			found = append(found, e)
+		}
+	}
+	x.mu.RUnlock()
+	sort.Slice(found, func(i, j int) bool { return found[i].Key < found[j].Key })
+	if q.Limit > 0 && len(found) > q.Limit {
+		found = found[:q.Limit]
+	}
+	return found, nil
+}
+
+// Save writes the index to w as JSON.
+func (x *MemIndex) Save(w io.Writer) error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return json.NewEncoder(w).Encode(x.entries)
+}
+
+// Load replaces the index with one written by Save.
+func (x *MemIndex) Load(r io.Reader) error {
+	entries := make(map[string]IndexEntry)
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.entries = entries
+	x.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,372 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// maxListPage is the most keys S3 returns from one LIST request.
+const maxListPage = 1000
+
+// defaultDirSize is the Size directories report unless DirSize is set.
+const defaultDirSize = 42
+
+// newestUnder returns the modification time of the newest file under the
+// directory name, whether only in S3 or only in the cache, or the zero
+// time if it's empty or can't be listed.
+func (m *MemS3Fs) newestUnder(name string) time.Time {
+	var newest time.Time
+	prefix := m.dirPrefix(name)
+	err := m.eachKey("stat", prefix, func(k s3.Key) error {
+		if t, err := time.Parse(time.RFC3339, k.LastModified); err == nil && t.After(newest) {
+			newest = t
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}
+	}
+	m.rlock()
+	for p, f := range m.getData() {
+		ff, ok := f.(*InMemoryFile)
+		if ok && !ff.dir && strings.HasPrefix(m.key(p), prefix) && ff.modtime.After(newest) {
+			newest = ff.modtime
+		}
+	}
+	m.runlock()
+	return newest
+}
+
+// key is the S3 key for the file name, under the filesystem's Prefix.
+// goamz accepts keys with or without a leading slash, but listings
+// return them without. name is cleaned first, so it can't climb out of
+// the Prefix.
+func (m *MemS3Fs) key(name string) string {
+	k := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if m.root == "" {
+		return k
+	}
+	if k == "" {
+		return m.root
+	}
+	return m.root + "/" + k
+}
+
+// keyPrefix is the key prefix for a prefix of names, which unlike a name
+// may end part way through a path element.
+func (m *MemS3Fs) keyPrefix(prefix string) string {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if m.root == "" {
+		return prefix
+	}
+	return m.root + "/" + prefix
+}
+
+// nameOf is the name of the file stored under key, relative to the
+// filesystem's Prefix.
+func (m *MemS3Fs) nameOf(key string) string {
+	if m.root == "" {
+		return key
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(key, m.root), "/")
+}
+
+// dirPrefix is the listing prefix for the contents of the directory name.
+func (m *MemS3Fs) dirPrefix(name string) string {
+	k := m.key(name)
+	if k == "" {
+		return ""
+	}
+	return k + "/"
+}
+
+// nextMarker is where the listing after resp should start. S3 only sets
+// NextMarker when a delimiter was given.
+func nextMarker(resp *s3.ListResp) string {
+	if resp.NextMarker != "" {
+		return resp.NextMarker
+	}
+	marker := ""
+	if n := len(resp.Contents); n > 0 {
+		marker = resp.Contents[n-1].Key
+	}
+	if n := len(resp.CommonPrefixes); n > 0 && resp.CommonPrefixes[n-1] > marker {
+		marker = resp.CommonPrefixes[n-1]
+	}
+	return marker
+}
+
+// eachKey calls fn for every object whose key starts with prefix,
+// listing them a page at a time.
+func (m *MemS3Fs) eachKey(op, prefix string, fn func(s3.Key) error) error {
+	return m.eachKeyAfter(op, prefix, "", fn)
+}
+
+// eachKeyAfter is eachKey for the keys that sort after marker.
+func (m *MemS3Fs) eachKeyAfter(op, prefix, marker string, fn func(s3.Key) error) error {
+	for {
+		var resp *s3.ListResp
+		err := m.doRead(op, prefix, func(b *s3.Bucket) (err error) {
+			resp, err = b.List(prefix, "", marker, m.listPageSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range resp.Contents {
+			if err := fn(k); err != nil {
+				return err
+			}
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return nil
+		}
+		marker = nextMarker(resp)
+	}
+}
+
+// PaginatedReaddir is implemented by directories that can be read from
+// S3 a page at a time, for callers such as web UIs that only show the
+// first few entries of a large directory.
+type PaginatedReaddir interface {
+	// ReaddirPage lists up to max entries (S3's limit of 1000 if max is
+	// zero) following marker, which is "" for the first page. next is
+	// the marker for the following page, or "" after the last one.
+	ReaddirPage(marker string, max int) (infos []os.FileInfo, next string, err error)
+}
+
+var _ PaginatedReaddir = new(InMemoryFile)
+
+// ReaddirPage implements PaginatedReaddir. Unlike Readdir it only lists
+// what's in S3, so files that haven't been flushed are missing.
+func (f *InMemoryFile) ReaddirPage(marker string, max int) (infos []os.FileInfo, next string, err error) {
+	if f.closed {
+		return nil, "", afero.ErrFileClosed
+	}
+	if f.memDir == nil {
+		return nil, "", &os.PathError{Op: "readdir", Path: f.Name(), Err: syscall.ENOTDIR}
+	}
+	prefix := f.fs.dirPrefix(f.Name())
+	var resp *s3.ListResp
+	err = f.fs.doRead("readdir", f.Name(), func(b *s3.Bucket) (err error) {
+		resp, err = b.List(prefix, "/", marker, max)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	dirs := make(map[string]bool)
+	for _, p := range resp.CommonPrefixes {
+		infos = append(infos, f.listedDir(p).Info())
+		dirs[p] = true
+	}
+	for _, k := range resp.Contents {
+		if dir, ok := f.fs.markedDir(k.Key); ok {
+			if p := dir + "/"; p != prefix && !dirs[p] {
+				infos = append(infos, f.listedDir(p).Info())
+				dirs[p] = true
+			}
+		} else if k.Key != prefix {
+			infos = append(infos, f.listedFile(k).Info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	if resp.IsTruncated {
+		next = nextMarker(resp)
+	}
+	return infos, next, nil
+}
+
+// listedDir caches the subdirectory of f that a listing returned prefix
+// for.
+func (f *InMemoryFile) listedDir(prefix string) *InMemoryFile {
+	name := path.Join(f.Name(), path.Base(prefix))
+	f.fs.mkdir(name)
+	f.fs.rlock()
+	defer f.fs.runlock()
+	return f.fs.getData()[name].(*InMemoryFile)
+}
+
+// unknownSize is the objSize of a listed file whose size depends on
+// whether its object is encrypted, which only a HEAD tells.
+const unknownSize = -1
+
+// listedFile caches the file in f that a listing returned k for, unless
+// it's cached already, and returns whichever is cached.
+func (f *InMemoryFile) listedFile(k s3.Key) *InMemoryFile {
+	modtime, _ := time.Parse(time.RFC3339, k.LastModified)
+	size := k.Size
+	if f.fs.encryption != nil {
+		// a listing doesn't say whether the object is encrypted
+		size = unknownSize
+	}
+	cached := f.fs.addRemote(&InMemoryFile{fs: f.fs, fileData: &fileData{
+		name:    path.Join(f.Name(), path.Base(k.Key)),
+		mode:    0640,
+		modtime: modtime,
+		objSize: size,
+		etag:    strings.Trim(k.ETag, "\""),
+	}})
+	return cached.(*InMemoryFile)
+}
+
+// listing is what S3 holds directly under a prefix: the keys of its
+// objects and its "subdirectories".
+type listing struct {
+	keys     []s3.Key
+	prefixes []string
+}
+
+// listDir lists the objects and subdirectories directly under prefix,
+// reusing a listing made within the last PrefixCacheTTL.
+func (m *MemS3Fs) listDir(prefix string) (*listing, error) {
+	l, ok, expired := m.prefixes.get(prefix)
+	m.recordLookup(PrefixCache, prefix, ok, expired)
+	if ok {
+		return l, nil
+	}
+	l = &listing{}
+	marker := ""
+	for {
+		var resp *s3.ListResp
+		err := m.doRead("readdir", prefix, func(b *s3.Bucket) (err error) {
+			resp, err = b.List(prefix, "/", marker, m.listPageSize)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		l.keys = append(l.keys, resp.Contents...)
+		l.prefixes = append(l.prefixes, resp.CommonPrefixes...)
+		if !resp.IsTruncated {
+			break
+		}
+		marker = nextMarker(resp)
+	}
+	m.prefixes.put(prefix, l)
+	return l, nil
+}
+
+// maxPrefixEntries bounds how many listings a prefixCache holds. Once
+// it's full, expired listings are dropped, then arbitrary ones.
+const maxPrefixEntries = 1000
+
+// prefixCache remembers directory listings separately from object
+// metadata, since trees are re-rendered far more often than they change.
+// A nil *prefixCache remembers nothing.
+type prefixCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	clock   Clock
+	entries map[string]prefixEntry
+}
+
+type prefixEntry struct {
+	listing *listing
+	at      time.Time
+}
+
+func newPrefixCache(ttl time.Duration) *prefixCache {
+	return &prefixCache{ttl: ttl, entries: make(map[string]prefixEntry)}
+}
+
+// get returns the remembered listing of prefix, if any, and whether an
+// expired one was dropped.
+func (c *prefixCache) get(prefix string) (l *listing, ok, expired bool) {
+	if c == nil {
+		return nil, false, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[prefix]
+	if !ok {
+		return nil, false, false
+	}
+	if clockOr(c.clock).Now().Sub(e.at) > c.ttl {
+		delete(c.entries, prefix)
+		return nil, false, true
+	}
+	return e.listing, true, false
+}
+
+func (c *prefixCache) put(prefix string, l *listing) {
+	if c == nil {
+		return
+	}
+	c.putAt(prefix, l, clockOr(c.clock).Now())
+}
+
+// putAt is put of a listing made at at.
+func (c *prefixCache) putAt(prefix string, l *listing, at time.Time) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.Lock()
+	now := clockOr(c.clock).Now()
+	if _, ok := c.entries[prefix]; !ok && len(c.entries) >= maxPrefixEntries {
+		for p, e := range c.entries {
+			if now.Sub(e.at) > c.ttl {
+				delete(c.entries, p)
+			}
+		}
+		for p := range c.entries {
+			if len(c.entries) < maxPrefixEntries {
+				break
+			}
+			delete(c.entries, p)
+		}
+	}
+	c.entries[prefix] = prefixEntry{listing: l, at: at}
+	c.Unlock()
+}
+
+// forgetAncestors drops the listings that key could appear in.
+func (c *prefixCache) forgetAncestors(key string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	for prefix := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, prefix)
+		}
+	}
+	c.Unlock()
+}
+
+// forgetPrefix drops the listings of prefix and everything under it.
+func (c *prefixCache) forgetPrefix(prefix string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	for p := range c.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.entries, p)
+		}
+	}
+	c.Unlock()
+}
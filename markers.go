@@ -0,0 +1,311 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// ErrNoLinks is returned by Symlink when the filesystem's Markers have
+// no way of storing links.
+var ErrNoLinks = errors.New("af3ro: symbolic links aren't supported")
+
+// maxLinkHops is how many links Open follows before failing with ELOOP,
+// as Linux does.
+const maxLinkHops = 40
+
+// A MarkerCodec decides how directories and symbolic links, which S3
+// doesn't have, are stored as objects, so that the filesystem can share
+// a bucket with tools that have their own conventions for them. Keys
+// passed to a MarkerCodec are full keys, including the filesystem's
+// Prefix.
+type MarkerCodec interface {
+	// DirMarker is the key of the empty object marking the directory
+	// whose key is dir.
+	DirMarker(dir string) string
+	// MarkedDir returns the key of the directory key marks, if it's a
+	// marker.
+	MarkedDir(key string) (dir string, ok bool)
+	// EncodeLink returns the contents and metadata of an object that's a
+	// link to target, or ErrNoLinks.
+	EncodeLink(target string) (data []byte, meta map[string][]string, err error)
+	// IsLink reports whether the object with header, from a HEAD, is a
+	// link.
+	IsLink(header http.Header) bool
+	// LinkTarget returns the target of the link with contents data and
+	// header.
+	LinkTarget(data []byte, header http.Header) string
+}
+
+// Markers stores directories and symbolic links as c encodes them. Mkdir
+// and MkdirAll write directory markers, directories are found by their
+// markers as well as by what's in them, and Open follows links. Without
+// it, directories only exist while there are objects in them.
+func Markers(c MarkerCodec) Option {
+	return func(s *MemS3Fs) {
+		s.markers = c
+	}
+}
+
+// The conventions of other tools that store directories and links in S3.
+var (
+	// S3FSMarkers are s3fs-fuse's: directories are marked by "dir/", and
+	// links hold their target, with a mode of S_IFLNK in their metadata.
+	S3FSMarkers MarkerCodec = s3fsMarkers{}
+	// GoofysMarkers are goofys': directories are marked by "dir/", and
+	// links are empty, with their target in their metadata.
+	GoofysMarkers MarkerCodec = goofysMarkers{}
+	// S3AMarkers are Hadoop S3A's: directories are marked by "dir/".
+	// S3A has no links.
+	S3AMarkers MarkerCodec = slashMarkers{}
+	// S3NMarkers are those of Hadoop's older S3N and of EMRFS:
+	// directories are marked by "dir_$folder$". They have no links.
+	S3NMarkers MarkerCodec = folderMarkers{}
+)
+
+// slashMarkers mark directories with their key and a trailing slash.
+type slashMarkers struct{}
+
+func (slashMarkers) DirMarker(dir string) string { return dir + "/" }
+
+func (slashMarkers) MarkedDir(key string) (string, bool) {
+	if key == "" || !strings.HasSuffix(key, "/") {
+		return "", false
+	}
+	return strings.TrimSuffix(key, "/"), true
+}
+
+func (slashMarkers) EncodeLink(target string) ([]byte, map[string][]string, error) {
+	return nil, nil, ErrNoLinks
+}
+
+func (slashMarkers) IsLink(header http.Header) bool                    { return false }
+func (slashMarkers) LinkTarget(data []byte, header http.Header) string { return "" }
+
+// folderMarkers mark directories with their key and "_$folder$".
+type folderMarkers struct{ slashMarkers }
+
+const folderSuffix = "_$folder$"
+
+func (folderMarkers) DirMarker(dir string) string { return dir + folderSuffix }
+
+func (folderMarkers) MarkedDir(key string) (string, bool) {
+	if !strings.HasSuffix(key, folderSuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(key, folderSuffix), true
+}
+
+// The st_mode bits s3fs stores for links.
+const (
+	s3fsIFMT     = 0170000
+	s3fsIFLNK    = 0120000
+	s3fsLinkMode = s3fsIFLNK | 0777
+)
+
+type s3fsMarkers struct{ slashMarkers }
+
+func (s3fsMarkers) EncodeLink(target string) ([]byte, map[string][]string, error) {
+	return []byte(target), map[string][]string{"mode": {strconv.Itoa(s3fsLinkMode)}}, nil
+}
+
+func (s3fsMarkers) IsLink(header http.Header) bool {
+	mode, err := strconv.ParseUint(header.Get("X-Amz-Meta-Mode"), 10, 32)
+	return err == nil && mode&s3fsIFMT == s3fsIFLNK
+}
+
+func (s3fsMarkers) LinkTarget(data []byte, header http.Header) string { return string(data) }
+
+// goofysLinkMeta is the metadata goofys keeps a link's target in, unless
+// it's given another with --symlink-attr.
+const goofysLinkMeta = "--symlink-target"
+
+type goofysMarkers struct{ slashMarkers }
+
+func (goofysMarkers) EncodeLink(target string) ([]byte, map[string][]string, error) {
+	return nil, map[string][]string{goofysLinkMeta: {target}}, nil
+}
+
+func (goofysMarkers) IsLink(header http.Header) bool {
+	return header.Get("X-Amz-Meta-"+goofysLinkMeta) != ""
+}
+
+func (goofysMarkers) LinkTarget(data []byte, header http.Header) string {
+	return header.Get("X-Amz-Meta-" + goofysLinkMeta)
+}
+
+// putMarker writes the marker of the directory name, if there are
+// Markers.
+func (m *MemS3Fs) putMarker(name string) error {
+	key := m.key(name)
+	if m.markers == nil || key == "" {
+		return nil
+	}
+	marker := m.markers.DirMarker(key)
+	err := m.do("mkdir", name, func(b *s3.Bucket) error {
+		return b.Put(marker, nil, "application/x-directory", s3.Private, m.putOptions())
+	})
+	m.prefixes.forgetAncestors(marker)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+// putMarkers writes the markers of the directory name and its parents.
+func (m *MemS3Fs) putMarkers(name string) error {
+	if m.markers == nil {
+		return nil
+	}
+	var dirs []string
+	for dir := path.Clean(name); m.key(dir) != ""; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := m.putMarker(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markedDir returns the directory key marks, if it's a marker.
+func (m *MemS3Fs) markedDir(key string) (string, bool) {
+	if m.markers == nil {
+		return "", false
+	}
+	return m.markers.MarkedDir(key)
+}
+
+// hasMarker reports whether the directory name has a marker that a
+// listing of its contents wouldn't find.
+func (m *MemS3Fs) hasMarker(name string) (bool, error) {
+	marker, ok := m.markerOutside(name)
+	if !ok {
+		return false, nil
+	}
+	err := m.doRead("stat", name, func(b *s3.Bucket) error {
+		_, err := headName(marker, b)
+		return err
+	})
+	if err == afero.ErrFileNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// markerOutside returns the marker of the directory name if a listing
+// of its contents wouldn't find it.
+func (m *MemS3Fs) markerOutside(name string) (string, bool) {
+	key := m.key(name)
+	if m.markers == nil || key == "" {
+		return "", false
+	}
+	marker := m.markers.DirMarker(key)
+	return marker, !strings.HasPrefix(marker, m.dirPrefix(name))
+}
+
+// removeMarker deletes the marker of the directory name, if there are
+// Markers.
+func (m *MemS3Fs) removeMarker(name string) error {
+	key := m.key(name)
+	if m.markers == nil || key == "" {
+		return nil
+	}
+	marker := m.markers.DirMarker(key)
+	err := m.do("remove", name, func(b *s3.Bucket) error { return b.Del(marker) })
+	m.prefixes.forgetAncestors(marker)
+	return err
+}
+
+// Symlink makes newname a symbolic link to oldname, stored as the
+// filesystem's Markers encode links. Relative targets are resolved from
+// newname's directory, and absolute ones from the filesystem's root.
+func (m *MemS3Fs) Symlink(oldname, newname string) error {
+	if m.markers == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrNoLinks}
+	}
+	data, meta, err := m.markers.EncodeLink(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	m.rlock()
+	_, cached := m.getData()[newname]
+	m.runlock()
+	if _, err := m.head(newname); cached || err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: afero.ErrFileExists}
+	}
+	opts := m.putOptions()
+	if opts.Meta == nil {
+		opts.Meta = make(map[string][]string)
+	}
+	for k, v := range meta {
+		opts.Meta[k] = v
+	}
+	err = m.do("symlink", newname, func(b *s3.Bucket) error {
+		return b.Put(m.key(newname), data, "application/octet-stream", s3.Private, opts)
+	})
+	m.heads.forget(newname)
+	m.prefixes.forgetAncestors(m.key(newname))
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// Readlink returns the target of the symbolic link name.
+func (m *MemS3Fs) Readlink(name string) (string, error) {
+	resp, err := m.head(name)
+	if err != nil {
+		return "", m.readError("readlink", name, err)
+	}
+	if m.markers == nil || !m.markers.IsLink(resp.Header) {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return m.linkTarget(name, resp.Header)
+}
+
+// linkTarget reads the target of the link name, whose HEAD returned
+// header.
+func (m *MemS3Fs) linkTarget(name string, header http.Header) (string, error) {
+	var data []byte
+	err := m.doRead("readlink", name, func(b *s3.Bucket) (err error) {
+		data, err = fetchObject(m.key(name), b)
+		return err
+	})
+	if err != nil {
+		return "", m.readError("readlink", name, err)
+	}
+	return m.markers.LinkTarget(data, header), nil
+}
+
+// resolveLink is the name of target, a link in name's directory
+// points to.
+func resolveLink(name, target string) string {
+	if path.IsAbs(target) {
+		return path.Clean(target)
+	}
+	return path.Join(path.Dir(name), target)
+}
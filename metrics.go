@@ -0,0 +1,216 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricKind identifies what a Metric measures.
+type MetricKind int
+
+const (
+	// CacheHit is recorded when a lookup in Cache is answered without
+	// asking S3.
+	CacheHit MetricKind = iota
+	// CacheMiss is recorded when a lookup in Cache has to go to S3.
+	CacheMiss
+	// CacheEviction is recorded when an expired entry is dropped from
+	// Cache.
+	CacheEviction
+	// Flush is recorded when a dirty file is written back to S3. Bytes
+	// is how much was uploaded and Duration how long it took.
+	Flush
+	// ShadowWrite is recorded when a flushed file is copied by Shadow.
+	// Bytes is the size of the copy and Err why it failed, if it did.
+	ShadowWrite
+	// IndexUpdate is recorded when the Indexer fails to record a change.
+	// Err is why.
+	IndexUpdate
+	// ChecksumMismatch is recorded when a download doesn't match the
+	// object's ETag. Bytes is how much was downloaded.
+	ChecksumMismatch
+	// FailedOver is recorded when requests switch to the Failover's
+	// secondary bucket, Name. Err is the failure that made them.
+	FailedOver
+	// Retried is recorded when a request for Name is made again after
+	// failing with Err.
+	Retried
+)
+
+// The caches a Metric's Cache field can name.
+const (
+	FileCache   = "files"
+	HeadCache   = "heads"
+	PrefixCache = "prefixes"
+	// ContentCache is the Cache given to CacheContents.
+	ContentCache = "contents"
+	// SectionCache is the blocks held by readers made with Section.
+	SectionCache = "sections"
+)
+
+// Metric is a single measurement about the filesystem.
+type Metric struct {
+	Kind     MetricKind
+	Cache    string
+	Name     string
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// A Recorder receives the filesystem's metrics. Record is called
+// synchronously, from whichever goroutine made the measurement.
+type Recorder interface {
+	Record(Metric)
+}
+
+// RecorderFunc adapts a function to the Recorder interface.
+type RecorderFunc func(Metric)
+
+// Record calls fn(m).
+func (fn RecorderFunc) Record(m Metric) {
+	fn(m)
+}
+
+// Metrics sends measurements of cache effectiveness and flushes to r.
+func Metrics(r Recorder) Option {
+	return func(s *MemS3Fs) {
+		s.metrics = r
+	}
+}
+
+func (m *MemS3Fs) record(mt Metric) {
+	if m.metrics != nil {
+		m.metrics.Record(mt)
+	}
+}
+
+// recordLookup records whether a lookup of name in cache hit, and
+// whether it found an expired entry.
+func (m *MemS3Fs) recordLookup(cache, name string, hit, expired bool) {
+	m.counts.add(cache, hit, expired)
+	if expired {
+		m.record(Metric{Kind: CacheEviction, Cache: cache, Name: name})
+	}
+	kind := CacheMiss
+	if hit {
+		kind = CacheHit
+	}
+	m.record(Metric{Kind: kind, Cache: cache, Name: name})
+}
+
+// CacheCounts counts the lookups in one of the filesystem's caches.
+type CacheCounts struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64 // entries dropped because they expired or for room
+}
+
+// CacheStats describes the filesystem's caches at one moment.
+type CacheStats struct {
+	// Caches holds the lookups made in each cache since the filesystem
+	// was created, by FileCache, HeadCache, PrefixCache, ContentCache
+	// and SectionCache.
+	Caches map[string]CacheCounts
+	// Files is how many files and directories are cached, and Bytes how
+	// much of their contents is held in memory, plus what the
+	// ContentCache holds if it's a CacheUsage.
+	Files int
+	Bytes int64
+	// Dirty is how many files have changes that haven't been uploaded,
+	// and DirtyBytes their size.
+	Dirty      int
+	DirtyBytes int64
+}
+
+// CacheStats returns counts of cache lookups and what is cached now,
+// for sizing the caches and watching the write-back backlog. The same
+// lookups are sent to the Metrics recorder as they happen.
+func (m *MemS3Fs) CacheStats() CacheStats {
+	st := CacheStats{Caches: m.counts.snapshot()}
+	var files []*InMemoryFile
+	m.rlock()
+	st.Files = len(m.getData())
+	for _, f := range m.getData() {
+		if ff, ok := f.(*InMemoryFile); ok {
+			files = append(files, ff)
+		}
+	}
+	m.runlock()
+	for _, f := range files {
+		f.mu.Lock()
+		st.Bytes += int64(len(f.data))
+		if f.dirty {
+			st.Dirty++
+			st.DirtyBytes += int64(len(f.data))
+		}
+		f.mu.Unlock()
+	}
+	if u, ok := m.cache.(CacheUsage); ok {
+		bytes, evictions := u.Usage()
+		st.Bytes += bytes
+		c := st.Caches[ContentCache]
+		c.Evictions += evictions
+		st.Caches[ContentCache] = c
+	}
+	return st
+}
+
+// cacheCounts accumulates CacheCounts by cache. A nil *cacheCounts
+// counts nothing.
+type cacheCounts struct {
+	mu     sync.Mutex
+	caches map[string]*CacheCounts
+}
+
+func (c *cacheCounts) add(cache string, hit, expired bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caches == nil {
+		c.caches = make(map[string]*CacheCounts)
+	}
+	n, ok := c.caches[cache]
+	if !ok {
+		n = new(CacheCounts)
+		c.caches[cache] = n
+	}
+	if hit {
+		n.Hits++
+	} else {
+		n.Misses++
+	}
+	if expired {
+		n.Evictions++
+	}
+}
+
+func (c *cacheCounts) snapshot() map[string]CacheCounts {
+	out := make(map[string]CacheCounts)
+	if c == nil {
+		return out
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cache, n := range c.caches {
+		out[cache] = *n
+	}
+	return out
+}
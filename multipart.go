@@ -0,0 +1,654 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+const (
+	// S3 rejects multipart uploads whose parts, other than the last,
+	// are smaller than this
+	minPartSize = 5 * mib
+	// nor will it copy more than this in one UploadPartCopy
+	maxCopyPartSize = 5 << 30
+	// objects smaller than this are cheaper to download and rewrite
+	// than to stitch
+	stitchMinSize = 32 * mib
+	// nor accept more parts than this
+	maxParts = 10000
+	// the part size for copying objects too big for one PutCopy
+	copyPartSize = 512 * mib
+
+	defaultMultipartThreshold   = 64 * mib
+	defaultPartSize             = 16 * mib
+	defaultMultipartConcurrency = 4
+)
+
+// partSizeFor is the size of the parts an object of size bytes is
+// uploaded or copied in: partSize, or larger if that would take more
+// parts than S3 accepts.
+func partSizeFor(size, partSize int64) int64 {
+	if n := (size + maxParts - 1) / maxParts; n > partSize {
+		return n
+	}
+	return partSize
+}
+
+// putMultipart uploads data as name in parts, several at a time.
+func (m *MemS3Fs) putMultipart(name string, data []byte, acl s3.ACL, opts s3.Options) error {
+	_, err := m.putMultipartETag(name, data, acl, opts, Headers{})
+	return err
+}
+
+// putMultipartETag is putMultipart, storing h with the object too, that
+// also returns the object's ETag, worked out from the ETags S3 gave the
+// parts. Each part is hashed as it's uploaded and fails with ErrChecksum
+// if S3 gives it the MD5 of something else.
+func (m *MemS3Fs) putMultipartETag(name string, data []byte, acl s3.ACL, opts s3.Options, h Headers) (string, error) {
+	partSize := partSizeFor(int64(len(data)), m.partSize)
+
+	var multi *s3.Multi
+	err := m.doOnce("write", name, func(b *s3.Bucket) (err error) {
+		multi, err = m.initMulti(b, m.key(name), m.contentType(name), acl, opts, h)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	n := int((int64(len(data)) + partSize - 1) / partSize)
+	parts := make([]s3.Part, n)
+	err = m.parallel(n, func(i int) error {
+		start := int64(i) * partSize
+		end := start + partSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		err := m.do("write", name, func(*s3.Bucket) (err error) {
+			parts[i], err = multi.PutPart(i+1, bytes.NewReader(data[start:end]))
+			return err
+		})
+		if err == nil && !partMatches(parts[i], data[start:end]) {
+			err = &os.PathError{Op: "write", Path: name, Err: ErrChecksum}
+		}
+		return err
+	})
+	if err == nil {
+		err = m.do("write", name, func(*s3.Bucket) error {
+			return multi.Complete(parts)
+		})
+	}
+	if err != nil {
+		m.abortMulti(multi)
+		return "", err
+	}
+	return partsETag(parts), nil
+}
+
+// initMulti is b.InitMulti, storing h with the object too. goamz has no
+// option for Expires, so uploads with one are started with a presigned
+// request instead.
+func (m *MemS3Fs) initMulti(b *s3.Bucket, key, ctype string, acl s3.ACL, opts s3.Options, h Headers) (*s3.Multi, error) {
+	if h.Expires.IsZero() {
+		return b.InitMulti(key, ctype, acl, opts)
+	}
+	hdr := http.Header(putHeaders(ctype, opts, h))
+	hdr.Set("x-amz-acl", string(acl))
+	u := b.SignedURLWithMethod("POST", key, m.now().Add(taggingURLTTL), url.Values{"uploads": {""}}, hdr)
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = hdr
+	resp, err := m.httpClient().Do(req.WithContext(m.context()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		serr := &s3.Error{StatusCode: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(serr)
+		return nil, serr
+	}
+	var result struct{ UploadId string }
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &s3.Multi{Bucket: b, Key: key, UploadId: result.UploadId}, nil
+}
+
+// abortMulti abandons an upload, discarding its parts. The request isn't
+// bound to the context or timeout the upload was started under, so that
+// uploads abandoned because those ran out are still cleaned up.
+func (m *MemS3Fs) abortMulti(multi *s3.Multi) {
+	abort := &s3.Multi{Bucket: m.bucket(), Key: multi.Key, UploadId: multi.UploadId}
+	abort.Abort()
+}
+
+// parallel calls fn for 0 through n-1, partConcurrency calls at a time,
+// and returns the error from the lowest i that failed.
+func (m *MemS3Fs) parallel(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < m.partConcurrency && w < n; w++ {
+		wg.Add(1)
+		m.spawn(context.Background(), "multipart upload", func(context.Context) error {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = m.workers.guard("multipart upload", func() error { return fn(i) })
+			}
+			return nil
+		})
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject has S3 copy the object src, of size bytes, to dst in
+// dstBucket, storing the copy with opts. The copy keeps src's content
+// type, metadata, tags and ACL, or gets acl if src's ACL can't be read.
+// Objects over maxCopyPartSize can't be copied in one request, so
+// they're copied in parts, partConcurrency at a time.
+func (m *MemS3Fs) copyObject(op, src, dstBucket, dst string, size int64, acl s3.ACL, opts s3.Options) error {
+	_, err := m.copyObjectETag(op, src, dstBucket, dst, size, acl, opts)
+	return err
+}
+
+// copyObjectETag is copyObject that also returns the copy's ETag.
+func (m *MemS3Fs) copyObjectETag(op, src, dstBucket, dst string, size int64, acl s3.ACL, opts s3.Options) (etag string, err error) {
+	// PutCopy requires name in the format bucket/key...
+	source := m.bucketName + "/" + src
+	// S3 never copies ACLs
+	acl = m.objectACL(src, acl)
+	if size <= maxCopyPartSize {
+		err = m.do(op, src, func(b *s3.Bucket) error {
+			res, err := b.S3.Bucket(dstBucket).PutCopy(dst, acl, s3.CopyOptions{Options: opts}, source)
+			if err == nil {
+				etag = strings.Trim(res.ETag, "\"")
+			}
+			return err
+		})
+		return etag, err
+	}
+
+	partSize := partSizeFor(size, copyPartSize)
+	opts, ctype, headers, err := m.copyOptions(op, src, opts)
+	if err != nil {
+		return "", err
+	}
+	// like its ACL, the object's tags are copied if they can be
+	tags, _ := m.tags(src)
+	var multi *s3.Multi
+	err = m.doOnce(op, dst, func(b *s3.Bucket) (err error) {
+		multi, err = m.initMulti(b.S3.Bucket(dstBucket), dst, ctype, acl, opts, headers)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	n := int((size + partSize - 1) / partSize)
+	parts := make([]s3.Part, n)
+	err = m.parallel(n, func(i int) error {
+		start := int64(i) * partSize
+		end := start + partSize
+		if end > size {
+			end = size
+		}
+		return m.do(op, src, func(*s3.Bucket) (err error) {
+			_, parts[i], err = multi.PutPartCopy(i+1, s3.CopyOptions{
+				CopySourceOptions: fmt.Sprintf("bytes=%d-%d", start, end-1),
+			}, source)
+			return err
+		})
+	})
+	if err == nil {
+		err = m.do(op, dst, func(*s3.Bucket) error {
+			return multi.Complete(parts)
+		})
+	}
+	if err != nil {
+		m.abortMulti(multi)
+		return "", err
+	}
+	if len(tags) > 0 {
+		m.putTags(dstBucket, dst, tags)
+	}
+	return partsETag(parts), nil
+}
+
+// patch is a WriteAt into an object that hasn't been downloaded.
+type patch struct {
+	off  int64
+	data []byte
+}
+
+// applyPatches writes patches over data, which holds the object's bytes
+// starting at base, in the order the patches were made. data is grown
+// to fit patches that extend past its end.
+func applyPatches(data []byte, base int64, patches []patch) []byte {
+	for _, p := range patches {
+		end := p.off + int64(len(p.data)) - base
+		if end > int64(len(data)) {
+			data = append(data, make([]byte, end-int64(len(data)))...)
+		}
+		start := p.off - base
+		src := p.data
+		if start < 0 {
+			if -start >= int64(len(src)) {
+				continue
+			}
+			src = src[-start:]
+			start = 0
+		}
+		if start < int64(len(data)) {
+			copy(data[start:], src)
+		}
+	}
+	return data
+}
+
+type byteRange struct {
+	start, end int64
+}
+
+// stitchPart is one part of a stitched upload: either a range copied
+// from the existing object, or one rebuilt locally from downloaded bytes
+// and patches.
+type stitchPart struct {
+	byteRange
+	copy bool
+}
+
+// mergeRanges sorts ranges and joins the ones that overlap or touch.
+func mergeRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	var merged []byteRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.start <= merged[n-1].end {
+			if r.end > merged[n-1].end {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// splitRange cuts r into the fewest equal pieces no bigger than max.
+func splitRange(r byteRange, max int64) []byteRange {
+	n := (r.end - r.start + max - 1) / max
+	size := (r.end - r.start + n - 1) / n
+	var pieces []byteRange
+	for start := r.start; start < r.end; start += size {
+		end := start + size
+		if end > r.end {
+			end = r.end
+		}
+		pieces = append(pieces, byteRange{start, end})
+	}
+	return pieces
+}
+
+// stitchPlan lays out the parts of an upload that rewrites the dirty
+// ranges of an object of size bytes. Dirty ranges are widened so that
+// every part but the last meets S3's minimum part size; the bytes they
+// absorb are downloaded, everything else is copied server-side.
+func stitchPlan(size int64, dirty []byteRange) []stitchPart {
+	final := size
+	for _, d := range dirty {
+		if d.end > final {
+			final = d.end
+		}
+	}
+	if final > size {
+		// there's nothing to copy past the end of the object
+		dirty = append(dirty, byteRange{size, final})
+	}
+	dirty = mergeRanges(dirty)
+
+	for i := range dirty {
+		if dirty[i].end-dirty[i].start >= minPartSize {
+			continue
+		}
+		dirty[i].end = dirty[i].start + minPartSize
+		if dirty[i].end > final {
+			dirty[i].end = final
+			dirty[i].start = final - minPartSize
+			if dirty[i].start < 0 {
+				dirty[i].start = 0
+			}
+		}
+	}
+	dirty = mergeRanges(dirty)
+
+	// copies too small to be parts are downloaded with the next range
+	cursor := int64(0)
+	for i := range dirty {
+		if gap := dirty[i].start - cursor; gap > 0 && gap < minPartSize {
+			dirty[i].start = cursor
+		}
+		cursor = dirty[i].end
+	}
+	dirty = mergeRanges(dirty)
+
+	var plan []stitchPart
+	cursor = 0
+	add := func(r byteRange, copy bool) {
+		for _, piece := range splitRange(r, maxCopyPartSize) {
+			plan = append(plan, stitchPart{piece, copy})
+		}
+	}
+	for _, d := range dirty {
+		if d.start > cursor {
+			add(byteRange{cursor, d.start}, true)
+		}
+		add(d, false)
+		cursor = d.end
+	}
+	if cursor < final {
+		add(byteRange{cursor, final}, true)
+	}
+	return plan
+}
+
+// stitch writes f's patches into its object with a multipart upload that
+// copies the unchanged ranges server-side.
+func (m *MemS3Fs) stitch(f *InMemoryFile) error {
+	// every range copied or downloaded is pinned to the ETag whose size
+	// the plan was laid out for
+	resp, err := m.headFresh(f.Name())
+	if err != nil {
+		return m.readError("write", f.Name(), err)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return err
+	}
+	size = m.plainSize(size, resp.Header)
+	etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+	dirty := make([]byteRange, len(f.patches))
+	for i, p := range f.patches {
+		dirty[i] = byteRange{p.off, p.off + int64(len(p.data))}
+	}
+	plan := stitchPlan(size, dirty)
+
+	var multi *s3.Multi
+	err = m.doOnce("write", f.Name(), func(b *s3.Bucket) (err error) {
+		multi, err = m.initMulti(b, m.key(f.Name()), m.contentType(f.Name()), getACL(f.mode), f.putOptions(), f.objectHeaders())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	parts := make([]s3.Part, len(plan))
+	for i, p := range plan {
+		if p.copy {
+			err = m.do("write", f.Name(), func(b *s3.Bucket) (err error) {
+				parts[i], err = m.putPartCopy(b, multi, i+1, m.key(f.Name()), p.byteRange, etag)
+				return err
+			})
+		} else {
+			var data []byte
+			if data, err = m.rebuildRange(f, p.byteRange, size, etag); err == nil {
+				err = m.do("write", f.Name(), func(*s3.Bucket) (err error) {
+					parts[i], err = multi.PutPart(i+1, bytes.NewReader(data))
+					return err
+				})
+			}
+		}
+		if isPreconditionFailed(err) {
+			err = &os.PathError{Op: "write", Path: f.Name(), Err: ErrChanged}
+		}
+		if err != nil {
+			m.abortMulti(multi)
+			return err
+		}
+	}
+	err = m.do("write", f.Name(), func(*s3.Bucket) error {
+		return multi.Complete(parts)
+	})
+	if err != nil {
+		m.abortMulti(multi)
+	}
+	return err
+}
+
+// putPartCopy is multi.PutPartCopy of r of key, failing as
+// isPreconditionFailed reports if key's ETag is no longer etag. goamz
+// has no option for x-amz-copy-source-if-match, so the part is copied
+// with a presigned request instead.
+func (m *MemS3Fs) putPartCopy(b *s3.Bucket, multi *s3.Multi, n int, key string, r byteRange, etag string) (s3.Part, error) {
+	hdr := http.Header{}
+	hdr.Set("x-amz-copy-source", (&url.URL{Path: "/" + b.Name + "/" + key}).EscapedPath())
+	hdr.Set("x-amz-copy-source-range", fmt.Sprintf("bytes=%d-%d", r.start, r.end-1))
+	if etag != "" {
+		hdr.Set("x-amz-copy-source-if-match", `"`+etag+`"`)
+	}
+	params := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {multi.UploadId}}
+	u := b.SignedURLWithMethod("PUT", multi.Key, m.now().Add(taggingURLTTL), params, hdr)
+	req, err := http.NewRequest("PUT", u, nil)
+	if err != nil {
+		return s3.Part{}, err
+	}
+	req.Header = hdr
+	resp, err := m.httpClient().Do(req.WithContext(m.context()))
+	if err != nil {
+		return s3.Part{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		serr := &s3.Error{StatusCode: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(serr)
+		return s3.Part{}, serr
+	}
+	var result struct{ ETag string }
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return s3.Part{}, err
+	}
+	return s3.Part{N: n, ETag: result.ETag, Size: r.end - r.start}, nil
+}
+
+// rebuildRange returns the bytes of r after f's patches, downloading the
+// part of r that lies within the existing object as long as its ETag is
+// still etag.
+func (m *MemS3Fs) rebuildRange(f *InMemoryFile, r byteRange, size int64, etag string) ([]byte, error) {
+	data := make([]byte, 0, r.end-r.start)
+	if r.start < size {
+		end := r.end
+		if end > size {
+			end = size
+		}
+		var orig []byte
+		err := m.doRead("read", f.Name(), func(b *s3.Bucket) (err error) {
+			orig, _, err = fetchRangeIfMatch(m.key(f.Name()), b, r.start, end-r.start, etag)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, orig...)
+	}
+	data = append(data, make([]byte, r.end-r.start-int64(len(data)))...)
+
+	var patches []patch
+	for _, p := range f.patches {
+		end := p.off + int64(len(p.data))
+		if p.off >= r.end || end <= r.start {
+			continue
+		}
+		if end > r.end {
+			p.data = p.data[:r.end-p.off]
+		}
+		patches = append(patches, p)
+	}
+	return applyPatches(data, r.start, patches), nil
+}
+
+// partWriter is the multipart upload behind a file written with
+// StreamingWrites. Parts are uploaded in the background as they fill, at
+// most partConcurrency at a time, so only that many are held in memory.
+type partWriter struct {
+	fs      *MemS3Fs
+	name    string
+	multi   *s3.Multi
+	written int64
+	next    int
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	done    chan struct{}
+
+	mu    sync.Mutex
+	parts []s3.Part
+	err   error
+}
+
+// started reports whether any part has been handed to S3, after which
+// the file's earlier bytes are no longer in memory.
+func (w *partWriter) started() bool {
+	return w != nil && w.multi != nil
+}
+
+// offset is how many of the file's bytes have been handed to S3.
+func (w *partWriter) offset() int64 {
+	if w == nil {
+		return 0
+	}
+	return w.written
+}
+
+// put uploads data as the next part, starting the upload if needed and
+// waiting while too many parts are in flight. It returns the error of any
+// earlier part that failed.
+func (w *partWriter) put(data []byte, acl s3.ACL, opts s3.Options, h Headers) error {
+	if w.multi == nil {
+		err := w.fs.doOnce("write", w.name, func(b *s3.Bucket) (err error) {
+			w.multi, err = w.fs.initMulti(b, w.fs.key(w.name), w.fs.contentType(w.name), acl, opts, h)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		w.sem = make(chan struct{}, w.fs.partConcurrency)
+		w.done = make(chan struct{})
+		w.fs.spawn(context.Background(), "multipart upload", w.abortOnCancel)
+	}
+	if err := w.failed(); err != nil {
+		return err
+	}
+	w.next++
+	w.written += int64(len(data))
+	n := w.next
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	w.fs.spawn(context.Background(), "multipart upload", func(context.Context) error {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+		var part s3.Part
+		err := w.fs.workers.guard("multipart upload", func() error {
+			return w.fs.do("write", w.name, func(*s3.Bucket) (err error) {
+				part, err = w.multi.PutPart(n, bytes.NewReader(data))
+				return err
+			})
+		})
+		if err != nil {
+			w.fail(err)
+		}
+		w.mu.Lock()
+		w.parts = append(w.parts, part)
+		w.mu.Unlock()
+		return nil
+	})
+	return nil
+}
+
+// abortOnCancel abandons the upload as soon as the context it was started
+// under is done, rather than when the file is closed. It stops watching
+// once the filesystem is closed.
+func (w *partWriter) abortOnCancel(closed context.Context) error {
+	ctx := w.fs.context()
+	select {
+	case <-ctx.Done():
+		w.fail(ctx.Err())
+		w.fs.abortMulti(w.multi)
+	case <-w.done:
+	case <-closed.Done():
+	}
+	return nil
+}
+
+func (w *partWriter) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+func (w *partWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// complete uploads data as the last part and finishes the upload, or
+// abandons it if any part failed.
+func (w *partWriter) complete(data []byte, acl s3.ACL, opts s3.Options, h Headers) error {
+	defer close(w.done)
+	var err error
+	if len(data) > 0 {
+		err = w.put(data, acl, opts, h)
+	}
+	w.wg.Wait()
+	if err == nil {
+		err = w.failed()
+	}
+	if err == nil {
+		sort.Slice(w.parts, func(i, j int) bool { return w.parts[i].N < w.parts[j].N })
+		err = w.fs.do("write", w.name, func(*s3.Bucket) error {
+			return w.multi.Complete(w.parts)
+		})
+	}
+	if err != nil {
+		w.fs.abortMulti(w.multi)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+)
+
+const (
+	defaultPartitionAge  = 5 * time.Minute
+	defaultPartitionSize = 128 * mib
+)
+
+// PartitionOptions controls when a PartitionedWriter starts a new object.
+type PartitionOptions struct {
+	// MaxAge is how long an object collects records, from its first,
+	// before it's written. It's five minutes unless set.
+	MaxAge time.Duration
+	// MaxSize is how many bytes of records an object collects before
+	// it's written. It's 128MiB unless set.
+	MaxSize int64
+	// ID is put at the start of every object's name, so that writers in
+	// different processes, named after their hosts say, don't collide.
+	ID string
+}
+
+// PartitionedWriter writes records, as RecordWriter does, to objects
+// under prefix/YYYY/MM/DD/HH/ for the UTC hour each record was written
+// in. Records collect in memory until their object is old or large
+// enough, as set by PartitionOptions, or is flushed. Delivery is at
+// least once: a batch that fails to upload is kept and tried again with
+// the next flush, and if S3 stored it before failing it will be stored
+// twice. Batches aren't dropped until they're written, so a writer that
+// can't reach S3 grows until it can.
+type PartitionedWriter struct {
+	fs     *MemS3Fs
+	prefix string
+	opts   PartitionOptions
+
+	mu     sync.Mutex
+	open   map[string]*partitionBatch // by hour
+	failed []*partitionBatch
+	seq    int
+	closed bool
+}
+
+// partitionBatch is the records collected for one object.
+type partitionBatch struct {
+	name    string
+	started time.Time
+	data    []byte
+}
+
+// CreatePartitioned returns a PartitionedWriter for objects under
+// prefix.
+func (m *MemS3Fs) CreatePartitioned(prefix string, opts PartitionOptions) *PartitionedWriter {
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultPartitionAge
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultPartitionSize
+	}
+	return &PartitionedWriter{
+		fs:     m,
+		prefix: prefix,
+		opts:   opts,
+		open:   make(map[string]*partitionBatch),
+	}
+}
+
+// WriteRecord appends p to the object for the current hour. It's safe
+// to call from several goroutines at once. If any object is now old or
+// large enough it's written before WriteRecord returns, along with any
+// batches that failed before, and the error of any that fail is
+// returned; p itself is kept either way.
+func (w *PartitionedWriter) WriteRecord(p []byte) error {
+	return w.WriteRecordAt(w.fs.now(), p)
+}
+
+// WriteRecordAt is WriteRecord for a record that belongs to the hour
+// containing t, such as when the event it records happened, rather than
+// the current one.
+func (w *PartitionedWriter) WriteRecordAt(t time.Time, p []byte) error {
+	if uint64(len(p)) > maxRecord {
+		return &os.PathError{Op: "write", Path: w.prefix, Err: os.ErrInvalid}
+	}
+	now := w.fs.now()
+	hour := t.UTC().Format("2006/01/02/15")
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return &os.PathError{Op: "write", Path: w.prefix, Err: os.ErrClosed}
+	}
+	b, ok := w.open[hour]
+	if !ok {
+		w.seq++
+		name := fmt.Sprintf("%d-%d", now.UnixNano(), w.seq)
+		if w.opts.ID != "" {
+			name = w.opts.ID + "-" + name
+		}
+		b = &partitionBatch{name: path.Join(w.prefix, hour, name), started: now}
+		w.open[hour] = b
+	}
+	b.data = appendRecord(b.data, p)
+	ready := w.take(now)
+	w.mu.Unlock()
+	return w.put(ready)
+}
+
+// take removes the batches that are ready to write at now for the
+// caller to put, along with those that failed before if there are any.
+// Passing the zero time takes every batch. w.mu must be held.
+func (w *PartitionedWriter) take(now time.Time) []*partitionBatch {
+	var ready []*partitionBatch
+	for hour, b := range w.open {
+		if now.IsZero() || int64(len(b.data)) >= w.opts.MaxSize || now.Sub(b.started) >= w.opts.MaxAge {
+			ready = append(ready, b)
+			delete(w.open, hour)
+		}
+	}
+	if len(ready) > 0 || now.IsZero() {
+		ready = append(w.failed, ready...)
+		w.failed = nil
+	}
+	return ready
+}
+
+// put uploads batches, retrying as flushes are retried, and keeps those
+// that still fail for next time. It returns the first error.
+func (w *PartitionedWriter) put(batches []*partitionBatch) error {
+	m := w.fs
+	var first error
+	for _, b := range batches {
+		start := m.now()
+		// a rejected batch is kept like a failed one, but not retried now
+		data, err := m.transformWrite("write", b.name, b.data)
+		delay := flushRetryDelay
+		for attempt := 0; err == nil && attempt <= m.flushRetries; attempt++ {
+			if attempt > 0 {
+				m.sleep(delay)
+				delay *= 2
+			}
+			if err = w.putBatch(b.name, data); err == nil {
+				break
+			}
+		}
+		m.record(Metric{Kind: Flush, Name: b.name, Bytes: int64(len(data)), Duration: m.now().Sub(start), Err: err})
+		if err != nil {
+			w.mu.Lock()
+			w.failed = append(w.failed, b)
+			w.mu.Unlock()
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		m.uploaded(b.name, int64(len(data)))
+	}
+	return first
+}
+
+func (w *PartitionedWriter) putBatch(name string, data []byte) error {
+	m := w.fs
+	data, opts, err := m.seal(data, m.putOptions())
+	if err != nil {
+		return &os.PathError{Op: "write", Path: name, Err: err}
+	}
+	if int64(len(data)) > m.multipartThreshold {
+		return m.putMultipart(name, data, s3.Private, opts)
+	}
+	return m.do("write", name, func(bk *s3.Bucket) error {
+		return bk.Put(m.key(name), data, m.contentType(name), s3.Private, opts)
+	})
+}
+
+// Flush writes every batch, however young, and returns the error of
+// any that failed. Those are kept to be tried again.
+func (w *PartitionedWriter) Flush() error {
+	w.mu.Lock()
+	ready := w.take(time.Time{})
+	w.mu.Unlock()
+	return w.put(ready)
+}
+
+// FlushEvery writes the batches that have reached MaxAge each interval
+// until ctx is done, so that objects are written on time even when
+// records stop arriving. Failures are reported by the Flush metric and
+// the filesystem's Err.
+func (w *PartitionedWriter) FlushEvery(ctx context.Context, interval time.Duration) {
+	w.fs.spawn(ctx, "PartitionedWriter.FlushEvery", func(ctx context.Context) error {
+		for {
+			select {
+			case <-clockOr(w.fs.clock).After(interval):
+			case <-ctx.Done():
+				return nil
+			}
+			w.mu.Lock()
+			ready := w.take(w.fs.now())
+			w.mu.Unlock()
+			w.fs.workers.fail(w.put(ready))
+		}
+	})
+}
+
+// Close flushes the writer and stops it accepting records. If any batch
+// can't be written its error is returned, and Flush can be called again
+// to retry it.
+func (w *PartitionedWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return &os.PathError{Op: "close", Path: w.prefix, Err: os.ErrClosed}
+	}
+	w.closed = true
+	w.mu.Unlock()
+	return w.Flush()
+}
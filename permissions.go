@@ -0,0 +1,121 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// A PermissionError is returned by CheckPermissions when the filesystem's
+// credentials lack actions it needs.
+type PermissionError struct {
+	Bucket string
+	// Denied are the IAM actions S3 refused, like "s3:PutObject".
+	Denied []string
+}
+
+func (e *PermissionError) Error() string {
+	return "af3ro: s3://" + e.Bucket + " denies " + strings.Join(e.Denied, ", ")
+}
+
+// CheckPermissions probes the actions the filesystem needs by listing
+// the bucket, writing, reading and deleting a scratch object under the
+// filesystem's Prefix, and starting and aborting a multipart upload. It
+// returns a *PermissionError naming every action that was denied, so a
+// deployment can fail fast rather than part way through its work, or
+// another error if S3 couldn't be asked at all. HeadBucket, which goamz
+// can't make, needs the same s3:ListBucket as listing. The scratch
+// object is named ".af3ro-permissions-" and the time; when
+// s3:DeleteObject is denied it's left behind for the caller to remove,
+// as is the multipart upload when s3:AbortMultipartUpload is.
+func (m *MemS3Fs) CheckPermissions(ctx context.Context) error {
+	view := *m
+	view.ctx = ctx
+	return view.checkPermissions()
+}
+
+func (m *MemS3Fs) checkPermissions() error {
+	denied := &PermissionError{Bucket: m.bucketName}
+	deny := func(action string, err error) error {
+		if !isForbidden(err) {
+			return err
+		}
+		for _, a := range denied.Denied {
+			if a == action {
+				return nil
+			}
+		}
+		denied.Denied = append(denied.Denied, action)
+		return nil
+	}
+	probe := func(action, name string, fn func(b *s3.Bucket) error) error {
+		return deny(action, m.do("check", name, fn))
+	}
+
+	if err := probe("s3:ListBucket", "/", func(b *s3.Bucket) error {
+		_, err := b.List(m.dirPrefix("/"), "/", "", 1)
+		return err
+	}); isNotFound(err) {
+		return &os.PathError{Op: "check", Path: "s3://" + m.bucketName, Err: ErrBucketNotFound}
+	} else if err != nil {
+		return err
+	}
+
+	name := "/.af3ro-permissions-" + m.now().UTC().Format("20060102T150405.000000000")
+	key := m.key(name)
+	if err := probe("s3:PutObject", name, func(b *s3.Bucket) error {
+		return b.Put(key, nil, "application/octet-stream", s3.Private, m.putOptions())
+	}); err != nil {
+		return err
+	}
+	// without the object, a GET S3 allows is still answered 404
+	if err := probe("s3:GetObject", name, func(b *s3.Bucket) error {
+		_, err := b.Get(key)
+		return err
+	}); err != nil && !isNotFound(err) {
+		return err
+	}
+	if err := probe("s3:DeleteObject", name, func(b *s3.Bucket) error {
+		return b.Del(key)
+	}); err != nil {
+		return err
+	}
+
+	// starting a multipart upload needs s3:PutObject too
+	var multi *s3.Multi
+	if err := deny("s3:PutObject", m.doOnce("check", name, func(b *s3.Bucket) (err error) {
+		multi, err = b.InitMulti(key, "application/octet-stream", s3.Private, m.putOptions())
+		return err
+	})); err != nil {
+		return err
+	}
+	if multi != nil {
+		if err := probe("s3:AbortMultipartUpload", name, func(*s3.Bucket) error {
+			return multi.Abort()
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(denied.Denied) > 0 {
+		return denied
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// cacheState is the form SaveCache writes the cache in.
+type cacheState struct {
+	Files    []fileState    `json:"files"`
+	Heads    []headState    `json:"heads"`
+	Listings []listingState `json:"listings"`
+}
+
+type fileState struct {
+	Name    string      `json:"name"`
+	Dir     bool        `json:"dir,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modtime"`
+	Size    int64       `json:"size"`
+	At      time.Time   `json:"at"`
+}
+
+type headState struct {
+	Name   string      `json:"name"`
+	Header http.Header `json:"header"`
+	At     time.Time   `json:"at"`
+}
+
+type listingState struct {
+	Prefix   string    `json:"prefix"`
+	Keys     []s3.Key  `json:"keys"`
+	Prefixes []string  `json:"prefixes"`
+	At       time.Time `json:"at"`
+}
+
+// SaveCache writes what the filesystem has learned about the bucket, so
+// that a later process can pick up where this one left off with
+// LoadCache. Only metadata is saved: file contents, including changes that
+// haven't been flushed, are not.
+func (m *MemS3Fs) SaveCache(w io.Writer) error {
+	var state cacheState
+	var files []*InMemoryFile
+	m.rlock()
+	for _, f := range m.getData() {
+		if ff, ok := f.(*InMemoryFile); ok {
+			files = append(files, ff)
+		}
+	}
+	m.runlock()
+	for _, f := range files {
+		f.mu.Lock()
+		s := fileState{
+			Name:    f.Name(),
+			Dir:     f.dir,
+			Mode:    f.mode,
+			ModTime: f.modtime,
+			At:      f.cachedAt,
+		}
+		dirty := f.dirty
+		f.mu.Unlock()
+		if dirty && !s.Dir {
+			continue
+		}
+		s.Size = f.Info().Size()
+		state.Files = append(state.Files, s)
+	}
+
+	if h := m.heads; h != nil {
+		h.Lock()
+		for name, e := range h.entries {
+			state.Heads = append(state.Heads, headState{Name: name, Header: e.resp.Header, At: e.at})
+		}
+		h.Unlock()
+	}
+	if c := m.prefixes; c != nil {
+		c.Lock()
+		for prefix, e := range c.entries {
+			state.Listings = append(state.Listings, listingState{
+				Prefix:   prefix,
+				Keys:     e.listing.keys,
+				Prefixes: e.listing.prefixes,
+				At:       e.at,
+			})
+		}
+		c.Unlock()
+	}
+	return json.NewEncoder(w).Encode(state)
+}
+
+// LoadCache adds the metadata written by SaveCache to the cache. Files
+// already cached are kept, and files, HEAD responses and listings keep
+// their age, so CacheTTL, HeadCacheTTL and PrefixCacheTTL still decide
+// when they're refreshed.
+func (m *MemS3Fs) LoadCache(r io.Reader) error {
+	var state cacheState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	for _, f := range state.Files {
+		if f.Dir {
+			m.mkdir(f.Name)
+			continue
+		}
+		ff := &InMemoryFile{fs: m, fileData: &fileData{
+			name:    f.Name,
+			mode:    f.Mode,
+			modtime: f.ModTime,
+			objSize: f.Size,
+		}}
+		if m.addRemote(ff) == ff && !f.At.IsZero() {
+			ff.mu.Lock()
+			ff.cachedAt = f.At
+			ff.mu.Unlock()
+		}
+	}
+	for _, e := range state.Heads {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: e.Header}
+		m.heads.putAt(e.Name, resp, e.At)
+	}
+	for _, e := range state.Listings {
+		m.prefixes.putAt(e.Prefix, &listing{keys: e.Keys, prefixes: e.Prefixes}, e.At)
+	}
+	return nil
+}
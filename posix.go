@@ -0,0 +1,166 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// The metadata PosixMetadata stores.
+const (
+	metaMode  = "af3ro-mode"
+	metaMtime = "af3ro-mtime"
+	metaUID   = "af3ro-uid"
+	metaGID   = "af3ro-gid"
+)
+
+// PosixMetadata stores each file's mode, modification time and owner in
+// its object's metadata, and reads them back when the object is opened
+// or stat'd, so they outlive the process. A listing doesn't include
+// them, so Readdir reads them with a HEAD of each file it returns that
+// hasn't been stat'd. Chmod, Chtimes and Chown of a file whose contents
+// haven't changed have S3 copy its object over itself with the new
+// metadata when the file is next flushed. A mode is only stored once a
+// file is created or chmod'd, so objects written without one don't get
+// the default. Without it, files' modes and times are only kept in
+// memory, and uploading new contents doesn't change a file's ModTime
+// until it's read back from S3.
+func PosixMetadata() Option {
+	return func(s *MemS3Fs) {
+		s.posixMeta = true
+	}
+}
+
+// Owner is what FileInfo.Sys returns for a file PosixMetadata has
+// recorded the owner of.
+type Owner struct {
+	UID, GID int
+}
+
+// Chown records uid and gid as name's owner. It's only kept with
+// PosixMetadata, and only means something to the caller.
+func (m *MemS3Fs) Chown(name string, uid, gid int) error {
+	m.rlock()
+	f, ok := m.getData()[name]
+	m.runlock()
+	if !ok {
+		return &os.PathError{Op: "chown", Path: name, Err: afero.ErrFileNotFound}
+	}
+	ff, ok := f.(*InMemoryFile)
+	if !ok {
+		return &os.PathError{Op: "chown", Path: name, Err: os.ErrInvalid}
+	}
+	ff.loadPosix()
+	ff.mu.Lock()
+	ff.owner = &Owner{uid, gid}
+	m.posixChanged(ff)
+	ff.mu.Unlock()
+	return nil
+}
+
+// posixChanged marks f to have its metadata stored, if it's kept. f.mu
+// must be held.
+func (m *MemS3Fs) posixChanged(f *InMemoryFile) {
+	if m.posixMeta && !f.dir {
+		f.dirty, f.metaDirty = true, true
+	}
+}
+
+// addPosix adds the file's mode, time and owner to opts.
+func (f *InMemoryFile) addPosix(opts s3.Options) s3.Options {
+	if !f.fs.posixMeta {
+		return opts
+	}
+	meta := make(map[string][]string, len(opts.Meta)+4)
+	for k, v := range opts.Meta {
+		meta[k] = v
+	}
+	if f.modeKnown {
+		meta[metaMode] = []string{strconv.FormatUint(uint64(f.mode), 8)}
+	}
+	meta[metaMtime] = []string{f.modtime.UTC().Format(time.RFC3339Nano)}
+	if f.owner != nil {
+		meta[metaUID] = []string{strconv.Itoa(f.owner.UID)}
+		meta[metaGID] = []string{strconv.Itoa(f.owner.GID)}
+	}
+	opts.Meta = meta
+	return opts
+}
+
+// applyPosix sets the file's mode, time and owner from those stored in
+// header, from a GET or HEAD of its object.
+func (f *InMemoryFile) applyPosix(header http.Header) {
+	f.posixRead = true
+	if v := header.Get("X-Amz-Meta-" + metaMode); v != "" {
+		if mode, err := strconv.ParseUint(v, 8, 32); err == nil {
+			f.mode, f.modeKnown = os.FileMode(mode), true
+		}
+	}
+	if v := header.Get("X-Amz-Meta-" + metaMtime); v != "" {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			f.modtime = t
+		}
+	}
+	uid, uerr := strconv.Atoi(header.Get("X-Amz-Meta-" + metaUID))
+	gid, gerr := strconv.Atoi(header.Get("X-Amz-Meta-" + metaGID))
+	if uerr == nil && gerr == nil {
+		f.owner = &Owner{uid, gid}
+	}
+}
+
+// loadPosix reads the file's mode, time and owner from its object's
+// metadata, for files only seen in a listing, which doesn't include it.
+// It's done before they're changed too, so what isn't changed is kept.
+func (f *InMemoryFile) loadPosix() {
+	if !f.fs.posixMeta || f.dir || !f.needsPosix() {
+		return
+	}
+	resp, err := f.fs.head(f.Name())
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the file may have been changed or read during the HEAD
+	if !f.posixRead && !f.dirty {
+		f.applyPosix(resp.Header)
+	}
+}
+
+// needsPosix reports whether the file's metadata is still to be read.
+func (f *InMemoryFile) needsPosix() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.posixRead && !f.dirty
+}
+
+// loadPosixAll loads the metadata of files, partConcurrency at a time,
+// so listing a directory doesn't make a HEAD per file one after another.
+func (m *MemS3Fs) loadPosixAll(files []*InMemoryFile) {
+	if !m.posixMeta {
+		return
+	}
+	m.parallel(len(files), func(i int) error {
+		files[i].loadPosix()
+		return nil
+	})
+}
@@ -0,0 +1,83 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+// PresignOptions controls the object an upload to a URL from PresignPut
+// creates. The zero value stores it as Create would.
+type PresignOptions struct {
+	// Mode sets the object's ACL, as for Chmod. Zero is 0640.
+	Mode os.FileMode
+	// ContentType replaces the type for name's extension.
+	ContentType string
+}
+
+// PresignGet returns a URL anyone can download name's object from, until
+// expiry has passed, without going through this process. The object is
+// served as stored, so that of an encrypted or transformed file isn't
+// what the file reads as.
+func (m *MemS3Fs) PresignGet(name string, expiry time.Duration) (string, error) {
+	return m.presign("GET", name, expiry, nil)
+}
+
+// PresignPut returns a URL anyone can upload name's object to with a PUT,
+// until expiry has passed, and the headers that PUT must send, which
+// the URL is signed for. Uploads bypass the filesystem: they're not
+// encrypted with its KeyWrapper, and files with write transforms can't
+// be presigned, failing with ErrTransformedWrite. The filesystem sees an
+// upload once what it has cached for name expires; see CacheTTL,
+// HeadCacheTTL and NegativeCacheTTL.
+func (m *MemS3Fs) PresignPut(name string, expiry time.Duration, opts *PresignOptions) (string, http.Header, error) {
+	if opts == nil {
+		opts = &PresignOptions{}
+	}
+	if len(matching(m.writeXforms, name)) > 0 {
+		return "", nil, &os.PathError{Op: "presign", Path: name, Err: ErrTransformedWrite}
+	}
+	mode, ctype := opts.Mode, opts.ContentType
+	if mode == 0 {
+		mode = 0640
+	}
+	if ctype == "" {
+		ctype = m.contentType(name)
+	}
+	h := m.headers(name)
+	hdr := http.Header(putHeaders(ctype, h.apply(m.putOptions()), h))
+	hdr.Set("x-amz-acl", string(getACL(mode)))
+	u, err := m.presign("PUT", name, expiry, hdr)
+	if err != nil {
+		return "", nil, err
+	}
+	return u, hdr, nil
+}
+
+// presign signs a request for name's object with method and headers.
+// Signing sends nothing, so beyond refreshing the credentials it signs
+// with, it isn't a request: it's not limited, retried or measured.
+func (m *MemS3Fs) presign(method, name string, expiry time.Duration, headers http.Header) (string, error) {
+	if expiry <= 0 {
+		return "", &os.PathError{Op: "presign", Path: name, Err: os.ErrInvalid}
+	}
+	if err := m.creds.refresh(m.context()); err != nil {
+		return "", &os.PathError{Op: "presign", Path: name, Err: err}
+	}
+	return m.bucket().SignedURLWithMethod(method, m.key(name), m.now().Add(expiry), nil, headers), nil
+}
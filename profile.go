@@ -0,0 +1,139 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/goamz/goamz/aws"
+)
+
+// Profile signs requests with the credentials of the named profile in
+// the shared credentials and config files, ~/.aws/credentials and
+// ~/.aws/config (or AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE), and
+// uses the profile's region, like the AWS CLI's --profile. An empty name
+// means AWS_PROFILE, or "default".
+func Profile(name string) Option {
+	return func(s *MemS3Fs) {
+		p := ProfileCredentials{Profile: name}
+		Credentials(p)(s)
+		if region := profileValue(configFile(), "profile "+p.profile(), "region"); region != "" {
+			s.region = regionNamed(region)
+		}
+	}
+}
+
+// ProfileCredentials reads static credentials from a profile in the
+// shared credentials file, or failing that, the shared config file.
+type ProfileCredentials struct {
+	Profile string // AWS_PROFILE or "default" if empty
+}
+
+func (p ProfileCredentials) profile() string {
+	if p.Profile != "" {
+		return p.Profile
+	}
+	if name := os.Getenv("AWS_PROFILE"); name != "" {
+		return name
+	}
+	return "default"
+}
+
+func (p ProfileCredentials) Retrieve(ctx context.Context) (*aws.Auth, error) {
+	name := p.profile()
+	for _, f := range []struct{ path, section string }{
+		{credentialsFile(), name},
+		{configFile(), "profile " + name},
+	} {
+		id := profileValue(f.path, f.section, "aws_access_key_id")
+		secret := profileValue(f.path, f.section, "aws_secret_access_key")
+		if id != "" && secret != "" {
+			token := profileValue(f.path, f.section, "aws_session_token")
+			return aws.NewAuth(id, secret, token, time.Time{}), nil
+		}
+	}
+	return nil, fmt.Errorf("no credentials for profile %q", name)
+}
+
+func credentialsFile() string {
+	if f := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); f != "" {
+		return f
+	}
+	return awsHomeFile("credentials")
+}
+
+func configFile() string {
+	if f := os.Getenv("AWS_CONFIG_FILE"); f != "" {
+		return f
+	}
+	return awsHomeFile("config")
+}
+
+func awsHomeFile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// profileValue returns key from section of the INI file at path, or ""
+// if it's missing or the file can't be read. The config file names its
+// default profile "default" rather than "profile default".
+func profileValue(path, section, key string) string {
+	if section == "profile default" {
+		section = "default"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var in bool
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == section
+		case in:
+			if i := strings.Index(line, "="); i > 0 && strings.TrimSpace(line[:i]) == key {
+				return strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return ""
+}
+
+// regionNamed returns the goamz region called name, or one addressing
+// S3 at its standard endpoint if goamz doesn't know it.
+func regionNamed(name string) aws.Region {
+	if r, ok := aws.Regions[name]; ok {
+		return r
+	}
+	return aws.Region{
+		Name:                 name,
+		S3Endpoint:           "https://s3." + name + ".amazonaws.com",
+		S3LocationConstraint: true,
+	}
+}
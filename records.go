@@ -0,0 +1,177 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// ErrTruncatedRecord is returned by ScanRecords when the data ends part
+// way through a record.
+var ErrTruncatedRecord = errors.New("af3ro: truncated record")
+
+const (
+	// recordHeader is the size of the length before each record
+	recordHeader = 4
+	maxRecord    = 1<<32 - 1
+)
+
+// RecordWriter collects records from any number of goroutines into one
+// object. Each record is written as its length, a big-endian uint32,
+// followed by its bytes, and records are never interleaved. Records are
+// buffered until a part's worth (see Multipart) is ready, which is
+// uploaded as the next part of a multipart upload while writing carries
+// on, so only a few parts are held in memory however large the object
+// grows. Read the records back with ScanRecords.
+type RecordWriter struct {
+	fs   *MemS3Fs
+	name string
+
+	mu      sync.Mutex
+	buf     []byte
+	upload  *partWriter
+	whole   bool
+	records int64
+	closed  bool
+}
+
+// CreateRecords returns a RecordWriter for name. Nothing is uploaded
+// until the first part is full or the writer is closed, and the object
+// only appears once it's closed. If name has write transforms (see
+// TransformWrites) or is encrypted (see ClientSideEncryption) every
+// record is held until then.
+func (m *MemS3Fs) CreateRecords(name string) *RecordWriter {
+	return &RecordWriter{
+		fs:     m,
+		name:   name,
+		upload: &partWriter{fs: m, name: name},
+		whole:  m.wholeWrites(name),
+	}
+}
+
+func (w *RecordWriter) Name() string {
+	return w.name
+}
+
+// WriteRecord appends p as one record. It's safe to call from several
+// goroutines at once, and blocks while too many parts are uploading. It
+// returns the error of any part that failed to upload, after which the
+// writer is unusable.
+func (w *RecordWriter) WriteRecord(p []byte) error {
+	if uint64(len(p)) > maxRecord {
+		return &os.PathError{Op: "write", Path: w.name, Err: os.ErrInvalid}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return &os.PathError{Op: "write", Path: w.name, Err: os.ErrClosed}
+	}
+	w.buf = appendRecord(w.buf, p)
+	w.records++
+	if w.whole || int64(len(w.buf)) < w.fs.partSize {
+		return nil
+	}
+	part := w.buf
+	w.buf = nil
+	return w.upload.put(part, s3.Private, w.fs.putOptions(), Headers{})
+}
+
+// Records is how many records have been written.
+func (w *RecordWriter) Records() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.records
+}
+
+// Size is how many bytes have been written, lengths included.
+func (w *RecordWriter) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.upload.offset() + int64(len(w.buf))
+}
+
+// Close uploads the records still buffered and completes the object. If
+// any part failed the upload is abandoned and nothing is written.
+func (w *RecordWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return &os.PathError{Op: "close", Path: w.name, Err: os.ErrClosed}
+	}
+	w.closed = true
+	m := w.fs
+	size := w.upload.offset() + int64(len(w.buf))
+	data, opts := w.buf, m.putOptions()
+	var err error
+	if w.whole {
+		data, err = m.transformWrite("write", w.name, data)
+		if err == nil {
+			data, opts, err = m.seal(data, opts)
+		}
+		size = int64(len(data))
+	}
+	switch {
+	case err != nil:
+	case w.upload.started():
+		err = w.upload.complete(data, s3.Private, opts, Headers{})
+	case size > m.multipartThreshold:
+		// held whole for its transforms
+		err = m.putMultipart(w.name, data, s3.Private, opts)
+	default:
+		// too few records for a part
+		err = m.do("write", w.name, func(b *s3.Bucket) error {
+			return b.Put(m.key(w.name), data, m.contentType(w.name), s3.Private, opts)
+		})
+	}
+	w.buf = nil
+	if err != nil {
+		return err
+	}
+	m.uploaded(w.name, size)
+	return nil
+}
+
+// appendRecord appends p to buf as a record.
+func appendRecord(buf, p []byte) []byte {
+	var n [recordHeader]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(p)))
+	return append(append(buf, n[:]...), p...)
+}
+
+// ScanRecords is a bufio.SplitFunc that splits what a RecordWriter
+// wrote into its records, for a bufio.Scanner or ShuffleOptions.Split.
+// Scanners must be given a buffer large enough for the largest record.
+func ScanRecords(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) < recordHeader {
+		if atEOF && len(data) > 0 {
+			return 0, nil, ErrTruncatedRecord
+		}
+		return 0, nil, nil
+	}
+	end := recordHeader + int(binary.BigEndian.Uint32(data))
+	if len(data) < end {
+		if atEOF {
+			return 0, nil, ErrTruncatedRecord
+		}
+		return 0, nil, nil
+	}
+	return end, data[recordHeader:end], nil
+}
@@ -0,0 +1,334 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// RenameError is returned when renaming a directory moves some of the
+// objects under it but not all. Moved objects are under the new name and
+// gone from the old one; failed objects are still under the old name,
+// though they may have been copied to the new one too.
+type RenameError struct {
+	Old, New string
+	Moved    []string
+	Failed   map[string]error
+}
+
+func (e *RenameError) Error() string {
+	return fmt.Sprintf("rename %s %s: %d of %d objects failed to move",
+		e.Old, e.New, len(e.Failed), len(e.Moved)+len(e.Failed))
+}
+
+// isDir reports whether any object's key starts with name's directory
+// prefix, or name has a marker.
+func (m *MemS3Fs) isDir(name string) (bool, error) {
+	var resp *s3.ListResp
+	err := m.doRead("stat", name, func(b *s3.Bucket) (err error) {
+		resp, err = b.List(m.dirPrefix(name), "", "", 1)
+		return err
+	})
+	if m.hide403 && isForbidden(err) {
+		// without s3:ListBucket, nothing is a directory
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Contents) > 0 {
+		return true, nil
+	}
+	return m.hasMarker(name)
+}
+
+// flushPrefix uploads the dirty files whose keys start with prefix,
+// except those still being written with StreamingWrites.
+func (m *MemS3Fs) flushPrefix(prefix string) error {
+	var dirty []*InMemoryFile
+	m.rlock()
+	for name, f := range m.getData() {
+		ff, ok := f.(*InMemoryFile)
+		if ok && ff.dirty && !ff.upload.started() && strings.HasPrefix(m.key(name), prefix) {
+			dirty = append(dirty, ff)
+		}
+	}
+	m.runlock()
+	for _, f := range dirty {
+		if err := f.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameOptions controls a directory rename made with RenameDir.
+type RenameOptions struct {
+	// Manifest names an object to keep the rename's progress in, so
+	// that, if the rename is interrupted or some objects fail to move,
+	// running it again with the same Manifest resumes it, carrying on
+	// the counts. It can't be under either directory, and it's removed
+	// once everything has moved.
+	Manifest string
+
+	// BatchSize is how many objects are copied before the copies'
+	// originals are deleted and progress is reported, up to the default
+	// of 1000.
+	BatchSize int
+
+	// Progress is called after each batch.
+	Progress func(RenameProgress)
+}
+
+// RenameProgress reports how far a directory rename has got, including
+// earlier runs resumed from its Manifest.
+type RenameProgress struct {
+	Moved  int   // objects moved
+	Failed int   // objects that failed to move in this run
+	Bytes  int64 // the total size of the objects moved
+}
+
+// renameManifest is the form RenameOptions.Manifest is stored in.
+type renameManifest struct {
+	Old      string         `json:"old"`
+	New      string         `json:"new"`
+	Progress RenameProgress `json:"progress"`
+}
+
+// RenameDir renames the directory oldname to newname as Rename does, for
+// directories too big to move in one go: objects are moved a batch at a
+// time, with the progress reported and kept as opts asks. A rename
+// resumed from a Manifest lists the objects still under oldname again,
+// so those that failed before are retried, and those that were copied
+// but not deleted are copied again. Only a resumed rename may find
+// objects under newname already. The OpResult's Bytes counts every
+// run's objects.
+func (m *MemS3Fs) RenameDir(oldname, newname string, opts *RenameOptions) (*OpResult, error) {
+	if m.skipsTransforms(oldname, newname) {
+		return nil, &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrTransformedWrite}
+	}
+	res := &OpResult{Op: "rename", Source: oldname, Dest: newname}
+	var err error
+	if res.Bytes, err = m.renameDir(oldname, newname, opts); err == nil {
+		err = m.keepParent(oldname)
+	}
+	return res, err
+}
+
+// renameDir copies every object under oldname to the same place under
+// newname, deleting the originals that were copied a batch at a time.
+// It returns the total size of the objects moved.
+func (m *MemS3Fs) renameDir(oldname, newname string, opts *RenameOptions) (int64, error) {
+	if opts == nil {
+		opts = &RenameOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 || batchSize > maxDeleteBatch {
+		batchSize = maxDeleteBatch
+	}
+	oldPrefix, newPrefix := m.dirPrefix(oldname), m.dirPrefix(newname)
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if mk := m.key(opts.Manifest); opts.Manifest != "" &&
+		(strings.HasPrefix(mk, oldPrefix) || strings.HasPrefix(mk, newPrefix)) {
+		return 0, linkErr(os.ErrInvalid)
+	}
+	state := renameManifest{Old: oldname, New: newname}
+	if opts.Manifest != "" {
+		if err := m.loadManifest(opts.Manifest, &state); err != nil {
+			return 0, linkErr(err)
+		}
+	}
+	if state.Progress == (RenameProgress{}) {
+		// only a resumed rename may find its own copies under newname
+		var resp *s3.ListResp
+		err := m.doRead("rename", newname, func(b *s3.Bucket) (err error) {
+			resp, err = b.List(newPrefix, "", "", 1)
+			return err
+		})
+		if err != nil {
+			return 0, linkErr(err)
+		}
+		if len(resp.Contents) > 0 {
+			return 0, linkErr(afero.ErrDestinationExists)
+		}
+	}
+	state.Progress.Failed = 0
+	if err := m.flushPrefix(oldPrefix); err != nil {
+		return 0, linkErr(err)
+	}
+
+	rerr := &RenameError{Old: oldname, New: newname, Failed: make(map[string]error)}
+	var batch []s3.Key
+	move := func() error {
+		var copied []s3.Object
+		sizes := make(map[string]int64, len(batch))
+		for _, k := range batch {
+			dst := newPrefix + strings.TrimPrefix(k.Key, oldPrefix)
+			options := m.putOptions()
+			if k.StorageClass != "" {
+				// copies are otherwise stored in the filesystem's class
+				options.StorageClass = s3.StorageClass(k.StorageClass)
+			}
+			err := m.scheduled(func() error {
+				return m.copyObject("rename", k.Key, m.bucketName, dst, k.Size, s3.Private, options)
+			})
+			if err != nil {
+				rerr.Failed[k.Key] = err
+				state.Progress.Failed++
+				continue
+			}
+			copied = append(copied, s3.Object{Key: k.Key})
+			sizes[k.Key] = k.Size
+			m.indexPut(dst, k.Size)
+		}
+		if len(copied) > 0 {
+			err := m.scheduled(func() error {
+				return m.do("rename", oldname, func(b *s3.Bucket) error {
+					return b.DelMulti(s3.Delete{Quiet: true, Objects: copied})
+				})
+			})
+			for _, o := range copied {
+				if err != nil {
+					rerr.Failed[o.Key] = err
+					state.Progress.Failed++
+				} else {
+					rerr.Moved = append(rerr.Moved, o.Key)
+					state.Progress.Moved++
+					state.Progress.Bytes += sizes[o.Key]
+					m.indexDelete(o.Key)
+				}
+			}
+		}
+		batch = batch[:0]
+		if opts.Manifest != "" {
+			if err := m.saveManifest(opts.Manifest, &state); err != nil {
+				return err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(state.Progress)
+		}
+		return nil
+	}
+	err := m.eachKey("rename", oldPrefix, func(k s3.Key) error {
+		if batch = append(batch, k); len(batch) < batchSize {
+			return nil
+		}
+		return move()
+	})
+	if err == nil && len(batch) > 0 {
+		err = move()
+	}
+
+	m.forgetMoved(oldname, oldPrefix, rerr)
+	m.prefixes.forgetAncestors(newPrefix)
+	m.prefixes.forgetPrefix(newPrefix)
+	m.heads.forgetPrefix(newname)
+	if err != nil {
+		// the listing failed, so there's no telling what was missed
+		return state.Progress.Bytes, linkErr(err)
+	}
+	if len(rerr.Failed) > 0 {
+		sort.Strings(rerr.Moved)
+		return state.Progress.Bytes, rerr
+	}
+	if opts.Manifest != "" {
+		m.removeKey("rename", opts.Manifest)
+	}
+	return state.Progress.Bytes, nil
+}
+
+// loadManifest reads a directory rename's manifest into state, leaving
+// it alone if there's none yet. A manifest for another rename is
+// refused.
+func (m *MemS3Fs) loadManifest(name string, state *renameManifest) error {
+	var data []byte
+	err := m.doRead("rename", name, func(b *s3.Bucket) (err error) {
+		data, err = fetchObject(m.key(name), b)
+		return err
+	})
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved renameManifest
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return &os.PathError{Op: "rename", Path: name, Err: err}
+	}
+	if saved.Old != state.Old || saved.New != state.New {
+		return &os.PathError{Op: "rename", Path: name, Err: os.ErrInvalid}
+	}
+	*state = saved
+	return nil
+}
+
+// saveManifest stores a directory rename's progress.
+func (m *MemS3Fs) saveManifest(name string, state *renameManifest) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = m.do("rename", name, func(b *s3.Bucket) error {
+		return b.Put(m.key(name), data, "application/json", s3.Private, m.putOptions())
+	})
+	m.heads.forget(name)
+	return err
+}
+
+// forgetMoved drops the cached files whose objects a directory rename
+// moved, and the directory itself if everything moved.
+func (m *MemS3Fs) forgetMoved(oldname, oldPrefix string, rerr *RenameError) {
+	if len(rerr.Failed) == 0 {
+		m.rlock()
+		dir, ok := m.getData()[oldname]
+		m.runlock()
+		if ok {
+			m.unregisterWithParent(dir)
+		}
+	}
+	moved := make(map[string]bool, len(rerr.Moved))
+	for _, key := range rerr.Moved {
+		moved[key] = true
+	}
+	m.lock()
+	for name, f := range m.getData() {
+		k := m.key(name)
+		if !strings.HasPrefix(k+"/", oldPrefix) {
+			continue
+		}
+		if ff, ok := f.(*InMemoryFile); ok && ff.dir {
+			if len(rerr.Failed) == 0 {
+				delete(m.getData(), name)
+			}
+		} else if moved[k] {
+			delete(m.getData(), name)
+		}
+	}
+	m.unlock()
+	m.heads.forgetPrefix(oldname)
+	m.prefixes.forgetAncestors(oldPrefix)
+	m.prefixes.forgetPrefix(oldPrefix)
+}
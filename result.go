@@ -0,0 +1,130 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// OpResult describes what RenameResult, RemoveResult or Copy did, from
+// what S3 said while doing it, so callers can record provenance without
+// more requests. Fields that weren't learnt along the way are empty;
+// goamz doesn't return the version IDs of copies, so only the source's
+// is known.
+type OpResult struct {
+	Op     string
+	Source string
+	Dest   string // "" for RemoveResult
+
+	SourceETag      string
+	SourceVersionID string
+	DestETag        string
+
+	// Bytes is how much was copied, or for a directory, moved.
+	Bytes int64
+}
+
+// known returns the ETag and version ID of name's object as far as the
+// caches know them.
+func (m *MemS3Fs) known(name string) (etag, versionID string) {
+	m.rlock()
+	f, ok := m.getData()[name]
+	m.runlock()
+	if ff, isFile := f.(*InMemoryFile); ok && isFile && !ff.dirty {
+		etag, versionID = ff.etag, ff.versionID
+	}
+	if resp, _ := m.heads.get(name); resp != nil {
+		if etag == "" {
+			etag = strings.Trim(resp.Header.Get("ETag"), "\"")
+		}
+		if versionID == "" {
+			versionID = resp.Header.Get("x-amz-version-id")
+		}
+	}
+	return etag, versionID
+}
+
+// lookup returns the cached file for name, or opens it from S3.
+func (m *MemS3Fs) lookup(name string) (afero.File, error) {
+	m.expire(name)
+	m.rlock()
+	f, ok := m.getData()[name]
+	m.runlock()
+	if ok {
+		return f, nil
+	}
+	return m.openRemote(name)
+}
+
+// Copy has S3 copy the file src to dst, replacing dst if it exists. src
+// is flushed first, since the copy is made from S3. Directories can't be
+// copied.
+func (m *MemS3Fs) Copy(src, dst string) (*OpResult, error) {
+	f, err := m.lookup(src)
+	if err != nil {
+		return nil, &os.LinkError{Op: "copy", Old: src, New: dst, Err: err}
+	}
+	ff, ok := f.(*InMemoryFile)
+	if !ok || ff.dir {
+		return nil, &os.LinkError{Op: "copy", Old: src, New: dst, Err: syscall.EISDIR}
+	}
+	if m.skipsTransforms(src, dst) {
+		return nil, &os.LinkError{Op: "copy", Old: src, New: dst, Err: ErrTransformedWrite}
+	}
+	if err := ff.flush(); err != nil {
+		return nil, &os.LinkError{Op: "copy", Old: src, New: dst, Err: err}
+	}
+	res := &OpResult{Op: "copy", Source: src, Dest: dst}
+	res.SourceETag, res.SourceVersionID = m.known(src)
+	res.Bytes, err = ff.size()
+	if err == nil {
+		res.DestETag, err = m.copyObjectETag("copy", m.key(src), m.bucketName, m.key(dst), res.Bytes, getACL(ff.mode), m.putOptions())
+	}
+	if err != nil {
+		return nil, &os.LinkError{Op: "copy", Old: src, New: dst, Err: err}
+	}
+
+	// whatever was cached for dst is out of date
+	m.rlock()
+	old, ok := m.getData()[dst]
+	m.runlock()
+	if ok {
+		m.unregisterWithParent(old)
+		m.lock()
+		delete(m.getData(), dst)
+		m.unlock()
+	}
+	m.heads.forget(dst)
+	m.prefixes.forgetAncestors(m.key(dst))
+	m.indexPut(dst, res.Bytes)
+	return res, nil
+}
+
+// removeKey deletes name's object and forgets it.
+func (m *MemS3Fs) removeKey(op, name string) error {
+	err := m.do(op, name, func(b *s3.Bucket) error { return b.Del(m.key(name)) })
+	if err == nil {
+		m.indexDelete(m.key(name))
+	}
+	m.heads.forget(name)
+	m.prefixes.forgetAncestors(m.key(name))
+	return err
+}
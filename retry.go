@@ -0,0 +1,154 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// RetryPolicy decides how S3 requests that fail with a server error,
+// throttling or a network error are retried.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a request is made in all. One
+	// disables retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, which doubles with
+	// each retry after it up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction of each delay that's random, from 0 to 1,
+	// so that clients that failed together don't retry together.
+	Jitter float64
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+	Jitter:      0.5,
+}
+
+// Retry sets how failed requests are retried. By default they're made
+// up to 3 times, 100ms apart and then 200ms, give or take half. When S3
+// answers SlowDown every request the filesystem makes, not just the one
+// throttled, is spaced out by a delay that grows with each SlowDown, up
+// to p.MaxBackoff, and shrinks with each success. Uploads retried by
+// FlushRetries are retried by p within each of those attempts, but the
+// request starting a multipart upload isn't, as a retry could leave an
+// upload the first attempt started with nothing to abort it.
+func Retry(p RetryPolicy) Option {
+	return func(s *MemS3Fs) {
+		if p.MaxAttempts < 1 {
+			p.MaxAttempts = 1
+		}
+		if p.MaxBackoff < p.Backoff {
+			p.MaxBackoff = p.Backoff
+		}
+		s.retry = p
+	}
+}
+
+// retryable reports whether a request that failed with err may succeed
+// if it's made again.
+func retryable(err error) bool {
+	if e, ok := err.(*s3.Error); ok {
+		switch e.Code {
+		case "SlowDown", "InternalError", "RequestTimeout", "ServiceUnavailable":
+			return true
+		}
+		return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// isSlowDown reports whether err is S3 asking for fewer requests.
+func isSlowDown(err error) bool {
+	e, ok := err.(*s3.Error)
+	return ok && (e.Code == "SlowDown" || e.StatusCode == http.StatusServiceUnavailable)
+}
+
+// backoff is the delay before retrying a request that has failed
+// attempts times.
+func (m *MemS3Fs) backoff(attempts int) time.Duration {
+	d := m.retry.Backoff
+	for i := 1; i < attempts && d < m.retry.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > m.retry.MaxBackoff {
+		d = m.retry.MaxBackoff
+	}
+	return d - time.Duration(float64(d)*m.retry.Jitter*m.random().Float64())
+}
+
+// pause waits for d, or until ctx is done.
+func (m *MemS3Fs) pause(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-clockOr(m.clock).After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle is the delay put before every request while S3 is asking for
+// fewer. A nil *throttle never delays.
+type throttle struct {
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+func (t *throttle) current() time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delay
+}
+
+// report adjusts the delay after a request ended with err, doubling it
+// from min, up to max, on SlowDown and halving it, down to nothing, on
+// success.
+func (t *throttle) report(err error, min, max time.Duration) {
+	if t == nil || (err != nil && !isSlowDown(err)) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case err != nil && t.delay < min:
+		t.delay = min
+	case err != nil:
+		t.delay *= 2
+		if t.delay > max {
+			t.delay = max
+		}
+	case t.delay < min:
+		t.delay = 0
+	default:
+		t.delay /= 2
+	}
+}
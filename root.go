@@ -0,0 +1,195 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ErrPathEscapes is returned by a RootFs for names that would reach
+// outside its directory.
+var ErrPathEscapes = errors.New("af3ro: path escapes from root")
+
+var _ afero.Fs = new(RootFs)
+
+// RootFs is a filesystem of the files under one directory of a MemS3Fs
+// that, like os.Root, refuses names that would leave it, so it can be
+// handed names from untrusted users. Names must be relative; absolute
+// names, and names whose ".." elements climb above the directory, fail
+// with ErrPathEscapes rather than being quietly cleaned. Links are
+// resolved inside the root, however their targets climb.
+type RootFs struct {
+	fs *MemS3Fs
+}
+
+// Sub returns a RootFs of the files under dir in fs. It has its own
+// cache, so files are only shared with fs once flushed.
+func Sub(fs *MemS3Fs, dir string) *RootFs {
+	sub := *fs
+	sub.root = fs.key(dir)
+	sub.name = ""
+	sub.base = nil
+	sub.data = make(map[string]afero.File)
+	sub.mutex = &sync.RWMutex{}
+	sub.failed = &failedFlushes{}
+	// remembered HEADs are by name, which now means something else
+	if fs.heads != nil {
+		sub.heads = newHeadMemo(fs.heads.ttl)
+		sub.heads.missTTL = fs.heads.missTTL
+		sub.heads.clock = fs.clock
+	}
+	return &RootFs{&sub}
+}
+
+// local checks that name stays inside the root, returning the name the
+// wrapped filesystem knows it by.
+func local(op, name string) (string, error) {
+	if path.IsAbs(name) || strings.ContainsRune(name, 0) {
+		return "", &os.PathError{Op: op, Path: name, Err: ErrPathEscapes}
+	}
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", &os.PathError{Op: op, Path: name, Err: ErrPathEscapes}
+	}
+	return path.Join("/", clean), nil
+}
+
+func (r *RootFs) Name() string { return r.fs.Name() }
+
+func (r *RootFs) Create(name string) (afero.File, error) {
+	name, err := local("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Create(name)
+}
+
+func (r *RootFs) Mkdir(name string, perm os.FileMode) error {
+	name, err := local("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return r.fs.Mkdir(name, perm)
+}
+
+func (r *RootFs) MkdirAll(name string, perm os.FileMode) error {
+	name, err := local("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return r.fs.MkdirAll(name, perm)
+}
+
+func (r *RootFs) Open(name string) (afero.File, error) {
+	name, err := local("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Open(name)
+}
+
+func (r *RootFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	name, err := local("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.OpenFile(name, flag, perm)
+}
+
+func (r *RootFs) Remove(name string) error {
+	name, err := local("remove", name)
+	if err != nil {
+		return err
+	}
+	return r.fs.Remove(name)
+}
+
+func (r *RootFs) RemoveAll(name string) error {
+	name, err := local("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "/" {
+		// the root itself isn't the caller's to remove
+		return &os.PathError{Op: "remove", Path: ".", Err: os.ErrPermission}
+	}
+	return r.fs.RemoveAll(name)
+}
+
+func (r *RootFs) Rename(oldname, newname string) error {
+	o, err := local("rename", oldname)
+	if err != nil {
+		return err
+	}
+	n, err := local("rename", newname)
+	if err != nil {
+		return err
+	}
+	return r.fs.Rename(o, n)
+}
+
+func (r *RootFs) Stat(name string) (os.FileInfo, error) {
+	name, err := local("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Stat(name)
+}
+
+func (r *RootFs) Chmod(name string, mode os.FileMode) error {
+	name, err := local("chmod", name)
+	if err != nil {
+		return err
+	}
+	return r.fs.Chmod(name, mode)
+}
+
+func (r *RootFs) Chtimes(name string, atime, mtime time.Time) error {
+	name, err := local("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return r.fs.Chtimes(name, atime, mtime)
+}
+
+// Symlink makes newname a link to oldname, which like any other name
+// must be relative and can't climb above the root, here from newname's
+// directory.
+func (r *RootFs) Symlink(oldname, newname string) error {
+	n, err := local("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if _, err := local("symlink", path.Join(path.Dir(n)[1:], oldname)); err != nil || path.IsAbs(oldname) {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrPathEscapes}
+	}
+	return r.fs.Symlink(oldname, n)
+}
+
+func (r *RootFs) Readlink(name string) (string, error) {
+	name, err := local("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return r.fs.Readlink(name)
+}
@@ -16,25 +16,187 @@
 package af3ro
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/goamz/goamz/s3"
 	"github.com/spf13/afero"
 )
 
-func getEtag(name string, bucket *s3.Bucket) (string, error) {
-	resp, err := headName(name, bucket)
+// do runs fn, which makes S3 requests on behalf of op on name, against
+// a fresh bucket handle, or the Failover's secondary bucket while failed
+// over. It gives up when the filesystem's context is done, and bounds
+// each request by the context's deadline or the filesystem's per-request
+// timeout.
+func (m *MemS3Fs) do(op, name string, fn func(b *s3.Bucket) error) error {
+	return m.request(op, name, false, fn)
+}
+
+// doOnce is do without retries, for requests that aren't safe to make
+// twice: an InitMulti that timed out may still have started an upload,
+// which a retry would leave with nothing to complete or abort it.
+func (m *MemS3Fs) doOnce(op, name string, fn func(b *s3.Bucket) error) error {
+	view := *m
+	view.retry.MaxAttempts = 1
+	return view.do(op, name, fn)
+}
+
+// doRead is do for requests that only read, which a Failover sends to
+// the secondary bucket whatever its WritePolicy.
+func (m *MemS3Fs) doRead(op, name string, fn func(b *s3.Bucket) error) error {
+	return m.request(op, name, true, fn)
+}
+
+func (m *MemS3Fs) request(op, name string, read bool, fn func(b *s3.Bucket) error) error {
+	ctx := m.context()
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	defer m.scheduler.request(ctx)()
+
+	if err := m.chaos.before(op, name); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if err := m.creds.refresh(ctx); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+
+	b := m.bucket()
+	secondary, err := m.failover.route(ctx, read, func() error {
+		_, err := b.List(m.keyPrefix(""), "", "", 1)
+		return err
+	})
+	if err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if secondary {
+		b.S3.Region = m.failover.config.Region
+		b = b.S3.Bucket(m.failover.config.Bucket)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		b.S3.ConnectTimeout = time.Until(deadline)
+		b.S3.ReadTimeout = time.Until(deadline)
+	}
+	if d := m.dialTimeout; d > 0 && (b.S3.ConnectTimeout <= 0 || d < b.S3.ConnectTimeout) {
+		b.S3.ConnectTimeout = d
+	}
+	run := func() error {
+		for attempt := 1; ; attempt++ {
+			if err := m.pause(ctx, m.throttle.current()); err != nil {
+				return &os.PathError{Op: op, Path: name, Err: err}
+			}
+			release, err := m.limiter.acquire(ctx)
+			if err != nil {
+				return &os.PathError{Op: op, Path: name, Err: err}
+			}
+			err = fn(b)
+			release()
+			if !secondary && m.failover.report(err) {
+				m.record(Metric{Kind: FailedOver, Name: m.failover.config.Bucket, Err: err})
+			}
+			m.throttle.report(err, m.retry.Backoff, m.retry.MaxBackoff)
+			if attempt >= m.retry.MaxAttempts || !retryable(err) {
+				return err
+			}
+			m.record(Metric{Kind: Retried, Name: name, Err: err})
+			if m.pause(ctx, m.backoff(attempt)) != nil {
+				return err
+			}
+		}
+	}
+	if ctx.Done() == nil {
+		return run()
+	}
+
+	// tracked rather than spawned: the request's error is its caller's,
+	// not Err's, and a request must be made even once Close has begun
+	done := make(chan error, 1)
+	m.track(func() { done <- m.workers.guard(op, run) })
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// goamz can't interrupt a request, so the one under way is left
+		// to finish on its own; run makes no more attempts, and Close
+		// waits for it
+		return &os.PathError{Op: op, Path: name, Err: ctx.Err()}
+	}
+}
+
+// etag returns name's ETag, or "" if it doesn't exist or its ETag isn't
+// an MD5 of its contents, as for objects encrypted with SSE-KMS or SSE-C.
+// S3 is always asked, since an upload skipped because of a remembered
+// ETag would lose whatever another writer has stored since.
+func (m *MemS3Fs) etag(name string) (string, error) {
+	resp, err := m.headFresh(name)
 	if err == afero.ErrFileNotFound {
 		return "", nil
 	} else if err != nil {
 		return "", err
 	}
-	return strings.Replace(
-		resp.Header.Get("ETag"), "\"", "", 0,
-	), nil
+	if resp.Header.Get("x-amz-server-side-encryption") == "aws:kms" ||
+		resp.Header.Get("x-amz-server-side-encryption-customer-algorithm") != "" {
+		return "", nil
+	}
+	return strings.Trim(resp.Header.Get("ETag"), "\""), nil
+}
+
+// head issues a HEAD for name unless one was answered within the last
+// HeadCacheTTL, or name was found missing within the last
+// NegativeCacheTTL.
+func (m *MemS3Fs) head(name string) (*http.Response, error) {
+	if m.heads.isMissing(name) {
+		m.recordLookup(HeadCache, name, true, false)
+		return nil, afero.ErrFileNotFound
+	}
+	resp, expired := m.heads.get(name)
+	m.recordLookup(HeadCache, name, resp != nil, expired)
+	if resp != nil {
+		return resp, nil
+	}
+	// concurrent HEADs of the same object share one
+	v, err, _ := m.flight("head "+m.key(name), func() (interface{}, error) {
+		return m.headFresh(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*http.Response), nil
+}
+
+// headFresh issues a HEAD for name, remembering the answer for head.
+func (m *MemS3Fs) headFresh(name string) (*http.Response, error) {
+	var resp *http.Response
+	err := m.doRead("stat", name, func(b *s3.Bucket) (err error) {
+		resp, err = headName(m.key(name), b)
+		return err
+	})
+	if m.hide403 && isForbidden(err) {
+		err = afero.ErrFileNotFound
+	}
+	if err == afero.ErrFileNotFound {
+		m.heads.putMissing(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.heads.put(name, resp)
+	return resp, nil
 }
 
 func keyIfExists(name string, bucket *s3.Bucket) (k *s3.Key, err error) {
@@ -52,8 +214,9 @@ func keyIfExists(name string, bucket *s3.Bucket) (k *s3.Key, err error) {
 }
 
 func headName(name string, bucket *s3.Bucket) (*http.Response, error) {
-	resp, err := bucket.Head(name, make(map[string][]string))
-	if err != nil && err.Error() == "404 Not Found" {
+	// the checksums S3 stores beside the ETag are only sent if asked for
+	resp, err := bucket.Head(name, map[string][]string{"x-amz-checksum-mode": {"ENABLED"}})
+	if isNotFound(err) {
 		return nil, afero.ErrFileNotFound
 	} else if err != nil {
 		return nil, err
@@ -61,6 +224,413 @@ func headName(name string, bucket *s3.Bucket) (*http.Response, error) {
 	return resp, nil
 }
 
+// KMSAccessError is returned when S3 won't return an object because the
+// caller isn't allowed to decrypt it with the KMS key it's encrypted
+// with, which usually means the key policy or kms:Decrypt grant is
+// missing.
+type KMSAccessError struct {
+	Op    string
+	Path  string
+	KeyID string // the object's KMS key, when S3 reports it
+	Err   error
+}
+
+func (e *KMSAccessError) Error() string {
+	key := e.KeyID
+	if key == "" {
+		key = "its KMS key"
+	}
+	return e.Op + " " + e.Path + ": not allowed to decrypt with " + key + ": " + e.Err.Error()
+}
+
+func (e *KMSAccessError) Unwrap() error { return e.Err }
+
+// readError translates an error from fetching name into the one returned
+// to callers.
+func (m *MemS3Fs) readError(op, name string, err error) error {
+	if isNotFound(err) {
+		return &os.PathError{Op: op, Path: name, Err: afero.ErrFileNotFound}
+	}
+	e, ok := err.(*s3.Error)
+	if !ok || e.StatusCode != http.StatusForbidden {
+		return err
+	}
+	if strings.Contains(strings.ToLower(e.Message), "kms") || strings.HasPrefix(e.Code, "KMS.") {
+		return &KMSAccessError{Op: op, Path: name, Err: err}
+	}
+	// a plain AccessDenied on GET is still KMS's fault when the caller
+	// may read the object's metadata but not decrypt it
+	if resp, herr := m.head(name); herr == nil &&
+		resp.Header.Get("x-amz-server-side-encryption") == "aws:kms" {
+		return &KMSAccessError{
+			Op:    op,
+			Path:  name,
+			KeyID: resp.Header.Get("x-amz-server-side-encryption-aws-kms-key-id"),
+			Err:   err,
+		}
+	}
+	if m.hide403 {
+		return &os.PathError{Op: op, Path: name, Err: afero.ErrFileNotFound}
+	}
+	return err
+}
+
+// isNotModified reports whether err is S3 answering a conditional GET
+// with 304 Not Modified.
+func isNotModified(err error) bool {
+	e, ok := err.(*s3.Error)
+	return ok && e.StatusCode == http.StatusNotModified
+}
+
+// isPreconditionFailed reports whether err is S3's answer to a request
+// made If-Match an ETag the object no longer has.
+func isPreconditionFailed(err error) bool {
+	e, ok := err.(*s3.Error)
+	return ok && e.StatusCode == http.StatusPreconditionFailed
+}
+
+// isForbidden reports whether err is S3 refusing a request.
+func isForbidden(err error) bool {
+	if e, ok := err.(*s3.Error); ok {
+		return e.StatusCode == http.StatusForbidden
+	}
+	return err != nil && err.Error() == "403 Forbidden"
+}
+
+// isNotFound reports whether err is S3's answer for a missing key. HEAD
+// responses have no body, so only the status is available for them.
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == afero.ErrFileNotFound {
+		return true
+	}
+	if e, ok := err.(*s3.Error); ok {
+		return e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey"
+	}
+	return err.Error() == "404 Not Found"
+}
+
+// maxHeadEntries bounds how many responses, and how many missing keys, a
+// headMemo holds. Once it's full, expired entries are dropped, then
+// arbitrary ones.
+const maxHeadEntries = 10000
+
+// headMemo remembers recent HEAD responses so that a Stat and Open of
+// the same key can share one request, and, for missTTL, which keys were
+// missing. A nil *headMemo remembers nothing.
+type headMemo struct {
+	sync.Mutex
+	ttl     time.Duration
+	missTTL time.Duration
+	clock   Clock
+	entries map[string]headEntry
+	missing map[string]time.Time
+}
+
+type headEntry struct {
+	resp *http.Response
+	at   time.Time
+}
+
+func newHeadMemo(ttl time.Duration) *headMemo {
+	return &headMemo{
+		ttl:     ttl,
+		entries: make(map[string]headEntry),
+		missing: make(map[string]time.Time),
+	}
+}
+
+// get returns the remembered response for name, if any, and whether an
+// expired one was dropped.
+func (h *headMemo) get(name string) (resp *http.Response, expired bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.Lock()
+	defer h.Unlock()
+	e, ok := h.entries[name]
+	if !ok {
+		return nil, false
+	}
+	if clockOr(h.clock).Now().Sub(e.at) > h.ttl {
+		delete(h.entries, name)
+		return nil, true
+	}
+	return e.resp, false
+}
+
+func (h *headMemo) put(name string, resp *http.Response) {
+	if h == nil {
+		return
+	}
+	h.putAt(name, resp, clockOr(h.clock).Now())
+}
+
+// putAt is put of a response received at at.
+func (h *headMemo) putAt(name string, resp *http.Response, at time.Time) {
+	if h == nil || h.ttl <= 0 {
+		return
+	}
+	h.Lock()
+	now := clockOr(h.clock).Now()
+	if _, ok := h.entries[name]; !ok && len(h.entries) >= maxHeadEntries {
+		for n, e := range h.entries {
+			if now.Sub(e.at) > h.ttl {
+				delete(h.entries, n)
+			}
+		}
+		for n := range h.entries {
+			if len(h.entries) < maxHeadEntries {
+				break
+			}
+			delete(h.entries, n)
+		}
+	}
+	h.entries[name] = headEntry{resp: resp, at: at}
+	h.Unlock()
+}
+
+// isMissing reports whether name was found missing within the last
+// missTTL.
+func (h *headMemo) isMissing(name string) bool {
+	if h == nil {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	at, ok := h.missing[name]
+	if ok && clockOr(h.clock).Now().Sub(at) > h.missTTL {
+		delete(h.missing, name)
+		return false
+	}
+	return ok
+}
+
+func (h *headMemo) putMissing(name string) {
+	if h == nil || h.missTTL <= 0 {
+		return
+	}
+	h.Lock()
+	now := clockOr(h.clock).Now()
+	if _, ok := h.missing[name]; !ok && len(h.missing) >= maxHeadEntries {
+		for n, at := range h.missing {
+			if now.Sub(at) > h.missTTL {
+				delete(h.missing, n)
+			}
+		}
+		for n := range h.missing {
+			if len(h.missing) < maxHeadEntries {
+				break
+			}
+			delete(h.missing, n)
+		}
+	}
+	h.missing[name] = now
+	h.Unlock()
+}
+
+func (h *headMemo) forget(name string) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	delete(h.entries, name)
+	delete(h.missing, name)
+	h.Unlock()
+}
+
+// forgetPrefix forgets the names starting with prefix, whether or not
+// either has a leading slash.
+func (h *headMemo) forgetPrefix(prefix string) {
+	if h == nil {
+		return
+	}
+	prefix = strings.TrimLeft(prefix, "/")
+	h.Lock()
+	for name := range h.entries {
+		if strings.HasPrefix(strings.TrimLeft(name, "/"), prefix) {
+			delete(h.entries, name)
+		}
+	}
+	for name := range h.missing {
+		if strings.HasPrefix(strings.TrimLeft(name, "/"), prefix) {
+			delete(h.missing, name)
+		}
+	}
+	h.Unlock()
+}
+
+// bufPool holds scratch buffers for responses that don't declare a
+// Content-Length.
+var bufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// fetchObject downloads name, allocating the result exactly once when S3
+// reports the object's size, which it does for every plain GET.
+func fetchObject(name string, bucket *s3.Bucket) ([]byte, error) {
+	data, _, err := fetchObjectHeader(name, bucket)
+	return data, err
+}
+
+// fetchObjectHeader is fetchObject that also returns the response's
+// headers.
+func fetchObjectHeader(name string, bucket *s3.Bucket) ([]byte, http.Header, error) {
+	return fetchObjectWith(name, bucket, map[string][]string{})
+}
+
+// fetchIfChanged is fetchObjectHeader unless the object's ETag is still
+// etag, when S3 answers 304 Not Modified instead; see isNotModified.
+func fetchIfChanged(name string, bucket *s3.Bucket, etag string) ([]byte, http.Header, error) {
+	return fetchObjectWith(name, bucket, map[string][]string{"If-None-Match": {`"` + etag + `"`}})
+}
+
+func fetchObjectWith(name string, bucket *s3.Bucket, headers map[string][]string) ([]byte, http.Header, error) {
+	resp, err := bucket.GetResponseWithHeaders(name, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength >= 0 {
+		data := make([]byte, resp.ContentLength)
+		_, err = io.ReadFull(resp.Body, data)
+		return data, resp.Header, err
+	}
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+	if _, err = buf.ReadFrom(resp.Body); err != nil {
+		return nil, nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), resp.Header, nil
+}
+
+// fetchRange downloads n bytes of name starting at off. The result is
+// shorter than n when the object ends first.
+func fetchRange(name string, bucket *s3.Bucket, off, n int64) ([]byte, error) {
+	data, _, err := fetchRangeIfMatch(name, bucket, off, n, "")
+	return data, err
+}
+
+// fetchRangeIfMatch is fetchRange that also returns the object's ETag,
+// failing as isPreconditionFailed reports if etag isn't "" and the
+// object's ETag isn't etag.
+func fetchRangeIfMatch(name string, bucket *s3.Bucket, off, n int64, etag string) ([]byte, string, error) {
+	if n <= 0 {
+		return []byte{}, etag, nil
+	}
+	headers := map[string][]string{
+		"Range": {fmt.Sprintf("bytes=%d-%d", off, off+n-1)},
+	}
+	if etag != "" {
+		headers["If-Match"] = []string{`"` + etag + `"`}
+	}
+	resp, err := bucket.GetResponseWithHeaders(name, headers)
+	if err != nil {
+		if e, ok := err.(*s3.Error); ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return []byte{}, etag, nil
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data := make([]byte, n)
+	read, err := io.ReadFull(resp.Body, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return data[:read], strings.Trim(resp.Header.Get("ETag"), "\""), err
+}
+
+// fetchSuffix downloads the last n bytes of name, or all of it if it's
+// shorter.
+func fetchSuffix(name string, bucket *s3.Bucket, n int64) ([]byte, error) {
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	resp, err := bucket.GetResponseWithHeaders(name, map[string][]string{
+		"Range": {fmt.Sprintf("bytes=-%d", n)},
+	})
+	if err != nil {
+		if e, ok := err.(*s3.Error); ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// the object is empty
+			return []byte{}, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// openStream starts a GET of name from off to the end of the object. It
+// returns a nil body when off is at or past the end.
+func openStream(name string, bucket *s3.Bucket, off int64) (io.ReadCloser, error) {
+	headers := map[string][]string{}
+	if off > 0 {
+		headers["Range"] = []string{fmt.Sprintf("bytes=%d-", off)}
+	}
+	resp, err := bucket.GetResponseWithHeaders(name, headers)
+	if e, ok := err.(*s3.Error); ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// idleBody is a GET body that's closed, failing the Read waiting on it
+// with ErrIdleTimeout, once that Read has waited timeout for data by
+// clock. One timer, reset by each Read, is kept for the body's life.
+type idleBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	clock   Clock
+	timer   Timer
+	state   int32
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration, clock Clock) *idleBody {
+	return &idleBody{body: body, timeout: timeout, clock: clock}
+}
+
+// The states of a Read of an idleBody.
+const (
+	reading int32 = iota
+	readDone
+	readIdle
+)
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&b.state) == readIdle {
+		return 0, ErrIdleTimeout
+	}
+	atomic.StoreInt32(&b.state, reading)
+	if b.timer == nil {
+		b.timer = afterFunc(b.clock, b.timeout, b.idle)
+	} else {
+		b.timer.Reset(b.timeout)
+	}
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	if !atomic.CompareAndSwapInt32(&b.state, reading, readDone) {
+		return n, ErrIdleTimeout
+	}
+	return n, err
+}
+
+// idle closes the body if a Read is still waiting on it.
+func (b *idleBody) idle() {
+	if atomic.CompareAndSwapInt32(&b.state, reading, readIdle) {
+		b.body.Close()
+	}
+}
+
+func (b *idleBody) Close() error {
+	return b.body.Close()
+}
+
 type PermU uint
 
 const (
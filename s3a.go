@@ -0,0 +1,92 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// S3ACompat makes the filesystem treat directories the way Hadoop's S3A
+// connector does, so that Spark and Hive jobs can share its data:
+//
+//   - directories are marked with S3AMarkers, unless other Markers are
+//     given after S3ACompat;
+//   - removing or renaming the last object in a directory writes the
+//     directory's marker, so the directory doesn't disappear;
+//   - renaming onto an existing directory moves the source into it;
+//   - renaming fails if the destination's parent doesn't exist, the
+//     destination is under the source, or a file already has its name.
+//
+// Markers of a file's parents are kept when the file is written, as
+// S3A's "keep" marker policy does. S3A from before Hadoop 3.3.1 deletes
+// them, but reads directories that still have them.
+func S3ACompat() Option {
+	return func(s *MemS3Fs) {
+		s.s3a = true
+		if s.markers == nil {
+			s.markers = S3AMarkers
+		}
+	}
+}
+
+// s3aDest is where S3A would move oldname when asked to rename it to
+// newname.
+func (m *MemS3Fs) s3aDest(oldname, newname string) (string, error) {
+	if k := m.key(newname); k != "" && strings.HasPrefix(k+"/", m.dirPrefix(oldname)) {
+		return "", &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+	if fi, err := m.Stat(newname); err == nil && fi.IsDir() {
+		dest := path.Join(newname, path.Base(oldname))
+		return dest, m.s3aFree(oldname, dest)
+	}
+	parent := path.Dir(path.Clean(newname))
+	if m.key(parent) != "" {
+		if fi, err := m.Stat(parent); err != nil || !fi.IsDir() {
+			return "", &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: afero.ErrFileNotFound}
+		}
+	}
+	return newname, m.s3aFree(oldname, newname)
+}
+
+// s3aFree fails if a file other than oldname is at dest, which S3A
+// won't rename over.
+func (m *MemS3Fs) s3aFree(oldname, dest string) error {
+	if m.key(oldname) == m.key(dest) {
+		return nil
+	}
+	if fi, err := m.Stat(dest); err == nil && !fi.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: dest, Err: os.ErrExist}
+	}
+	return nil
+}
+
+// keepParent writes the marker of name's parent if removing name left
+// it empty, under S3ACompat.
+func (m *MemS3Fs) keepParent(name string) error {
+	parent := path.Dir(path.Clean(name))
+	if !m.s3a || m.key(parent) == "" {
+		return nil
+	}
+	if dir, err := m.isDir(parent); err != nil || dir {
+		return err
+	}
+	return m.putMarker(parent)
+}
@@ -0,0 +1,231 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BulkLimits caps the work done by all the filesystem's bulk operations
+// together, such as RemoveAll, directory renames, Snapshot,
+// ReEncryptPrefix, TransitionPrefix and ListByTag, so that several at once
+// don't starve other requests. At most concurrency objects (or delete
+// batches) are worked on at once, and at most rps are started each
+// second. Zero leaves either unlimited. The limits are shared by views
+// made with WithContext and WithTimeout; each operation's
+// BulkOptions.Concurrency still applies within them. Work waiting for a
+// turn goes in order of Priority.
+func BulkLimits(concurrency int, rps float64) Option {
+	return func(s *MemS3Fs) {
+		sched := &scheduler{limit: concurrency}
+		if rps > 0 {
+			sched.interval = time.Duration(float64(time.Second) / rps)
+		}
+		s.scheduler = sched
+	}
+}
+
+// Priority ranks the requests made under a context for the filesystem's
+// BulkLimits, which are the only place it has an effect.
+type Priority int
+
+const (
+	// PriorityLow work waits while any other is waiting for a turn.
+	PriorityLow Priority = iota
+	// PriorityNormal is the priority of contexts that don't set one.
+	PriorityNormal
+	// PriorityHigh requests, such as a user waiting on a read, hold up
+	// every other bulk turn while they're being made, and their own
+	// bulk work skips the queue and the rate limit.
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh) + 1
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose requests have priority p. Use it
+// with WithContext or the Context methods, such as OpenContext.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityOf returns the priority set on ctx with WithPriority.
+func priorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= PriorityLow && p <= PriorityHigh {
+		return p
+	}
+	return PriorityNormal
+}
+
+// MaxRequestsPerSecond limits the filesystem to starting n S3 requests a
+// second, retries included, so that jobs such as an afero.Walk of a huge
+// bucket don't trip S3's throttling or starve others using the bucket.
+// The limit is shared by views made with WithContext and WithTimeout,
+// and requests waiting for a turn go in order of Priority.
+func MaxRequestsPerSecond(n float64) Option {
+	return func(s *MemS3Fs) {
+		s.requestLimits().interval = 0
+		if n > 0 {
+			s.requestLimits().interval = time.Duration(float64(time.Second) / n)
+		}
+	}
+}
+
+// MaxConcurrentRequests limits the filesystem to n S3 requests at once,
+// shared as MaxRequestsPerSecond is.
+func MaxConcurrentRequests(n int) Option {
+	return func(s *MemS3Fs) {
+		s.requestLimits().limit = n
+	}
+}
+
+// requestLimits returns the scheduler that limits requests, making it
+// if need be.
+func (m *MemS3Fs) requestLimits() *scheduler {
+	if m.limiter == nil {
+		m.limiter = &scheduler{strict: true}
+	}
+	return m.limiter
+}
+
+// scheduler hands out turns to do a unit of bulk work, or make a
+// request. A nil *scheduler hands them out freely.
+type scheduler struct {
+	limit    int
+	interval time.Duration
+	strict   bool // PriorityHigh turns count against the rate too
+	clock    Clock
+
+	mu      sync.Mutex
+	next    time.Time
+	inUse   int
+	waiting [numPriorities]int
+	urgent  int           // PriorityHigh requests being made
+	changed chan struct{} // closed when a turn might have become free
+}
+
+// acquire waits for a turn, until ctx is done, and returns the function
+// that ends it.
+func (s *scheduler) acquire(ctx context.Context) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	p := priorityOf(ctx)
+	s.mu.Lock()
+	s.waiting[p]++
+	for !s.mayStart(p) {
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.waiting[p]--
+			s.signal()
+			s.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	s.waiting[p]--
+	s.inUse++
+	// lower priorities may have been waiting on this one
+	s.signal()
+	s.mu.Unlock()
+	release = func() {
+		s.mu.Lock()
+		s.inUse--
+		s.signal()
+		s.mu.Unlock()
+	}
+	if s.interval > 0 && (p < PriorityHigh || s.strict) {
+		clock := clockOr(s.clock)
+		s.mu.Lock()
+		now := clock.Now()
+		at := s.next
+		if at.Before(now) {
+			at = now
+		}
+		s.next = at.Add(s.interval)
+		s.mu.Unlock()
+		if wait := at.Sub(now); wait > 0 {
+			select {
+			case <-clock.After(wait):
+			case <-ctx.Done():
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return release, nil
+}
+
+// mayStart reports whether work of priority p can have a turn now.
+// s.mu must be held.
+func (s *scheduler) mayStart(p Priority) bool {
+	for q := int(p) + 1; q < numPriorities; q++ {
+		if s.waiting[q] > 0 {
+			return false
+		}
+	}
+	if p < PriorityHigh && s.urgent > 0 {
+		return false
+	}
+	return s.limit <= 0 || s.inUse < s.limit
+}
+
+// signal wakes the work waiting for a turn to check again. s.mu must be
+// held.
+func (s *scheduler) signal() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// request marks a request made under ctx as in progress until the
+// function it returns is called, holding up bulk turns if it's
+// PriorityHigh.
+func (s *scheduler) request(ctx context.Context) (done func()) {
+	if s == nil || priorityOf(ctx) != PriorityHigh {
+		return func() {}
+	}
+	s.mu.Lock()
+	s.urgent++
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.urgent--
+		s.signal()
+		s.mu.Unlock()
+	}
+}
+
+// scheduled runs fn, a unit of bulk work, in its turn.
+func (m *MemS3Fs) scheduled(fn func() error) error {
+	release, err := m.scheduler.acquire(m.context())
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn()
+}
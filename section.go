@@ -0,0 +1,142 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// ErrChanged is returned by a read, a stitched WriteAt or a metadata
+// change that would mix the contents or metadata of an object from
+// before and after it was overwritten.
+var ErrChanged = errors.New("af3ro: object changed while it was being read")
+
+const (
+	// sectionBlock is how much a Section fetches at once, unless
+	// StreamingReads asks for more.
+	sectionBlock = 256 * 1024
+	// sectionBlocks is how many blocks a Section keeps.
+	sectionBlocks = 4
+)
+
+// Section returns a reader of the n bytes of name's object starting at
+// off, for libraries that want an io.ReadSeeker or io.ReaderAt, such as
+// zip and Parquet readers, pointed at part of an object. It's an
+// *io.SectionReader, reading with range GETs a block at a time and
+// keeping the last few blocks, so nothing is fetched until it's read.
+// It reads what's in S3, not a file's unflushed writes. Encrypted and
+// transformed objects are downloaded whole on the first read. Reads
+// fail with ErrChanged once the object has been overwritten since the
+// first block was fetched.
+func (m *MemS3Fs) Section(name string, off, n int64) io.ReadSeeker {
+	return m.section(name, "", off, n)
+}
+
+// section is Section pinned to the object with etag, or to the object
+// read first when etag is "".
+func (m *MemS3Fs) section(name, etag string, off, n int64) io.ReadSeeker {
+	block := int64(sectionBlock)
+	if int64(m.readahead) > block {
+		block = int64(m.readahead)
+	}
+	return io.NewSectionReader(&rangeReader{fs: m, name: name, block: block, etag: etag}, off, n)
+}
+
+// rangeReader reads an object at any offset through a small cache of
+// aligned blocks.
+type rangeReader struct {
+	fs    *MemS3Fs
+	name  string
+	block int64
+
+	mu     sync.Mutex
+	etag   string        // the object's, when the first block was fetched
+	blocks []cachedBlock // least recently used first
+	whole  *cachedBlock
+}
+
+// cachedBlock is the part of an object starting at off.
+type cachedBlock struct {
+	off  int64
+	data []byte
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		at := off + int64(n)
+		b, err := r.blockAt(at)
+		if err != nil {
+			return n, err
+		}
+		if at-b.off >= int64(len(b.data)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], b.data[at-b.off:])
+	}
+	return n, nil
+}
+
+// blockAt returns the block holding at, fetching it if it isn't kept.
+func (r *rangeReader) blockAt(at int64) (cachedBlock, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.fs
+	if m.wholeReads(r.name) {
+		if r.whole == nil {
+			data, _, err := m.download("read", r.name)
+			if err != nil {
+				return cachedBlock{}, m.readError("read", r.name, err)
+			}
+			r.whole = &cachedBlock{0, data}
+		}
+		return *r.whole, nil
+	}
+
+	start := at - at%r.block
+	for i, b := range r.blocks {
+		if b.off == start {
+			r.blocks = append(append(r.blocks[:i:i], r.blocks[i+1:]...), b)
+			m.recordLookup(SectionCache, r.name, true, false)
+			return b, nil
+		}
+	}
+	m.recordLookup(SectionCache, r.name, false, false)
+	var data []byte
+	var etag string
+	err := m.doRead("read", r.name, func(b *s3.Bucket) (err error) {
+		data, etag, err = fetchRangeIfMatch(m.key(r.name), b, start, r.block, r.etag)
+		return err
+	})
+	if isPreconditionFailed(err) {
+		return cachedBlock{}, &os.PathError{Op: "read", Path: r.name, Err: ErrChanged}
+	}
+	if err != nil {
+		return cachedBlock{}, m.readError("read", r.name, err)
+	}
+	r.etag = etag
+	if len(r.blocks) == sectionBlocks {
+		r.blocks = r.blocks[1:]
+	}
+	b := cachedBlock{start, data}
+	r.blocks = append(r.blocks, b)
+	return b, nil
+}
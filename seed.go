@@ -0,0 +1,100 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// Seed copies the files of src into the directory prefix, for shipping
+// default assets with a service, such as from a go:embed FS, and pushing
+// them on first boot. Files that already exist are left alone, so Seed
+// can run on every boot without undoing changes made since, even by
+// another process seeding the same files at once. Files are written as
+// Create writes them, one at a time, each with a PUT that S3 refuses if
+// the object exists.
+func (m *MemS3Fs) Seed(src iofs.FS, prefix string) error {
+	return m.seed(prefix, func(put seedFunc) error {
+		return iofs.WalkDir(src, ".", func(p string, d iofs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			return put(p, func() ([]byte, error) { return iofs.ReadFile(src, p) })
+		})
+	})
+}
+
+// SeedFs is Seed from the files under root in src.
+func (m *MemS3Fs) SeedFs(src afero.Fs, root, prefix string) error {
+	return m.seed(prefix, func(put seedFunc) error {
+		return afero.Walk(src, root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			return put(filepath.ToSlash(rel), func() ([]byte, error) { return afero.ReadFile(src, p) })
+		})
+	})
+}
+
+// seedFunc writes the file at rel below the seeded directory with what
+// read returns, unless it exists.
+type seedFunc func(rel string, read func() ([]byte, error)) error
+
+// seed has walk put each file to be seeded under prefix.
+func (m *MemS3Fs) seed(prefix string, walk func(put seedFunc) error) error {
+	stored := make(map[string]bool)
+	err := m.eachKey("seed", m.dirPrefix(prefix), func(k s3.Key) error {
+		stored[k.Key] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return walk(func(rel string, read func() ([]byte, error)) error {
+		name := path.Join(prefix, rel)
+		m.rlock()
+		_, cached := m.getData()[name]
+		m.runlock()
+		if cached || stored[m.key(name)] {
+			return nil
+		}
+		data, err := read()
+		if err != nil {
+			return err
+		}
+		// another replica may seed it first, or have seeded and changed
+		// it since the listing
+		f := newMemFile(name, m.origin())
+		f.data, f.exclusive = data, true
+		if err := f.in(m).flush(); isPreconditionFailed(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m.addRemote(f)
+		return nil
+	})
+}
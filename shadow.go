@@ -0,0 +1,79 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"strconv"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// ShadowConfig describes where Shadow copies written files.
+type ShadowConfig struct {
+	// Bucket receives the copies.
+	Bucket string
+
+	// Key maps an object's key to the key of its copy. Copies keep the
+	// same key when it's nil.
+	Key func(key string) string
+
+	// Options are used to store the copies, such as a new encryption
+	// scheme. The filesystem's own settings are used when it's nil.
+	Options *s3.Options
+
+	// Rate is the fraction of writes that are copied.
+	Rate float64
+}
+
+// Shadow copies a sample of the files written through the filesystem as
+// described by c, so that a migration to a new bucket, key layout or
+// encryption scheme can be checked against live traffic. Copies are made
+// by S3 after each successful flush. Shadowing is best-effort: the write
+// has already succeeded when its copy is made, so a copy that fails is
+// recorded as a ShadowWrite metric with its Err, and otherwise ignored.
+func Shadow(c ShadowConfig) Option {
+	return func(s *MemS3Fs) {
+		s.shadow = &c
+	}
+}
+
+// shadowWrite copies the object just written for name, of size bytes
+// (asking S3 if it's negative), if it's sampled.
+func (m *MemS3Fs) shadowWrite(name string, size int64) {
+	c := m.shadow
+	if c == nil || m.random().Float64() >= c.Rate {
+		return
+	}
+	if size < 0 {
+		resp, err := m.head(name)
+		if err != nil {
+			m.record(Metric{Kind: ShadowWrite, Name: name, Err: err})
+			return
+		}
+		size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	}
+	key := m.key(name)
+	dst := key
+	if c.Key != nil {
+		dst = c.Key(key)
+	}
+	opts := m.putOptions()
+	if c.Options != nil {
+		opts = *c.Options
+	}
+	err := m.copyObject("shadow", key, c.Bucket, dst, size, s3.Private, opts)
+	m.record(Metric{Kind: ShadowWrite, Name: name, Bytes: size, Err: err})
+}
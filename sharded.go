@@ -0,0 +1,259 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/goamz/goamz/s3"
+)
+
+var (
+	// ErrRangeLocked is returned by LockRange when part of the range is
+	// locked by another writer or has already been written.
+	ErrRangeLocked = errors.New("af3ro: byte range is locked or already written")
+	// ErrRangeAlignment is returned by LockRange when a range doesn't
+	// start and end on the file's chunk boundaries.
+	ErrRangeAlignment = errors.New("af3ro: byte range isn't aligned to the file's chunks")
+	// ErrIncomplete is returned by Finalize while any chunk of the file is
+	// locked or hasn't been written.
+	ErrIncomplete = errors.New("af3ro: file has unwritten or locked ranges")
+)
+
+// chunk states
+const (
+	chunkFree = iota
+	chunkLocked
+	chunkWritten
+)
+
+// ShardedFile is a file of known size that several writers in one
+// process fill in at once. Each writer locks a disjoint range of
+// whole chunks with LockRange, writes it and closes it, which uploads its
+// chunks as parts of a multipart upload; Finalize assembles them into the
+// object once every chunk is written. Only the locked ranges are held in
+// memory.
+type ShardedFile struct {
+	fs    *MemS3Fs
+	name  string
+	size  int64
+	chunk int64
+	multi *s3.Multi
+
+	mu     sync.Mutex
+	chunks []int
+	parts  []s3.Part
+}
+
+// CreateSharded starts the multipart upload of a file of size bytes,
+// split into chunks of the filesystem's part size (see Multipart), or
+// more if the file would need over 10,000 of them. It fails with
+// ErrTransformedWrite if name has write transforms or is encrypted,
+// since neither can be done a chunk at a time.
+func (m *MemS3Fs) CreateSharded(name string, size int64) (*ShardedFile, error) {
+	if size <= 0 {
+		return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrInvalid}
+	}
+	if m.wholeWrites(name) {
+		return nil, &os.PathError{Op: "create", Path: name, Err: ErrTransformedWrite}
+	}
+	chunk := partSizeFor(size, m.partSize)
+	s := &ShardedFile{fs: m, name: name, size: size, chunk: chunk}
+	s.chunks = make([]int, (size+chunk-1)/chunk)
+	err := m.doOnce("create", name, func(b *s3.Bucket) (err error) {
+		s.multi, err = b.InitMulti(m.key(name), m.contentType(name), getACL(0640), m.putOptions())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ShardedFile) Name() string {
+	return s.name
+}
+
+// ChunkSize is the size of every chunk but the last, which may be
+// shorter. Ranges passed to LockRange start and end on multiples of it.
+func (s *ShardedFile) ChunkSize() int64 {
+	return s.chunk
+}
+
+// LockRange locks the n bytes starting at off for the caller to write.
+// It fails with ErrRangeLocked rather than waiting if any of them are
+// locked by another writer.
+func (s *ShardedFile) LockRange(off, n int64) (*FileRange, error) {
+	end := off + n
+	if off < 0 || n <= 0 || end > s.size || off%s.chunk != 0 || (end%s.chunk != 0 && end != s.size) {
+		return nil, &os.PathError{Op: "lock", Path: s.name, Err: ErrRangeAlignment}
+	}
+	first, last := int(off/s.chunk), int((end-1)/s.chunk)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := first; i <= last; i++ {
+		if s.chunks[i] != chunkFree {
+			return nil, &os.PathError{Op: "lock", Path: s.name, Err: ErrRangeLocked}
+		}
+	}
+	for i := first; i <= last; i++ {
+		s.chunks[i] = chunkLocked
+	}
+	return &FileRange{file: s, off: off, data: make([]byte, n)}, nil
+}
+
+// setChunks moves the chunks of r to state.
+func (s *ShardedFile) setChunks(r *FileRange, state int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last := int(r.off/s.chunk), int((r.off+int64(len(r.data))-1)/s.chunk)
+	for i := first; i <= last; i++ {
+		s.chunks[i] = state
+	}
+}
+
+// Finalize assembles the written chunks into the file's object. It fails
+// with ErrIncomplete while any chunk is locked or unwritten. The upload
+// is left open when it fails, so Finalize can be tried again, or Abort
+// called.
+func (s *ShardedFile) Finalize() error {
+	s.mu.Lock()
+	for _, state := range s.chunks {
+		if state != chunkWritten {
+			s.mu.Unlock()
+			return &os.PathError{Op: "finalize", Path: s.name, Err: ErrIncomplete}
+		}
+	}
+	parts := append([]s3.Part(nil), s.parts...)
+	s.mu.Unlock()
+
+	m := s.fs
+	sort.Slice(parts, func(i, j int) bool { return parts[i].N < parts[j].N })
+	err := m.do("finalize", s.name, func(*s3.Bucket) error {
+		return s.multi.Complete(parts)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.uploaded(s.name, s.size)
+	return nil
+}
+
+// uploaded follows an upload of name's size bytes that didn't go through
+// its cached file, which is dropped.
+func (m *MemS3Fs) uploaded(name string, size int64) {
+	m.lock()
+	delete(m.getData(), name)
+	m.unlock()
+	m.heads.forget(name)
+	m.prefixes.forgetAncestors(m.key(name))
+	m.shadowWrite(name, size)
+	m.indexPut(name, size)
+	if m.onFlush != nil {
+		var version string
+		if resp, err := m.head(name); err == nil {
+			version = resp.Header.Get("x-amz-version-id")
+		}
+		m.onFlush(name, version)
+	}
+	m.derive(name)
+}
+
+// Abort abandons the upload, discarding every chunk written so far.
+func (s *ShardedFile) Abort() error {
+	return s.fs.do("abort", s.name, func(*s3.Bucket) error {
+		return s.multi.Abort()
+	})
+}
+
+// FileRange is a locked range of a ShardedFile, held in memory until
+// it's closed. Bytes that aren't written are zeros.
+type FileRange struct {
+	file   *ShardedFile
+	off    int64
+	data   []byte
+	pos    int64
+	closed bool
+}
+
+// Offset is where the range starts in the file.
+func (r *FileRange) Offset() int64 {
+	return r.off
+}
+
+// Write writes p at the range's current position, failing with
+// io.ErrShortWrite at its end.
+func (r *FileRange) Write(p []byte) (int, error) {
+	n, err := r.WriteAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+// WriteAt writes p at off, counted from the start of the range.
+func (r *FileRange) WriteAt(p []byte, off int64) (int, error) {
+	if r.closed {
+		return 0, &os.PathError{Op: "write", Path: r.file.name, Err: os.ErrClosed}
+	}
+	if off < 0 || off > int64(len(r.data)) {
+		return 0, &os.PathError{Op: "write", Path: r.file.name, Err: os.ErrInvalid}
+	}
+	n := copy(r.data[off:], p)
+	if n < len(p) {
+		return n, &os.PathError{Op: "write", Path: r.file.name, Err: io.ErrShortWrite}
+	}
+	return n, nil
+}
+
+// Close uploads the range's chunks and releases its lock. If any chunk
+// fails to upload the range is unlocked without being written, so it can
+// be locked and written again.
+func (r *FileRange) Close() error {
+	if r.closed {
+		return &os.PathError{Op: "close", Path: r.file.name, Err: os.ErrClosed}
+	}
+	r.closed = true
+	s := r.file
+	first := int(r.off / s.chunk)
+	n := int((int64(len(r.data)) + s.chunk - 1) / s.chunk)
+	parts := make([]s3.Part, n)
+	err := s.fs.parallel(n, func(i int) error {
+		start := int64(i) * s.chunk
+		end := start + s.chunk
+		if end > int64(len(r.data)) {
+			end = int64(len(r.data))
+		}
+		return s.fs.do("write", s.name, func(*s3.Bucket) (err error) {
+			parts[i], err = s.multi.PutPart(first+i+1, bytes.NewReader(r.data[start:end]))
+			return err
+		})
+	})
+	if err != nil {
+		s.setChunks(r, chunkFree)
+	} else {
+		s.mu.Lock()
+		s.parts = append(s.parts, parts...)
+		s.mu.Unlock()
+		s.setChunks(r, chunkWritten)
+	}
+	r.data = nil
+	return err
+}
@@ -0,0 +1,117 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ServeCache shares c with other processes on the host, serving it on l,
+// a listener on a Unix socket, until l is closed. Processes give the
+// socket's path to NewSocketCache to use the cache, so that an object
+// read by any of them is downloaded once. It returns the error that
+// stopped it, as http.Serve does.
+func ServeCache(l net.Listener, c Cache) error {
+	return http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, etag := r.URL.Query().Get("key"), r.URL.Query().Get("etag")
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := c.Get(key, etag)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		case http.MethodPut:
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.Put(key, etag, data)
+		case http.MethodDelete:
+			c.Remove(key)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+// SocketCache is a Cache served by ServeCache in another process. It's
+// best effort: if the server can't be reached, or doesn't answer within
+// socketCacheTimeout, lookups miss and contents aren't cached.
+type SocketCache struct {
+	client *http.Client
+}
+
+// socketCacheTimeout bounds each request to a SocketCache's server, so a
+// hung server doesn't hold up reads.
+const socketCacheTimeout = time.Second
+
+// NewSocketCache returns a Cache that uses the one served on the Unix
+// socket at path.
+func NewSocketCache(path string) *SocketCache {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return &SocketCache{client: &http.Client{
+		Transport: &http.Transport{DialContext: dial},
+		Timeout:   socketCacheTimeout,
+	}}
+}
+
+// url is the request URL for key at etag; the host is ignored.
+func (c *SocketCache) url(key, etag string) string {
+	return "http://cache/?" + url.Values{"key": {key}, "etag": {etag}}.Encode()
+}
+
+func (c *SocketCache) Get(key, etag string) ([]byte, bool) {
+	resp, err := c.client.Get(c.url(key, etag))
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, err == nil
+}
+
+func (c *SocketCache) Put(key, etag string, data []byte) {
+	c.send(http.MethodPut, c.url(key, etag), data)
+}
+
+func (c *SocketCache) Remove(key string) {
+	c.send(http.MethodDelete, c.url(key, ""), nil)
+}
+
+func (c *SocketCache) send(method, u string, data []byte) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	if resp, err := c.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// Defaults for ShuffleOptions.
+const (
+	defaultShuffleWorkers  = 4
+	defaultShuffleBuffer   = 10000
+	defaultShufflePrefetch = 2
+)
+
+// ShuffleOptions controls the order a ShuffleReader returns records in,
+// and how far it reads ahead.
+type ShuffleOptions struct {
+	// Split splits shards into records. It's bufio.ScanLines, for
+	// newline-delimited records, unless set.
+	Split bufio.SplitFunc
+
+	// Workers is how many shards are downloaded at once.
+	Workers int
+
+	// Prefetch is how many downloaded shards may wait to be split into
+	// records, beyond those being downloaded.
+	Prefetch int
+
+	// Buffer is how many records are shuffled together. Records are
+	// drawn at random from a buffer this size that's refilled from the
+	// shards, so the larger it is the further a record can move from
+	// where it is in its shard.
+	Buffer int
+}
+
+// A ShuffleReader returns the records of every shard object under a
+// prefix in shuffled order, for training pipelines that want each epoch
+// to see the data differently. Shards are visited in random order, and
+// records are drawn from a shuffle buffer; see ShuffleOptions. The order
+// depends on the filesystem's RandSource.
+type ShuffleReader struct {
+	m       *MemS3Fs
+	opts    ShuffleOptions
+	shards  chan []byte
+	cancel  context.CancelFunc
+	buf     [][]byte
+	scanner *bufio.Scanner
+	err     error
+}
+
+// Shuffle starts reading the shards under prefix for a ShuffleReader.
+// Reading stops once ctx is done or the reader is closed.
+func (m *MemS3Fs) Shuffle(ctx context.Context, prefix string, opts ShuffleOptions) *ShuffleReader {
+	if opts.Split == nil {
+		opts.Split = bufio.ScanLines
+	}
+	if opts.Workers < 1 {
+		opts.Workers = defaultShuffleWorkers
+	}
+	if opts.Prefetch < 1 {
+		opts.Prefetch = defaultShufflePrefetch
+	}
+	if opts.Buffer < 1 {
+		opts.Buffer = defaultShuffleBuffer
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &ShuffleReader{
+		m:      m,
+		opts:   opts,
+		shards: make(chan []byte, opts.Prefetch),
+		cancel: cancel,
+	}
+	m.spawn(ctx, "Shuffle", func(ctx context.Context) error {
+		r.fetch(ctx, m.keyPrefix(prefix))
+		return nil
+	})
+	return r
+}
+
+// shardResult is a downloaded shard, or why it couldn't be.
+type shardResult struct {
+	data []byte
+	err  error
+}
+
+// fetch downloads the shards under prefix in random order, handing them
+// to Next through r.shards, which it closes when they're all sent.
+func (r *ShuffleReader) fetch(ctx context.Context, prefix string) {
+	defer close(r.shards)
+	var keys []string
+	err := r.m.eachKey("shuffle", prefix, func(k s3.Key) error {
+		if _, dir := r.m.markedDir(k.Key); !dir && k.Size > 0 {
+			keys = append(keys, k.Key)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		r.fail(ctx, err)
+		return
+	}
+	rand := r.m.random()
+	for i := len(keys) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+
+	// each shard has a result slot so errors come out in shard order
+	results := make(chan chan shardResult, r.opts.Workers)
+	r.m.spawn(ctx, "Shuffle", func(ctx context.Context) error {
+		defer close(results)
+		for _, key := range keys {
+			res := make(chan shardResult, 1)
+			select {
+			case results <- res:
+			case <-ctx.Done():
+				return nil
+			}
+			key := key
+			r.m.spawn(ctx, "Shuffle", func(context.Context) error {
+				var data []byte
+				err := r.m.workers.guard("Shuffle", func() (err error) {
+					data, _, err = r.m.download("shuffle", r.m.nameOf(key))
+					return err
+				})
+				res <- shardResult{data, err}
+				return nil
+			})
+		}
+		return nil
+	})
+	for res := range results {
+		var s shardResult
+		select {
+		case s = <-res:
+		case <-ctx.Done():
+			return
+		}
+		if s.err != nil {
+			r.fail(ctx, s.err)
+			return
+		}
+		select {
+		case r.shards <- s.data:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fail hands err to Next after the shards already downloaded.
+func (r *ShuffleReader) fail(ctx context.Context, err error) {
+	r.err = err
+	select {
+	case r.shards <- nil:
+	case <-ctx.Done():
+	}
+}
+
+// Next returns the next record, or io.EOF once every record has been
+// returned.
+func (r *ShuffleReader) Next() ([]byte, error) {
+	for len(r.buf) < r.opts.Buffer {
+		if r.scanner != nil && r.scanner.Scan() {
+			r.buf = append(r.buf, append([]byte(nil), r.scanner.Bytes()...))
+			continue
+		}
+		if r.scanner != nil && r.scanner.Err() != nil {
+			return nil, r.scanner.Err()
+		}
+		data, ok := <-r.shards
+		if !ok || data == nil {
+			break
+		}
+		r.scanner = bufio.NewScanner(bytes.NewReader(data))
+		r.scanner.Buffer(nil, len(data)+1)
+		r.scanner.Split(r.opts.Split)
+	}
+	if len(r.buf) == 0 {
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, io.EOF
+	}
+	i := r.m.random().Intn(len(r.buf))
+	rec := r.buf[i]
+	last := len(r.buf) - 1
+	r.buf[i], r.buf[last] = r.buf[last], nil
+	r.buf = r.buf[:last]
+	return rec, nil
+}
+
+// Close stops reading ahead.
+func (r *ShuffleReader) Close() error {
+	r.cancel()
+	return nil
+}
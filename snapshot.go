@@ -0,0 +1,51 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"strings"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// snapshotLayout names the prefix a snapshot is copied under.
+const snapshotLayout = "20060102T150405Z"
+
+// Snapshot copies every object whose name starts with prefix into
+// dstBucket, under a new prefix named for the current time, and returns
+// that prefix. The copies are made by S3 without downloading anything, so
+// they're a cheap point-in-time backup for buckets without versioning.
+// Files under prefix that haven't been flushed are uploaded first, except
+// those still being written with StreamingWrites. When dstBucket is the
+// filesystem's own, the new prefix is left out of the copy.
+func (m *MemS3Fs) Snapshot(dstBucket, prefix string) (string, error) {
+	prefix = m.keyPrefix(prefix)
+	if err := m.flushPrefix(prefix); err != nil {
+		return "", err
+	}
+
+	dst := m.now().UTC().Format(snapshotLayout) + "/"
+	err := m.eachKey("snapshot", prefix, func(k s3.Key) error {
+		if dstBucket == m.bucketName && strings.HasPrefix(k.Key, dst) {
+			// one of this snapshot's own copies
+			return nil
+		}
+		return m.scheduled(func() error {
+			return m.copyObject("snapshot", k.Key, dstBucket, dst+k.Key, k.Size, s3.Private, m.putOptions())
+		})
+	})
+	return dst, err
+}
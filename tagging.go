@@ -0,0 +1,137 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goamz/goamz/s3"
+)
+
+// taggingURLTTL is how long the presigned URLs used for tags and ACLs
+// last.
+const taggingURLTTL = 5 * time.Minute
+
+// tagging is the body of a GetObjectTagging response.
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []struct {
+		Key   string
+		Value string
+	} `xml:"TagSet>Tag"`
+}
+
+// parseTagging decodes a GetObjectTagging response body.
+func parseTagging(r io.Reader) (map[string]string, error) {
+	var t tagging
+	if err := xml.NewDecoder(r).Decode(&t); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(t.Tags))
+	for _, tag := range t.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
+
+// tags returns the tags on the object key. goamz has no call for
+// GetObjectTagging, so it's made with a presigned URL.
+func (m *MemS3Fs) tags(key string) (tags map[string]string, err error) {
+	err = m.subresource("GET", m.bucketName, key, "tagging", nil, func(body io.Reader) (err error) {
+		tags, err = parseTagging(body)
+		return err
+	})
+	return tags, err
+}
+
+// putTags replaces the tags on the object key in bucket.
+func (m *MemS3Fs) putTags(bucket, key string, tags map[string]string) error {
+	var t tagging
+	for k, v := range tags {
+		t.Tags = append(t.Tags, struct {
+			Key   string
+			Value string
+		}{k, v})
+	}
+	sort.Slice(t.Tags, func(i, j int) bool { return t.Tags[i].Key < t.Tags[j].Key })
+	body, err := xml.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return m.subresource("PUT", bucket, key, "tagging", body, nil)
+}
+
+// subresource makes a request for a subresource of the object key in
+// bucket, such as its tagging, with a presigned URL, and passes the
+// response's body to read if it isn't nil.
+func (m *MemS3Fs) subresource(method, bucket, key, sub string, body []byte, read func(io.Reader) error) error {
+	return m.request(sub, key, method == "GET", func(b *s3.Bucket) error {
+		if bucket != m.bucketName {
+			// b is the Failover's secondary while failed over
+			b = b.S3.Bucket(bucket)
+		}
+		u := b.SignedURLWithMethod(method, key, m.now().Add(taggingURLTTL), url.Values{sub: {""}}, nil)
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp, err := m.httpClient().Do(req.WithContext(m.context()))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			serr := &s3.Error{StatusCode: resp.StatusCode}
+			xml.NewDecoder(resp.Body).Decode(serr)
+			return serr
+		}
+		if read == nil {
+			return nil
+		}
+		return read(resp.Body)
+	})
+}
+
+// ListByTag returns the names of the files under prefix whose objects
+// are tagged with key set to value. Each object's tags take a request
+// to read, so they're read several at a time as for a bulk operation.
+func (m *MemS3Fs) ListByTag(prefix, key, value string) ([]string, error) {
+	var (
+		mu      sync.Mutex
+		matches []string
+	)
+	err := m.bulk("tagging", m.keyPrefix(prefix), nil, func(k s3.Key) error {
+		tags, err := m.tags(k.Key)
+		if err != nil {
+			return err
+		}
+		if v, ok := tags[key]; ok && v == value {
+			mu.Lock()
+			matches = append(matches, m.nameOf(k.Key))
+			mu.Unlock()
+		}
+		return nil
+	})
+	sort.Strings(matches)
+	return matches, err
+}
@@ -0,0 +1,135 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrTransformedWrite is returned for writes that would store a file's
+// contents without its write transforms (see TransformWrites), or
+// ClientSideEncryption, seeing them whole.
+var ErrTransformedWrite = errors.New("af3ro: file's writes are transformed")
+
+// A Transform rewrites the contents of the file name, such as to
+// decompress, decrypt, redact or convert them.
+type Transform func(name string, data []byte) ([]byte, error)
+
+// transformRule is a Transform for the files under a prefix.
+type transformRule struct {
+	prefix string
+	fn     Transform
+}
+
+// TransformReads has t rewrite the contents of objects whose names start
+// with prefix as they're downloaded, so readers see what t returns in
+// place of what's stored, as with S3 Object Lambda but in process.
+// Where several match, they apply in the order given. The Cache holds
+// contents after t, so contents written through the filesystem aren't
+// cached; until they're downloaded again, the process that wrote them
+// sees them as written. Transformed files are downloaded whole, even with
+// StreamingReads, and until they've been read their size is that of
+// the object.
+func TransformReads(prefix string, t Transform) Option {
+	return func(s *MemS3Fs) {
+		s.readXforms = append(s.readXforms, transformRule{prefix, t})
+	}
+}
+
+// TransformWrites has t rewrite the contents of files whose names start
+// with prefix as they're flushed, so what t returns is stored in place
+// of what was written, or reject them by returning an error, which the
+// flush (or Close) returns with the file left dirty. Where several
+// match, they apply in the order given, and once a file is flushed its
+// contents are what they returned.
+//
+// t sees every write through the Fs: such files are uploaded whole,
+// even with StreamingWrites, each Appender segment and partitioned batch
+// is transformed alone, and records are held until the RecordWriter is
+// closed. Writes that can't be transformed, sharded uploads and copies
+// made by S3 from files t hasn't seen, fail with ErrTransformedWrite.
+func TransformWrites(prefix string, t Transform) Option {
+	return func(s *MemS3Fs) {
+		s.writeXforms = append(s.writeXforms, transformRule{prefix, t})
+	}
+}
+
+// matching returns the transforms of rules that apply to name.
+func matching(rules []transformRule, name string) (fns []Transform) {
+	for _, r := range rules {
+		if under(r.prefix, name) {
+			fns = append(fns, r.fn)
+		}
+	}
+	return fns
+}
+
+// under reports whether name starts with prefix.
+func under(prefix, name string) bool {
+	subject := strings.TrimPrefix(path.Clean("/"+name), "/")
+	return strings.HasPrefix(subject, strings.TrimPrefix(prefix, "/"))
+}
+
+// transformRead applies the read transforms for name to data.
+func (m *MemS3Fs) transformRead(op, name string, data []byte) ([]byte, error) {
+	for _, fn := range matching(m.readXforms, name) {
+		var err error
+		if data, err = fn(name, data); err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	return data, nil
+}
+
+// transformWrite applies the write transforms for name to data.
+func (m *MemS3Fs) transformWrite(op, name string, data []byte) ([]byte, error) {
+	for _, fn := range matching(m.writeXforms, name) {
+		var err error
+		if data, err = fn(name, data); err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	return data, nil
+}
+
+// wholeWrites reports whether name must be uploaded whole, because it's
+// encrypted or transformed.
+func (m *MemS3Fs) wholeWrites(name string) bool {
+	return m.encryption != nil || len(matching(m.writeXforms, name)) > 0
+}
+
+// skipsTransforms reports whether a copy made by S3 from src to dst, files
+// or directories, could store contents under dst that its write
+// transforms haven't seen.
+func (m *MemS3Fs) skipsTransforms(src, dst string) bool {
+	dir := strings.TrimPrefix(path.Clean("/"+dst), "/") + "/"
+	for _, r := range m.writeXforms {
+		reaches := under(r.prefix, dst) || under(dir, r.prefix)
+		if reaches && !under(r.prefix, src) {
+			return true
+		}
+	}
+	return false
+}
+
+// wholeReads reports whether name's object must be downloaded whole to
+// be read, because it's encrypted or transformed.
+func (m *MemS3Fs) wholeReads(name string) bool {
+	return m.encryption != nil || len(matching(m.readXforms, name)) > 0
+}
@@ -0,0 +1,176 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// workerGroup runs the filesystem's background work, such as FlushEvery
+// and prefetching, so that it can be stopped and waited for together
+// and its failures seen.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+// spawn runs fn in the background under a context that's done once ctx
+// is or the filesystem is closed. A panic in fn, or the error it
+// returns, is kept for Err.
+func (m *MemS3Fs) spawn(ctx context.Context, what string, fn func(ctx context.Context) error) {
+	g := m.workers
+	ctx, cancel := context.WithCancel(ctx)
+	g.mu.Lock()
+	closed := g.closed
+	if !closed {
+		g.wg.Add(2)
+	}
+	g.mu.Unlock()
+	done := func() {
+		if !closed {
+			g.wg.Done()
+		}
+	}
+	if closed {
+		cancel()
+	}
+
+	go func() {
+		defer done()
+		select {
+		case <-g.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer done()
+		defer cancel()
+		defer g.recover(what)
+		g.fail(fn(ctx))
+	}()
+}
+
+// finish runs fn in the background like spawn, but under ctx alone:
+// closing the filesystem waits for fn rather than cancelling it, for
+// work that would otherwise be lost. Once closed fn isn't run.
+func (m *MemS3Fs) finish(ctx context.Context, what string, fn func(ctx context.Context) error) {
+	g := m.workers
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.recover(what)
+		g.fail(fn(ctx))
+	}()
+}
+
+// track runs fn in the background as part of the filesystem's work, so
+// that Close waits for it. Unlike spawn, fn is run even once the
+// filesystem is closed, and what it does with its outcome is up to it.
+func (m *MemS3Fs) track(fn func()) {
+	g := m.workers
+	g.mu.Lock()
+	closed := g.closed
+	if !closed {
+		g.wg.Add(1)
+	}
+	g.mu.Unlock()
+	go func() {
+		if !closed {
+			defer g.wg.Done()
+		}
+		fn()
+	}()
+}
+
+// guard calls fn, part of the work what, returning a panic in it as its
+// error and keeping that for Err too, for work whose caller waits on
+// its outcome.
+func (g *workerGroup) guard(what string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("af3ro: %s panicked: %v", what, r)
+			g.fail(err)
+		}
+	}()
+	return fn()
+}
+
+// recover keeps a panic in the work what as its failure. It must be
+// deferred.
+func (g *workerGroup) recover(what string) {
+	if r := recover(); r != nil {
+		g.fail(fmt.Errorf("af3ro: %s panicked: %v", what, r))
+	}
+}
+
+// fail keeps err, if it's the first.
+func (g *workerGroup) fail(err error) {
+	if err == nil {
+		return
+	}
+	g.mu.Lock()
+	if g.err == nil {
+		g.err = err
+	}
+	g.mu.Unlock()
+}
+
+// Err returns the first failure of the filesystem's background work,
+// started by FlushEvery, AccessLog, Shuffle, Prefetch, Derive and
+// PartitionedWriter.FlushEvery, including any panic, which is recovered
+// rather than crashing the process. Panics in the work requests, uploads
+// and bulk operations run concurrently are kept too, and also fail the
+// call that was waiting for them. Work that fails carries on where it
+// can, so later failures are only seen through metrics.
+func (m *MemS3Fs) Err() error {
+	g := m.workers
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// Close stops the filesystem's background work, waits for it to finish
+// and returns Err. Derivatives being made (see Derive) are finished
+// first. Work started afterwards stops at once. Files are not
+// flushed; close them first. Views made with WithContext share their
+// background work, so closing one closes all.
+func (m *MemS3Fs) Close() error {
+	g := m.workers
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	g.cancel()
+	g.wg.Wait()
+	return m.Err()
+}
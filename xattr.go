@@ -0,0 +1,258 @@
+// Copyright © 2014 Ryan Brown <sb@ryansb.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package af3ro provides an afero-compliant interface to AWS S3.
+
+package af3ro
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/goamz/goamz/s3"
+	"github.com/spf13/afero"
+)
+
+// ErrNoXattr is returned for attributes a file doesn't have.
+var ErrNoXattr = errors.New("af3ro: no such attribute")
+
+// XattrFile is implemented by files whose objects carry user metadata,
+// the x-amz-meta-* headers, as extended attributes. Names are lowercase,
+// as S3 stores them. Changes are stored with the object when the file is
+// next flushed; if its contents are unchanged, S3 copies the object over
+// itself with the new metadata rather than it being uploaded again. New
+// contents are stored without the object's attributes unless they've
+// been read or changed through the file. A file written with
+// StreamingWrites is stored with the attributes it has when its first
+// part is uploaded.
+type XattrFile interface {
+	afero.File
+	GetXattr(name string) (string, error)
+	SetXattr(name, value string) error
+	RemoveXattr(name string) error
+	ListXattr() ([]string, error)
+}
+
+var _ XattrFile = new(InMemoryFile)
+
+// internalMeta are the metadata names af3ro keeps for itself.
+var internalMeta = map[string]bool{
+	metaDataKey: true,
+	metaNonce:   true,
+	metaMode:    true,
+	metaMtime:   true,
+	metaUID:     true,
+	metaGID:     true,
+}
+
+// userMeta returns the user metadata in header, from a GET or HEAD.
+func userMeta(header http.Header) map[string]string {
+	meta := make(map[string]string)
+	for k, v := range header {
+		if !strings.HasPrefix(k, "X-Amz-Meta-") || len(v) == 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))
+		if !internalMeta[name] {
+			meta[name] = v[0]
+		}
+	}
+	return meta
+}
+
+// loadXattrs reads the metadata of the file's object the first time it's
+// needed. A file without an object has none.
+func (f *InMemoryFile) loadXattrs() error {
+	if f.xattrs != nil {
+		return nil
+	}
+	resp, err := f.fs.head(f.Name())
+	if err == afero.ErrFileNotFound {
+		f.xattrs = make(map[string]string)
+		return nil
+	} else if err != nil {
+		return f.fs.readError("getxattr", f.Name(), err)
+	}
+	f.xattrs = userMeta(resp.Header)
+	return nil
+}
+
+func (f *InMemoryFile) GetXattr(name string) (string, error) {
+	if err := f.loadXattrs(); err != nil {
+		return "", err
+	}
+	v, ok := f.xattrs[strings.ToLower(name)]
+	if !ok {
+		return "", &os.PathError{Op: "getxattr", Path: f.Name(), Err: ErrNoXattr}
+	}
+	return v, nil
+}
+
+func (f *InMemoryFile) ListXattr() ([]string, error) {
+	if err := f.loadXattrs(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(f.xattrs))
+	for name := range f.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *InMemoryFile) SetXattr(name, value string) error {
+	name = strings.ToLower(name)
+	if name == "" || internalMeta[name] {
+		return &os.PathError{Op: "setxattr", Path: f.Name(), Err: os.ErrInvalid}
+	}
+	if err := f.loadXattrs(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.xattrs[name] = value
+	f.dirty, f.metaDirty = true, true
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *InMemoryFile) RemoveXattr(name string) error {
+	if err := f.loadXattrs(); err != nil {
+		return err
+	}
+	name = strings.ToLower(name)
+	if _, ok := f.xattrs[name]; !ok {
+		return &os.PathError{Op: "removexattr", Path: f.Name(), Err: ErrNoXattr}
+	}
+	f.mu.Lock()
+	delete(f.xattrs, name)
+	f.dirty, f.metaDirty = true, true
+	f.mu.Unlock()
+	return nil
+}
+
+// addXattrs adds the file's attributes to opts.
+func (f *InMemoryFile) addXattrs(opts s3.Options) s3.Options {
+	if len(f.xattrs) == 0 {
+		return opts
+	}
+	meta := make(map[string][]string, len(opts.Meta)+len(f.xattrs))
+	for k, v := range f.xattrs {
+		meta[k] = []string{v}
+	}
+	for k, v := range opts.Meta {
+		meta[k] = v
+	}
+	opts.Meta = meta
+	return opts
+}
+
+// replaceMeta has S3 copy the file's unchanged object over itself with
+// the file's metadata and headers. Whatever the file doesn't set is kept
+// from the object as a fresh HEAD finds it: its other metadata, headers,
+// content type, encryption and storage class. The copy fails with
+// ErrChanged if the object is overwritten after that HEAD.
+func (f *InMemoryFile) replaceMeta() error {
+	resp, err := f.fs.headFresh(f.Name())
+	if err != nil {
+		return f.fs.readError("setxattr", f.Name(), err)
+	}
+	opts := f.putOptions()
+	meta := make(map[string][]string, len(opts.Meta))
+	for k, v := range resp.Header {
+		if !strings.HasPrefix(k, "X-Amz-Meta-") {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))
+		// attributes the file has read are all in opts, less any removed
+		if f.xattrs == nil || internalMeta[name] {
+			meta[name] = v
+		}
+	}
+	for k, v := range opts.Meta {
+		meta[k] = v
+	}
+	opts.Meta = meta
+	if opts.CacheControl == "" {
+		opts.CacheControl = resp.Header.Get("Cache-Control")
+	}
+	if opts.ContentEncoding == "" {
+		opts.ContentEncoding = resp.Header.Get("Content-Encoding")
+	}
+	if opts.ContentDisposition == "" {
+		opts.ContentDisposition = resp.Header.Get("Content-Disposition")
+	}
+	if !opts.SSE && !opts.SSEKMS {
+		switch resp.Header.Get("x-amz-server-side-encryption") {
+		case "aws:kms":
+			opts.SSEKMS = true
+			opts.SSEKMSKeyId = resp.Header.Get("x-amz-server-side-encryption-aws-kms-key-id")
+		case "AES256":
+			opts.SSE = true
+		}
+	}
+	if opts.StorageClass == "" {
+		opts.StorageClass = s3.StorageClass(resp.Header.Get("x-amz-storage-class"))
+	}
+	h := f.objectHeaders()
+	if h.Expires.IsZero() {
+		h.Expires, _ = http.ParseTime(resp.Header.Get("Expires"))
+	}
+	ctype := resp.Header.Get("Content-Type")
+	if ctype == "" {
+		ctype = f.fs.contentType(f.Name())
+	}
+	hdr := http.Header(putHeaders(ctype, opts, h))
+	hdr.Set("x-amz-acl", string(getACL(f.mode)))
+	hdr.Set("x-amz-metadata-directive", "REPLACE")
+	if etag := strings.Trim(resp.Header.Get("ETag"), "\""); etag != "" {
+		hdr.Set("x-amz-copy-source-if-match", `"`+etag+`"`)
+	}
+	key := f.fs.key(f.Name())
+	err = f.fs.do("setxattr", f.Name(), func(b *s3.Bucket) error {
+		return f.fs.copyOver(b, key, hdr)
+	})
+	if isPreconditionFailed(err) {
+		return &os.PathError{Op: "setxattr", Path: f.Name(), Err: ErrChanged}
+	}
+	return err
+}
+
+// copyOver has S3 copy key over itself with the headers in hdr. goamz
+// has no option for x-amz-copy-source-if-match or Expires, so the copy
+// is made with a presigned request instead.
+func (m *MemS3Fs) copyOver(b *s3.Bucket, key string, hdr http.Header) error {
+	hdr = hdr.Clone()
+	hdr.Set("x-amz-copy-source", (&url.URL{Path: "/" + b.Name + "/" + key}).EscapedPath())
+	u := b.SignedURLWithMethod("PUT", key, m.now().Add(taggingURLTTL), nil, hdr)
+	req, err := http.NewRequest("PUT", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = hdr
+	resp, err := m.httpClient().Do(req.WithContext(m.context()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		serr := &s3.Error{StatusCode: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(serr)
+		return serr
+	}
+	return nil
+}